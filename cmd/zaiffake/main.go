@@ -0,0 +1,73 @@
+// zaiffake は台本ファイルに従って動く偽のZaifを起動します。
+//
+//	zaiffake -addr :9090 -script script.json
+//	zaifbotbattleviewer -domain "" -stream-url "ws://localhost:9090/stream?currency_pair=" \
+//		-depth-url http://localhost:9090/depth/ -ticker-url http://localhost:9090/ticker/
+//
+// 台本ファイルは通貨ペア毎に接続直後に送るストリーム・板情報・ティッカーを書きます。
+//
+//	{"btc_jpy": {"stream": [...], "depth": {"asks": [...], "bids": [...]}, "ticker": {...}}}
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/tanaton/zaifbotbattleviewer/zbbv"
+	"github.com/tanaton/zaifbotbattleviewer/zbbv/zaiftest"
+)
+
+type script map[string]struct {
+	Stream []zbbv.ZaifStream `json:"stream"`
+	Depth  *zbbv.Depth       `json:"depth"`
+	Ticker *zbbv.ZaifTicker  `json:"ticker"`
+}
+
+func main() {
+	os.Exit(_main())
+}
+
+func _main() int {
+	addr := flag.String("addr", ":9090", "待ち受けアドレス")
+	path := flag.String("script", "", "台本ファイル")
+	interval := flag.Duration("interval", 0, "ストリームのメッセージを送る間隔")
+	flag.Parse()
+
+	s := zaiftest.New()
+	s.SetInterval(*interval)
+	if *path != "" {
+		sc, err := readScript(*path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+			return 1
+		}
+		for key, it := range sc {
+			s.Script(key, it.Stream...)
+			if it.Depth != nil {
+				s.SetDepth(key, *it.Depth)
+			}
+			if it.Ticker != nil {
+				s.SetTicker(key, *it.Ticker)
+			}
+		}
+	}
+	if err := http.ListenAndServe(*addr, s); err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func readScript(p string) (script, error) {
+	fp, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	sc := script{}
+	err = json.NewDecoder(fp).Decode(&sc)
+	return sc, err
+}
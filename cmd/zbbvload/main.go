@@ -0,0 +1,144 @@
+// zbbvload は起動中のzaifbotbattleviewerのAPIに同時に大量のリクエストを送り、スループットと応答時間を表示します。
+//
+//	zaiffake -addr :9090 -script script.json -interval 100ms
+//	zaifbotbattleviewer -domain "" -listen :8080 -stream-url "ws://localhost:9090/stream?currency_pair=" \
+//		-depth-url http://localhost:9090/depth/ -ticker-url http://localhost:9090/ticker/
+//	zbbvload -c 2000 -d 30s http://localhost:8080/api/zaif/1/lastprice/btc_jpy http://localhost:8080/api/zaif/1/oldstream/btc_jpy
+//
+// URLを複数指定すると順番に使います。-etagを付けると前回のETagでIf-None-Matchを送ります。
+// 同時接続数に合わせてファイルディスクリプタの上限（ulimit -n）を上げてください。
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type result struct {
+	lat    []time.Duration
+	status map[int]int
+	errs   int
+	bytes  int64
+}
+
+func main() {
+	os.Exit(_main())
+}
+
+func _main() int {
+	c := flag.Int("c", 1000, "同時に送るリクエスト数")
+	d := flag.Duration("d", 10*time.Second, "送り続ける時間")
+	timeout := flag.Duration("timeout", 10*time.Second, "1リクエストのタイムアウト")
+	etag := flag.Bool("etag", false, "前回のETagでIf-None-Matchを送る")
+	flag.Parse()
+	urls := flag.Args()
+	if len(urls) == 0 || *c <= 0 {
+		flag.Usage()
+		return 2
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		Transport: &http.Transport{
+			MaxIdleConns:        *c,
+			MaxIdleConnsPerHost: *c,
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *d)
+	defer cancel()
+	rl := make([]result, *c)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range rl {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rl[i] = worker(ctx, client, urls, i, *etag)
+		}(i)
+	}
+	wg.Wait()
+	ela := time.Since(start)
+
+	total := result{status: make(map[int]int)}
+	for _, r := range rl {
+		total.lat = append(total.lat, r.lat...)
+		total.errs += r.errs
+		total.bytes += r.bytes
+		for code, n := range r.status {
+			total.status[code] += n
+		}
+	}
+	report(os.Stdout, total, ela, *c)
+	return 0
+}
+
+func worker(ctx context.Context, client *http.Client, urls []string, n int, useETag bool) result {
+	r := result{status: make(map[int]int)}
+	etags := make(map[string]string, len(urls))
+	for i := n; ctx.Err() == nil; i++ {
+		u := urls[i%len(urls)]
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			r.errs++
+			continue
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		if tag, ok := etags[u]; useETag && ok {
+			req.Header.Set("If-None-Match", tag)
+		}
+		st := time.Now()
+		res, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				r.errs++
+			}
+			continue
+		}
+		nb, err := io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if err != nil {
+			if ctx.Err() == nil {
+				r.errs++
+			}
+			continue
+		}
+		r.lat = append(r.lat, time.Since(st))
+		r.status[res.StatusCode]++
+		r.bytes += nb
+		if tag := res.Header.Get("ETag"); tag != "" {
+			etags[u] = tag
+		}
+	}
+	return r
+}
+
+func report(w io.Writer, r result, ela time.Duration, c int) {
+	sort.Slice(r.lat, func(i, j int) bool { return r.lat[i] < r.lat[j] })
+	q := func(p float64) time.Duration {
+		if len(r.lat) == 0 {
+			return 0
+		}
+		return r.lat[int(p*float64(len(r.lat)-1))]
+	}
+	fmt.Fprintf(w, "同時接続数   %d\n", c)
+	fmt.Fprintf(w, "時間         %s\n", ela.Round(time.Millisecond))
+	fmt.Fprintf(w, "リクエスト数 %d (%.1f req/s)\n", len(r.lat), float64(len(r.lat))/ela.Seconds())
+	fmt.Fprintf(w, "エラー       %d\n", r.errs)
+	fmt.Fprintf(w, "受信         %.1f MB\n", float64(r.bytes)/(1<<20))
+	codes := make([]int, 0, len(r.status))
+	for code := range r.status {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %d         %d\n", code, r.status[code])
+	}
+	fmt.Fprintf(w, "応答時間     p50 %s  p90 %s  p99 %s  max %s\n", q(0.5), q(0.9), q(0.99), q(1))
+}
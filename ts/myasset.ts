@@ -92,7 +92,7 @@ type Display = {
 
 const svgIDDepth = "svgdepth";
 const svgIDCandlestick = "svgcandlestick";
-const streamBaseURL = "wss://ws.zaif.jp/stream?currency_pair=";
+const streamBaseURL = "/api/zaif/1/stream/";
 const depthUrl = "/api/zaif/1/depth/xem_jpy";
 const ticksUrl = "/api/zaif/1/ticks/xem_jpy";
 const floatFormat = d3.format(".1f");
@@ -108,65 +108,36 @@ type Box = {
 	readonly left: number;
 }
 
-type ZaifStream = {
-	readonly currency_pair: CurrencyPair;
-	readonly timestamp: string;
-	asks: readonly [number, number][];
-	bids: readonly [number, number][];
-	trades: readonly {
-		readonly tid: number;
+// サーバーが中継するStoreData
+type RelayData = {
+	readonly ts: number;
+	readonly ask?: readonly [number, number];
+	readonly bid?: readonly [number, number];
+	readonly trade?: {
+		readonly currenty_pair: string;
 		readonly trade_type: DirectionEng;
 		readonly price: number;
+		readonly tid: number;
 		readonly amount: number;
 		readonly date: number;
-	}[];
-	readonly last_price: {
-		readonly price: number;
-		readonly action: DirectionEng;
 	};
 }
-function isZaifStream(a: any): a is ZaifStream {
+function isRelayData(a: any): a is RelayData {
 	if ((a instanceof Object) === false) {
 		return false;
 	}
-	if (isCurrencyPair(a.currency_pair) === false) {
-		return false;
-	}
-	if (!a.timestamp) {
-		return false;
-	}
-	if ((a.asks instanceof Array) === false) {
-		return false;
-	}
-	if ((a.asks as [number, number][]).every(it => it.length === 2) === false) {
-		return false;
-	}
-	if ((a.bids instanceof Array) === false) {
-		return false;
-	}
-	if ((a.bids as [number, number][]).every(it => it.length === 2) === false) {
+	if (typeof a.ts !== "number") {
 		return false;
 	}
-	if ((a.trades instanceof Array) === false) {
-		return false;
-	}
-	if ((a.trades as readonly {
-		readonly tid: number;
-		readonly trade_type: DirectionEng;
-		readonly price: number;
-		readonly amount: number;
-		readonly date: number;
-	}[]).every(it => isDirectionEng(it.trade_type)) === false) {
-		return false;
-	}
-	if ((a.last_price instanceof Object) === false) {
-		return false;
-	}
-	if (isDirectionEng(a.last_price.action) === false) {
+	if (a.trade !== undefined && isDirectionEng(a.trade.trade_type) === false) {
 		return false;
 	}
 	return true;
 }
+type LastPrice = {
+	readonly price: number;
+	readonly action: DirectionEng;
+}
 
 type ZaifTick = {
 	date: string;
@@ -560,14 +531,16 @@ class Client {
 	private timer: Timer;
 
 	constructor() {
-		this.ws = new WebSocket(streamBaseURL + CurrencyPair.xem_jpy);
+		const scheme = location.protocol === "https:" ? "wss://" : "ws://";
+		this.ws = new WebSocket(scheme + location.host + streamBaseURL + CurrencyPair.xem_jpy);
 		this.ws.addEventListener('open', () => { console.log('接続しました。'); });
 		this.ws.addEventListener('error', error => { console.error(`WebSocket Error ${error}`); });
 		this.ws.addEventListener('close', () => { console.log('切断しました。'); });
 		this.ws.addEventListener('message', msg => {
 			const obj = JSON.parse(msg.data);
-			if (isZaifStream(obj)) {
-				this.update(obj);
+			// 最終取引価格は約定から取る
+			if (isRelayData(obj) && obj.trade !== undefined) {
+				this.update({ price: obj.trade.price, action: obj.trade.trade_type });
 			}
 		});
 
@@ -603,11 +576,11 @@ class Client {
 	private static getDirection(action: DirectionEng): Direction {
 		return action === DirectionEng.ask ? Direction.down : Direction.up;
 	}
-	private update(obj: ZaifStream) {
-		dispdata.last_trade.price = obj.last_price.price.toLocaleString(undefined, { maximumFractionDigits: 5 });
-		dispdata.last_trade.action = Client.getDirection(obj.last_price.action);
-		dispdata.last_trade.type = obj.last_price.action;
-		const asset_now = obj.last_price.price * dispdata.currency_number;
+	private update(lp: LastPrice) {
+		dispdata.last_trade.price = lp.price.toLocaleString(undefined, { maximumFractionDigits: 5 });
+		dispdata.last_trade.action = Client.getDirection(lp.action);
+		dispdata.last_trade.type = lp.action;
+		const asset_now = lp.price * dispdata.currency_number;
 		dispdata.asset_now = Math.round(asset_now).toLocaleString(undefined, { maximumFractionDigits: 5 });
 		const per = asset_now / (dispdata.currency_number * dispdata.purchase_price);
 		dispdata.asset_per = (Math.round(per * 10000) / 100).toLocaleString(undefined, { maximumFractionDigits: 5 });
@@ -164,42 +164,44 @@ type ZaifStream = {
 	trades: ZaifTrade[];
 	last_price: ZaifLastPrice;
 }
-function isZaifStream(a: any): a is ZaifStream {
+// サーバーが中継するStoreData
+type RelayData = {
+	readonly ts: number;
+	readonly ask?: ZaifBoard;
+	readonly bid?: ZaifBoard;
+	readonly trade?: {
+		readonly currenty_pair: string;
+		readonly trade_type: DirectionEng;
+		readonly price: number;
+		readonly tid: number;
+		readonly amount: number;
+		readonly date: number;
+	};
+}
+function isRelayData(a: any): a is RelayData {
 	if ((a instanceof Object) === false) {
 		return false;
 	}
-	if (isCurrencyPair(a.currency_pair) === false) {
-		return false;
-	}
-	if (!a.timestamp) {
-		return false;
-	}
-	if ((a.asks instanceof Array) === false) {
-		return false;
-	}
-	if ((a.asks as ZaifBoard[]).every(it => it.length === 2) === false) {
+	if (typeof a.ts !== "number") {
 		return false;
 	}
-	if ((a.bids instanceof Array) === false) {
+	if (a.ask !== undefined && ((a.ask instanceof Array) === false || a.ask.length !== 2)) {
 		return false;
 	}
-	if ((a.bids as ZaifBoard[]).every(it => it.length === 2) === false) {
+	if (a.bid !== undefined && ((a.bid instanceof Array) === false || a.bid.length !== 2)) {
 		return false;
 	}
-	if ((a.trades instanceof Array) === false) {
-		return false;
-	}
-	if ((a.trades as ZaifTrade[]).every(it => isDirectionEng(it.trade_type)) === false) {
-		return false;
-	}
-	if ((a.last_price instanceof Object) === false) {
-		return false;
-	}
-	if (isDirectionEng(a.last_price.action) === false) {
+	if (a.trade !== undefined && isDirectionEng(a.trade.trade_type) === false) {
 		return false;
 	}
 	return true;
 }
+// サーバーの板情報
+type BookData = {
+	readonly asks?: ZaifBoard[];
+	readonly bids?: ZaifBoard[];
+	readonly trades?: ZaifTrade[];
+}
 
 type StreamSignals = {
 	[key in Signal]: {
@@ -281,8 +283,11 @@ type Display = {
 }
 
 const svgID = "svgarea" as const;
-const streamBaseURL = "wss://ws.zaif.jp/stream?currency_pair=" as const;
+const streamBaseURL = "/api/zaif/1/stream/" as const;
 const historyDataURL = "/api/zaif/1/oldstream/" as const;
+const depthDataURL = "/api/zaif/1/depth/" as const;
+const depthUpdateInterval = 5 * 1000;	// 5秒
+const relayTradesMax = 50;
 const currency_pair_list = [
 	CurrencyPair.btc_jpy,
 	CurrencyPair.xem_jpy,
@@ -1034,6 +1039,9 @@ class Client {
 	private ws?: WebSocket;
 	private currency_pair: CurrencyPair = Client.getCurrencyPair(currency_hash_default);
 	private resize_timeid: number = 0;
+	private depth_timeid: number = 0;
+	// 中継されたStoreDataと板情報から組み立てたストリーム
+	private stream?: ZaifStream;
 	private tmpdate: Date;
 
 	constructor(hash: string = currency_hash_default) {
@@ -1052,14 +1060,17 @@ class Client {
 		fixDate.reset();    // 時間補正を初期化
 		this.currency_pair = Client.getCurrencyPair(hash);
 		this.loadHistory();
+		// 中継は最良気配と約定だけなので、板全体は定期的に取得する
+		this.loadDepth();
+		this.depth_timeid = window.setInterval(() => this.loadDepth(), depthUpdateInterval);
 		this.ws = new WebSocket(this.getWebsocketURL());
 		this.ws.addEventListener('open', () => { console.log('接続しました。'); });
 		this.ws.addEventListener('error', error => { console.error(`WebSocket Error ${error}`); });
 		this.ws.addEventListener('close', () => { console.log('切断しました。'); });
 		this.ws.addEventListener('message', msg => {
 			const obj = JSON.parse(msg.data);
-			if (isZaifStream(obj)) {
-				this.update(obj);
+			if (isRelayData(obj)) {
+				this.relay(obj);
 			}
 		});
 	}
@@ -1068,6 +1079,11 @@ class Client {
 			window.clearTimeout(this.resize_timeid);
 			this.resize_timeid = 0;
 		}
+		if (this.depth_timeid > 0) {
+			window.clearInterval(this.depth_timeid);
+			this.depth_timeid = 0;
+		}
+		this.stream = undefined;
 		this.ws?.close();
 		this.ws = undefined;
 		this.graph?.dispose();
@@ -1092,7 +1108,80 @@ class Client {
 		return currency_pair_list.find(data => data === cp) ?? currency_pair_list[0];
 	}
 	private getWebsocketURL(): string {
-		return streamBaseURL + this.currency_pair;
+		const scheme = location.protocol === "https:" ? "wss://" : "ws://";
+		return scheme + location.host + streamBaseURL + this.currency_pair;
+	}
+	private getStream(): ZaifStream {
+		if (this.stream === undefined) {
+			this.stream = {
+				currency_pair: this.currency_pair,
+				timestamp: "",
+				asks: [],
+				bids: [],
+				trades: [],
+				last_price: {
+					price: 0,
+					action: DirectionEng.bid
+				}
+			};
+		}
+		return this.stream;
+	}
+	// relay 中継されたStoreDataをストリームに反映する
+	// 最良気配が変わったら、それより内側の気配は約定か取消で無くなっている
+	private relay(it: RelayData): void {
+		const st = this.getStream();
+		st.timestamp = new Date(it.ts * 1000).toISOString();
+		if (it.ask !== undefined) {
+			const ask = it.ask;
+			st.asks = [ask, ...st.asks.filter(a => a[0] > ask[0])];
+		}
+		if (it.bid !== undefined) {
+			const bid = it.bid;
+			st.bids = [bid, ...st.bids.filter(b => b[0] < bid[0])];
+		}
+		if (it.trade !== undefined) {
+			const tr = it.trade;
+			st.trades = [{
+				tid: tr.tid,
+				trade_type: tr.trade_type,
+				price: tr.price,
+				amount: tr.amount,
+				date: tr.date
+			}, ...st.trades].slice(0, relayTradesMax);
+			st.last_price = {
+				price: tr.price,
+				action: tr.trade_type
+			};
+		}
+		if (st.asks.length > 0 && st.bids.length > 0 && st.trades.length > 0) {
+			this.update(st);
+		}
+	}
+	private loadDepth(): void {
+		const cp = this.currency_pair;
+		fetch(depthDataURL + cp).then((resp: Response) => {
+			if (resp.ok) {
+				return resp.json();
+			}
+			throw new Error(resp.statusText);
+		}).then((value: BookData) => {
+			if (cp !== this.currency_pair) {
+				return;
+			}
+			const st = this.getStream();
+			st.asks = value.asks ?? st.asks;
+			st.bids = value.bids ?? st.bids;
+			if (st.trades.length === 0 && value.trades !== undefined && value.trades.length > 0) {
+				st.trades = value.trades.slice(0, relayTradesMax);
+				st.last_price = {
+					price: st.trades[0].price,
+					action: st.trades[0].trade_type
+				};
+			}
+		}).catch(err => {
+			console.error(err);
+		});
 	}
 	private static getDirection(action: DirectionEng): Direction {
 		return action === DirectionEng.ask ? Direction.down : Direction.up;
@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/tanaton/zaifbotbattleviewer/zbbv"
 )
@@ -26,10 +29,157 @@ func _main() int {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	app := zbbv.New()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backfill":
+			return backfill(os.Args[2:])
+		case "book":
+			return book(os.Args[2:])
+		case "convert":
+			return convert(os.Args[2:])
+		case "verify":
+			return verify(os.Args[2:])
+		}
+	}
+	conf, err := loadConfig(flag.NewFlagSet(os.Args[0], flag.ContinueOnError), os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 2
+	}
+	app, err := zbbv.New(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "設定に誤りがあります。\n%s\n", err)
+		return 2
+	}
 	if err := app.Run(ctx); err != nil {
 		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
 		return 1
 	}
 	return 0
 }
+
+// backfill アーカイブの約定から日毎のティッカーを作り直す
+//
+//	zaifbotbattleviewer backfill -pairs btc_jpy -tolerance 0.01
+func backfill(args []string) int {
+	fs := flag.NewFlagSet(os.Args[0]+" backfill", flag.ContinueOnError)
+	tol := fs.Float64("tolerance", zbbv.DefaultTickTolerance, "スナップショットとの差をこの割合まで許容する")
+	conf, err := loadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 2
+	}
+	if err := zbbv.Backfill(conf, os.Stdout, *tol); err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// convert 圧縮済みのアーカイブを列指向形式に変換する
+//
+//	zaifbotbattleviewer convert -pairs btc_jpy -remove
+func convert(args []string) int {
+	fs := flag.NewFlagSet(os.Args[0]+" convert", flag.ContinueOnError)
+	remove := fs.Bool("remove", false, "列指向形式と一致する変換元のアーカイブを消す")
+	conf, err := loadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 2
+	}
+	if err := zbbv.ConvertArchive(conf, os.Stdout, zbbv.ConvertOptions{Remove: *remove}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// verify アーカイブをマニフェストと突き合わせて抜けを報告する
+// 問題があれば終了コードは1
+//
+//	zaifbotbattleviewer verify -pairs btc_jpy -gap 10m
+func verify(args []string) int {
+	fs := flag.NewFlagSet(os.Args[0]+" verify", flag.ContinueOnError)
+	gap := fs.Duration("gap", zbbv.DefaultVerifyGap, "時刻がこれ以上空いていたら報告する")
+	tidgap := fs.Uint64("tid-gap", 0, "Tidがこれより大きく飛んでいたら報告する（0で報告しない）")
+	write := fs.Bool("write", false, "マニフェストが無いアーカイブのマニフェストを作る")
+	conf, err := loadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 2
+	}
+	bad, err := zbbv.Verify(conf, os.Stdout, zbbv.VerifyOptions{Gap: *gap, TidGap: *tidgap, Write: *write})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 1
+	}
+	if bad > 0 {
+		fmt.Fprintf(os.Stderr, "%d件の問題がありました。\n", bad)
+		return 1
+	}
+	return 0
+}
+
+// book アーカイブからある時点の板を再現してJSONで出力する
+//
+//	zaifbotbattleviewer book -pair btc_jpy -at 2023-11-15T07:00:00+09:00
+func book(args []string) int {
+	fs := flag.NewFlagSet(os.Args[0]+" book", flag.ContinueOnError)
+	exchange := fs.String("exchange", zbbv.DefaultExchange, "取引所")
+	pair := fs.String("pair", "btc_jpy", "通貨ペア")
+	at := fs.String("at", "", "時刻（UNIX時間かRFC3339形式、省略時は現在）")
+	conf, err := loadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 2
+	}
+	t := time.Now()
+	if *at != "" {
+		if t, err = zbbv.ParseTime(*at); err != nil {
+			fmt.Fprintf(os.Stderr, "Error:-at %s\n", err)
+			return 2
+		}
+	}
+	bs, err := zbbv.ReconstructBook(conf, *exchange, *pair, t)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 1
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(bs); err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// 設定の優先順位は 既定値 < 設定ファイル < 環境変数 < フラグ
+func loadConfig(fs *flag.FlagSet, args []string) (*zbbv.Config, error) {
+	conf := zbbv.NewConfig()
+	confpath := fs.String("config", "", "JSON形式の設定ファイル")
+	names := make(map[string]bool)
+	for _, it := range conf.Flags() {
+		fs.String(it.Name, "", it.Usage)
+		names[it.Name] = true
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *confpath != "" {
+		if err := conf.LoadFile(*confpath); err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.LoadEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if names[f.Name] == false || err != nil {
+			return
+		}
+		if serr := conf.Set(f.Name, f.Value.String()); serr != nil {
+			err = fmt.Errorf("-%s: %w", f.Name, serr)
+		}
+	})
+	return conf, err
+}
@@ -0,0 +1,390 @@
+package zbbv_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tanaton/zaifbotbattleviewer/zbbv"
+	"github.com/tanaton/zaifbotbattleviewer/zbbv/zaiftest"
+)
+
+const testPair = "btc_jpy"
+
+var jst = func() *time.Location {
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		return time.FixedZone("Asia/Tokyo", 9*60*60)
+	}
+	return loc
+}()
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// newTestConfig 偽サーバに接続してループバックアドレスで待ち受ける設定
+func newTestConfig(t *testing.T, fake *zaiftest.Server) *zbbv.Config {
+	t.Helper()
+	dir := t.TempDir()
+	conf := zbbv.NewConfig()
+	conf.RootDomain = ""
+	conf.ListenAddr = freeAddr(t)
+	conf.RootDataPath = filepath.Join(dir, "data")
+	conf.AccessLogPath = filepath.Join(dir, "log")
+	conf.PublicPath = filepath.Join(dir, "public")
+	conf.Exchanges = []zbbv.ExchangeConfig{fake.ExchangeConfig(testPair)}
+	return conf
+}
+
+// runApp Appを起動して/healthzが応答するまで待つ
+// 返り値の関数で停止して終了を待つ
+func runApp(t *testing.T, conf *zbbv.Config) (base string, stop func()) {
+	t.Helper()
+	zbbv.SetStreamRetryJitter(10 * time.Millisecond)
+	app, err := zbbv.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// ログの同期は標準エラーがパイプだと失敗するので見ない
+		app.Run(ctx)
+	}()
+	stopped := false
+	stop = func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			t.Fatal("Appが停止しません")
+		}
+	}
+	t.Cleanup(stop)
+	base = "http://" + conf.ListenAddr
+	eventually(t, 10*time.Second, func() error {
+		res, err := http.Get(base + zbbv.HealthzPath)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d", res.StatusCode)
+		}
+		return nil
+	})
+	return base, stop
+}
+
+// eventually fnがnilを返すまで繰り返す
+func eventually(t *testing.T, timeout time.Duration, fn func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("タイムアウトしました。%v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func getJSON(base, kind string, v interface{}) (http.Header, error) {
+	res, err := http.Get(base + zbbv.PairAPIPrefix(zbbv.DefaultExchange) + kind + "/" + testPair)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: status %d", kind, res.StatusCode)
+	}
+	return res.Header, json.NewDecoder(res.Body).Decode(v)
+}
+
+// waitLastPrice lastpriceがpriceになるまで待つ
+func waitLastPrice(t *testing.T, base string, price float64) {
+	t.Helper()
+	eventually(t, 10*time.Second, func() error {
+		var lp zbbv.LastPrice
+		if _, err := getJSON(base, "lastprice", &lp); err != nil {
+			return err
+		}
+		if lp.Price != price {
+			return fmt.Errorf("lastprice %v, want %v", lp.Price, price)
+		}
+		return nil
+	})
+}
+
+func message(ts time.Time, tid uint64, price float64) zbbv.ZaifStream {
+	return zbbv.ZaifStream{
+		Asks: []zbbv.PriceAmount{{price + 5, 1}},
+		Bids: []zbbv.PriceAmount{{price - 5, 1}},
+		Trades: []zbbv.Trade{{
+			CurrentyPair: testPair,
+			TradeType:    "bid",
+			Price:        price,
+			Tid:          tid,
+			Amount:       0.1,
+			Date:         uint64(ts.Unix()),
+		}},
+		Timestamp:    zbbv.Timestamp(ts),
+		LastPrice:    zbbv.LastPrice{Action: "bid", Price: price},
+		CurrentyPair: testPair,
+	}
+}
+
+func tids(sda []zbbv.StoreData) []uint64 {
+	var l []uint64
+	for _, sd := range sda {
+		if sd.Trade != nil {
+			l = append(l, sd.Trade.Tid)
+		}
+	}
+	return l
+}
+
+func equalTids(got []uint64, want ...uint64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAppServesFakeZaif(t *testing.T) {
+	fake := zaiftest.NewServer()
+	defer fake.Close()
+	now := time.Now()
+	fake.Script(testPair,
+		message(now, 1, 100),
+		message(now, 2, 110),
+		message(now, 3, 120),
+	)
+	fake.SetDepth(testPair, zbbv.Depth{
+		Asks: []zbbv.PriceAmount{{125, 2}, {130, 1}},
+		Bids: []zbbv.PriceAmount{{115, 3}},
+	})
+	fake.SetTicker(testPair, zbbv.ZaifTicker{Last: 120, High: 130, Low: 90, Vwap: 110, Volume: 10})
+
+	conf := newTestConfig(t, fake)
+	// 前の日に取得したティッカー
+	yesterday := now.In(jst).AddDate(0, 0, -1).Format("20060102")
+	tp := filepath.Join(conf.RootDataPath, "tick", testPair, yesterday+"_"+testPair+".json")
+	if err := os.MkdirAll(filepath.Dir(tp), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tp, []byte(`{"last":100,"high":105,"low":95,"vwap":101,"volume":7}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base, _ := runApp(t, conf)
+	waitLastPrice(t, base, 120)
+
+	var sda []zbbv.StoreData
+	h, err := getJSON(base, "oldstream", &sda)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tids(sda); equalTids(got, 1, 2, 3) == false {
+		t.Errorf("oldstream tids = %v", got)
+	}
+	if src := h.Get("X-Data-Source"); src != zbbv.DataSourceStream {
+		t.Errorf("oldstream X-Data-Source = %q", src)
+	}
+	if h.Get("ETag") == "" {
+		t.Error("oldstream ETagがありません")
+	}
+
+	var lp zbbv.LastPrice
+	if _, err := getJSON(base, "lastprice", &lp); err != nil {
+		t.Fatal(err)
+	}
+	if lp.Action != "bid" || lp.Price != 120 {
+		t.Errorf("lastprice = %+v", lp)
+	}
+
+	// 板はストリームの気配で更新される
+	var bs zbbv.BookSnapshot
+	h, err = getJSON(base, "depth", &bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs.Asks) == 0 || len(bs.Bids) == 0 {
+		t.Errorf("depth = %+v", bs)
+	}
+	if h.Get("X-Data-As-Of") == "" {
+		t.Error("depth X-Data-As-Ofがありません")
+	}
+
+	var tl []zbbv.Ticker
+	if _, err := getJSON(base, "ticks", &tl); err != nil {
+		t.Fatal(err)
+	}
+	if len(tl) == 0 || tl[0].Date != yesterday || tl[0].Close != 100 {
+		t.Errorf("ticks = %+v", tl)
+	}
+
+	// 変わっていなければ304
+	u := base + zbbv.PairAPIPrefix(zbbv.DefaultExchange) + "lastprice/" + testPair
+	res, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	req, _ := http.NewRequest(http.MethodGet, u, nil)
+	req.Header.Set("If-None-Match", res.Header.Get("ETag"))
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match status = %d", res.StatusCode)
+	}
+}
+
+func TestAppReconnects(t *testing.T) {
+	fake := zaiftest.NewServer()
+	defer fake.Close()
+	now := time.Now()
+	fake.Script(testPair, message(now, 1, 100))
+
+	base, _ := runApp(t, newTestConfig(t, fake))
+	waitLastPrice(t, base, 100)
+
+	fake.Disconnect(testPair)
+	if fake.WaitConnections(testPair, 2, 10*time.Second) == false {
+		t.Fatalf("再接続しません。connections:%d", fake.Connections(testPair))
+	}
+	// 再接続した後も台本の約定が届くが、重複しては保存しない
+	fake.Send(testPair, message(now.Add(time.Second), 2, 200))
+	waitLastPrice(t, base, 200)
+
+	var sda []zbbv.StoreData
+	if _, err := getJSON(base, "oldstream", &sda); err != nil {
+		t.Fatal(err)
+	}
+	if got := tids(sda); equalTids(got, 1, 2) == false {
+		t.Errorf("oldstream tids = %v", got)
+	}
+
+	// 切断していた期間は欠損として記録する
+	eventually(t, 10*time.Second, func() error {
+		var gl []zbbv.Gap
+		if _, err := getJSON(base, "gaps", &gl); err != nil {
+			return err
+		}
+		for _, g := range gl {
+			if g.Reason == zbbv.GapRead && g.End != nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("gaps = %+v", gl)
+	})
+}
+
+func TestAppStoreFiles(t *testing.T) {
+	fake := zaiftest.NewServer()
+	defer fake.Close()
+	now := time.Now().In(jst)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, jst)
+	tomorrow := today.AddDate(0, 0, 1)
+	fake.Script(testPair,
+		message(now, 1, 100),
+		message(now, 2, 110),
+		// 日付が変わると前の日のファイルをアーカイブにする
+		message(tomorrow.Add(time.Minute), 3, 120),
+	)
+
+	conf := newTestConfig(t, fake)
+	base, stop := runApp(t, conf)
+	waitLastPrice(t, base, 120)
+	stop()
+
+	root := conf.RootDataPath
+	name := func(day time.Time) string {
+		return testPair + "_" + day.Format("20060102") + ".json"
+	}
+
+	// 前の日のアーカイブとマニフェスト
+	buf, err := readGzip(filepath.Join(root, "stream", testPair, name(today)+".gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sda []zbbv.StoreData
+	if err := json.Unmarshal(buf, &sda); err != nil {
+		t.Fatalf("アーカイブがJSONの配列ではありません。%v\n%s", err, buf)
+	}
+	if got := tids(sda); equalTids(got, 1, 2) == false {
+		t.Errorf("archive tids = %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(root, "manifest", testPair, name(today))); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "tmp", testPair, name(today))); os.IsNotExist(err) == false {
+		t.Errorf("アーカイブにした書き込み中のファイルが残っています。%v", err)
+	}
+
+	// 書き込み中のファイルは閉じ括弧の無い配列
+	buf, err = os.ReadFile(filepath.Join(root, "tmp", testPair, name(tomorrow)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.HasPrefix(buf, []byte("[")) == false || bytes.HasSuffix(buf, []byte("]")) {
+		t.Errorf("書き込み中のファイル = %s", buf)
+	}
+	sda = nil
+	if err := json.Unmarshal(append(buf, ']'), &sda); err != nil {
+		t.Fatalf("%v\n%s", err, buf)
+	}
+	if got := tids(sda); equalTids(got, 3) == false {
+		t.Errorf("tmp tids = %v", got)
+	}
+
+	// 再起動用のバッファ
+	if _, err := os.Stat(filepath.Join(root, "tmp", testPair+"_buffer.gob")); err != nil {
+		t.Error(err)
+	}
+}
+
+func readGzip(p string) ([]byte, error) {
+	fp, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	gz, err := gzip.NewReader(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return io.ReadAll(gz)
+}
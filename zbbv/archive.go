@@ -0,0 +1,123 @@
+package zbbv
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// errStopRead 読み込みを途中でやめる時にコールバックから返す
+var errStopRead = errors.New("stop")
+
+// dayStart 日本時間でその日の0時
+func dayStart(t time.Time) time.Time {
+	t = t.In(jst)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, jst)
+}
+
+// isDayStart 日本時間の0時ちょうどか
+func isDayStart(t time.Time) bool {
+	return t.Equal(dayStart(t))
+}
+
+// dayFileKind 日毎のファイルの種類
+type dayFileKind int
+
+const (
+	dayFileTmp      dayFileKind = iota // 書き込み中のJSON
+	dayFileGzip                        // 圧縮済みのJSON
+	dayFileColumnar                    // 列指向のバイナリ
+)
+
+// storeDataDayFile 日毎のファイルの場所
+// 列指向のファイル、圧縮済みのアーカイブ、書き込み中のファイルの順に探す
+func storeDataDayFile(root, key string, day time.Time) (p string, kind dayFileKind, ok bool) {
+	day = day.In(jst)
+	p = createColFilePath(root, day, key)
+	if _, err := os.Stat(p); err == nil {
+		return p, dayFileColumnar, true
+	}
+	p = createStoreFilePath(root, day, key, "stream") + ".gz"
+	if _, err := os.Stat(p); err == nil {
+		return p, dayFileGzip, true
+	}
+	p = createStoreFilePath(root, day, key, "tmp")
+	if _, err := os.Stat(p); err == nil {
+		return p, dayFileTmp, true
+	}
+	return "", dayFileTmp, false
+}
+
+// readStoreDataFile 日毎のファイルを先頭から読んでfnに渡す
+// 書き込み中のファイルは閉じ括弧が無かったり最後の1件が途中までだったりするので、そこで終わりとする
+func readStoreDataFile(p string, gz bool, fn func(StoreData) error) error {
+	fp, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	var r io.Reader = bufio.NewReaderSize(fp, 64*1024)
+	if gz {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	dec := json.NewDecoder(r)
+	if _, err := dec.Token(); err != nil {
+		if err == io.EOF && gz == false {
+			return nil
+		}
+		return err
+	}
+	for dec.More() {
+		var sd StoreData
+		if err := dec.Decode(&sd); err != nil {
+			if gz == false {
+				return nil
+			}
+			return err
+		}
+		if err := fn(sd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readStoreDataRange [since, until) の範囲のStoreDataを日毎のファイルから時刻順に読んでfnに渡す
+// fnがerrStopReadを返した場合はnilを返して終了する
+func readStoreDataRange(root, key string, since, until time.Time, fn func(StoreData) error) error {
+	for day := dayStart(since); day.Before(until); day = day.AddDate(0, 0, 1) {
+		p, kind, ok := storeDataDayFile(root, key, day)
+		if ok == false {
+			continue
+		}
+		f := func(sd StoreData) error {
+			ts := time.Time(sd.Timestamp)
+			if ts.Before(since) || ts.Before(until) == false {
+				return nil
+			}
+			return fn(sd)
+		}
+		var err error
+		if kind == dayFileColumnar {
+			err = readColFile(p, since, until, f)
+		} else {
+			err = readStoreDataFile(p, kind == dayFileGzip, f)
+		}
+		if err == errStopRead {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
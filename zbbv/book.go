@@ -0,0 +1,146 @@
+package zbbv
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// 板に残しておく直近の約定数
+	bookTradeMax = 100
+	// ストリームからの更新がこれより古い場合は板情報APIの値で置き換える
+	bookStale = time.Minute
+)
+
+const (
+	BookSourceStream = "stream"
+	BookSourceDepth  = "depth"
+)
+
+// OrderBook 通貨ペア毎の板
+// ストリームの全てのメッセージで全ての気配と約定を反映し、更新する度にseqを進める
+// 板情報APIの値はストリームから更新されるまでの初期値と、ストリームが途切れた時の代わりに使う
+// 更新する度に写しを公開するので、読む側はロックを取らない
+type OrderBook struct {
+	sync.Mutex
+	seq     uint64
+	ts      time.Time
+	updated time.Time // 反映した時刻
+	source  string
+	asks    []PriceAmount
+	bids    []PriceAmount
+	trades  []Trade // 新しい順
+	pub     *publisher[BookSnapshot]
+}
+
+// BookSnapshot ある時点の板の写し
+type BookSnapshot struct {
+	Seq       uint64        `json:"seq"`
+	Timestamp Unixtime      `json:"ts"`
+	Source    string        `json:"source"`
+	Asks      []PriceAmount `json:"asks"`
+	Bids      []PriceAmount `json:"bids"`
+	Trades    []Trade       `json:"trades,omitempty"`
+}
+
+func newOrderBook() *OrderBook {
+	return &OrderBook{
+		trades: make([]Trade, 0, bookTradeMax),
+		pub:    newPublisher[BookSnapshot](nil),
+	}
+}
+
+// Update ストリームのメッセージを反映する
+func (b *OrderBook) Update(s Stream) {
+	asks, bids := sortedLevels(s.Asks, s.Bids)
+	b.Lock()
+	defer b.Unlock()
+	b.asks = asks
+	b.bids = bids
+	b.trades = mergeTrades(b.trades, s.Trades, bookTradeMax)
+	b.ts = s.Timestamp
+	b.updated = time.Now()
+	b.source = BookSourceStream
+	b.seq++
+	b.publish()
+}
+
+// Seed 板情報APIの値を反映する
+// ストリームからの更新が新しい場合は何もせずにfalseを返す
+func (b *OrderBook) Seed(d *Depth, now time.Time) bool {
+	asks, bids := sortedLevels(d.Asks, d.Bids)
+	b.Lock()
+	defer b.Unlock()
+	if b.source == BookSourceStream && now.Sub(b.updated) < bookStale {
+		return false
+	}
+	b.asks = asks
+	b.bids = bids
+	b.ts = now
+	b.updated = now
+	b.source = BookSourceDepth
+	b.seq++
+	b.publish()
+	return true
+}
+
+// publish 現在の板の写しを公開する
+// ロックを取った状態で呼ぶ
+func (b *OrderBook) publish() {
+	bs := BookSnapshot{
+		Seq:       b.seq,
+		Timestamp: Unixtime(b.ts),
+		Source:    b.source,
+		Asks:      append(make([]PriceAmount, 0, len(b.asks)), b.asks...),
+		Bids:      append(make([]PriceAmount, 0, len(b.bids)), b.bids...),
+		Trades:    append(make([]Trade, 0, len(b.trades)), b.trades...),
+	}
+	b.pub.Publish(bs, bookMeta(bs))
+}
+
+// Snapshot 最後に公開した板の写しを返す
+// 写しは共有しているので変更しないこと
+// 一度も更新されていない場合はSeqが0になる
+func (b *OrderBook) Snapshot() BookSnapshot {
+	if s := b.pub.Load(); s != nil {
+		return s.data
+	}
+	return BookSnapshot{}
+}
+
+// Published 最後に公開した板の写し
+// 一度も更新されていない場合はnil
+func (b *OrderBook) Published() *snapshot[BookSnapshot] {
+	return b.pub.Load()
+}
+
+// sortedLevels 売りは安い順、買いは高い順に並べた写しを返す
+func sortedLevels(asks, bids []PriceAmount) ([]PriceAmount, []PriceAmount) {
+	a := append(make([]PriceAmount, 0, len(asks)), asks...)
+	bl := append(make([]PriceAmount, 0, len(bids)), bids...)
+	sort.SliceStable(a, func(i, j int) bool { return a[i][0] < a[j][0] })
+	sort.SliceStable(bl, func(i, j int) bool { return bl[i][0] > bl[j][0] })
+	return a, bl
+}
+
+// mergeTrades Tidの新しい順に並んだtlにtrを混ぜる
+// 同じTidの約定は1件にまとめ、max件を超えた古いものは捨てる
+func mergeTrades(tl, tr []Trade, max int) []Trade {
+	for _, t := range tr {
+		i := sort.Search(len(tl), func(i int) bool { return tl[i].Tid <= t.Tid })
+		if i < len(tl) && tl[i].Tid == t.Tid {
+			continue
+		}
+		if i >= max {
+			continue
+		}
+		tl = append(tl, Trade{})
+		copy(tl[i+1:], tl[i:])
+		tl[i] = t
+		if len(tl) > max {
+			tl = tl[:max]
+		}
+	}
+	return tl
+}
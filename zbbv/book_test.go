@@ -0,0 +1,166 @@
+package zbbv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMergeTrades(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		tl   []uint64
+		tr   []uint64
+		max  int
+		want []uint64
+	}{
+		{"空", nil, []uint64{3, 1, 2}, 10, []uint64{3, 2, 1}},
+		{"新しい約定", []uint64{5, 4}, []uint64{7, 6}, 10, []uint64{7, 6, 5, 4}},
+		{"遅れて届いた約定", []uint64{9, 5}, []uint64{7}, 10, []uint64{9, 7, 5}},
+		{"重複", []uint64{5, 4}, []uint64{5, 4, 5}, 10, []uint64{5, 4}},
+		{"上限", []uint64{5, 4, 3}, []uint64{6, 7}, 3, []uint64{7, 6, 5}},
+		// 上限より古い約定は入れない
+		{"上限より古い", []uint64{5, 4, 3}, []uint64{1}, 3, []uint64{5, 4, 3}},
+	} {
+		var tl []Trade
+		if tc.tl != nil {
+			tl = tradeList(tc.tl...)
+		}
+		got := tradeTids(mergeTrades(tl, tradeList(tc.tr...), tc.max))
+		if equalUint64s(got, tc.want) == false {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestOrderBookUpdate(t *testing.T) {
+	b := newOrderBook()
+	if b.Published() != nil || b.Snapshot().Seq != 0 {
+		t.Fatal("更新前に公開しています。")
+	}
+	ts := time.Date(2023, 11, 15, 10, 0, 0, 0, jst)
+	b.Update(Stream{
+		Asks:      []PriceAmount{{102, 1}, {101, 2}},
+		Bids:      []PriceAmount{{98, 1}, {99, 3}},
+		Trades:    tradeList(2, 1),
+		Timestamp: ts,
+	})
+	first := b.Snapshot()
+	b.Update(Stream{
+		Asks:      []PriceAmount{{103, 1}},
+		Bids:      []PriceAmount{{97, 1}},
+		Trades:    tradeList(4, 3, 2),
+		Timestamp: ts.Add(time.Second),
+	})
+	bs := b.Snapshot()
+	if bs.Seq != 2 || bs.Source != BookSourceStream || time.Time(bs.Timestamp).Equal(ts.Add(time.Second)) == false {
+		t.Errorf("snapshot %+v", bs)
+	}
+	// 気配は毎回置き換え、約定は混ぜる
+	if len(bs.Asks) != 1 || bs.Asks[0] != (PriceAmount{103, 1}) || len(bs.Bids) != 1 || bs.Bids[0] != (PriceAmount{97, 1}) {
+		t.Errorf("気配 %+v %+v", bs.Asks, bs.Bids)
+	}
+	if got := tradeTids(bs.Trades); equalUint64s(got, []uint64{4, 3, 2, 1}) == false {
+		t.Errorf("約定 %v", got)
+	}
+	// 公開済みの写しは後の更新で変わらない
+	if first.Seq != 1 || first.Asks[0] != (PriceAmount{101, 2}) || first.Bids[0] != (PriceAmount{99, 3}) || len(first.Trades) != 2 {
+		t.Errorf("最初の写し %+v", first)
+	}
+	if meta := b.Published().meta; meta.Source != DataSourceStream || meta.AsOf.Equal(ts.Add(time.Second)) == false {
+		t.Errorf("meta %+v", meta)
+	}
+}
+
+func TestOrderBookSeed(t *testing.T) {
+	depth := &Depth{
+		Asks: []PriceAmount{{111, 1}, {110, 1}},
+		Bids: []PriceAmount{{89, 1}, {90, 1}},
+	}
+	stream := Stream{
+		Asks:      []PriceAmount{{101, 1}},
+		Bids:      []PriceAmount{{99, 1}},
+		Trades:    tradeList(1),
+		Timestamp: time.Now(),
+	}
+
+	// 板情報APIが先。ストリームが届いたらストリームの値になる
+	b := newOrderBook()
+	now := time.Now()
+	if b.Seed(depth, now) == false {
+		t.Fatal("初期値を反映しません。")
+	}
+	bs := b.Snapshot()
+	if bs.Seq != 1 || bs.Source != BookSourceDepth || bs.Asks[0] != (PriceAmount{110, 1}) || bs.Bids[0] != (PriceAmount{90, 1}) {
+		t.Errorf("初期値 %+v", bs)
+	}
+	if meta := b.Published().meta; meta.Source != DataSourcePoll || meta.AsOf.Equal(now) == false {
+		t.Errorf("meta %+v", meta)
+	}
+	b.Update(stream)
+	if bs := b.Snapshot(); bs.Seq != 2 || bs.Source != BookSourceStream || bs.Asks[0] != (PriceAmount{101, 1}) {
+		t.Errorf("ストリームの値になりません。%+v", bs)
+	}
+
+	// ストリームが先。新しいうちは板情報APIの値で置き換えない
+	b = newOrderBook()
+	b.Update(stream)
+	if b.Seed(depth, time.Now()) {
+		t.Error("新しいストリームの値を置き換えました。")
+	}
+	if bs := b.Snapshot(); bs.Seq != 1 || bs.Source != BookSourceStream {
+		t.Errorf("snapshot %+v", bs)
+	}
+	// ストリームが途切れたら置き換える。約定はストリームで受信した分を残す
+	if b.Seed(depth, time.Now().Add(bookStale)) == false {
+		t.Error("古いストリームの値を置き換えません。")
+	}
+	bs = b.Snapshot()
+	if bs.Seq != 2 || bs.Source != BookSourceDepth || bs.Asks[0] != (PriceAmount{110, 1}) {
+		t.Errorf("snapshot %+v", bs)
+	}
+	if got := tradeTids(bs.Trades); equalUint64s(got, []uint64{1}) == false {
+		t.Errorf("約定 %v", got)
+	}
+	// 板情報APIの値どうしは常に置き換える
+	if b.Seed(&Depth{Asks: []PriceAmount{{120, 1}}}, time.Now()) == false || b.Snapshot().Seq != 3 {
+		t.Errorf("板情報APIの値を置き換えません。%+v", b.Snapshot())
+	}
+}
+
+func TestDepthHandler(t *testing.T) {
+	b := newOrderBook()
+	h := &DepthHandler{cp: "btc_jpy", book: b}
+	get := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/zaif/1/depth/btc_jpy"+query, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	// まだ何も受け取っていなければ空のオブジェクト
+	w := get("")
+	if w.Code != http.StatusOK || w.Body.String() != "{}\n" || w.Header().Get("X-Data-As-Of") != "" {
+		t.Errorf("更新前 status:%d body:%q header:%v", w.Code, w.Body, w.Header())
+	}
+	if w := get("?envelope=1"); w.Code != http.StatusOK || w.Body.String() != `{"data":{}}`+"\n" {
+		t.Errorf("更新前のenvelope status:%d body:%q", w.Code, w.Body)
+	}
+	ts := time.Now().Add(-time.Minute).Truncate(time.Second)
+	b.Update(Stream{Asks: []PriceAmount{{101, 1}}, Bids: []PriceAmount{{99, 1}}, Trades: tradeList(1), Timestamp: ts})
+	w = get("")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status:%d", w.Code)
+	}
+	var bs BookSnapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &bs); err != nil {
+		t.Fatal(err)
+	}
+	if bs.Seq != 1 || bs.Source != BookSourceStream || len(bs.Asks) != 1 || len(bs.Trades) != 1 {
+		t.Errorf("板 %+v", bs)
+	}
+	if w.Header().Get("X-Data-Source") != DataSourceStream || w.Header().Get("X-Data-As-Of") == "" {
+		t.Errorf("header %v", w.Header())
+	}
+}
@@ -0,0 +1,274 @@
+package zbbv
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// 差分の間に全体を書き出す間隔
+const bookSnapshotInterval = 10 * time.Minute
+
+const (
+	bookRecordSnapshot = "s"
+	bookRecordDiff     = "d"
+)
+
+var ErrBookNotFound = errors.New("指定された時刻の板がありません。")
+
+// bookRecord 板のアーカイブの1行
+// 差分の数量が0の気配は消えたことを表す
+type bookRecord struct {
+	Type      string        `json:"t"`
+	Seq       uint64        `json:"seq"`
+	Timestamp Unixtime      `json:"ts"`
+	Source    string        `json:"source,omitempty"`
+	Asks      []PriceAmount `json:"asks"`
+	Bids      []PriceAmount `json:"bids"`
+}
+
+// bookLevels 価格毎の数量
+type bookLevels map[float64]float64
+
+func newBookLevels(l []PriceAmount) bookLevels {
+	m := make(bookLevels, len(l))
+	for _, pa := range l {
+		m[pa[0]] = pa[1]
+	}
+	return m
+}
+
+// diff lからの変化
+func (m bookLevels) diff(l bookLevels) []PriceAmount {
+	d := make([]PriceAmount, 0, 8)
+	for p, a := range m {
+		if old, ok := l[p]; ok == false || old != a {
+			d = append(d, PriceAmount{p, a})
+		}
+	}
+	for p := range l {
+		if _, ok := m[p]; ok == false {
+			d = append(d, PriceAmount{p, 0})
+		}
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i][0] < d[j][0] })
+	return d
+}
+
+func (m bookLevels) apply(d []PriceAmount) {
+	for _, pa := range d {
+		if pa[1] == 0 {
+			delete(m, pa[0])
+		} else {
+			m[pa[0]] = pa[1]
+		}
+	}
+}
+
+func (m bookLevels) list() []PriceAmount {
+	l := make([]PriceAmount, 0, len(m))
+	for p, a := range m {
+		l = append(l, PriceAmount{p, a})
+	}
+	return l
+}
+
+func createBookFilePath(root string, date time.Time, key string) string {
+	return filepath.Join(root, "book", key, fmt.Sprintf("%s_%s.ndjson", key, date.In(jst).Format("20060102")))
+}
+
+// BookWriter 板の全体と差分を日毎のファイルに追記する
+// 日毎のファイルは必ず全体から始まるので、その日のファイルだけで板を再現できる
+type BookWriter struct {
+	root     string
+	key      string
+	day      time.Time
+	fp       *os.File
+	asks     bookLevels
+	bids     bookLevels
+	snapshot time.Time // 最後に全体を書き出した時刻
+}
+
+func newBookWriter(root, key string) *BookWriter {
+	return &BookWriter{root: root, key: key}
+}
+
+// Write 板の写しを書き出す
+// 前回から変化が無ければ何も書かない
+func (bw *BookWriter) Write(bs BookSnapshot) error {
+	ts := time.Time(bs.Timestamp)
+	day := dayStart(ts)
+	if bw.fp == nil || day.Equal(bw.day) == false {
+		if err := bw.open(day); err != nil {
+			return err
+		}
+	}
+	asks := newBookLevels(bs.Asks)
+	bids := newBookLevels(bs.Bids)
+	rec := bookRecord{
+		Seq:       bs.Seq,
+		Timestamp: bs.Timestamp,
+		Source:    bs.Source,
+	}
+	if bw.asks == nil || ts.Sub(bw.snapshot) >= bookSnapshotInterval {
+		rec.Type = bookRecordSnapshot
+		rec.Asks = bs.Asks
+		rec.Bids = bs.Bids
+		bw.snapshot = ts
+	} else {
+		rec.Type = bookRecordDiff
+		rec.Asks = asks.diff(bw.asks)
+		rec.Bids = bids.diff(bw.bids)
+		if len(rec.Asks) == 0 && len(rec.Bids) == 0 {
+			return nil
+		}
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := bw.fp.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	bw.asks = asks
+	bw.bids = bids
+	return nil
+}
+
+func (bw *BookWriter) open(day time.Time) error {
+	bw.Close()
+	p := createBookFilePath(bw.root, day, bw.key)
+	if err := createDir(p); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// 書き込み途中で止まった行に続けて書かないように改行しておく
+	if err := terminateLine(fp); err != nil {
+		fp.Close()
+		return err
+	}
+	bw.fp = fp
+	bw.day = day
+	// 新しいファイルは全体から始める
+	bw.asks = nil
+	bw.bids = nil
+	return nil
+}
+
+// terminateLine fpが改行で終わっていなければ改行を書く
+func terminateLine(fp *os.File) error {
+	st, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() == 0 {
+		return nil
+	}
+	b := make([]byte, 1)
+	if _, err := fp.ReadAt(b, st.Size()-1); err != nil {
+		return err
+	}
+	if b[0] == '\n' {
+		return nil
+	}
+	_, err = fp.Write([]byte{'\n'})
+	return err
+}
+
+func (bw *BookWriter) Close() error {
+	if bw.fp == nil {
+		return nil
+	}
+	err := bw.fp.Close()
+	bw.fp = nil
+	return err
+}
+
+// readBookFile 日毎のファイルからat以前で最後の板を作る
+// at以前の記録が無い場合と、壊れた行から次の全体までの間の場合はokがfalse
+func readBookFile(p string, at time.Time) (bs BookSnapshot, ok bool, err error) {
+	fp, err := os.Open(p)
+	if err != nil {
+		return bs, false, err
+	}
+	defer fp.Close()
+	var asks, bids bookLevels
+	torn := false
+	sc := bufio.NewScanner(fp)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var rec bookRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			// 書き込み途中で止まった行
+			torn = true
+			continue
+		}
+		if time.Time(rec.Timestamp).After(at) {
+			break
+		}
+		if torn {
+			// 続く差分は欠けた板に重ねることになるので、次の全体から読み直す
+			asks, bids = nil, nil
+			ok = false
+			torn = false
+		}
+		switch rec.Type {
+		case bookRecordSnapshot:
+			asks = newBookLevels(rec.Asks)
+			bids = newBookLevels(rec.Bids)
+		case bookRecordDiff:
+			if asks == nil {
+				// 全体より前の差分は使えない
+				continue
+			}
+			asks.apply(rec.Asks)
+			bids.apply(rec.Bids)
+		default:
+			continue
+		}
+		bs.Seq = rec.Seq
+		bs.Timestamp = rec.Timestamp
+		bs.Source = rec.Source
+		ok = true
+	}
+	if err := sc.Err(); err != nil {
+		return bs, false, err
+	}
+	if ok {
+		bs.Asks, bs.Bids = sortedLevels(asks.list(), bids.list())
+	}
+	return bs, ok, nil
+}
+
+// reconstructBook atの時点の板をアーカイブから再現する
+// その日の記録がat以降から始まる場合は前日の最後の板を返す
+func reconstructBook(root, key string, at time.Time) (BookSnapshot, error) {
+	day := dayStart(at)
+	for _, d := range []time.Time{day, day.AddDate(0, 0, -1)} {
+		bs, ok, err := readBookFile(createBookFilePath(root, d, key), at)
+		if err != nil && os.IsNotExist(err) == false {
+			return bs, err
+		}
+		if ok {
+			return bs, nil
+		}
+	}
+	return BookSnapshot{}, ErrBookNotFound
+}
+
+// ReconstructBook 設定されたデータ保存先からatの時点の板を再現する
+func ReconstructBook(conf *Config, exchange, key string, at time.Time) (BookSnapshot, error) {
+	ec, ok := conf.Exchange(exchange)
+	if ok == false {
+		return BookSnapshot{}, ErrExchangeNotFound
+	}
+	return reconstructBook(ec.dataPath(conf.RootDataPath), key, at)
+}
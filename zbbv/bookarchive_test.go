@@ -0,0 +1,268 @@
+package zbbv
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func bookAt(ts time.Time, seq uint64, asks, bids []PriceAmount) BookSnapshot {
+	return BookSnapshot{Seq: seq, Timestamp: Unixtime(ts), Source: BookSourceStream, Asks: asks, Bids: bids}
+}
+
+// readBookTypes 板のアーカイブの各行の種類を返す
+// 読めない行は空文字にする
+func readBookTypes(t *testing.T, p string) []string {
+	t.Helper()
+	fp, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	var types []string
+	sc := bufio.NewScanner(fp)
+	for sc.Scan() {
+		var rec bookRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			types = append(types, "")
+			continue
+		}
+		types = append(types, rec.Type)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return types
+}
+
+func sameBook(a, b BookSnapshot) bool {
+	return a.Seq == b.Seq &&
+		time.Time(a.Timestamp).Equal(time.Time(b.Timestamp)) &&
+		reflect.DeepEqual(a.Asks, b.Asks) &&
+		reflect.DeepEqual(a.Bids, b.Bids)
+}
+
+func writeBookLines(t *testing.T, p string, lines ...string) {
+	t.Helper()
+	if err := createDir(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBookWriterRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	base := time.Date(2023, 11, 15, 10, 0, 0, 0, jst)
+	books := []BookSnapshot{
+		bookAt(base, 1, []PriceAmount{{101, 1}, {102, 2}}, []PriceAmount{{99, 1}, {98, 2}}),
+		// 気配の数量の変化と、消えた気配
+		bookAt(base.Add(time.Second), 2, []PriceAmount{{101, 3}, {102, 2}}, []PriceAmount{{99, 1}}),
+		// 変化が無いので書かない
+		bookAt(base.Add(2*time.Second), 3, []PriceAmount{{101, 3}, {102, 2}}, []PriceAmount{{99, 1}}),
+		// 新しい気配
+		bookAt(base.Add(3*time.Second), 4, []PriceAmount{{100, 1}, {101, 3}, {102, 2}}, []PriceAmount{{99, 1}, {97, 5}}),
+		// 間隔が空いたので全体
+		bookAt(base.Add(bookSnapshotInterval+3*time.Second), 5, []PriceAmount{{100, 2}}, []PriceAmount{{99, 2}}),
+		bookAt(base.Add(bookSnapshotInterval+4*time.Second), 6, []PriceAmount{{100, 2}, {101, 1}}, []PriceAmount{{99, 2}}),
+	}
+	bw := newBookWriter(root, "btc_jpy")
+	for _, bs := range books {
+		if err := bw.Write(bs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p := createBookFilePath(root, base, "btc_jpy")
+	if types, want := readBookTypes(t, p), []string{"s", "d", "d", "s", "d"}; reflect.DeepEqual(types, want) == false {
+		t.Errorf("記録の種類が違います。%v, want %v", types, want)
+	}
+	if _, ok, err := readBookFile(p, base.Add(-time.Second)); err != nil || ok {
+		t.Errorf("最初の記録より前の板があります。ok:%v err:%v", ok, err)
+	}
+	for i, bs := range books {
+		want := bs
+		if i == 2 {
+			// 書かなかった板は1つ前の板のまま
+			want = books[1]
+		}
+		want.Asks, want.Bids = sortedLevels(want.Asks, want.Bids)
+		got, ok, err := readBookFile(p, time.Time(bs.Timestamp))
+		if err != nil || ok == false {
+			t.Errorf("%d: 板がありません。ok:%v err:%v", i, ok, err)
+			continue
+		}
+		if sameBook(got, want) == false {
+			t.Errorf("%d: 板が違います。%+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestReconstructBookDayBoundary(t *testing.T) {
+	root := t.TempDir()
+	day := time.Date(2023, 11, 16, 0, 0, 0, 0, jst)
+	before := bookAt(day.Add(-10*time.Second), 1, []PriceAmount{{101, 1}}, []PriceAmount{{99, 1}})
+	last := bookAt(day.Add(-5*time.Second), 2, []PriceAmount{{101, 2}}, []PriceAmount{{99, 1}})
+	after := bookAt(day.Add(10*time.Second), 3, []PriceAmount{{101, 2}}, []PriceAmount{{99, 3}})
+	bw := newBookWriter(root, "btc_jpy")
+	for _, bs := range []BookSnapshot{before, last, after} {
+		if err := bw.Write(bs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 日毎のファイルは全体から始まる
+	if types, want := readBookTypes(t, createBookFilePath(root, day, "btc_jpy")), []string{"s"}; reflect.DeepEqual(types, want) == false {
+		t.Errorf("次の日の記録の種類が違います。%v, want %v", types, want)
+	}
+	for _, it := range []struct {
+		name string
+		at   time.Time
+		want *BookSnapshot
+	}{
+		{"前日の記録より前", day.Add(-time.Minute), nil},
+		{"前日の最後", day.Add(-time.Second), &last},
+		{"その日の記録より前", day.Add(5 * time.Second), &last},
+		{"その日の記録", day.Add(time.Minute), &after},
+		{"記録の無い日", day.AddDate(0, 0, 2), nil},
+	} {
+		got, err := reconstructBook(root, "btc_jpy", it.at)
+		if it.want == nil {
+			if errors.Is(err, ErrBookNotFound) == false {
+				t.Errorf("%s: err = %v, want %v", it.name, err, ErrBookNotFound)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", it.name, err)
+			continue
+		}
+		if sameBook(got, *it.want) == false {
+			t.Errorf("%s: 板が違います。%+v, want %+v", it.name, got, *it.want)
+		}
+	}
+}
+
+func TestReadBookFileDiffFirst(t *testing.T) {
+	p := createBookFilePath(t.TempDir(), time.Date(2023, 11, 15, 0, 0, 0, 0, jst), "btc_jpy")
+	// 前日から続いた差分の後に全体が来る
+	writeBookLines(t, p,
+		`{"t":"d","seq":1,"ts":1700010000,"asks":[[101,5]],"bids":[]}`,
+		`{"t":"s","seq":2,"ts":1700010001,"asks":[[102,1]],"bids":[[99,1]]}`,
+		`{"t":"d","seq":3,"ts":1700010002,"asks":[[101,2]],"bids":[[99,0]]}`,
+	)
+	if _, ok, err := readBookFile(p, time.Unix(1700010000, 0)); err != nil || ok {
+		t.Errorf("全体より前の差分から板を作りました。ok:%v err:%v", ok, err)
+	}
+	for _, it := range []struct {
+		at   int64
+		want BookSnapshot
+	}{
+		{1700010001, bookAt(time.Unix(1700010001, 0), 2, []PriceAmount{{102, 1}}, []PriceAmount{{99, 1}})},
+		{1700010002, bookAt(time.Unix(1700010002, 0), 3, []PriceAmount{{101, 2}, {102, 1}}, []PriceAmount{})},
+	} {
+		got, ok, err := readBookFile(p, time.Unix(it.at, 0))
+		if err != nil || ok == false {
+			t.Errorf("%d: 板がありません。ok:%v err:%v", it.at, ok, err)
+			continue
+		}
+		if sameBook(got, it.want) == false {
+			t.Errorf("%d: 板が違います。%+v, want %+v", it.at, got, it.want)
+		}
+	}
+}
+
+func TestReadBookFileTornLine(t *testing.T) {
+	p := createBookFilePath(t.TempDir(), time.Date(2023, 11, 15, 0, 0, 0, 0, jst), "btc_jpy")
+	writeBookLines(t, p,
+		`{"t":"s","seq":1,"ts":1700010000,"asks":[[101,1]],"bids":[[99,1]]}`,
+		`{"t":"d","seq":2,"ts":1700010001,"as`,
+		// 壊れた行の変化が抜けているので、この差分は使えない
+		`{"t":"d","seq":3,"ts":1700010002,"asks":[[100,1]],"bids":[]}`,
+		`{"t":"s","seq":4,"ts":1700010003,"asks":[[100,1],[101,3]],"bids":[[99,1]]}`,
+		`{"t":"d","seq":5,"ts":1700010004,"asks":[[100,0]],"bids":[[98,2]]}`,
+	)
+	for _, it := range []struct {
+		at   int64
+		want *BookSnapshot
+	}{
+		{1700010000, &BookSnapshot{Seq: 1, Timestamp: Unixtime(time.Unix(1700010000, 0)), Asks: []PriceAmount{{101, 1}}, Bids: []PriceAmount{{99, 1}}}},
+		{1700010002, nil},
+		{1700010003, &BookSnapshot{Seq: 4, Timestamp: Unixtime(time.Unix(1700010003, 0)), Asks: []PriceAmount{{100, 1}, {101, 3}}, Bids: []PriceAmount{{99, 1}}}},
+		// 壊れた行の後も最後まで読む
+		{1700010004, &BookSnapshot{Seq: 5, Timestamp: Unixtime(time.Unix(1700010004, 0)), Asks: []PriceAmount{{101, 3}}, Bids: []PriceAmount{{99, 1}, {98, 2}}}},
+	} {
+		got, ok, err := readBookFile(p, time.Unix(it.at, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if it.want == nil {
+			if ok {
+				t.Errorf("%d: 壊れた行の後の差分から板を作りました。%+v", it.at, got)
+			}
+			continue
+		}
+		if ok == false || sameBook(got, *it.want) == false {
+			t.Errorf("%d: 板が違います。ok:%v %+v, want %+v", it.at, ok, got, *it.want)
+		}
+	}
+}
+
+func TestBookWriterReopenTornLine(t *testing.T) {
+	root := t.TempDir()
+	base := time.Date(2023, 11, 15, 10, 0, 0, 0, jst)
+	first := bookAt(base, 1, []PriceAmount{{101, 1}}, []PriceAmount{{99, 1}})
+	bw := newBookWriter(root, "btc_jpy")
+	if err := bw.Write(first); err != nil {
+		t.Fatal(err)
+	}
+	bw.Close()
+	// 書き込み途中で止まった
+	p := createBookFilePath(root, base, "btc_jpy")
+	fp, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.WriteString(`{"t":"d","seq":2,"ts":`)
+	fp.Close()
+
+	second := bookAt(base.Add(time.Minute), 3, []PriceAmount{{101, 2}}, []PriceAmount{{99, 1}})
+	third := bookAt(base.Add(time.Minute+time.Second), 4, []PriceAmount{{101, 2}, {102, 1}}, []PriceAmount{{99, 1}})
+	bw = newBookWriter(root, "btc_jpy")
+	for _, bs := range []BookSnapshot{second, third} {
+		if err := bw.Write(bs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bw.Close()
+	// 壊れた行は1行だけで、再開後の全体は繋がっていない
+	if types, want := readBookTypes(t, p), []string{"s", "", "s", "d"}; reflect.DeepEqual(types, want) == false {
+		t.Errorf("記録の種類が違います。%v, want %v", types, want)
+	}
+	got, ok, err := readBookFile(p, time.Time(third.Timestamp))
+	if err != nil || ok == false {
+		t.Fatalf("板がありません。ok:%v err:%v", ok, err)
+	}
+	if sameBook(got, third) == false {
+		t.Errorf("板が違います。%+v, want %+v", got, third)
+	}
+	// 改行で終わっているファイルには何も足さない
+	bw = newBookWriter(root, "btc_jpy")
+	if err := bw.open(base); err != nil {
+		t.Fatal(err)
+	}
+	bw.Close()
+	if types := readBookTypes(t, p); len(types) != 4 {
+		t.Errorf("行数が変わりました。%v", types)
+	}
+}
@@ -0,0 +1,225 @@
+package zbbv
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 間隔毎に保持する足の最小数
+// 起動時に作り直す日数分が収まらない場合は、その日数分を保持する
+const CandleMax = 1440
+
+// Candle 約定から作ったローソク足
+type Candle struct {
+	Time   Unixtime `json:"time"` // 足の開始時刻
+	Open   float64  `json:"open"`
+	High   float64  `json:"high"`
+	Low    float64  `json:"low"`
+	Close  float64  `json:"close"`
+	Volume float64  `json:"volume"`
+	Count  int      `json:"count"` // 約定数
+}
+
+type candleInterval struct {
+	name string
+	d    time.Duration
+}
+
+// 4時間足と日足は日本時間の0時を起点に揃える
+var candleIntervals = []candleInterval{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+	{"1h", time.Hour},
+	{"4h", 4 * time.Hour},
+	{"1d", 24 * time.Hour},
+}
+
+// CandleSet 通貨ペア毎の各間隔のローソク足
+type CandleSet struct {
+	sync.RWMutex
+	trades *tradeTracker
+	series map[string][]Candle
+	limit  map[string]int // 間隔毎の最大保持数
+}
+
+// newCandleSet days日分の足を保持できるCandleSet
+func newCandleSet(days int) *CandleSet {
+	cs := &CandleSet{
+		trades: newTradeTracker(),
+		series: make(map[string][]Candle, len(candleIntervals)),
+		limit:  make(map[string]int, len(candleIntervals)),
+	}
+	for _, it := range candleIntervals {
+		cs.series[it.name] = make([]Candle, 0, 64)
+		cs.limit[it.name] = candleLimit(days, it.d)
+	}
+	return cs
+}
+
+// candleLimit days日分のd間隔の足の数
+// CandleMaxより少なくはしない
+func candleLimit(days int, d time.Duration) int {
+	n := int(time.Duration(days) * 24 * time.Hour / d)
+	if n < CandleMax {
+		return CandleMax
+	}
+	return n
+}
+
+// CandleIntervalNames 対応している間隔の一覧
+func CandleIntervalNames() []string {
+	l := make([]string, 0, len(candleIntervals))
+	for _, it := range candleIntervals {
+		l = append(l, it.name)
+	}
+	return l
+}
+
+func lookupCandleInterval(name string) (candleInterval, error) {
+	for _, it := range candleIntervals {
+		if it.name == name {
+			return it, nil
+		}
+	}
+	return candleInterval{}, fmt.Errorf("intervalは%sのいずれかにしてください。", strings.Join(CandleIntervalNames(), ","))
+}
+
+// candleStart tを含む足の開始時刻
+func candleStart(t time.Time, d time.Duration) time.Time {
+	_, offset := t.In(jst).Zone()
+	sec := int64(d / time.Second)
+	u := t.Unix() + int64(offset)
+	return time.Unix(u-(u%sec+sec)%sec-int64(offset), 0)
+}
+
+// AddStoreData StoreDataの約定を足に反映する
+func (cs *CandleSet) AddStoreData(sd StoreData) {
+	if sd.Trade == nil {
+		return
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	cs.add(sd)
+}
+
+func (cs *CandleSet) add(sd StoreData) {
+	t := sd.Trade
+	// 遅れて届いた約定で終値を戻さないように
+	latest := t.Tid > cs.trades.last
+	if cs.trades.add(t.Tid) == false {
+		// 取り込み済み
+		return
+	}
+	ts := time.Time(sd.Timestamp)
+	if t.Date > 0 {
+		ts = time.Unix(int64(t.Date), 0)
+	}
+	for _, it := range candleIntervals {
+		cs.series[it.name] = addCandle(cs.series[it.name], cs.limit[it.name], candleStart(ts, it.d), t.Price, t.Amount, latest)
+	}
+}
+
+// addCandle startから始まる足に約定を反映する
+// 足がmax本を超えたら古い方から捨てる
+func addCandle(cl []Candle, max int, start time.Time, price, amount float64, latest bool) []Candle {
+	// 遅れて届いた約定は該当する足を後ろから探す
+	i := len(cl) - 1
+	for ; i >= 0; i-- {
+		if time.Time(cl[i].Time).After(start) == false {
+			break
+		}
+	}
+	if i >= 0 && time.Time(cl[i].Time).Equal(start) {
+		c := &cl[i]
+		if price > c.High {
+			c.High = price
+		}
+		if price < c.Low {
+			c.Low = price
+		}
+		if i == len(cl)-1 && latest {
+			c.Close = price
+		}
+		c.Volume += amount
+		c.Count++
+		return cl
+	}
+	c := Candle{
+		Time:   Unixtime(start),
+		Open:   price,
+		High:   price,
+		Low:    price,
+		Close:  price,
+		Volume: amount,
+		Count:  1,
+	}
+	cl = append(cl, Candle{})
+	copy(cl[i+2:], cl[i+1:])
+	cl[i+1] = c
+	if len(cl) > max {
+		cl = append(cl[:0], cl[len(cl)-max:]...)
+	}
+	return cl
+}
+
+// Candles [since, until)の範囲の足を古い順に返す
+// limitが1以上の場合は新しい方からlimit本
+func (cs *CandleSet) Candles(interval string, since, until time.Time, limit int) ([]Candle, error) {
+	if _, err := lookupCandleInterval(interval); err != nil {
+		return nil, err
+	}
+	cs.RLock()
+	defer cs.RUnlock()
+	cl := cs.series[interval]
+	start := 0
+	if since.IsZero() == false {
+		start = sort.Search(len(cl), func(i int) bool {
+			return time.Time(cl[i].Time).Before(since) == false
+		})
+	}
+	end := len(cl)
+	if until.IsZero() == false {
+		end = sort.Search(len(cl), func(i int) bool {
+			return time.Time(cl[i].Time).Before(until) == false
+		})
+	}
+	if end < start {
+		end = start
+	}
+	if limit > 0 && end-start > limit {
+		start = end - limit
+	}
+	return append(make([]Candle, 0, end-start), cl[start:end]...), nil
+}
+
+// replace 作り直した足に置き換える
+// 作り直している間に届いたStoreDataはsdaから取り込む
+func (cs *CandleSet) replace(rs *CandleSet, sda StoreDataArray) {
+	for _, sd := range sda {
+		if sd.Trade != nil {
+			rs.add(sd)
+		}
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	cs.series = rs.series
+	cs.trades = rs.trades
+	cs.limit = rs.limit
+}
+
+// rebuildCandleSet アーカイブからdays日分の足を作り直す
+func rebuildCandleSet(st Store, days int, now time.Time) (*CandleSet, error) {
+	rs := newCandleSet(days)
+	since := dayStart(now).AddDate(0, 0, -days+1)
+	err := st.Range(since, now, func(sd StoreData) error {
+		if sd.Trade != nil {
+			rs.add(sd)
+		}
+		return nil
+	})
+	return rs, err
+}
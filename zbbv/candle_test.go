@@ -0,0 +1,218 @@
+package zbbv
+
+import (
+	"testing"
+	"time"
+)
+
+func candleTrade(ts time.Time, tid uint64, price, amount float64) StoreData {
+	sd := tradeData(ts, tid)
+	sd.Trade.Price = price
+	sd.Trade.Amount = amount
+	return sd
+}
+
+func TestCandleStart(t *testing.T) {
+	ts := time.Date(2023, 11, 15, 5, 37, 42, 0, jst)
+	for _, tc := range []struct {
+		d    time.Duration
+		want time.Time
+	}{
+		{time.Minute, time.Date(2023, 11, 15, 5, 37, 0, 0, jst)},
+		{5 * time.Minute, time.Date(2023, 11, 15, 5, 35, 0, 0, jst)},
+		{15 * time.Minute, time.Date(2023, 11, 15, 5, 30, 0, 0, jst)},
+		{time.Hour, time.Date(2023, 11, 15, 5, 0, 0, 0, jst)},
+		// 4時間足と日足は日本時間の0時起点
+		{4 * time.Hour, time.Date(2023, 11, 15, 4, 0, 0, 0, jst)},
+		{24 * time.Hour, time.Date(2023, 11, 15, 0, 0, 0, 0, jst)},
+	} {
+		if got := candleStart(ts, tc.d); got.Equal(tc.want) == false {
+			t.Errorf("%v: got %v, want %v", tc.d, got.In(jst), tc.want)
+		}
+		// 境界ちょうどはその足に入る
+		if got := candleStart(tc.want, tc.d); got.Equal(tc.want) == false {
+			t.Errorf("%v 境界: got %v, want %v", tc.d, got.In(jst), tc.want)
+		}
+	}
+}
+
+func TestCandleSetBucket(t *testing.T) {
+	cs := newCandleSet(1)
+	base := time.Date(2023, 11, 15, 10, 0, 0, 0, jst)
+	for _, sd := range []StoreData{
+		candleTrade(base.Add(10*time.Second), 1, 100, 1),
+		candleTrade(base.Add(20*time.Second), 2, 105, 2),
+		candleTrade(base.Add(30*time.Second), 3, 95, 0.5),
+		candleTrade(base.Add(40*time.Second), 5, 102, 1),
+		// 遅れて届いた約定は高値安値と出来高だけ反映する
+		candleTrade(base.Add(35*time.Second), 4, 90, 1),
+		// 取り込み済み
+		candleTrade(base.Add(50*time.Second), 5, 200, 1),
+		// 約定の無いStoreData
+		{Ask: &PriceAmount{300, 1}, Timestamp: Unixtime(base.Add(50 * time.Second))},
+	} {
+		cs.AddStoreData(sd)
+	}
+	want := Candle{Time: Unixtime(base), Open: 100, High: 105, Low: 90, Close: 102, Volume: 5.5, Count: 5}
+	for _, name := range CandleIntervalNames() {
+		cl, err := cs.Candles(name, time.Time{}, time.Time{}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cl) != 1 {
+			t.Fatalf("%s: %d本", name, len(cl))
+		}
+		w := want
+		if it, _ := lookupCandleInterval(name); it.d > time.Hour {
+			w.Time = Unixtime(candleStart(base, it.d))
+		}
+		if time.Time(cl[0].Time).Equal(time.Time(w.Time)) == false || cl[0].Open != w.Open || cl[0].High != w.High ||
+			cl[0].Low != w.Low || cl[0].Close != w.Close || cl[0].Volume != w.Volume || cl[0].Count != w.Count {
+			t.Errorf("%s: got %+v, want %+v", name, cl[0], w)
+		}
+	}
+	if _, err := cs.Candles("2m", time.Time{}, time.Time{}, 0); err == nil {
+		t.Error("対応していない間隔でエラーになりません。")
+	}
+}
+
+func TestCandleSetRollover(t *testing.T) {
+	cs := newCandleSet(1)
+	// 日本時間の0時をまたいで1分毎に約定する
+	base := time.Date(2023, 11, 15, 23, 50, 0, 0, jst)
+	const n = 20
+	for i := 0; i < n; i++ {
+		cs.AddStoreData(candleTrade(base.Add(time.Duration(i)*time.Minute), uint64(i+1), float64(100+i), 1))
+	}
+	for _, tc := range []struct {
+		name  string
+		count int
+		last  time.Time
+	}{
+		{"1m", n, base.Add((n - 1) * time.Minute)},
+		{"5m", 4, time.Date(2023, 11, 16, 0, 5, 0, 0, jst)},
+		{"15m", 2, time.Date(2023, 11, 16, 0, 0, 0, 0, jst)},
+		{"1h", 2, time.Date(2023, 11, 16, 0, 0, 0, 0, jst)},
+		{"4h", 2, time.Date(2023, 11, 16, 0, 0, 0, 0, jst)},
+		{"1d", 2, time.Date(2023, 11, 16, 0, 0, 0, 0, jst)},
+	} {
+		cl, _ := cs.Candles(tc.name, time.Time{}, time.Time{}, 0)
+		if len(cl) != tc.count {
+			t.Errorf("%s: %d本, want %d本", tc.name, len(cl), tc.count)
+			continue
+		}
+		last := cl[len(cl)-1]
+		if time.Time(last.Time).Equal(tc.last) == false {
+			t.Errorf("%s: 最後の足 %v, want %v", tc.name, time.Time(last.Time).In(jst), tc.last)
+		}
+		// 0時をまたいだ足は前の足の続きから始まる
+		if last.Close != float64(100+n-1) {
+			t.Errorf("%s: Close %v", tc.name, last.Close)
+		}
+		total := 0
+		for _, c := range cl {
+			total += c.Count
+		}
+		if total != n {
+			t.Errorf("%s: 約定数 %d, want %d", tc.name, total, n)
+		}
+	}
+	// 日足は0時で分かれる
+	cl, _ := cs.Candles("1d", time.Time{}, time.Time{}, 0)
+	if cl[0].Count != 10 || cl[0].Close != 109 || cl[1].Open != 110 {
+		t.Errorf("日足 %+v", cl)
+	}
+	// 範囲と本数
+	cl, _ = cs.Candles("1m", base.Add(5*time.Minute), base.Add(8*time.Minute), 0)
+	if len(cl) != 3 || time.Time(cl[0].Time).Equal(base.Add(5*time.Minute)) == false {
+		t.Errorf("範囲 %+v", cl)
+	}
+	cl, _ = cs.Candles("1m", time.Time{}, time.Time{}, 2)
+	if len(cl) != 2 || cl[1].Close != float64(100+n-1) {
+		t.Errorf("limit %+v", cl)
+	}
+}
+
+func TestCandleLimit(t *testing.T) {
+	for _, tc := range []struct {
+		days int
+		d    time.Duration
+		want int
+	}{
+		{0, time.Minute, CandleMax},
+		{1, time.Minute, CandleMax},
+		{7, time.Minute, 7 * 1440},
+		{7, 5 * time.Minute, 7 * 288},
+		{7, time.Hour, CandleMax},
+		{30, 15 * time.Minute, 30 * 96},
+	} {
+		if got := candleLimit(tc.days, tc.d); got != tc.want {
+			t.Errorf("days:%d d:%v got %d, want %d", tc.days, tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestRebuildCandleSet(t *testing.T) {
+	root := t.TempDir()
+	const key = "btc_jpy"
+	const days = 7
+	now := time.Date(2023, 11, 20, 12, 0, 0, 0, jst)
+	first := dayStart(now).AddDate(0, 0, -days+1)
+	// 作り直す範囲の前日から、1分毎に約定がある
+	tid := uint64(0)
+	for d := first.AddDate(0, 0, -1); d.Before(now); d = d.AddDate(0, 0, 1) {
+		var sda StoreDataArray
+		for m := 0; m < 24*60; m++ {
+			ts := d.Add(time.Duration(m) * time.Minute)
+			if ts.Before(now) == false {
+				break
+			}
+			tid++
+			sda = append(sda, candleTrade(ts, tid, 100, 1))
+		}
+		writeArchive(t, root, key, d, sda)
+	}
+	st, err := newFileStore(NewConfig(), root, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	rs, err := rebuildCandleSet(st, days, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 作り直した日数分の1分足が全部残る
+	want := int(now.Sub(first) / time.Minute)
+	cl, _ := rs.Candles("1m", time.Time{}, time.Time{}, 0)
+	if len(cl) != want {
+		t.Errorf("1分足 %d本, want %d本", len(cl), want)
+	}
+	if len(cl) > 0 && time.Time(cl[0].Time).Equal(first) == false {
+		t.Errorf("最初の1分足 %v, want %v", time.Time(cl[0].Time).In(jst), first)
+	}
+	if cl, _ := rs.Candles("1d", time.Time{}, time.Time{}, 0); len(cl) != days || cl[0].Count != 24*60 {
+		t.Errorf("日足 %d本 %+v", len(cl), cl)
+	}
+
+	// 作り直している間に届いた約定を取り込んでから置き換える
+	cs := newCandleSet(days)
+	late := []StoreData{
+		candleTrade(now.Add(-time.Minute), tid, 100, 1),
+		candleTrade(now, tid+1, 120, 2),
+	}
+	for _, sd := range late {
+		cs.AddStoreData(sd)
+	}
+	cs.replace(rs, StoreDataArray(late))
+	cl, _ = cs.Candles("1m", time.Time{}, time.Time{}, 0)
+	if len(cl) != want+1 {
+		t.Fatalf("置き換えた後の1分足 %d本, want %d本", len(cl), want+1)
+	}
+	// 取り込み済みの約定は数えない
+	if c := cl[len(cl)-2]; c.Count != 1 {
+		t.Errorf("重複した約定 %+v", c)
+	}
+	if c := cl[len(cl)-1]; time.Time(c.Time).Equal(now) == false || c.Close != 120 || c.Volume != 2 {
+		t.Errorf("最後の1分足 %+v", c)
+	}
+}
@@ -0,0 +1,851 @@
+package zbbv
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 列指向形式のファイル
+//
+//	ファイル: colMagic ブロック...
+//	ブロック: 見出し(colBlockHeaderSize) flateで圧縮した本体
+//	見出し:   本体の長さ(uint32) 件数(uint32) 最初の時刻(int64) 最後の時刻(int64) 本体のCRC32(uint32)
+//
+// 見出しだけを辿ればブロックを展開せずに時刻で読み飛ばせる。
+// 本体は時刻・種類・売り気配・買い気配・約定・欠損の印の列を順に並べたもので、
+// 時刻と価格は前の値との差分、価格と数量は桁数が足りれば固定小数点の整数にして可変長で書く。
+// 欠損の印の列は後から足したので、無いブロックも読める。
+var colMagic = []byte("ZCOL\x01")
+
+const (
+	colBlockHeaderSize = 28
+	// 1ブロックの最大件数
+	colBlockMax = 4096
+	// 書き込み中のブロックをこの間隔で書き出す
+	colBlockInterval = time.Minute
+	// 固定小数点にできない場合の印
+	colRawScale = 0xff
+	colMaxScale = 8
+)
+
+const (
+	colFlagAsk = 1 << iota
+	colFlagBid
+	colFlagTrade
+	colFlagGap
+)
+
+var errColCorrupt = errors.New("列指向形式のファイルが壊れています。")
+
+var pow10 = [colMaxScale + 1]float64{1, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8}
+
+func createColFilePath(root string, date time.Time, key string) string {
+	return filepath.Join(root, "col", key, fmt.Sprintf("%s_%s.zcol", key, date.In(jst).Format("20060102")))
+}
+
+// createColManifestPath 列指向形式のファイルのマニフェスト
+// JSONのアーカイブのマニフェストと並べて置く
+func createColManifestPath(root string, date time.Time, key string) string {
+	return filepath.Join(root, "manifest", key, fmt.Sprintf("%s_%s.zcol.json", key, date.In(jst).Format("20060102")))
+}
+
+// colScale 全ての値を誤差無く整数にできる10進の桁数
+func colScale(vl []float64) byte {
+	for k := 0; k <= colMaxScale; k++ {
+		ok := true
+		for _, v := range vl {
+			i := math.Round(v * pow10[k])
+			if math.Abs(i) >= 1<<53 || i/pow10[k] != v {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return byte(k)
+		}
+	}
+	return colRawScale
+}
+
+// colFloats 小数の列
+type colFloats struct {
+	scale byte
+	delta bool
+	prev  int64
+	buf   []byte
+}
+
+func (c *colFloats) put(v float64) {
+	var i int64
+	if c.scale == colRawScale {
+		i = int64(math.Float64bits(v))
+	} else {
+		i = int64(math.Round(v * pow10[c.scale]))
+	}
+	if c.delta {
+		i, c.prev = i-c.prev, i
+	}
+	c.buf = binary.AppendVarint(c.buf, i)
+}
+
+func (c *colFloats) get(r *bytes.Reader) (float64, error) {
+	i, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if c.delta {
+		i += c.prev
+		c.prev = i
+	}
+	if c.scale == colRawScale {
+		return math.Float64frombits(uint64(i)), nil
+	}
+	return float64(i) / pow10[c.scale], nil
+}
+
+// encodeColBlock StoreDataを列に分けて並べる
+func encodeColBlock(sdl []StoreData) []byte {
+	prices := make([]float64, 0, len(sdl)*2)
+	amounts := make([]float64, 0, len(sdl)*2)
+	for _, sd := range sdl {
+		if sd.Ask != nil {
+			prices = append(prices, sd.Ask[0])
+			amounts = append(amounts, sd.Ask[1])
+		}
+		if sd.Bid != nil {
+			prices = append(prices, sd.Bid[0])
+			amounts = append(amounts, sd.Bid[1])
+		}
+		if sd.Trade != nil {
+			prices = append(prices, sd.Trade.Price)
+			amounts = append(amounts, sd.Trade.Amount)
+		}
+	}
+	ps, as := colScale(prices), colScale(amounts)
+	askP := &colFloats{scale: ps, delta: true}
+	askA := &colFloats{scale: as}
+	bidP := &colFloats{scale: ps, delta: true}
+	bidA := &colFloats{scale: as}
+	trP := &colFloats{scale: ps, delta: true}
+	trA := &colFloats{scale: as}
+	var ts, flags, tid, date, str, gap []byte
+	strs := make([]string, 0, 4)
+	strIdx := make(map[string]uint64, 4)
+	intern := func(s string) uint64 {
+		i, ok := strIdx[s]
+		if ok == false {
+			i = uint64(len(strs))
+			strIdx[s] = i
+			strs = append(strs, s)
+		}
+		return i
+	}
+	var prevTs, prevTid int64
+	for _, sd := range sdl {
+		t := time.Time(sd.Timestamp).Unix()
+		ts = binary.AppendVarint(ts, t-prevTs)
+		prevTs = t
+		var f byte
+		if sd.Ask != nil {
+			f |= colFlagAsk
+			askP.put(sd.Ask[0])
+			askA.put(sd.Ask[1])
+		}
+		if sd.Bid != nil {
+			f |= colFlagBid
+			bidP.put(sd.Bid[0])
+			bidA.put(sd.Bid[1])
+		}
+		if sd.Trade != nil {
+			tr := sd.Trade
+			f |= colFlagTrade
+			trP.put(tr.Price)
+			trA.put(tr.Amount)
+			tid = binary.AppendVarint(tid, int64(tr.Tid)-prevTid)
+			prevTid = int64(tr.Tid)
+			date = binary.AppendVarint(date, int64(tr.Date)-t)
+			str = binary.AppendUvarint(str, intern(tr.TradeType))
+			str = binary.AppendUvarint(str, intern(tr.CurrentyPair))
+		}
+		if g := sd.Gap; g != nil {
+			// 開始は記録した時刻との差、終わりは開始からの秒数に1を足したもの（続いている場合は0）
+			f |= colFlagGap
+			start := time.Time(g.Start).Unix()
+			gap = binary.AppendVarint(gap, start-t)
+			var end uint64
+			if g.End != nil {
+				end = uint64(time.Time(*g.End).Unix()-start) + 1
+			}
+			gap = binary.AppendUvarint(gap, end)
+			gap = binary.AppendUvarint(gap, intern(g.Reason))
+			gap = binary.AppendUvarint(gap, intern(g.Error))
+		}
+		flags = append(flags, f)
+	}
+	buf := make([]byte, 0, 64+len(sdl)*16)
+	buf = binary.AppendUvarint(buf, uint64(len(sdl)))
+	buf = append(buf, ps, as)
+	buf = binary.AppendUvarint(buf, uint64(len(strs)))
+	for _, s := range strs {
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	cols := [][]byte{ts, flags, askP.buf, askA.buf, bidP.buf, bidA.buf, trP.buf, trA.buf, tid, date, str}
+	if len(gap) > 0 {
+		// 欠損の印が無いブロックは以前と同じ形にする
+		cols = append(cols, gap)
+	}
+	for _, col := range cols {
+		buf = binary.AppendUvarint(buf, uint64(len(col)))
+		buf = append(buf, col...)
+	}
+	return buf
+}
+
+// decodeColBlock encodeColBlockの逆
+func decodeColBlock(buf []byte) ([]StoreData, error) {
+	r := bytes.NewReader(buf)
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > colBlockMax*16 {
+		return nil, errColCorrupt
+	}
+	ps, err1 := r.ReadByte()
+	as, err2 := r.ReadByte()
+	if err1 != nil || err2 != nil {
+		return nil, errColCorrupt
+	}
+	ns, err := binary.ReadUvarint(r)
+	if err != nil || ns > n*4+1 {
+		return nil, errColCorrupt
+	}
+	strs := make([]string, ns)
+	for i := range strs {
+		l, err := binary.ReadUvarint(r)
+		if err != nil || l > uint64(r.Len()) {
+			return nil, errColCorrupt
+		}
+		b := make([]byte, l)
+		r.Read(b)
+		strs[i] = string(b)
+	}
+	cols := make([]*bytes.Reader, 12)
+	for i := range cols {
+		if i == 11 && r.Len() == 0 {
+			// 欠損の印の列が無いブロック
+			cols[i] = bytes.NewReader(nil)
+			break
+		}
+		l, err := binary.ReadUvarint(r)
+		if err != nil || l > uint64(r.Len()) {
+			return nil, errColCorrupt
+		}
+		b := make([]byte, l)
+		r.Read(b)
+		cols[i] = bytes.NewReader(b)
+	}
+	ts, flags, tid, date, str, gap := cols[0], cols[1], cols[8], cols[9], cols[10], cols[11]
+	askP := &colFloats{scale: ps, delta: true}
+	askA := &colFloats{scale: as}
+	bidP := &colFloats{scale: ps, delta: true}
+	bidA := &colFloats{scale: as}
+	trP := &colFloats{scale: ps, delta: true}
+	trA := &colFloats{scale: as}
+	getStr := func(str *bytes.Reader) (string, error) {
+		i, err := binary.ReadUvarint(str)
+		if err != nil || i >= uint64(len(strs)) {
+			return "", errColCorrupt
+		}
+		return strs[i], nil
+	}
+	sdl := make([]StoreData, 0, n)
+	var prevTs, prevTid int64
+	for i := uint64(0); i < n; i++ {
+		d, err := binary.ReadVarint(ts)
+		if err != nil {
+			return nil, errColCorrupt
+		}
+		prevTs += d
+		f, err := flags.ReadByte()
+		if err != nil {
+			return nil, errColCorrupt
+		}
+		sd := StoreData{Timestamp: Unixtime(time.Unix(prevTs, 0))}
+		if f&colFlagAsk != 0 {
+			var pa PriceAmount
+			if pa[0], err = askP.get(cols[2]); err == nil {
+				pa[1], err = askA.get(cols[3])
+			}
+			if err != nil {
+				return nil, errColCorrupt
+			}
+			sd.Ask = &pa
+		}
+		if f&colFlagBid != 0 {
+			var pa PriceAmount
+			if pa[0], err = bidP.get(cols[4]); err == nil {
+				pa[1], err = bidA.get(cols[5])
+			}
+			if err != nil {
+				return nil, errColCorrupt
+			}
+			sd.Bid = &pa
+		}
+		if f&colFlagTrade != 0 {
+			tr := &Trade{}
+			if tr.Price, err = trP.get(cols[6]); err != nil {
+				return nil, errColCorrupt
+			}
+			if tr.Amount, err = trA.get(cols[7]); err != nil {
+				return nil, errColCorrupt
+			}
+			dt, err := binary.ReadVarint(tid)
+			if err != nil {
+				return nil, errColCorrupt
+			}
+			prevTid += dt
+			tr.Tid = uint64(prevTid)
+			dd, err := binary.ReadVarint(date)
+			if err != nil {
+				return nil, errColCorrupt
+			}
+			tr.Date = uint64(prevTs + dd)
+			if tr.TradeType, err = getStr(str); err != nil {
+				return nil, err
+			}
+			if tr.CurrentyPair, err = getStr(str); err != nil {
+				return nil, err
+			}
+			sd.Trade = tr
+		}
+		if f&colFlagGap != 0 {
+			g := &Gap{}
+			ds, err := binary.ReadVarint(gap)
+			if err != nil {
+				return nil, errColCorrupt
+			}
+			start := prevTs + ds
+			g.Start = Unixtime(time.Unix(start, 0))
+			end, err := binary.ReadUvarint(gap)
+			if err != nil {
+				return nil, errColCorrupt
+			}
+			if end > 0 {
+				e := Unixtime(time.Unix(start+int64(end-1), 0))
+				g.End = &e
+			}
+			if g.Reason, err = getStr(gap); err != nil {
+				return nil, err
+			}
+			if g.Error, err = getStr(gap); err != nil {
+				return nil, err
+			}
+			sd.Gap = g
+		}
+		sdl = append(sdl, sd)
+	}
+	return sdl, nil
+}
+
+type colBlockHeader struct {
+	size  uint32
+	count uint32
+	first int64
+	last  int64
+	crc   uint32
+}
+
+func (h colBlockHeader) marshal() []byte {
+	buf := make([]byte, colBlockHeaderSize)
+	binary.BigEndian.PutUint32(buf[0:], h.size)
+	binary.BigEndian.PutUint32(buf[4:], h.count)
+	binary.BigEndian.PutUint64(buf[8:], uint64(h.first))
+	binary.BigEndian.PutUint64(buf[16:], uint64(h.last))
+	binary.BigEndian.PutUint32(buf[24:], h.crc)
+	return buf
+}
+
+func readColBlockHeader(r io.Reader) (colBlockHeader, error) {
+	var h colBlockHeader
+	buf := make([]byte, colBlockHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return h, err
+	}
+	h.size = binary.BigEndian.Uint32(buf[0:])
+	h.count = binary.BigEndian.Uint32(buf[4:])
+	h.first = int64(binary.BigEndian.Uint64(buf[8:]))
+	h.last = int64(binary.BigEndian.Uint64(buf[16:]))
+	h.crc = binary.BigEndian.Uint32(buf[24:])
+	return h, nil
+}
+
+// marshalColBlock 見出しと圧縮した本体
+func marshalColBlock(sdl []StoreData) ([]byte, error) {
+	var zb bytes.Buffer
+	zw, err := flate.NewWriter(&zb, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(encodeColBlock(sdl)); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	h := colBlockHeader{
+		size:  uint32(zb.Len()),
+		count: uint32(len(sdl)),
+		first: time.Time(sdl[0].Timestamp).Unix(),
+		last:  time.Time(sdl[0].Timestamp).Unix(),
+		crc:   crc32.ChecksumIEEE(zb.Bytes()),
+	}
+	for _, sd := range sdl {
+		t := time.Time(sd.Timestamp).Unix()
+		if t < h.first {
+			h.first = t
+		}
+		if t > h.last {
+			h.last = t
+		}
+	}
+	return append(h.marshal(), zb.Bytes()...), nil
+}
+
+func readColBlock(r io.Reader, h colBlockHeader) ([]StoreData, error) {
+	zb := make([]byte, h.size)
+	if _, err := io.ReadFull(r, zb); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(zb) != h.crc {
+		return nil, errColCorrupt
+	}
+	buf, err := io.ReadAll(flate.NewReader(bytes.NewReader(zb)))
+	if err != nil {
+		return nil, errColCorrupt
+	}
+	sdl, err := decodeColBlock(buf)
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(sdl)) != h.count {
+		return nil, errColCorrupt
+	}
+	return sdl, nil
+}
+
+// readColFile 列指向形式のファイルから[since, until)に掛かるブロックを読んでfnに渡す
+// 最後のブロックが書き込み途中の場合はそこで終わりとする
+func readColFile(p string, since, until time.Time, fn func(StoreData) error) error {
+	fp, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	magic := make([]byte, len(colMagic))
+	if _, err := io.ReadFull(fp, magic); err != nil || bytes.Equal(magic, colMagic) == false {
+		return errColCorrupt
+	}
+	for {
+		h, err := readColBlockHeader(fp)
+		if err != nil {
+			// 終わりか書き込み途中
+			return nil
+		}
+		if h.last < since.Unix() {
+			if _, err := fp.Seek(int64(h.size), io.SeekCurrent); err != nil {
+				return err
+			}
+			continue
+		}
+		if until.IsZero() == false && h.first >= until.Unix() {
+			// 遅れて届いたStoreDataがあるとブロックは時刻順とは限らないので、後ろのブロックも見る
+			if _, err := fp.Seek(int64(h.size), io.SeekCurrent); err != nil {
+				return err
+			}
+			continue
+		}
+		sdl, err := readColBlock(fp, h)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w path:%s", err, p)
+		}
+		for _, sd := range sdl {
+			if err := fn(sd); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// colFileWriter 列指向形式のファイルにブロックを追記する
+type colFileWriter struct {
+	fp *os.File
+}
+
+// openColFile 追記用に開く
+// 書き込み途中で終わっているブロックは切り捨てる
+func openColFile(p string) (*colFileWriter, error) {
+	if err := createDir(p); err != nil {
+		return nil, err
+	}
+	fp, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	end, err := colValidEnd(fp)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if end == 0 {
+		if err := fp.Truncate(0); err != nil {
+			fp.Close()
+			return nil, err
+		}
+		if _, err := fp.WriteAt(colMagic, 0); err != nil {
+			fp.Close()
+			return nil, err
+		}
+		end = int64(len(colMagic))
+	} else if err := fp.Truncate(end); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if _, err := fp.Seek(end, io.SeekStart); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return &colFileWriter{fp: fp}, nil
+}
+
+// colValidEnd 読めるブロックの終わりの位置
+// 空か先頭が壊れている場合は0
+func colValidEnd(fp *os.File) (int64, error) {
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	magic := make([]byte, len(colMagic))
+	if _, err := io.ReadFull(fp, magic); err != nil || bytes.Equal(magic, colMagic) == false {
+		return 0, nil
+	}
+	end := int64(len(colMagic))
+	for {
+		h, err := readColBlockHeader(fp)
+		if err != nil {
+			return end, nil
+		}
+		if _, err := readColBlock(fp, h); err != nil {
+			log.Warnw("壊れたブロックを切り捨てます。", "error", err, "path", fp.Name(), "offset", end)
+			return end, nil
+		}
+		end += colBlockHeaderSize + int64(h.size)
+	}
+}
+
+func (cw *colFileWriter) writeBlock(sdl []StoreData) error {
+	if len(sdl) == 0 {
+		return nil
+	}
+	buf, err := marshalColBlock(sdl)
+	if err != nil {
+		return err
+	}
+	_, err = cw.fp.Write(buf)
+	return err
+}
+
+func (cw *colFileWriter) Close() error {
+	if err := cw.fp.Sync(); err != nil {
+		cw.fp.Close()
+		return err
+	}
+	return cw.fp.Close()
+}
+
+// colStreamStorage 列指向形式で保存する
+// 書き込み中のブロックはcolBlockMax件に達するかcolBlockIntervalが経つまでメモリ上にある
+// 日付はjsonStreamStorageと同じくStoreDataの時刻か時計の新しい方で決める
+type colStreamStorage struct {
+	root    string
+	key     string
+	day     time.Time // 書き込み中の日（日本時間の0時）
+	w       *colFileWriter
+	wday    time.Time // wで開いている日
+	pending []StoreData
+	started time.Time // 書き込み中のブロックの最初の1件を受け取った時刻
+}
+
+func newColumnarStreamStorage(root, key string) (StreamStorage, error) {
+	return &colStreamStorage{
+		root:    root,
+		key:     key,
+		day:     dayStart(time.Now()),
+		pending: make([]StoreData, 0, colBlockMax),
+	}, nil
+}
+
+func (s *colStreamStorage) Append(sd StoreData) error {
+	// 遅れて届いた前の日のStoreDataで前の日のファイルを開き直さない
+	if day := dayStart(time.Time(sd.Timestamp)); day.After(s.day) {
+		s.day = day
+	}
+	if s.w == nil || s.wday.Equal(s.day) == false {
+		if err := s.closeDay(); err != nil {
+			log.Warnw("列指向形式のファイルを閉じるのに失敗しました。", "error", err, "key", s.key)
+		}
+		w, err := openColFile(createColFilePath(s.root, s.day, s.key))
+		if err != nil {
+			return err
+		}
+		s.w = w
+		s.wday = s.day
+	}
+	if len(s.pending) == 0 {
+		s.started = time.Now()
+	}
+	s.pending = append(s.pending, sd)
+	if len(s.pending) >= colBlockMax || time.Since(s.started) >= colBlockInterval {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *colStreamStorage) flush() error {
+	err := s.w.writeBlock(s.pending)
+	s.pending = s.pending[:0]
+	return err
+}
+
+// Flush 書き込み中のブロックはcolBlockIntervalが経っていれば書き出す
+func (s *colStreamStorage) Flush() error {
+	if s.w == nil {
+		return nil
+	}
+	if len(s.pending) > 0 && time.Since(s.started) >= colBlockInterval {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+	return s.w.fp.Sync()
+}
+
+func (s *colStreamStorage) Rotate(now time.Time) error {
+	day := dayStart(now)
+	if day.After(s.day) == false {
+		return nil
+	}
+	s.day = day
+	return s.closeDay()
+}
+
+// closeDay 書き込み中の日のファイルを閉じてマニフェストを作る
+// 閉じた日のファイルには追記しないので、JSONのアーカイブと同じくこの時点の内容を記録する
+func (s *colStreamStorage) closeDay() error {
+	if s.w == nil {
+		return nil
+	}
+	day := s.wday
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return writeColManifest(createColFilePath(s.root, day, s.key), createColManifestPath(s.root, day, s.key))
+}
+
+func (s *colStreamStorage) Range(since, until time.Time, fn func(StoreData) error) error {
+	return readStoreDataRange(s.root, s.key, since, until, fn)
+}
+
+func (s *colStreamStorage) Close() error {
+	if s.w == nil {
+		return nil
+	}
+	err := s.flush()
+	if cerr := s.w.Close(); err == nil {
+		err = cerr
+	}
+	s.w = nil
+	return err
+}
+
+func writeColManifest(p, mp string) error {
+	m, err := buildManifest(p)
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(mp, m)
+}
+
+// sweepColFiles 停止している間に日付が変わった場合に残る前の日までのファイルを閉じてマニフェストを作る
+// 変換が途中で止まった一時ファイルは消す
+func sweepColFiles(root, key string, today time.Time) {
+	tmps, _ := filepath.Glob(filepath.Join(root, "col", key, key+"_*.zcol.tmp"))
+	for _, p := range tmps {
+		if err := os.Remove(p); err != nil {
+			log.Warnw("変換途中の一時ファイルの削除に失敗しました。", "error", err, "path", p)
+			continue
+		}
+		log.Infow("変換途中の一時ファイルを削除しました。", "path", p)
+	}
+	match, _ := filepath.Glob(filepath.Join(root, "col", key, key+"_*.zcol"))
+	for _, p := range match {
+		day, ok := dayFileDate(key, filepath.Base(p))
+		if ok == false || day.Before(today) == false {
+			continue
+		}
+		mp := createColManifestPath(root, day, key)
+		if _, err := os.Stat(mp); err == nil {
+			continue
+		}
+		if err := finishColFile(p, mp); err != nil {
+			log.Warnw("列指向形式のファイルのマニフェストの作成に失敗しました。", "error", err, "path", p)
+			continue
+		}
+		log.Infow("列指向形式のファイルのマニフェストを作りました。", "path", p, "manifest", mp)
+	}
+}
+
+// finishColFile 書き込み途中で終わっているブロックを切り捨ててからマニフェストを作る
+func finishColFile(p, mp string) error {
+	cw, err := openColFile(p)
+	if err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	return writeColManifest(p, mp)
+}
+
+// convertDayToCol 圧縮済みのJSONのアーカイブを列指向形式に変換する
+// 書き出した後に読み直して件数を確かめてから置き換える
+func convertDayToCol(src, dst string) (m Manifest, err error) {
+	n := 0
+	tmp := dst + ".tmp"
+	os.Remove(tmp)
+	cw, err := openColFile(tmp)
+	if err != nil {
+		return m, err
+	}
+	sdl := make([]StoreData, 0, colBlockMax)
+	err = readStoreDataFile(src, true, func(sd StoreData) error {
+		sdl = append(sdl, sd)
+		n++
+		if len(sdl) >= colBlockMax {
+			err := cw.writeBlock(sdl)
+			sdl = sdl[:0]
+			return err
+		}
+		return nil
+	})
+	if err == nil {
+		err = cw.writeBlock(sdl)
+	}
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return m, err
+	}
+	m, err = scanColFile(tmp, nil)
+	if err == nil && m.Count != n {
+		err = fmt.Errorf("変換前後で件数が違います。before:%d after:%d", n, m.Count)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return m, err
+	}
+	return m, os.Rename(tmp, dst)
+}
+
+// ConvertOptions convertの条件
+type ConvertOptions struct {
+	// 列指向形式と件数が一致する変換元のアーカイブとマニフェストを消す
+	Remove bool
+}
+
+// ConvertArchive 設定された全ての通貨ペアの圧縮済みのアーカイブを列指向形式に変換してマニフェストを作る
+// 変換済みの日は飛ばす
+func ConvertArchive(conf *Config, w io.Writer, opt ConvertOptions) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	kept := 0
+	for _, ec := range conf.Exchanges {
+		root := ec.dataPath(conf.RootDataPath)
+		for _, key := range ec.CurrencyPairs {
+			match, _ := filepath.Glob(filepath.Join(root, "stream", key, key+"_*.json.gz"))
+			for _, src := range match {
+				name := filepath.Base(src)
+				day, ok := dayFileDate(key, name)
+				if ok == false {
+					continue
+				}
+				date := day.Format("20060102")
+				dst := createColFilePath(root, day, key)
+				mp := createColManifestPath(root, day, key)
+				var m Manifest
+				if _, err := os.Stat(dst); err != nil {
+					if m, err = convertDayToCol(src, dst); err != nil {
+						return fmt.Errorf("%s %s: %w", ec.Name, name, err)
+					}
+					if err := writeJSONFile(mp, m); err != nil {
+						return fmt.Errorf("%s %s: %w", ec.Name, name, err)
+					}
+					fmt.Fprintf(w, "%s %s %s %d件 %d→%dバイト\n", ec.Name, key, date, m.Count, fileSize(src), fileSize(dst))
+				} else if m, err = readManifest(mp); err != nil {
+					// 以前に変換した日はマニフェストが無い
+					if m, err = buildManifest(dst); err != nil {
+						return fmt.Errorf("%s %s: %w", ec.Name, filepath.Base(dst), err)
+					}
+					if err := writeJSONFile(mp, m); err != nil {
+						return fmt.Errorf("%s %s: %w", ec.Name, name, err)
+					}
+				}
+				if opt.Remove == false {
+					kept++
+					continue
+				}
+				// 変換元を読み直して一致する場合だけ消す
+				sm, err := buildManifest(src)
+				if err != nil {
+					return fmt.Errorf("%s %s: %w", ec.Name, name, err)
+				}
+				// 大きさとSHA-256は形式が違うので比べない
+				sm.Size, sm.SHA256 = m.Size, m.SHA256
+				if dl := sm.diff(m); len(dl) > 0 {
+					fmt.Fprintf(w, "%s %s %s 列指向形式と一致しないので変換元を残します %v\n", ec.Name, key, date, dl)
+					continue
+				}
+				for _, p := range []string{src, createStoreFilePath(root, day, key, "manifest")} {
+					if err := os.Remove(p); err != nil && os.IsNotExist(err) == false {
+						return err
+					}
+				}
+				fmt.Fprintf(w, "%s %s %s 変換元を削除しました\n", ec.Name, key, date)
+			}
+		}
+	}
+	if kept > 0 {
+		fmt.Fprintf(w, "変換元のアーカイブを%d日分残しています。消す場合は-removeを付けてください。\n", kept)
+	}
+	return nil
+}
+
+func fileSize(p string) int64 {
+	st, err := os.Stat(p)
+	if err != nil {
+		return 0
+	}
+	return st.Size()
+}
@@ -0,0 +1,496 @@
+package zbbv
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func colTestData() []StoreData {
+	base := time.Date(2023, 11, 15, 10, 0, 0, 0, jst)
+	at := func(sec int) Unixtime { return Unixtime(base.Add(time.Duration(sec) * time.Second)) }
+	return []StoreData{
+		{Ask: &PriceAmount{5000000, 0.0123}, Bid: &PriceAmount{4999995, 1.5}, Timestamp: at(0)},
+		{
+			Ask:       &PriceAmount{5000005, 0.0001},
+			Trade:     &Trade{CurrentyPair: "btc_jpy", TradeType: "bid", Price: 5000005, Tid: 100, Amount: 0.0001, Date: uint64(base.Unix())},
+			Timestamp: at(1),
+		},
+		// 同じ時刻に複数の約定
+		{Trade: &Trade{CurrentyPair: "btc_jpy", TradeType: "ask", Price: 4999990, Tid: 102, Amount: 2, Date: uint64(base.Unix()) + 1}, Timestamp: at(1)},
+		// 遅れて届いた約定（時刻もTidも戻る）
+		{Trade: &Trade{CurrentyPair: "btc_jpy", TradeType: "bid", Price: 4999000, Tid: 101, Amount: 0.5, Date: uint64(base.Unix()) - 30}, Timestamp: at(-5)},
+		{Bid: &PriceAmount{4999990, 0}, Timestamp: at(60)},
+	}
+}
+
+func TestColBlockRoundTrip(t *testing.T) {
+	for _, sdl := range [][]StoreData{
+		colTestData(),
+		colTestData()[:1],
+		{},
+	} {
+		got, err := decodeColBlock(encodeColBlock(sdl))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(sdl) {
+			t.Fatalf("len = %d, want %d", len(got), len(sdl))
+		}
+		for i := range sdl {
+			if sameStoreData(got[i], sdl[i]) == false {
+				t.Errorf("%d: got %+v, want %+v", i, got[i], sdl[i])
+			}
+		}
+	}
+}
+
+// sameStoreData 時刻はタイムゾーンを見ずに比べる
+func sameStoreData(a, b StoreData) bool {
+	if time.Time(a.Timestamp).Equal(time.Time(b.Timestamp)) == false {
+		return false
+	}
+	a.Timestamp, b.Timestamp = Unixtime{}, Unixtime{}
+	return reflect.DeepEqual(a, b)
+}
+
+func TestColBlockCorrupt(t *testing.T) {
+	buf := encodeColBlock(colTestData())
+	for _, n := range []int{0, 1, 3, len(buf) / 2, len(buf) - 1} {
+		if _, err := decodeColBlock(buf[:n]); err == nil {
+			t.Errorf("%dバイトに切り詰めてもエラーになりません", n)
+		}
+	}
+}
+
+func TestColScale(t *testing.T) {
+	for _, it := range []struct {
+		vl   []float64
+		want byte
+	}{
+		{nil, 0},
+		{[]float64{100, -3}, 0},
+		{[]float64{1.5, 2.25}, 2},
+		{[]float64{0.00000001}, 8},
+		// 10進の8桁で表せない
+		{[]float64{math.Nextafter(0.3, 1)}, colRawScale},
+		{[]float64{1, math.Pi}, colRawScale},
+		{[]float64{0.000000001}, colRawScale},
+		// 整数にすると2^53を超える
+		{[]float64{1e300}, colRawScale},
+		{[]float64{math.NaN()}, colRawScale},
+		{[]float64{math.Inf(1)}, colRawScale},
+	} {
+		if got := colScale(it.vl); got != it.want {
+			t.Errorf("colScale(%v) = %d, want %d", it.vl, got, it.want)
+		}
+	}
+}
+
+func TestColBlockRawFloat(t *testing.T) {
+	// 固定小数点にできない値が混ざっていてもビット単位で戻る
+	vl := []float64{math.Nextafter(0.3, 1), math.Pi, -math.MaxFloat64, math.SmallestNonzeroFloat64, 1e300, 0}
+	sdl := make([]StoreData, 0, len(vl))
+	for i, v := range vl {
+		sdl = append(sdl, StoreData{
+			Ask:       &PriceAmount{v, -v},
+			Trade:     &Trade{Price: v, Amount: v, Tid: uint64(i + 1)},
+			Timestamp: Unixtime(time.Unix(1700000000+int64(i), 0)),
+		})
+	}
+	got, err := decodeColBlock(encodeColBlock(sdl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range vl {
+		for _, f := range []float64{got[i].Ask[0], got[i].Trade.Price, got[i].Trade.Amount} {
+			if math.Float64bits(f) != math.Float64bits(v) {
+				t.Errorf("%d: got %v, want %v", i, f, v)
+			}
+		}
+		if math.Float64bits(got[i].Ask[1]) != math.Float64bits(-v) {
+			t.Errorf("%d: got %v, want %v", i, got[i].Ask[1], -v)
+		}
+	}
+}
+
+func readColTids(t *testing.T, p string, since, until time.Time) []uint64 {
+	t.Helper()
+	var l []uint64
+	err := readColFile(p, since, until, func(sd StoreData) error {
+		l = append(l, sd.Trade.Tid)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func colTrades(ts time.Time, tids ...uint64) []StoreData {
+	sdl := make([]StoreData, 0, len(tids))
+	for _, tid := range tids {
+		sdl = append(sdl, tradeData(ts, tid))
+	}
+	return sdl
+}
+
+func TestColFileTruncatedLastBlock(t *testing.T) {
+	p := createColFilePath(t.TempDir(), time.Unix(1700000000, 0), "btc_jpy")
+	ts := time.Unix(1700000000, 0)
+	cw, err := openColFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sdl := range [][]StoreData{colTrades(ts, 1, 2), colTrades(ts, 3)} {
+		if err := cw.writeBlock(sdl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := st.Size()
+	// 書き込み途中で止まった3つ目のブロック
+	buf, err := marshalColBlock(colTrades(ts, 4, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{colBlockHeaderSize / 2, colBlockHeaderSize, len(buf) - 1} {
+		fp, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp.Write(buf[:n])
+		fp.Close()
+
+		// 読む時は途中のブロックの前で終わる
+		if got := readColTids(t, p, time.Time{}, time.Time{}); equalUint64s(got, []uint64{1, 2, 3}) == false {
+			t.Errorf("%dバイト: got %v", n, got)
+		}
+		// 追記する時は途中のブロックを切り捨てる
+		cw, err := openColFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cw.Close()
+		if st, err := os.Stat(p); err != nil || st.Size() != valid {
+			t.Errorf("%dバイト: 切り詰めた大きさ %v, want %d", n, st.Size(), valid)
+		}
+	}
+	// 切り詰めた後に書いたブロックも読める
+	cw, err = openColFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.writeBlock(colTrades(ts, 6)); err != nil {
+		t.Fatal(err)
+	}
+	cw.Close()
+	if got := readColTids(t, p, time.Time{}, time.Time{}); equalUint64s(got, []uint64{1, 2, 3, 6}) == false {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestReadColFileUnorderedBlocks(t *testing.T) {
+	p := createColFilePath(t.TempDir(), time.Unix(1700000000, 0), "btc_jpy")
+	t1 := time.Unix(1700000000, 0)
+	t2 := t1.Add(time.Hour)
+	t3 := t2.Add(time.Hour)
+	cw, err := openColFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2つ目のブロックは遅れて届いた古いStoreData
+	for _, sdl := range [][]StoreData{colTrades(t2, 1), colTrades(t1, 2), colTrades(t3, 3)} {
+		if err := cw.writeBlock(sdl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cw.Close()
+	for _, it := range []struct {
+		since, until time.Time
+		want         []uint64
+	}{
+		{t1, t2, []uint64{2}},
+		{t2, t3, []uint64{1}},
+		{t3, time.Time{}, []uint64{3}},
+		{time.Time{}, t2, []uint64{2}},
+	} {
+		var got []uint64
+		err := readColFile(p, it.since, it.until, func(sd StoreData) error {
+			// 範囲の絞り込みはブロック単位なので呼び出し側で行う
+			ts := time.Time(sd.Timestamp)
+			if ts.Before(it.since) || (it.until.IsZero() == false && ts.Before(it.until) == false) {
+				return nil
+			}
+			got = append(got, sd.Trade.Tid)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if equalUint64s(got, it.want) == false {
+			t.Errorf("[%v, %v) got %v, want %v", it.since.Unix(), it.until.Unix(), got, it.want)
+		}
+	}
+}
+
+func TestColStreamStorageLateRecord(t *testing.T) {
+	root := t.TempDir()
+	st, err := newColumnarStreamStorage(root, "btc_jpy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	today := dayStart(time.Now())
+	yesterday := today.AddDate(0, 0, -1)
+	tomorrow := today.AddDate(0, 0, 1)
+	for _, sd := range []StoreData{
+		tradeData(today.Add(time.Minute), 1),
+		// 日付が変わった後に届いた前の日のStoreDataは今の日のファイルに入れる
+		tradeData(yesterday.Add(23*time.Hour+59*time.Minute), 2),
+		tradeData(today.Add(2*time.Minute), 3),
+		tradeData(tomorrow.Add(time.Minute), 4),
+		tradeData(today.Add(23*time.Hour), 5),
+	} {
+		if err := st.Append(sd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(createColFilePath(root, yesterday, "btc_jpy")); os.IsNotExist(err) == false {
+		t.Errorf("前の日のファイルを開き直しています。%v", err)
+	}
+	if got := readColTids(t, createColFilePath(root, today, "btc_jpy"), time.Time{}, time.Time{}); equalUint64s(got, []uint64{1, 2, 3}) == false {
+		t.Errorf("today got %v", got)
+	}
+	if got := readColTids(t, createColFilePath(root, tomorrow, "btc_jpy"), time.Time{}, time.Time{}); equalUint64s(got, []uint64{4, 5}) == false {
+		t.Errorf("tomorrow got %v", got)
+	}
+}
+
+func TestColStreamStorageManifest(t *testing.T) {
+	root := t.TempDir()
+	st, err := newColumnarStreamStorage(root, "btc_jpy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	today := dayStart(time.Now())
+	tomorrow := today.AddDate(0, 0, 1)
+	for _, sd := range []StoreData{
+		tradeData(today.Add(time.Minute), 1),
+		tradeData(today.Add(2*time.Minute), 2),
+		tradeData(tomorrow.Add(time.Minute), 3),
+	} {
+		if err := st.Append(sd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 日付が変わって閉じた日はマニフェストがある
+	m, err := readManifest(createColManifestPath(root, today, "btc_jpy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, err := buildManifest(createColFilePath(root, today, "btc_jpy")); err != nil || m != want {
+		t.Errorf("manifest = %+v, want %+v (%v)", m, want, err)
+	}
+	if m.Count != 2 || m.FirstTid != 1 || m.LastTid != 2 {
+		t.Errorf("manifest = %+v", m)
+	}
+	// 書き込み中の日は無い
+	mp := createColManifestPath(root, tomorrow, "btc_jpy")
+	if _, err := os.Stat(mp); os.IsNotExist(err) == false {
+		t.Errorf("書き込み中の日のマニフェストがあります。%v", err)
+	}
+	if err := st.Rotate(tomorrow.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := readManifest(mp); err != nil || m.Count != 1 || m.LastTid != 3 {
+		t.Errorf("Rotate後のmanifest = %+v %v", m, err)
+	}
+}
+
+func TestSweepColFiles(t *testing.T) {
+	root := t.TempDir()
+	today := dayStart(time.Now())
+	yesterday := today.AddDate(0, 0, -1)
+	for _, day := range []time.Time{yesterday, today} {
+		cw, err := openColFile(createColFilePath(root, day, "btc_jpy"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cw.writeBlock(colTrades(day.Add(time.Hour), 1, 2)); err != nil {
+			t.Fatal(err)
+		}
+		cw.Close()
+	}
+	// 前の日のファイルは最後のブロックの途中で止まっている
+	p := createColFilePath(root, yesterday, "btc_jpy")
+	buf, err := marshalColBlock(colTrades(yesterday.Add(2*time.Hour), 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Write(buf[:len(buf)-1])
+	fp.Close()
+	tmp := createColFilePath(root, yesterday.AddDate(0, 0, -1), "btc_jpy") + ".tmp"
+	if err := os.WriteFile(tmp, colMagic, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sweepColFiles(root, "btc_jpy", today)
+	m, err := readManifest(createColManifestPath(root, yesterday, "btc_jpy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Count != 2 || m.Size != fileSize(p) {
+		t.Errorf("manifest = %+v, size:%d", m, fileSize(p))
+	}
+	if _, err := os.Stat(createColManifestPath(root, today, "btc_jpy")); os.IsNotExist(err) == false {
+		t.Errorf("今日のマニフェストがあります。%v", err)
+	}
+	if _, err := os.Stat(tmp); os.IsNotExist(err) == false {
+		t.Errorf("変換途中の一時ファイルが残っています。%v", err)
+	}
+}
+
+func TestConvertArchive(t *testing.T) {
+	root := t.TempDir()
+	key := "btc_jpy"
+	day := time.Date(2023, 11, 15, 0, 0, 0, 0, jst)
+	for i, d := range []time.Time{day, day.AddDate(0, 0, 1)} {
+		writeArchive(t, root, key, d, StoreDataArray{
+			tradeData(d.Add(time.Hour), uint64(i*2+1)),
+			tradeData(d.Add(2*time.Hour), uint64(i*2+2)),
+		})
+		ap := createStoreFilePath(root, d, key, "stream") + ".gz"
+		m, err := buildManifest(ap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeJSONFile(createStoreFilePath(root, d, key, "manifest"), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := NewConfig()
+	conf.RootDataPath = root
+	conf.Exchanges[0].CurrencyPairs = []string{key}
+	verify := func() (int, []string) {
+		var l []string
+		bad, err := verifyPair(root, key, VerifyOptions{}, func(s string) { l = append(l, s) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bad, l
+	}
+
+	var out bytes.Buffer
+	if err := ConvertArchive(conf, &out, ConvertOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// 変換元は残したことを表示する
+	if strings.Contains(out.String(), "2日分残しています") == false {
+		t.Errorf("out:\n%s", out.String())
+	}
+	// 両方の形式があってもTidの逆転にはならない
+	if bad, l := verify(); bad != 0 || len(l) != 4 {
+		t.Errorf("bad:%d %v", bad, l)
+	}
+
+	// 列指向形式のマニフェストと食い違えば報告する
+	cmp := createColManifestPath(root, day, key)
+	m, err := readManifest(cmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Count++
+	if err := writeJSONFile(cmp, m); err != nil {
+		t.Fatal(err)
+	}
+	if bad, l := verify(); bad != 1 {
+		t.Errorf("bad:%d %v", bad, l)
+	}
+	// 食い違っている日の変換元は消さない
+	out.Reset()
+	if err := ConvertArchive(conf, &out, ConvertOptions{Remove: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(createStoreFilePath(root, day, key, "stream") + ".gz"); err != nil {
+		t.Errorf("食い違っている日の変換元を消しました。%v\n%s", err, out.String())
+	}
+	next := day.AddDate(0, 0, 1)
+	for _, p := range []string{
+		createStoreFilePath(root, next, key, "stream") + ".gz",
+		createStoreFilePath(root, next, key, "manifest"),
+	} {
+		if _, err := os.Stat(p); os.IsNotExist(err) == false {
+			t.Errorf("%s が残っています。%v", p, err)
+		}
+	}
+	m.Count--
+	if err := writeJSONFile(cmp, m); err != nil {
+		t.Fatal(err)
+	}
+	if bad, l := verify(); bad != 0 || len(l) != 3 {
+		t.Errorf("bad:%d %v", bad, l)
+	}
+}
+
+func TestColBlockGap(t *testing.T) {
+	base := time.Date(2023, 11, 15, 10, 0, 0, 0, jst)
+	end := Unixtime(base.Add(-time.Hour))
+	now := Unixtime(base)
+	sdl := []StoreData{
+		// 開始が前の日の欠損
+		{Gap: &Gap{Start: Unixtime(base.Add(-30 * time.Hour)), Reason: GapCrash}, Timestamp: Unixtime(base.Add(-2 * time.Hour))},
+		{Gap: &Gap{Start: Unixtime(base.Add(-30 * time.Hour)), End: &end, Reason: GapCrash}, Timestamp: end},
+		colTestData()[1],
+		// 終わりと開始が同じ時刻
+		{Gap: &Gap{Start: now, End: &now, Reason: GapRead, Error: "EOF"}, Timestamp: now},
+	}
+	buf := encodeColBlock(sdl)
+	got, err := decodeColBlock(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(sdl) {
+		t.Fatalf("len = %d, want %d", len(got), len(sdl))
+	}
+	for i := range sdl {
+		g, w := got[i], sdl[i]
+		if (g.Gap == nil) != (w.Gap == nil) {
+			t.Errorf("%d: got %+v, want %+v", i, g.Gap, w.Gap)
+			continue
+		}
+		if w.Gap != nil {
+			same := time.Time(g.Gap.Start).Equal(time.Time(w.Gap.Start)) && g.Gap.Reason == w.Gap.Reason && g.Gap.Error == w.Gap.Error &&
+				(g.Gap.End == nil) == (w.Gap.End == nil) && (w.Gap.End == nil || time.Time(*g.Gap.End).Equal(time.Time(*w.Gap.End)))
+			if same == false {
+				t.Errorf("%d: got %+v, want %+v", i, *g.Gap, *w.Gap)
+			}
+			g.Gap, w.Gap = nil, nil
+		}
+		if sameStoreData(g, w) == false {
+			t.Errorf("%d: got %+v, want %+v", i, g, w)
+		}
+	}
+	// 欠損の印の列が欠けたブロックは壊れている
+	for _, n := range []int{len(buf) - 1, len(buf) / 2} {
+		if _, err := decodeColBlock(buf[:n]); err == nil {
+			t.Errorf("%dバイトに切り詰めてもエラーになりません", n)
+		}
+	}
+}
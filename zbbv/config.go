@@ -0,0 +1,428 @@
+package zbbv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultRootDomain    = "crypto.unko.in"
+	DefaultListenAddr    = ":8080"
+	DefaultStoreDataMax  = 1 << 14 // 16384
+	DefaultExchange      = "zaif"
+	DefaultZaifStremUrl  = "wss://ws.zaif.jp/stream?currency_pair="
+	DefaultZaifDepthUrl  = "https://api.zaif.jp/api/1/depth/"
+	DefaultZaifTickerUrl = "https://api.zaif.jp/api/1/ticker/"
+	DefaultAccessLogPath = "./log"
+	DefaultRootDataPath  = "data"
+	DefaultPublicPath    = "./public_html"
+	DefaultRelayQueue    = 256
+	DefaultCandleDays    = 7
+	DefaultStreamFormat  = StreamFormatJSON
+	DefaultStore         = StoreBackendFile
+	DefaultAccessLogDays = 7
+)
+
+// 環境変数の接頭辞
+const ConfigEnvPrefix = "ZBBV_"
+
+var defaultCurrencyPairs = []string{
+	"btc_jpy",
+	"xem_jpy",
+	"mona_jpy",
+	"bch_jpy",
+	"eth_jpy",
+}
+
+var currencyPairRegexp = regexp.MustCompile(`^[a-z0-9]+_[a-z0-9]+$`)
+var exchangeNameRegexp = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// Config アプリケーションの設定
+type Config struct {
+	// 空の場合はautocertによるTLSサーバを起動しない
+	RootDomain string `json:"root_domain"`
+	// 空の場合は平文HTTPサーバを起動しない
+	ListenAddr    string `json:"listen_addr"`
+	AccessLogPath string `json:"access_log_path"`
+	RootDataPath  string `json:"root_data_path"`
+	PublicPath    string `json:"public_path"`
+	StoreDataMax  int    `json:"store_data_max"`
+	// 中継WebSocketのクライアント毎の送信待ち上限（溢れたら切断）
+	RelayQueueSize int `json:"relay_queue_size"`
+	// 起動時にローソク足を作り直す日数
+	CandleRebuildDays int `json:"candle_rebuild_days"`
+	// 保存先（file・sqlite）
+	Store string `json:"store"`
+	// storeがfileの場合のストリームの保存形式（json・columnar）
+	StreamFormat string `json:"stream_format"`
+	// カテゴリ毎の保持日数
+	Retention RetentionConfig `json:"retention"`
+	// readyzで準備ができていないとする条件
+	Health HealthConfig `json:"health"`
+	// 空の場合は通貨ペア管理APIを無効にする
+	AdminToken string           `json:"admin_token"`
+	Exchanges  []ExchangeConfig `json:"exchanges"`
+}
+
+// ExchangeConfig 取引所毎の設定
+type ExchangeConfig struct {
+	// 対応している取引所の名前（URLの名前空間にも使う）
+	Name      string `json:"name"`
+	StreamURL string `json:"stream_url"`
+	DepthURL  string `json:"depth_url"`
+	TickerURL string `json:"ticker_url"`
+	// 空の場合はzaifはroot_data_path、それ以外はroot_data_path/取引所名
+	DataPath      string   `json:"data_path"`
+	CurrencyPairs []string `json:"currency_pairs"`
+}
+
+// NewConfig 既定値で埋めた設定を返す
+func NewConfig() *Config {
+	return &Config{
+		RootDomain:        DefaultRootDomain,
+		ListenAddr:        DefaultListenAddr,
+		AccessLogPath:     DefaultAccessLogPath,
+		RootDataPath:      DefaultRootDataPath,
+		PublicPath:        DefaultPublicPath,
+		StoreDataMax:      DefaultStoreDataMax,
+		RelayQueueSize:    DefaultRelayQueue,
+		CandleRebuildDays: DefaultCandleDays,
+		Store:             DefaultStore,
+		StreamFormat:      DefaultStreamFormat,
+		Retention:         RetentionConfig{AccessLog: DefaultAccessLogDays},
+		Health: HealthConfig{
+			StreamMaxAge:   DefaultHealthStreamMaxAge,
+			DepthMaxAge:    DefaultHealthDepthMaxAge,
+			MinFreeDisk:    DefaultHealthMinFreeDisk,
+			ReconnectGrace: DefaultHealthReconnectGrace,
+		},
+		Exchanges: []ExchangeConfig{{
+			Name:          DefaultExchange,
+			StreamURL:     DefaultZaifStremUrl,
+			DepthURL:      DefaultZaifDepthUrl,
+			TickerURL:     DefaultZaifTickerUrl,
+			CurrencyPairs: append([]string(nil), defaultCurrencyPairs...),
+		}},
+	}
+}
+
+// Exchange 名前を指定して取引所の設定を返す
+func (c *Config) Exchange(name string) (*ExchangeConfig, bool) {
+	for i := range c.Exchanges {
+		if c.Exchanges[i].Name == name {
+			return &c.Exchanges[i], true
+		}
+	}
+	return nil, false
+}
+
+// defaultExchange フラグ・環境変数で上書きする取引所の設定
+// 無ければ作る
+func (c *Config) defaultExchange() *ExchangeConfig {
+	if ec, ok := c.Exchange(DefaultExchange); ok {
+		return ec
+	}
+	c.Exchanges = append(c.Exchanges, ExchangeConfig{Name: DefaultExchange})
+	return &c.Exchanges[len(c.Exchanges)-1]
+}
+
+// dataPath 取引所のデータ保存先
+func (ec *ExchangeConfig) dataPath(root string) string {
+	switch {
+	case ec.DataPath != "":
+		return ec.DataPath
+	case ec.Name == DefaultExchange:
+		// 以前からのデータ配置を維持する
+		return root
+	default:
+		return filepath.Join(root, ec.Name)
+	}
+}
+
+// LoadFile JSON形式の設定ファイルを読み込んで上書きする
+// ファイルに書かれていない項目は元の値のまま
+// exchangesは要素毎に混ぜずに置き換え、zaifの空のURLだけ既定値で補う
+func (c *Config) LoadFile(p string) error {
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &keys); err != nil {
+		return fmt.Errorf("設定ファイルの読み込みに失敗しました。path:%s %w", p, err)
+	}
+	if _, ok := keys["exchanges"]; ok {
+		// 既定値の入ったスライスに要素の位置で上書きされないように
+		c.Exchanges = nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("設定ファイルの読み込みに失敗しました。path:%s %w", p, err)
+	}
+	for i := range c.Exchanges {
+		c.Exchanges[i].applyDefaults()
+	}
+	return nil
+}
+
+// applyDefaults 既定値がある取引所の空のURLを補う
+func (ec *ExchangeConfig) applyDefaults() {
+	if ec.Name != DefaultExchange {
+		return
+	}
+	for _, it := range []struct {
+		p *string
+		v string
+	}{
+		{&ec.StreamURL, DefaultZaifStremUrl},
+		{&ec.DepthURL, DefaultZaifDepthUrl},
+		{&ec.TickerURL, DefaultZaifTickerUrl},
+	} {
+		if *it.p == "" {
+			*it.p = it.v
+		}
+	}
+}
+
+// LoadEnv ZBBV_ から始まる環境変数で上書きする
+func (c *Config) LoadEnv(lookup func(string) (string, bool)) error {
+	for _, it := range c.fields() {
+		v, ok := lookup(ConfigEnvPrefix + it.env)
+		if !ok {
+			continue
+		}
+		if err := it.set(v); err != nil {
+			return fmt.Errorf("環境変数の値が不正です。name:%s %w", ConfigEnvPrefix+it.env, err)
+		}
+	}
+	return nil
+}
+
+// Set 名前を指定して値を上書きする
+// フラグからの上書き用
+func (c *Config) Set(name, v string) error {
+	for _, it := range c.fields() {
+		if it.flag == name {
+			return it.set(v)
+		}
+	}
+	return fmt.Errorf("不明な設定項目です。name:%s", name)
+}
+
+type configField struct {
+	flag  string
+	env   string
+	usage string
+	set   func(string) error
+}
+
+// ConfigFlag フラグ定義用の情報
+type ConfigFlag struct {
+	Name  string
+	Usage string
+}
+
+// Flags 上書き可能な設定項目の一覧
+func (c *Config) Flags() []ConfigFlag {
+	fl := c.fields()
+	cfl := make([]ConfigFlag, 0, len(fl))
+	for _, it := range fl {
+		cfl = append(cfl, ConfigFlag{Name: it.flag, Usage: it.usage})
+	}
+	return cfl
+}
+
+func (c *Config) fields() []configField {
+	str := func(p *string) func(string) error {
+		return func(v string) error {
+			*p = v
+			return nil
+		}
+	}
+	integer := func(p *int) func(string) error {
+		return func(v string) error {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+			*p = i
+			return nil
+		}
+	}
+	exstr := func(f func(ec *ExchangeConfig) *string) func(string) error {
+		return func(v string) error {
+			*f(c.defaultExchange()) = v
+			return nil
+		}
+	}
+	return []configField{
+		{"domain", "ROOT_DOMAIN", "autocertで証明書を取得するドメイン", str(&c.RootDomain)},
+		{"listen", "LISTEN_ADDR", "平文HTTPサーバの待ち受けアドレス", str(&c.ListenAddr)},
+		{"stream-url", "STREAM_URL", "zaifのストリームAPIのURL（末尾に通貨ペアを付与）", exstr(func(ec *ExchangeConfig) *string { return &ec.StreamURL })},
+		{"depth-url", "DEPTH_URL", "zaifの板情報APIのURL（末尾に通貨ペアを付与）", exstr(func(ec *ExchangeConfig) *string { return &ec.DepthURL })},
+		{"ticker-url", "TICKER_URL", "zaifのティッカーAPIのURL（末尾に通貨ペアを付与）", exstr(func(ec *ExchangeConfig) *string { return &ec.TickerURL })},
+		{"log", "ACCESS_LOG_PATH", "アクセスログの出力先フォルダ", str(&c.AccessLogPath)},
+		{"data", "ROOT_DATA_PATH", "データの保存先フォルダ", str(&c.RootDataPath)},
+		{"public", "PUBLIC_PATH", "静的ファイルのフォルダ", str(&c.PublicPath)},
+		{"store-max", "STORE_DATA_MAX", "メモリ上に保持するストリームデータ数", integer(&c.StoreDataMax)},
+		{"relay-queue", "RELAY_QUEUE_SIZE", "中継WebSocketのクライアント毎の送信待ち上限", integer(&c.RelayQueueSize)},
+		{"candle-days", "CANDLE_REBUILD_DAYS", "起動時にローソク足を作り直して保持する日数", integer(&c.CandleRebuildDays)},
+		{"store", "STORE", "保存先（file・sqlite）", str(&c.Store)},
+		{"stream-format", "STREAM_FORMAT", "ストリームの保存形式（json・columnar）", str(&c.StreamFormat)},
+		{"retention-stream", "RETENTION_STREAM", "ストリームの保持日数（0で無期限）", integer(&c.Retention.Stream)},
+		{"retention-book", "RETENTION_BOOK", "板の記録の保持日数（0で無期限）", integer(&c.Retention.Book)},
+		{"retention-candle", "RETENTION_CANDLE", "間引いた1分足の保持日数（0で無期限）", integer(&c.Retention.Candle)},
+		{"retention-access-log", "RETENTION_ACCESS_LOG", "アクセスログの保持日数（0で無期限）", integer(&c.Retention.AccessLog)},
+		{"health-stream-max-age", "HEALTH_STREAM_MAX_AGE", "ストリームを受信しない秒数がこれを超えたらreadyzを失敗させる（0で見ない）", integer(&c.Health.StreamMaxAge)},
+		{"health-depth-max-age", "HEALTH_DEPTH_MAX_AGE", "板情報APIの取得に成功しない秒数がこれを超えたらreadyzを失敗させる（0で見ない）", integer(&c.Health.DepthMaxAge)},
+		{"health-ticker-max-age", "HEALTH_TICKER_MAX_AGE", "ティッカーAPIの取得に成功しない秒数がこれを超えたらreadyzを失敗させる（0で見ない）", integer(&c.Health.TickerMaxAge)},
+		{"health-min-free-disk", "HEALTH_MIN_FREE_DISK", "データの保存先の空き容量(MB)がこれを下回ったらreadyzを失敗させる（0で見ない）", integer(&c.Health.MinFreeDisk)},
+		{"health-reconnect-grace", "HEALTH_RECONNECT_GRACE", "ストリームが切断されてからreadyzを失敗させるまでの秒数", integer(&c.Health.ReconnectGrace)},
+		{"health-optional-pairs", "HEALTH_OPTIONAL_PAIRS", "readyzを失敗させないカンマ区切りの通貨ペア一覧（{取引所}/{通貨ペア}）", func(v string) error {
+			c.Health.OptionalPairs = splitList(v)
+			return nil
+		}},
+		{"admin-token", "ADMIN_TOKEN", "通貨ペア管理APIのBearerトークン（空で無効）", str(&c.AdminToken)},
+		{"pairs", "CURRENCY_PAIRS", "zaifのカンマ区切りの通貨ペア一覧", func(v string) error {
+			c.defaultExchange().CurrencyPairs = splitList(v)
+			return nil
+		}},
+	}
+}
+
+// Validate 設定値の検査
+func (c *Config) Validate() error {
+	var errs []error
+	if c.RootDomain == "" && c.ListenAddr == "" {
+		errs = append(errs, errors.New("root_domainとlisten_addrの両方が空です"))
+	}
+	if c.AccessLogPath == "" {
+		errs = append(errs, errors.New("access_log_pathが空です"))
+	}
+	if c.RootDataPath == "" {
+		errs = append(errs, errors.New("root_data_pathが空です"))
+	}
+	if c.PublicPath == "" {
+		errs = append(errs, errors.New("public_pathが空です"))
+	}
+	if c.StoreDataMax <= 0 {
+		errs = append(errs, fmt.Errorf("store_data_maxは1以上にしてください。value:%d", c.StoreDataMax))
+	}
+	if c.RelayQueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("relay_queue_sizeは1以上にしてください。value:%d", c.RelayQueueSize))
+	}
+	if c.CandleRebuildDays < 0 {
+		errs = append(errs, fmt.Errorf("candle_rebuild_daysは0以上にしてください。value:%d", c.CandleRebuildDays))
+	}
+	for _, it := range []struct {
+		name string
+		v    int
+	}{
+		{"retention.stream", c.Retention.Stream},
+		{"retention.book", c.Retention.Book},
+		{"retention.candle", c.Retention.Candle},
+		{"retention.access_log", c.Retention.AccessLog},
+		{"health.stream_max_age", c.Health.StreamMaxAge},
+		{"health.depth_max_age", c.Health.DepthMaxAge},
+		{"health.ticker_max_age", c.Health.TickerMaxAge},
+		{"health.min_free_disk_mb", c.Health.MinFreeDisk},
+		{"health.reconnect_grace", c.Health.ReconnectGrace},
+	} {
+		if it.v < 0 {
+			errs = append(errs, fmt.Errorf("%sは0以上にしてください。value:%d", it.name, it.v))
+		}
+	}
+	if _, ok := storeFactories[c.Store]; ok == false {
+		errs = append(errs, fmt.Errorf("storeは%sのいずれかにしてください。value:%q", strings.Join(StoreBackends(), ","), c.Store))
+	}
+	if _, ok := streamStorageFactories[c.StreamFormat]; ok == false {
+		errs = append(errs, fmt.Errorf("stream_formatは%sのいずれかにしてください。value:%q", strings.Join(StreamFormats(), ","), c.StreamFormat))
+	}
+	for _, s := range c.Health.OptionalPairs {
+		l := strings.Split(s, "/")
+		if len(l) != 2 || exchangeNameRegexp.MatchString(l[0]) == false || currencyPairRegexp.MatchString(l[1]) == false {
+			errs = append(errs, fmt.Errorf("health.optional_pairsは{取引所}/{通貨ペア}の形式にしてください。value:%q", s))
+		}
+	}
+	exseen := make(map[string]struct{}, len(c.Exchanges))
+	for i := range c.Exchanges {
+		ec := &c.Exchanges[i]
+		if _, ok := exseen[ec.Name]; ok {
+			errs = append(errs, fmt.Errorf("取引所が重複しています。name:%q", ec.Name))
+			continue
+		}
+		exseen[ec.Name] = struct{}{}
+		if err := ec.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("exchanges[%d]: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (ec *ExchangeConfig) validate() error {
+	var errs []error
+	if exchangeNameRegexp.MatchString(ec.Name) == false {
+		return fmt.Errorf("取引所名の形式が不正です。name:%q", ec.Name)
+	}
+	if _, ok := exchangeFactories[ec.Name]; ok == false {
+		return fmt.Errorf("対応していない取引所です。name:%q 対応:%s", ec.Name, strings.Join(ExchangeNames(), ","))
+	}
+	if err := validateURL(ec.StreamURL, "ws", "wss"); err != nil {
+		errs = append(errs, fmt.Errorf("stream_url: %w", err))
+	}
+	if err := validateURL(ec.DepthURL, "http", "https"); err != nil {
+		errs = append(errs, fmt.Errorf("depth_url: %w", err))
+	}
+	if err := validateURL(ec.TickerURL, "http", "https"); err != nil {
+		errs = append(errs, fmt.Errorf("ticker_url: %w", err))
+	}
+	seen := make(map[string]struct{}, len(ec.CurrencyPairs))
+	for _, key := range ec.CurrencyPairs {
+		if currencyPairRegexp.MatchString(key) == false {
+			errs = append(errs, fmt.Errorf("通貨ペアの形式が不正です。pair:%q", key))
+			continue
+		}
+		if _, ok := seen[key]; ok {
+			errs = append(errs, fmt.Errorf("通貨ペアが重複しています。pair:%q", key))
+			continue
+		}
+		seen[key] = struct{}{}
+	}
+	return errors.Join(errs...)
+}
+
+func validateURL(s string, schemes ...string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	for _, it := range schemes {
+		if u.Scheme == it {
+			if u.Host == "" {
+				return fmt.Errorf("ホストが空です。url:%q", s)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("スキームは%sのいずれかにしてください。url:%q", strings.Join(schemes, ","), s)
+}
+
+func splitList(v string) []string {
+	l := []string{}
+	for _, it := range strings.Split(v, ",") {
+		it = strings.TrimSpace(it)
+		if it != "" {
+			l = append(l, it)
+		}
+	}
+	return l
+}
@@ -0,0 +1,94 @@
+package zbbv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, s string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(p, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadFileReplacesExchanges(t *testing.T) {
+	c := NewConfig()
+	p := writeConfigFile(t, `{"exchanges": [
+		{"name": "other", "stream_url": "wss://example.com/stream?pair=", "depth_url": "https://example.com/depth/", "ticker_url": "https://example.com/ticker/", "currency_pairs": ["btc_jpy"]},
+		{"name": "zaif", "currency_pairs": ["xem_jpy"]}
+	]}`)
+	if err := c.LoadFile(p); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Exchanges) != 2 {
+		t.Fatalf("len(Exchanges) = %d, want 2", len(c.Exchanges))
+	}
+	other := c.Exchanges[0]
+	if other.StreamURL != "wss://example.com/stream?pair=" || other.DepthURL != "https://example.com/depth/" {
+		t.Errorf("other = %+v", other)
+	}
+	if got := other.CurrencyPairs; len(got) != 1 || got[0] != "btc_jpy" {
+		t.Errorf("other.CurrencyPairs = %v", got)
+	}
+	zaif := c.Exchanges[1]
+	if zaif.StreamURL != DefaultZaifStremUrl || zaif.DepthURL != DefaultZaifDepthUrl || zaif.TickerURL != DefaultZaifTickerUrl {
+		t.Errorf("zaif = %+v", zaif)
+	}
+	if got := zaif.CurrencyPairs; len(got) != 1 || got[0] != "xem_jpy" {
+		t.Errorf("zaif.CurrencyPairs = %v", got)
+	}
+}
+
+func TestLoadFileKeepsDefaultExchanges(t *testing.T) {
+	c := NewConfig()
+	p := writeConfigFile(t, `{"store_data_max": 100}`)
+	if err := c.LoadFile(p); err != nil {
+		t.Fatal(err)
+	}
+	if c.StoreDataMax != 100 {
+		t.Errorf("StoreDataMax = %d", c.StoreDataMax)
+	}
+	if len(c.Exchanges) != 1 || c.Exchanges[0].Name != DefaultExchange || len(c.Exchanges[0].CurrencyPairs) != len(defaultCurrencyPairs) {
+		t.Errorf("Exchanges = %+v", c.Exchanges)
+	}
+}
+
+func TestSetInteger(t *testing.T) {
+	c := NewConfig()
+	for _, it := range []struct {
+		name string
+		p    *int
+	}{
+		{"store-max", &c.StoreDataMax},
+		{"relay-queue", &c.RelayQueueSize},
+		{"candle-days", &c.CandleRebuildDays},
+	} {
+		if err := c.Set(it.name, "42"); err != nil {
+			t.Errorf("%s: %v", it.name, err)
+		}
+		if *it.p != 42 {
+			t.Errorf("%s = %d", it.name, *it.p)
+		}
+		if err := c.Set(it.name, "x"); err == nil {
+			t.Errorf("%s: 不正な値でエラーになりません", it.name)
+		}
+	}
+}
+
+func TestValidateOptionalPairs(t *testing.T) {
+	conf := NewConfig()
+	conf.Health.OptionalPairs = []string{"zaif/xem_jpy"}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"xem_jpy", "zaif/", "/xem_jpy", "zaif/xem_jpy/1", "Zaif/xem_jpy"} {
+		conf.Health.OptionalPairs = []string{s}
+		if err := conf.Validate(); err == nil {
+			t.Errorf("%q: エラーになりません", s)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package zbbv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// スナップショットとアーカイブの差をこの割合まで許容する
+const DefaultTickTolerance = 0.01
+
+// 日付が変わった後にティッカーの取得を再試行する回数（1分毎）
+const tickRetryMax = 10
+
+// 日が終わってからこれだけ経てば、その日のStoreDataはもう増えないとみなす
+const tickFinalAfter = time.Hour
+
+// TickReport アーカイブから作った日毎のティッカーとスナップショットの突き合わせ結果
+type TickReport struct {
+	Pair     string
+	Date     string
+	Archive  Ticker
+	Snapshot *Ticker24h // スナップショットが無い日はnil
+	Fields   []string   // 食い違っている項目
+}
+
+func (r TickReport) String() string {
+	if r.Snapshot == nil {
+		return fmt.Sprintf("%s %s スナップショット無し", r.Pair, r.Date)
+	}
+	l := make([]string, 0, len(r.Fields))
+	for _, f := range r.Fields {
+		a, s := tickField(r.Archive, r.Snapshot, f)
+		l = append(l, fmt.Sprintf("%s=%g/%g", f, a, s))
+	}
+	return fmt.Sprintf("%s %s 不一致 %s", r.Pair, r.Date, strings.Join(l, " "))
+}
+
+var tickFields = []string{"close", "high", "low", "vwap", "volume"}
+
+func tickField(t Ticker, zt *Ticker24h, name string) (float64, float64) {
+	switch name {
+	case "close":
+		return t.Close, zt.Last
+	case "high":
+		return t.High, zt.High
+	case "low":
+		return t.Low, zt.Low
+	case "vwap":
+		return t.Vwap, zt.Vwap
+	case "volume":
+		return t.Volume, zt.Volume
+	}
+	return 0, 0
+}
+
+// compareTicker tolを超えて食い違っている項目を返す
+func compareTicker(t Ticker, zt *Ticker24h, tol float64) []string {
+	var l []string
+	for _, f := range tickFields {
+		a, s := tickField(t, zt, f)
+		if math.Abs(a-s) > tol*math.Max(math.Abs(a), math.Abs(s)) {
+			l = append(l, f)
+		}
+	}
+	return l
+}
+
+// archiveTicker その日の約定から日毎のティッカーを作る
+// 約定が1件も無い場合はokがfalse
+func archiveTicker(st Store, day time.Time) (t Ticker, ok bool, err error) {
+	day = dayStart(day)
+	seen := make(map[uint64]struct{}, 1024)
+	var sum float64
+	err = st.Range(day, day.AddDate(0, 0, 1), func(sd StoreData) error {
+		tr := sd.Trade
+		if tr == nil {
+			return nil
+		}
+		if _, dup := seen[tr.Tid]; dup {
+			return nil
+		}
+		seen[tr.Tid] = struct{}{}
+		if ok == false {
+			t.Open, t.High, t.Low = tr.Price, tr.Price, tr.Price
+			ok = true
+		}
+		if tr.Price > t.High {
+			t.High = tr.Price
+		}
+		if tr.Price < t.Low {
+			t.Low = tr.Price
+		}
+		t.Close = tr.Price
+		t.Volume += tr.Amount
+		sum += tr.Price * tr.Amount
+		return nil
+	})
+	if t.Volume > 0 {
+		t.Vwap = sum / t.Volume
+	}
+	t.Date = day.Format("20060102")
+	return t, ok, err
+}
+
+func readDailyTicker(p string) (Ticker, error) {
+	var t Ticker
+	fp, err := os.Open(p)
+	if err != nil {
+		return t, err
+	}
+	defer fp.Close()
+	err = json.NewDecoder(fp).Decode(&t)
+	return t, err
+}
+
+func writeDailyTicker(p string, t Ticker) error {
+	if err := createDir(p); err != nil {
+		return err
+	}
+	wfp, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer wfp.Close()
+	if err := json.NewEncoder(wfp).Encode(t); err != nil {
+		return err
+	}
+	return wfp.Sync()
+}
+
+// buildTicks スナップショットとアーカイブから日毎のティッカーを作る
+// アーカイブがある日はアーカイブから作った値を優先し、新たに作った日のうちスナップショットが無い日と食い違う日はreportに渡す
+// 終わってからtickFinalAfter経った日の値はdaily以下に保存して次回から使い回す
+// forceがtrueの場合は保存済みの値を使わずに全て作り直す
+func buildTicks(st Store, root, key string, now time.Time, force bool, tol float64, report func(TickReport)) ([]Ticker, error) {
+	sl, err := st.LoadTickers()
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make(map[string]*Ticker24h, len(sl))
+	for i := range sl {
+		snapshots[sl[i].Date] = &sl[i].Ticker24h
+	}
+	days, err := st.Days()
+	if err != nil {
+		return nil, err
+	}
+	// 保持期間を過ぎてストリームを消した日は保存済みの値だけがある
+	days = unionDays(days, dailyTickerDays(root, key))
+	al := make([]Ticker, 0, 365)
+	today := dayStart(now)
+	for _, day := range days {
+		if day.Before(today) == false {
+			continue
+		}
+		cp := createStoreFilePath(root, day, key, "daily")
+		t, err := readDailyTicker(cp)
+		if force || err != nil {
+			at, ok, aerr := archiveTicker(st, day)
+			if aerr != nil {
+				return nil, aerr
+			}
+			if ok == false {
+				if err == nil {
+					al = append(al, t)
+				}
+				continue
+			}
+			t = at
+			if now.Sub(day.AddDate(0, 0, 1)) >= tickFinalAfter {
+				if err := writeDailyTicker(cp, t); err != nil {
+					log.Warnw("日毎のティッカーの保存に失敗しました。", "error", err, "path", cp)
+				}
+			}
+			if report != nil {
+				zt, ok := snapshots[t.Date]
+				if ok == false {
+					report(TickReport{Pair: key, Date: t.Date, Archive: t})
+				} else if fl := compareTicker(t, zt, tol); len(fl) > 0 {
+					report(TickReport{Pair: key, Date: t.Date, Archive: t, Snapshot: zt, Fields: fl})
+				}
+			}
+		}
+		al = append(al, t)
+	}
+	return mergeTicks(al, ticksFromSnapshots(sl)), nil
+}
+
+// dailyTickerDays 日毎のティッカーを保存してある日の一覧
+func dailyTickerDays(root, key string) []time.Time {
+	match, _ := filepath.Glob(filepath.Join(root, "daily", key, key+"_*.json"))
+	days := make([]time.Time, 0, len(match))
+	for _, p := range match {
+		if day, ok := dayFileDate(key, filepath.Base(p)); ok {
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// unionDays 重複を除いて古い順にまとめる
+func unionDays(a, b []time.Time) []time.Time {
+	set := make(map[time.Time]struct{}, len(a)+len(b))
+	days := make([]time.Time, 0, len(a)+len(b))
+	for _, l := range [][]time.Time{a, b} {
+		for _, day := range l {
+			if _, ok := set[day]; ok {
+				continue
+			}
+			set[day] = struct{}{}
+			days = append(days, day)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days
+}
+
+// Backfill 設定された全ての通貨ペアについてアーカイブから日毎のティッカーを作り直す
+// スナップショットが無い日と食い違う日をwに書き出す
+func Backfill(conf *Config, w io.Writer, tol float64) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, ec := range conf.Exchanges {
+		root := ec.dataPath(conf.RootDataPath)
+		for _, key := range ec.CurrencyPairs {
+			st, err := openStore(conf, root, key)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", ec.Name, key, err)
+			}
+			tl, err := buildTicks(st, root, key, now, true, tol, func(r TickReport) {
+				fmt.Fprintf(w, "%s %s\n", ec.Name, r)
+			})
+			st.Close()
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", ec.Name, key, err)
+			}
+			fmt.Fprintf(w, "%s %s %d日分\n", ec.Name, key, len(tl))
+		}
+	}
+	return nil
+}
+
+// mergeTicks 日付が同じものはaを優先して日付順にまとめる
+func mergeTicks(a, b []Ticker) []Ticker {
+	m := make(map[string]Ticker, len(a)+len(b))
+	for _, t := range b {
+		m[t.Date] = t
+	}
+	for _, t := range a {
+		m[t.Date] = t
+	}
+	tl := make([]Ticker, 0, len(m))
+	for _, t := range m {
+		tl = append(tl, t)
+	}
+	sort.Slice(tl, func(i, j int) bool { return tl[i].Date < tl[j].Date })
+	return tl
+}
@@ -0,0 +1,252 @@
+package zbbv
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeDailyFixture todayの6日前から今日までのアーカイブ・スナップショット・保存済みの日毎のティッカー
+//
+//	6日前 保存済みの日毎のティッカーだけ（ストリームは消した）
+//	5日前 スナップショットだけ
+//	4日前 アーカイブだけ。重複した約定と約定の無いStoreDataを含む
+//	3日前 アーカイブとスナップショット。許容範囲内で食い違う
+//	2日前 アーカイブとスナップショット。高値が食い違う
+//	1日前 アーカイブだけ
+//	今日  アーカイブだけ（まだ終わっていない）
+func writeDailyFixture(t *testing.T, root, key string, today time.Time) Store {
+	t.Helper()
+	day := func(i int) time.Time { return today.AddDate(0, 0, i) }
+	writeDailyTicker(createStoreFilePath(root, day(-6), key, "daily"), Ticker{
+		Date: day(-6).Format("20060102"), Open: 80, Close: 81, High: 82, Low: 79, Vwap: 80.5, Volume: 10,
+	})
+	at := func(i int, h int) time.Time { return day(i).Add(time.Duration(h) * time.Hour) }
+	writeArchive(t, root, key, day(-4), StoreDataArray{
+		candleTrade(at(-4, 1), 1, 100, 1),
+		candleTrade(at(-4, 2), 2, 120, 2),
+		{Ask: &PriceAmount{130, 1}, Timestamp: Unixtime(at(-4, 2))},
+		candleTrade(at(-4, 3), 2, 120, 2),
+		candleTrade(at(-4, 4), 3, 90, 1),
+		candleTrade(at(-4, 5), 4, 110, 1),
+	})
+	for i, tid := range map[int]uint64{-3: 10, -2: 20} {
+		writeArchive(t, root, key, day(i), StoreDataArray{
+			candleTrade(at(i, 1), tid, 100, 1),
+			candleTrade(at(i, 2), tid+1, 102, 1),
+		})
+	}
+	writeArchive(t, root, key, day(-1), StoreDataArray{candleTrade(at(-1, 1), 30, 105, 3)})
+	writeArchive(t, root, key, day(0), StoreDataArray{candleTrade(at(0, 1), 40, 200, 1)})
+	st, err := newFileStore(NewConfig(), root, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	for i, zt := range map[int]Ticker24h{
+		-5: {Last: 95, High: 96, Low: 94, Vwap: 95, Volume: 4},
+		-3: {Last: 102, High: 102, Low: 100, Vwap: 101.5, Volume: 2},
+		-2: {Last: 102, High: 110, Low: 100, Vwap: 101, Volume: 2},
+	} {
+		zt := zt
+		if err := st.SaveTicker(day(i).Format("20060102"), &zt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return st
+}
+
+func TestArchiveTicker(t *testing.T) {
+	root := t.TempDir()
+	today := time.Date(2023, 11, 20, 0, 0, 0, 0, jst)
+	st := writeDailyFixture(t, root, "btc_jpy", today)
+	for _, tc := range []struct {
+		day  int
+		ok   bool
+		want Ticker
+	}{
+		// 重複した約定は1回だけ数える
+		{-4, true, Ticker{Open: 100, High: 120, Low: 90, Close: 110, Volume: 5, Vwap: 540.0 / 5}},
+		{-3, true, Ticker{Open: 100, High: 102, Low: 100, Close: 102, Volume: 2, Vwap: 101}},
+		{-5, false, Ticker{}},
+	} {
+		day := today.AddDate(0, 0, tc.day)
+		// 日の途中の時刻でもその日全体
+		got, ok, err := archiveTicker(st, day.Add(15*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.want.Date = day.Format("20060102")
+		if ok != tc.ok || got != tc.want {
+			t.Errorf("%s: got %+v %v, want %+v %v", tc.want.Date, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestCompareTicker(t *testing.T) {
+	base := Ticker{Close: 100, High: 110, Low: 90, Vwap: 100, Volume: 1000}
+	for _, tc := range []struct {
+		name string
+		zt   Ticker24h
+		tol  float64
+		want []string
+	}{
+		{"一致", Ticker24h{Last: 100, High: 110, Low: 90, Vwap: 100, Volume: 1000}, 0.01, nil},
+		{"許容範囲内", Ticker24h{Last: 100.9, High: 110, Low: 90, Vwap: 99.5, Volume: 1009}, 0.01, nil},
+		{"許容範囲外", Ticker24h{Last: 102, High: 110, Low: 90, Vwap: 100, Volume: 1100}, 0.01, []string{"close", "volume"}},
+		{"許容しない", Ticker24h{Last: 100.1, High: 110, Low: 90, Vwap: 100, Volume: 1000}, 0, []string{"close"}},
+		{"全部違う", Ticker24h{}, 0.5, []string{"close", "high", "low", "vwap", "volume"}},
+	} {
+		got := compareTicker(base, &tc.zt, tc.tol)
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	// 両方0なら一致
+	if got := compareTicker(Ticker{}, &Ticker24h{}, 0); len(got) != 0 {
+		t.Errorf("0同士 got %v", got)
+	}
+}
+
+func TestMergeTicks(t *testing.T) {
+	a := []Ticker{{Date: "20231117", Open: 1}, {Date: "20231115", Open: 2}}
+	b := []Ticker{{Date: "20231116", Open: 3}, {Date: "20231117", Open: 4}, {Date: "20231114", Open: 5}}
+	got := mergeTicks(a, b)
+	want := []Ticker{{Date: "20231114", Open: 5}, {Date: "20231115", Open: 2}, {Date: "20231116", Open: 3}, {Date: "20231117", Open: 1}}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBuildTicks(t *testing.T) {
+	root := t.TempDir()
+	const key = "btc_jpy"
+	today := time.Date(2023, 11, 20, 0, 0, 0, 0, jst)
+	st := writeDailyFixture(t, root, key, today)
+	date := func(i int) string { return today.AddDate(0, 0, i).Format("20060102") }
+	var reports []TickReport
+	report := func(r TickReport) { reports = append(reports, r) }
+	tl, err := buildTicks(st, root, key, today.Add(12*time.Hour), false, DefaultTickTolerance, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Ticker{
+		{Date: date(-6), Open: 80, Close: 81, High: 82, Low: 79, Vwap: 80.5, Volume: 10},
+		// スナップショットしか無い日はスナップショットから作る
+		{Date: date(-5), Open: 95, Close: 95, High: 96, Low: 94, Vwap: 95, Volume: 4},
+		{Date: date(-4), Open: 100, Close: 110, High: 120, Low: 90, Vwap: 108, Volume: 5},
+		// アーカイブがある日はスナップショットよりアーカイブを優先する
+		{Date: date(-3), Open: 100, Close: 102, High: 102, Low: 100, Vwap: 101, Volume: 2},
+		{Date: date(-2), Open: 100, Close: 102, High: 102, Low: 100, Vwap: 101, Volume: 2},
+		{Date: date(-1), Open: 105, Close: 105, High: 105, Low: 105, Vwap: 105, Volume: 3},
+	}
+	if len(tl) != len(want) {
+		t.Fatalf("got %+v", tl)
+	}
+	for i := range want {
+		if tl[i] != want[i] {
+			t.Errorf("%d: got %+v, want %+v", i, tl[i], want[i])
+		}
+	}
+	if len(reports) != 3 {
+		t.Fatalf("reports %+v", reports)
+	}
+	if reports[0].Date != date(-4) || reports[0].Snapshot != nil {
+		t.Errorf("スナップショットの無い日 %+v", reports[0])
+	}
+	if reports[1].Date != date(-2) || reports[1].Snapshot == nil || strings.Join(reports[1].Fields, ",") != "high" {
+		t.Errorf("食い違う日 %+v", reports[1])
+	}
+	if s := reports[1].String(); s != key+" "+date(-2)+" 不一致 high=102/110" {
+		t.Errorf("String() = %q", s)
+	}
+	if reports[2].Date != date(-1) || reports[2].Snapshot != nil {
+		t.Errorf("スナップショットの無い日 %+v", reports[2])
+	}
+	// 作った値は保存して次から使う
+	for i := -4; i <= -1; i++ {
+		p := createStoreFilePath(root, today.AddDate(0, 0, i), key, "daily")
+		if tk, err := readDailyTicker(p); err != nil || tk != want[i+6] {
+			t.Errorf("%s: 保存した値 %+v %v", date(i), tk, err)
+		}
+	}
+	if fileExists(createStoreFilePath(root, today, key, "daily")) {
+		t.Error("終わっていない日を保存しました。")
+	}
+	changed := want[2]
+	changed.Close = 111
+	writeDailyTicker(createStoreFilePath(root, today.AddDate(0, 0, -4), key, "daily"), changed)
+	reports = nil
+	tl, err = buildTicks(st, root, key, today.Add(12*time.Hour), false, DefaultTickTolerance, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 0 || len(tl) != len(want) || tl[2] != changed {
+		t.Errorf("保存した値を使っていません。%+v reports:%+v", tl, reports)
+	}
+	// forceなら作り直す
+	tl, err = buildTicks(st, root, key, today.Add(12*time.Hour), true, DefaultTickTolerance, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tl) != len(want) || tl[2] != want[2] || len(reports) != 3 {
+		t.Errorf("作り直していません。%+v reports:%+v", tl, reports)
+	}
+}
+
+func TestBuildTicksNotFinal(t *testing.T) {
+	root := t.TempDir()
+	const key = "btc_jpy"
+	today := time.Date(2023, 11, 20, 0, 0, 0, 0, jst)
+	st := writeDailyFixture(t, root, key, today)
+	// 日が変わってすぐは前日のStoreDataがまだ増えるので保存しない
+	if _, err := buildTicks(st, root, key, today.Add(tickFinalAfter-time.Minute), false, DefaultTickTolerance, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(createStoreFilePath(root, today.AddDate(0, 0, -1), key, "daily")) {
+		t.Error("終わったばかりの日を保存しました。")
+	}
+	if fileExists(createStoreFilePath(root, today.AddDate(0, 0, -2), key, "daily")) == false {
+		t.Error("終わった日を保存していません。")
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	root := t.TempDir()
+	const key = "btc_jpy"
+	today := dayStart(time.Now())
+	writeDailyFixture(t, root, key, today)
+	conf := NewConfig()
+	conf.RootDataPath = root
+	conf.Exchanges[0].CurrencyPairs = []string{key}
+	var buf bytes.Buffer
+	if err := Backfill(conf, &buf, DefaultTickTolerance); err != nil {
+		t.Fatal(err)
+	}
+	date := func(i int) string { return today.AddDate(0, 0, i).Format("20060102") }
+	want := strings.Join([]string{
+		"zaif " + key + " " + date(-4) + " スナップショット無し",
+		"zaif " + key + " " + date(-2) + " 不一致 high=102/110",
+		"zaif " + key + " " + date(-1) + " スナップショット無し",
+		"zaif " + key + " 6日分",
+	}, "\n") + "\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+	// 保存済みの値があっても作り直す
+	changed := Ticker{Date: date(-4), Close: 1}
+	writeDailyTicker(createStoreFilePath(root, today.AddDate(0, 0, -4), key, "daily"), changed)
+	buf.Reset()
+	if err := Backfill(conf, &buf, DefaultTickTolerance); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("作り直していません。\n%s", buf.String())
+	}
+}
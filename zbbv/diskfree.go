@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package zbbv
+
+import "syscall"
+
+// diskFree pのあるファイルシステムで一般ユーザが使える空き容量
+func diskFree(p string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
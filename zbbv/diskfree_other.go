@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package zbbv
+
+import "errors"
+
+func diskFree(p string) (uint64, error) {
+	return 0, errors.New("空き容量の取得に対応していません")
+}
@@ -0,0 +1,16 @@
+package zbbv
+
+import "golang.org/x/sys/windows"
+
+// diskFree pのあるドライブで呼び出し元が使える空き容量
+func diskFree(p string) (uint64, error) {
+	dir, err := windows.UTF16PtrFromString(p)
+	if err != nil {
+		return 0, err
+	}
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(dir, &free, &total, &totalFree); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
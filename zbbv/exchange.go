@@ -0,0 +1,67 @@
+package zbbv
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Exchange 取引所毎の差異を吸収する
+// 取得したデータはStream・Depth・Ticker24hに正規化して返す
+type Exchange interface {
+	Name() string
+	// Subscribe 通貨ペアのストリームに接続する
+	Subscribe(ctx context.Context, pair string) (StreamConn, error)
+	// Depth 板情報のスナップショット
+	Depth(ctx context.Context, pair string) (*Depth, error)
+	// Ticker 過去24時間のティッカー
+	Ticker(ctx context.Context, pair string) (*Ticker24h, error)
+}
+
+// StreamConn ストリームの接続
+// Closeを呼ぶと読み込み中のReadはエラーを返す
+type StreamConn interface {
+	Read() (Stream, error)
+	Close() error
+}
+
+// Stream 正規化したストリームの1メッセージ
+type Stream struct {
+	Asks         []PriceAmount
+	Bids         []PriceAmount
+	Trades       []Trade
+	Timestamp    time.Time
+	LastPrice    LastPrice
+	CurrencyPair string
+}
+
+// Depth 正規化した板情報
+type Depth struct {
+	Asks []PriceAmount `json:"asks"`
+	Bids []PriceAmount `json:"bids"`
+}
+
+type exchangeFactory func(ec ExchangeConfig) (Exchange, error)
+
+var exchangeFactories = map[string]exchangeFactory{
+	"zaif": newZaifExchange,
+}
+
+func newExchange(ec ExchangeConfig) (Exchange, error) {
+	f, ok := exchangeFactories[ec.Name]
+	if ok == false {
+		return nil, fmt.Errorf("対応していない取引所です。name:%q", ec.Name)
+	}
+	return f(ec)
+}
+
+// ExchangeNames 対応している取引所の一覧
+func ExchangeNames() []string {
+	l := make([]string, 0, len(exchangeFactories))
+	for name := range exchangeFactories {
+		l = append(l, name)
+	}
+	sort.Strings(l)
+	return l
+}
@@ -0,0 +1,9 @@
+package zbbv
+
+import "time"
+
+// SetStreamRetryJitter 再接続までの待ち時間を短くする
+// Appを起動する前に呼ぶこと
+func SetStreamRetryJitter(d time.Duration) {
+	streamRetryJitter = d
+}
@@ -0,0 +1,151 @@
+package zbbv
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// データの出どころ
+const (
+	DataSourceStream   = "stream"   // ストリームで受信した
+	DataSourcePoll     = "poll"     // APIを取得した
+	DataSourceCache    = "cache"    // 保存しておいたスナップショットやアーカイブから作った
+	DataSourceRestored = "restored" // 前回停止した時に保存したバッファ（gob）を読み込んだ
+)
+
+// DataMeta 応答するデータの時点と出どころ
+// AsOfはデータが最新だと分かっている時刻で、まだ何も無ければゼロ値
+type DataMeta struct {
+	AsOf   time.Time
+	Source string
+}
+
+// dataEnvelope envelope=1の場合の応答
+type dataEnvelope struct {
+	AsOf   *Unixtime       `json:"as_of,omitempty"`
+	Source string          `json:"source,omitempty"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// writeFresh bodyにデータの時点と出どころを付けて返す
+func writeFresh(w http.ResponseWriter, r *http.Request, meta DataMeta, body []byte) {
+	writeFreshETag(w, r, meta, body, "")
+}
+
+// writeFreshETag bodyにデータの時点と出どころを付けて返す
+// X-Data-As-Of（UNIX時間）・X-Data-Age（秒）・X-Data-Sourceヘッダを付け、
+// クエリにenvelope=1があれば{"as_of","source","data"}で包む
+// If-None-MatchがETagと一致すれば304を返す
+// etagが空の場合はbodyから作る
+func writeFreshETag(w http.ResponseWriter, r *http.Request, meta DataMeta, body []byte, etag string) {
+	if v := r.URL.Query().Get("envelope"); v == "1" || v == "true" {
+		var err error
+		body, err = json.Marshal(dataEnvelope{
+			AsOf:   optUnixtime(meta.AsOf),
+			Source: meta.Source,
+			Data:   bytes.TrimRight(body, "\n"),
+		})
+		if err != nil {
+			http.Error(w, "データ取得に失敗しました。", http.StatusInternalServerError)
+			return
+		}
+		body = append(body, '\n')
+		etag = ""
+	}
+	h := w.Header()
+	if meta.AsOf.IsZero() == false {
+		h.Set("X-Data-As-Of", strconv.FormatInt(meta.AsOf.Unix(), 10))
+		age := time.Since(meta.AsOf)
+		if age < 0 {
+			age = 0
+		}
+		h.Set("X-Data-Age", strconv.FormatFloat(age.Seconds(), 'f', 3, 64))
+	}
+	if meta.Source != "" {
+		h.Set("X-Data-Source", meta.Source)
+	}
+	if etag == "" {
+		etag = bodyETag(body)
+	}
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "no-cache")
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(body); err != nil {
+		log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
+	}
+}
+
+// bodyETag gzipで圧縮されても同じ値を返すので弱いETagにする
+func bodyETag(body []byte) string {
+	fh := fnv.New64a()
+	fh.Write(body)
+	return `W/"` + strconv.FormatUint(fh.Sum64(), 16) + `"`
+}
+
+// writeSnapshot 公開されたデータをwriteFreshETagで返す
+// まだ公開されていなければ503
+func writeSnapshot[T any](w http.ResponseWriter, r *http.Request, s *snapshot[T]) {
+	if s == nil {
+		http.Error(w, "データ取得に失敗しました。", http.StatusServiceUnavailable)
+		return
+	}
+	body, etag, err := s.JSON()
+	if err != nil {
+		log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
+		http.Error(w, "データ取得に失敗しました。", http.StatusInternalServerError)
+		return
+	}
+	writeFreshETag(w, r, s.meta, body, etag)
+}
+
+// etagMatch If-None-Matchの弱い比較
+func etagMatch(inm, etag string) bool {
+	if inm == "" {
+		return false
+	}
+	if strings.TrimSpace(inm) == "*" {
+		return true
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, it := range strings.Split(inm, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(it), "W/") == want {
+			return true
+		}
+	}
+	return false
+}
+
+// bookMeta 板の写しの時点と出どころ
+func bookMeta(bs BookSnapshot) DataMeta {
+	src := DataSourceStream
+	if bs.Source == BookSourceDepth {
+		src = DataSourcePoll
+	}
+	return DataMeta{AsOf: time.Time(bs.Timestamp), Source: src}
+}
+
+// ticksMeta 日毎のティッカーは最後の日が終わった時点のもの
+// 最後の日がまだ終わっていなければnow
+func ticksMeta(tl []Ticker, src string, now time.Time) DataMeta {
+	if len(tl) == 0 {
+		return DataMeta{Source: src}
+	}
+	day, err := time.ParseInLocation("20060102", tl[len(tl)-1].Date, jst)
+	if err != nil {
+		return DataMeta{Source: src}
+	}
+	asof := day.AddDate(0, 0, 1)
+	if asof.After(now) {
+		asof = now
+	}
+	return DataMeta{AsOf: asof, Source: src}
+}
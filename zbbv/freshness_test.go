@@ -0,0 +1,164 @@
+package zbbv
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func getFresh(h http.Handler, query string, inm string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/api/zaif/1/x/btc_jpy"+query, nil)
+	if inm != "" {
+		r.Header.Set("If-None-Match", inm)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// checkFresh 応答のヘッダとenvelope=1で包んだ応答を確かめる
+func checkFresh(t *testing.T, name string, h http.Handler, query string, asof time.Time, src string) {
+	t.Helper()
+	sep := "?"
+	if query != "" {
+		sep = "&"
+	}
+	w := getFresh(h, query, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: status:%d %s", name, w.Code, w.Body)
+	}
+	hd := w.Header()
+	if asof.IsZero() {
+		if hd.Get("X-Data-As-Of") != "" || hd.Get("X-Data-Age") != "" {
+			t.Errorf("%s: 時点が無いのにヘッダがあります。%v", name, hd)
+		}
+	} else {
+		if got := hd.Get("X-Data-As-Of"); got != strconv.FormatInt(asof.Unix(), 10) {
+			t.Errorf("%s: X-Data-As-Of %q, want %d", name, got, asof.Unix())
+		}
+		age, err := strconv.ParseFloat(hd.Get("X-Data-Age"), 64)
+		if want := time.Since(asof).Seconds(); err != nil || age < want-1 || age > want+60 {
+			t.Errorf("%s: X-Data-Age %q, want %g", name, hd.Get("X-Data-Age"), want)
+		}
+	}
+	if got := hd.Get("X-Data-Source"); got != src {
+		t.Errorf("%s: X-Data-Source %q, want %q", name, got, src)
+	}
+	body := w.Body.Bytes()
+	etag := hd.Get("ETag")
+	if w := getFresh(h, query, etag); w.Code != http.StatusNotModified {
+		t.Errorf("%s: If-None-Match status:%d", name, w.Code)
+	}
+
+	ew := getFresh(h, query+sep+"envelope=1", "")
+	if ew.Code != http.StatusOK {
+		t.Fatalf("%s envelope: status:%d %s", name, ew.Code, ew.Body)
+	}
+	var env struct {
+		AsOf   *int64          `json:"as_of"`
+		Source *string         `json:"source"`
+		Data   json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(ew.Body.Bytes(), &env); err != nil {
+		t.Fatalf("%s envelope: %v\n%s", name, err, ew.Body)
+	}
+	switch {
+	case asof.IsZero() && env.AsOf != nil:
+		t.Errorf("%s envelope: as_of %d", name, *env.AsOf)
+	case asof.IsZero() == false && (env.AsOf == nil || *env.AsOf != asof.Unix()):
+		t.Errorf("%s envelope: as_of %v, want %d", name, env.AsOf, asof.Unix())
+	}
+	if (src == "") != (env.Source == nil) || (env.Source != nil && *env.Source != src) {
+		t.Errorf("%s envelope: source %v, want %q", name, env.Source, src)
+	}
+	// dataは包まない場合の応答そのもの
+	if bytes.Equal(env.Data, bytes.TrimRight(body, "\n")) == false {
+		t.Errorf("%s envelope: data %s, want %s", name, env.Data, body)
+	}
+	// ヘッダは包んでも同じ
+	if ew.Header().Get("X-Data-Source") != src || ew.Header().Get("X-Data-As-Of") != hd.Get("X-Data-As-Of") {
+		t.Errorf("%s envelope: header %v", name, ew.Header())
+	}
+	if ew.Header().Get("ETag") == etag {
+		t.Errorf("%s envelope: 包まない場合と同じETagです。", name)
+	}
+}
+
+func TestFreshnessHandlers(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	ts := now.Add(-90 * time.Second)
+
+	// 前回保存したバッファを読み込んだ直後
+	oldstream := newPublisher[StoreDataArray](encodeStoreDataArray)
+	sda := StoreDataArray{tradeData(ts.Add(-time.Minute), 1), tradeData(ts, 2)}
+	oldstream.Publish(sda, DataMeta{AsOf: ts, Source: DataSourceRestored})
+	osh := &OldStreamHandler{cp: "btc_jpy", pub: oldstream}
+	checkFresh(t, "oldstream", osh, "", ts, DataSourceRestored)
+	// 絞り込んでも同じ時点と出どころ
+	checkFresh(t, "oldstream fields", osh, "?fields=trade&limit=1", ts, DataSourceRestored)
+
+	// ストリームで受信した
+	lastprice := newPublisher[LastPrice](nil)
+	lastprice.Publish(LastPrice{Action: "bid", Price: 100}, DataMeta{AsOf: ts, Source: DataSourceStream})
+	checkFresh(t, "lastprice", &LastPriceHandler{cp: "btc_jpy", pub: lastprice}, "", ts, DataSourceStream)
+
+	// 板情報APIを取得した後、ストリームで受信した
+	book := newOrderBook()
+	dh := &DepthHandler{cp: "btc_jpy", book: book}
+	checkFresh(t, "depth 更新前", dh, "", time.Time{}, "")
+	book.Seed(&Depth{Asks: []PriceAmount{{101, 1}}, Bids: []PriceAmount{{99, 1}}}, ts)
+	checkFresh(t, "depth poll", dh, "", ts, DataSourcePoll)
+	book.Update(Stream{Asks: []PriceAmount{{102, 1}}, Bids: []PriceAmount{{98, 1}}, Timestamp: now})
+	checkFresh(t, "depth stream", dh, "", now, DataSourceStream)
+
+	// 保存しておいたスナップショットから作った日毎のティッカー
+	ticks := newPublisher[[]Ticker](nil)
+	th := &TicksHandler{cp: "btc_jpy", pub: ticks}
+	yesterday := dayStart(now).AddDate(0, 0, -1)
+	tl := []Ticker{{Date: yesterday.AddDate(0, 0, -1).Format("20060102"), Close: 100}, {Date: yesterday.Format("20060102"), Close: 101}}
+	ticks.Publish(tl, ticksMeta(tl, DataSourceCache, now))
+	checkFresh(t, "ticks cache", th, "", dayStart(now), DataSourceCache)
+	ticks.Publish(tl, ticksMeta(tl, DataSourcePoll, now))
+	checkFresh(t, "ticks poll", th, "", dayStart(now), DataSourcePoll)
+}
+
+func TestTicksMeta(t *testing.T) {
+	now := time.Date(2023, 11, 20, 12, 0, 0, 0, jst)
+	for _, tc := range []struct {
+		name string
+		tl   []Ticker
+		want time.Time
+	}{
+		{"空", nil, time.Time{}},
+		// 最後の日が終わった時点
+		{"前日まで", []Ticker{{Date: "20231118"}, {Date: "20231119"}}, time.Date(2023, 11, 20, 0, 0, 0, 0, jst)},
+		// まだ終わっていなければnow
+		{"今日", []Ticker{{Date: "20231120"}}, now},
+		{"日付が不正", []Ticker{{Date: "2023-11-19"}}, time.Time{}},
+	} {
+		meta := ticksMeta(tc.tl, DataSourceCache, now)
+		if meta.AsOf.Equal(tc.want) == false || meta.Source != DataSourceCache {
+			t.Errorf("%s: got %+v, want %v", tc.name, meta, tc.want)
+		}
+	}
+}
+
+func TestBookMeta(t *testing.T) {
+	ts := time.Unix(1700010000, 0)
+	for _, tc := range []struct {
+		source string
+		want   string
+	}{
+		{BookSourceStream, DataSourceStream},
+		{BookSourceDepth, DataSourcePoll},
+	} {
+		meta := bookMeta(BookSnapshot{Timestamp: Unixtime(ts), Source: tc.source})
+		if meta.AsOf.Equal(ts) == false || meta.Source != tc.want {
+			t.Errorf("%s: got %+v, want %s", tc.source, meta, tc.want)
+		}
+	}
+}
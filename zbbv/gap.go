@@ -0,0 +1,248 @@
+package zbbv
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 欠損の理由
+const (
+	GapDial     = "dial"     // 接続に失敗した
+	GapRead     = "read"     // 接続中に切断された
+	GapShutdown = "shutdown" // 停止していた
+	GapCrash    = "crash"    // 停止の記録が無いまま再起動した（開始は最後に受信した時刻）
+)
+
+// Gap ストリームを受信できなかった期間
+// 始まった時と終わった時に同じStartで記録し、後の記録で上書きする
+type Gap struct {
+	Start  Unixtime  `json:"start"`
+	End    *Unixtime `json:"end,omitempty"` // 続いている場合は無し
+	Reason string    `json:"reason"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func (g Gap) overlaps(since, until time.Time) bool {
+	if until.IsZero() == false && time.Time(g.Start).Before(until) == false {
+		return false
+	}
+	return g.End == nil || since.IsZero() || time.Time(*g.End).After(since)
+}
+
+// mergeGaps 同じ開始時刻の記録は後のものを使って開始時刻順に並べる
+func mergeGaps(gl []Gap) []Gap {
+	m := make(map[int64]int, len(gl))
+	l := make([]Gap, 0, len(gl))
+	for _, g := range gl {
+		k := time.Time(g.Start).Unix()
+		if i, ok := m[k]; ok {
+			l[i] = g
+			continue
+		}
+		m[k] = len(l)
+		l = append(l, g)
+	}
+	sort.SliceStable(l, func(i, j int) bool { return time.Time(l[i].Start).Before(time.Time(l[j].Start)) })
+	return l
+}
+
+// gapFile 1件1行のJSONで追記する
+// gap/{通貨ペア}.ndjson
+//
+// 一覧はこのファイルから作る。ストリームのアーカイブにも同じ記録を印として追記するが、
+// 閉じた日のファイルは書き直さないので、日をまたいだ欠損は始まった日と終わった日に分かれる。
+type gapFile struct {
+	sync.Mutex
+	p string
+}
+
+func (gf *gapFile) append(g Gap) error {
+	gf.Lock()
+	defer gf.Unlock()
+	if err := createDir(gf.p); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(gf.p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	buf, _ := json.Marshal(g)
+	buf = append(buf, '\n')
+	if _, err := fp.Write(buf); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+func (gf *gapFile) read() ([]Gap, error) {
+	gf.Lock()
+	defer gf.Unlock()
+	fp, err := os.Open(gf.p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var gl []Gap
+	sc := bufio.NewScanner(fp)
+	for sc.Scan() {
+		var g Gap
+		if err := json.Unmarshal(sc.Bytes(), &g); err != nil {
+			// 書き込み中に止まった行は読み飛ばす
+			continue
+		}
+		gl = append(gl, g)
+	}
+	return mergeGaps(gl), sc.Err()
+}
+
+func createGapFilePath(root, key string) string {
+	return filepath.Join(root, "gap", key+".ndjson")
+}
+
+// gapTracker 通貨ペア毎の続いている欠損
+// 記録する度にアーカイブに入れる印を溜めておき、Appendを呼ぶgoroutineがtakeMarksで受け取る
+type gapTracker struct {
+	sync.Mutex
+	st    Store
+	key   string
+	cur   *Gap
+	beat  time.Time   // 保存した最後に受信した時刻
+	marks []StoreData // アーカイブに入れていない印
+}
+
+// newGapTracker 前回の記録から起動するまでの欠損を引き継ぐ
+// 最後の記録が終わっていなければそれを続ける
+// 停止すれば必ず終わっていない欠損を記録するので、終わっていれば異常終了している。
+// その場合は最後に受信した時刻か最後の欠損が終わった時刻の新しい方から欠損を始める
+func newGapTracker(st Store, key string) *gapTracker {
+	gt := &gapTracker{st: st, key: key}
+	gl, err := st.Gaps()
+	if err != nil {
+		log.Warnw("欠損の記録の読み込みに失敗しました。", "error", err, "key", key)
+	}
+	if len(gl) > 0 && gl[len(gl)-1].End == nil {
+		g := gl[len(gl)-1]
+		gt.cur = &g
+		return gt
+	}
+	gt.beat, err = st.LoadHeartbeat()
+	if err != nil {
+		log.Warnw("最後に受信した時刻の読み込みに失敗しました。", "error", err, "key", key)
+	}
+	start := gt.beat
+	if len(gl) > 0 && time.Time(*gl[len(gl)-1].End).After(start) {
+		start = time.Time(*gl[len(gl)-1].End)
+	}
+	// 初めて起動した
+	if start.IsZero() {
+		return gt
+	}
+	log.Warnw("停止の記録がありません。異常終了した間を欠損として記録します。", "key", key, "start", start)
+	gt.open(start, GapCrash, nil)
+	return gt
+}
+
+// heartbeat 最後に受信した時刻を保存する
+// 異常終了した時はこの時刻から欠損を始めるので、同期の間隔で呼ぶ
+func (gt *gapTracker) heartbeat(last time.Time) {
+	gt.Lock()
+	defer gt.Unlock()
+	if last.After(gt.beat) == false {
+		return
+	}
+	if err := gt.st.SaveHeartbeat(last); err != nil {
+		log.Warnw("最後に受信した時刻の保存に失敗しました。", "error", err, "key", gt.key)
+		return
+	}
+	gt.beat = last
+}
+
+// open 欠損が続いていなければ始める
+func (gt *gapTracker) open(start time.Time, reason string, err error) {
+	gt.Lock()
+	defer gt.Unlock()
+	if gt.cur != nil {
+		return
+	}
+	g := Gap{Start: Unixtime(start), Reason: reason}
+	if err != nil {
+		g.Error = err.Error()
+	}
+	gt.cur = &g
+	// 異常終了の欠損は開始が前の日のこともあるので、印は記録した時刻で入れる
+	gt.save(g, time.Now())
+}
+
+// close 続いている欠損をendで終える
+func (gt *gapTracker) close(end time.Time) {
+	gt.Lock()
+	defer gt.Unlock()
+	if gt.cur == nil {
+		return
+	}
+	g := *gt.cur
+	e := Unixtime(end)
+	g.End = &e
+	gt.cur = nil
+	gt.save(g, end)
+	log.Infow("ストリームの欠損が終わりました。", "key", gt.key, "reason", g.Reason, "start", time.Time(g.Start), "end", end)
+}
+
+// save 欠損を記録して、atの時刻の印を溜める
+// ロックを取った状態で呼ぶ
+func (gt *gapTracker) save(g Gap, at time.Time) {
+	if err := gt.st.AppendGap(g); err != nil {
+		log.Warnw("欠損の記録に失敗しました。", "error", err, "key", gt.key)
+	}
+	gt.marks = append(gt.marks, StoreData{Gap: &g, Timestamp: Unixtime(at)})
+}
+
+// takeMarks 溜めた印を記録した順に返す
+func (gt *gapTracker) takeMarks() []StoreData {
+	gt.Lock()
+	defer gt.Unlock()
+	l := gt.marks
+	gt.marks = nil
+	return l
+}
+
+// shutdown 停止している間の欠損を始める
+// 続いている欠損は停止した時刻で終える
+func (gt *gapTracker) shutdown(now time.Time) {
+	gt.close(now)
+	gt.open(now, GapShutdown, nil)
+}
+
+// Gaps [since, until)と重なる欠損を開始時刻順に返す
+// 続いている欠損はEndが無い
+func (gt *gapTracker) Gaps(since, until time.Time) ([]Gap, error) {
+	gl, err := gt.st.Gaps()
+	if err != nil {
+		return nil, err
+	}
+	gt.Lock()
+	if gt.cur != nil {
+		gl = mergeGaps(append(gl, *gt.cur))
+	}
+	gt.Unlock()
+	l := make([]Gap, 0, len(gl))
+	for _, g := range gl {
+		if g.overlaps(since, until) {
+			l = append(l, g)
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,155 @@
+package zbbv
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func closedGap(start, end time.Time, reason string) Gap {
+	e := Unixtime(end)
+	return Gap{Start: Unixtime(start), End: &e, Reason: reason}
+}
+
+func TestNewGapTrackerCrash(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	for _, it := range []struct {
+		name   string
+		gaps   []Gap
+		beat   time.Time
+		start  time.Time
+		reason string
+	}{
+		{"初めて起動した", nil, time.Time{}, time.Time{}, ""},
+		{"停止していた", []Gap{{Start: Unixtime(t0), Reason: GapShutdown}}, t0.Add(-time.Minute), t0, GapShutdown},
+		{"欠損の記録が無いまま異常終了した", nil, t0, t0, GapCrash},
+		{"欠損が終わった後に異常終了した", []Gap{closedGap(t0, t0.Add(time.Minute), GapRead)}, t0.Add(time.Hour), t0.Add(time.Hour), GapCrash},
+		// 欠損が終わってから最初の保存までに異常終了した
+		{"受信した時刻が古い", []Gap{closedGap(t0, t0.Add(time.Minute), GapDial)}, t0.Add(-time.Hour), t0.Add(time.Minute), GapCrash},
+		{"受信した時刻が無い", []Gap{closedGap(t0, t0.Add(time.Minute), GapShutdown)}, time.Time{}, t0.Add(time.Minute), GapCrash},
+	} {
+		st, err := newFileStore(NewConfig(), t.TempDir(), "btc_jpy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, g := range it.gaps {
+			if err := st.AppendGap(g); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if it.beat.IsZero() == false {
+			if err := st.SaveHeartbeat(it.beat); err != nil {
+				t.Fatal(err)
+			}
+		}
+		gt := newGapTracker(st, "btc_jpy")
+		if it.reason == "" {
+			if gt.cur != nil {
+				t.Errorf("%s: cur = %+v", it.name, *gt.cur)
+			}
+			continue
+		}
+		if gt.cur == nil || time.Time(gt.cur.Start).Equal(it.start) == false || gt.cur.Reason != it.reason {
+			t.Errorf("%s: cur = %+v, want start:%v reason:%s", it.name, gt.cur, it.start, it.reason)
+			continue
+		}
+		// 記録しておき、最初のメッセージで終える
+		gt.close(t0.Add(2 * time.Hour))
+		gl, err := st.Gaps()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last := gl[len(gl)-1]; time.Time(last.Start).Equal(it.start) == false || last.End == nil || last.Reason != it.reason {
+			t.Errorf("%s: gaps = %+v", it.name, gl)
+		}
+		st.Close()
+	}
+}
+
+func TestGapTrackerHeartbeat(t *testing.T) {
+	st, err := newFileStore(NewConfig(), t.TempDir(), "btc_jpy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	t0 := time.Unix(1700000000, 0)
+	gt := newGapTracker(st, "btc_jpy")
+	// まだ受信していない
+	gt.heartbeat(time.Time{})
+	if beat, err := st.LoadHeartbeat(); err != nil || beat.IsZero() == false {
+		t.Errorf("beat = %v %v", beat, err)
+	}
+	gt.heartbeat(t0)
+	// 受信していない間は古い時刻で上書きしない
+	gt.heartbeat(t0.Add(-time.Second))
+	if beat, err := st.LoadHeartbeat(); err != nil || beat.Equal(t0) == false {
+		t.Errorf("beat = %v %v", beat, err)
+	}
+	// 異常終了して起動し直すと保存した時刻から欠損を始める
+	gt = newGapTracker(st, "btc_jpy")
+	if gt.cur == nil || time.Time(gt.cur.Start).Equal(t0) == false || gt.cur.Reason != GapCrash {
+		t.Errorf("cur = %+v", gt.cur)
+	}
+	// 停止してから起動し直すと停止の欠損を続ける
+	gt.shutdown(t0.Add(time.Minute))
+	gt = newGapTracker(st, "btc_jpy")
+	if gt.cur == nil || time.Time(gt.cur.Start).Equal(t0.Add(time.Minute)) == false || gt.cur.Reason != GapShutdown {
+		t.Errorf("cur = %+v", gt.cur)
+	}
+}
+
+func TestGapMarksArchive(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	start := now.Add(-time.Minute)
+	for _, format := range StreamFormats() {
+		conf := NewConfig()
+		conf.StreamFormat = format
+		st, err := newFileStore(conf, t.TempDir(), "btc_jpy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		gt := newGapTracker(st, "btc_jpy")
+		gt.open(start, GapRead, errors.New(`read "tcp": reset`))
+		// 続いている欠損は開き直さない
+		gt.open(now, GapDial, nil)
+		gt.close(now)
+		marks := gt.takeMarks()
+		if len(marks) != 2 || len(gt.takeMarks()) != 0 {
+			t.Fatalf("%s: marks = %+v", format, marks)
+		}
+		for _, sd := range append(marks, tradeData(now, 1)) {
+			if err := st.Append(sd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := st.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var gl []Gap
+		n := 0
+		err = st.Range(start.Add(-24*time.Hour), now.Add(24*time.Hour), func(sd StoreData) error {
+			n++
+			if sd.Gap != nil {
+				gl = append(gl, *sd.Gap)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 || len(gl) != 2 {
+			t.Fatalf("%s: 件数:%d 印:%+v", format, n, gl)
+		}
+		open, closed := gl[0], gl[1]
+		if time.Time(open.Start).Equal(start) == false || open.End != nil || open.Reason != GapRead || open.Error != `read "tcp": reset` {
+			t.Errorf("%s: 始まりの印 = %+v", format, open)
+		}
+		if time.Time(closed.Start).Equal(start) == false || closed.End == nil || time.Time(*closed.End).Equal(now) == false || closed.Reason != GapRead {
+			t.Errorf("%s: 終わりの印 = %+v", format, closed)
+		}
+		// 一覧と同じ記録
+		if fl, err := st.Gaps(); err != nil || len(fl) != 1 || fl[0].End == nil || time.Time(fl[0].Start).Equal(start) == false {
+			t.Errorf("%s: gaps = %+v %v", format, fl, err)
+		}
+	}
+}
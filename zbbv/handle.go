@@ -1,155 +1,652 @@
 package zbbv
 
 import (
-	"context"
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
+const PairAdminPath = "/api/unko.in/1/admin/pairs"
+
 type OldStreamHandler struct {
-	cp string
-	ch <-chan StoreDataArray
+	cp  string
+	pub *publisher[StoreDataArray]
 }
 type LastPriceHandler struct {
-	cp string
-	ch <-chan LastPrice
+	cp  string
+	pub *publisher[LastPrice]
 }
 type GetMonitoringHandler struct {
-	ch <-chan ResultMonitor
+	pub *publisher[ResultMonitor]
 }
 type DepthHandler struct {
-	cp string
-	ch <-chan []byte
+	cp   string
+	book *OrderBook
 }
 type TicksHandler struct {
+	cp  string
+	pub *publisher[[]Ticker]
+}
+type StreamRelayHandler struct {
+	cp  string
+	hub *StreamHub
+}
+type EventStreamHandler struct {
+	cp        string
+	hub       *StreamHub
+	oldstream *publisher[StoreDataArray]
+	lastprice *publisher[LastPrice]
+}
+type HistoryHandler struct {
+	cp   string
+	root string
+	st   Store
+}
+type BookHandler struct {
+	cp   string
+	root string
+}
+type CandlesHandler struct {
 	cp string
-	ch <-chan []Ticker
+	cs *CandleSet
+}
+type GapsHandler struct {
+	cp   string
+	gaps *gapTracker
+}
+type HealthzHandler struct{}
+type ReadyzHandler struct {
+	reg *PairRegistry
+}
+type DiskUsageHandler struct {
+	sync.Mutex
+	conf *Config
+	rep  DiskUsageReport
+	at   time.Time
+}
+type PairAdminHandler struct {
+	reg   *PairRegistry
+	token string
 }
 
-func (h *OldStreamHandler) getStoreData(ctx context.Context) (sda StoreDataArray, err error) {
-	lctx, lcancel := context.WithTimeout(ctx, time.Second*3)
-	defer lcancel()
-	select {
-	case <-lctx.Done():
-		err = errors.New("timeout")
-	case sda = <-h.ch:
+// ServeHTTP メモリ上のStoreDataArrayを返す
+// since・until（UNIX時間かRFC3339）で範囲を、limitで件数（新しい方から）を、
+// fields（ask,bid,trade,gapのカンマ区切り）で項目を絞り込める
+// 絞り込まない場合は公開した時に一度だけ作ったJSONを返す
+func (h *OldStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseStoreDataQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s := h.pub.Load()
+	if s == nil || q == (StoreDataQuery{}) {
+		writeSnapshot(w, r, s)
+		return
 	}
-	return
+	var buf bytes.Buffer
+	storeDataArrayToJSON(&buf, q.apply(s.data))
+	writeFresh(w, r, s.meta, buf.Bytes())
 }
 
-func (h *OldStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	sda, err := h.getStoreData(r.Context())
-	if err == nil {
-		defer sda.Close()
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		storeDataArrayToJSON(w, sda)
-	} else {
-		http.NotFound(w, r)
+func (h *LastPriceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeSnapshot(w, r, h.pub.Load())
+}
+
+// ServeHTTP 最新の板を返す
+// ストリームと板情報APIのどちらからもまだ受け取っていなければ空のオブジェクト
+func (h *DepthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := h.book.Published()
+	if s == nil {
+		writeFresh(w, r, DataMeta{}, []byte("{}\n"))
+		return
 	}
+	writeSnapshot(w, r, s)
+}
+
+func (h *TicksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeSnapshot(w, r, h.pub.Load())
 }
 
-func (h *LastPriceHandler) getLastPrice(ctx context.Context) (LastPrice, error) {
-	var res LastPrice
-	lctx, lcancel := context.WithTimeout(ctx, time.Second*3)
-	defer lcancel()
-	select {
-	case <-lctx.Done():
-		return res, errors.New("timeout")
-	case res = <-h.ch:
-		log.Debugw("受信！ getLastPrice", "key", h.cp, "data", res)
+// ServeHTTP 1分毎に集計した結果を返す
+func (h *GetMonitoringHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeSnapshot(w, r, h.pub.Load())
+}
+
+var relayUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 16 * 1024,
+}
+
+const (
+	relayWriteWait  = 10 * time.Second
+	relayPingPeriod = 30 * time.Second
+)
+
+// ServeHTTP streamStoreProcが生成したStoreDataをWebSocketで中継する
+func (h *StreamRelayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	con, err := relayUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade内でエラー応答済み
+		log.Infow("WebSocketの開始に失敗しました。", "error", err, "key", h.cp)
+		return
+	}
+	defer con.Close()
+	sub := h.hub.Subscribe()
+	defer h.hub.Unsubscribe(sub)
+
+	// クライアントからの切断を検知するために読み捨てる
+	readerr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := con.NextReader(); err != nil {
+				readerr <- err
+				return
+			}
+		}
+	}()
+	tc := time.NewTicker(relayPingPeriod)
+	defer tc.Stop()
+	buf := make([]byte, 0, 512)
+	for {
+		select {
+		case ev := <-sub.C():
+			buf = storeDataToJSON(buf[:0], ev.Data)
+			con.SetWriteDeadline(time.Now().Add(relayWriteWait))
+			if err := con.WriteMessage(websocket.TextMessage, buf); err != nil {
+				return
+			}
+		case <-tc.C:
+			if err := con.WriteControl(websocket.PingMessage, nil, time.Now().Add(relayWriteWait)); err != nil {
+				return
+			}
+		case <-sub.Done():
+			code, text := websocket.CloseGoingAway, "shutdown"
+			if sub.Evicted() {
+				// 受信が遅いクライアントは切り離す
+				code, text = websocket.ClosePolicyViolation, "slow consumer"
+				log.Infow("受信が遅いクライアントを切断しました。", "key", h.cp, "addr", r.RemoteAddr)
+			}
+			con.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(relayWriteWait))
+			return
+		case <-readerr:
+			return
+		}
 	}
-	return res, nil
 }
 
-func (h *LastPriceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	res, err := h.getLastPrice(r.Context())
-	if err == nil {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		err := json.NewEncoder(w).Encode(res)
-		if err != nil {
-			log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
+// eventStreamHeartbeat 何も送らない間に送るコメント行の間隔
+var eventStreamHeartbeat = 15 * time.Second
+
+// ServeHTTP 最終取引価格の変化と新しい約定をServer-Sent Eventsで送信する
+// イベントIDは約定のtidで、Last-Event-IDの約定より後に受信した約定はメモリ上のStoreDataArrayから再送する
+// 約定は受信した順に送るので、tidが小さい約定が後から届くこともある
+func (h *EventStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if ok == false {
+		http.Error(w, "ストリーミングに対応していません。", http.StatusInternalServerError)
+		return
+	}
+	var lastid uint64
+	resume := false
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		lastid, resume = parseEventID(v)
+	} else if v := r.URL.Query().Get("last_event_id"); v != "" {
+		lastid, resume = parseEventID(v)
+	}
+	// 取りこぼさないように先に購読しておく
+	sub := h.hub.Subscribe()
+	defer h.hub.Unsubscribe(sub)
+
+	ctx := r.Context()
+	var lp LastPrice
+	if s := h.lastprice.Load(); s != nil {
+		lp = s.data
+	}
+	var sda StoreDataArray
+	if s := h.oldstream.Load(); resume && s != nil {
+		sda = resumeTrades(s.data, lastid)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	buf := make([]byte, 0, 512)
+	buf = append(buf, "retry: 3000\n\n"...)
+	// 再送した約定は購読した分と重なることがある
+	var resent map[uint64]struct{}
+	if len(sda) > 0 {
+		resent = make(map[uint64]struct{}, len(sda))
+	}
+	for _, sd := range sda {
+		resent[sd.Trade.Tid] = struct{}{}
+		lastid = sd.Trade.Tid
+		buf = appendTradeEvent(buf, sd.Trade)
+	}
+	if lp.Price != 0 {
+		// まだ何も受信していない場合は送らない
+		buf = appendLastPriceEvent(buf, lastid, lp)
+	}
+	if _, err := w.Write(buf); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	tc := time.NewTicker(eventStreamHeartbeat)
+	defer tc.Stop()
+	for {
+		buf = buf[:0]
+		select {
+		case ev := <-sub.C():
+			if t := ev.Data.Trade; t != nil {
+				if _, ok := resent[t.Tid]; ok == false {
+					// 再送した後に受信した約定が届いたら、もう重ならない
+					resent = nil
+					lastid = t.Tid
+					buf = appendTradeEvent(buf, t)
+				}
+			}
+			if ev.LastPrice != lp {
+				lp = ev.LastPrice
+				buf = appendLastPriceEvent(buf, lastid, lp)
+			}
+			if len(buf) == 0 {
+				continue
+			}
+		case <-tc.C:
+			buf = append(buf, ": heartbeat\n\n"...)
+		case <-sub.Done():
+			return
+		case <-ctx.Done():
+			return
 		}
-	} else {
-		http.Error(w, "データ取得に失敗しました。", http.StatusInternalServerError)
+		if _, err := w.Write(buf); err != nil {
+			return
+		}
+		flusher.Flush()
 	}
 }
 
-func (h *DepthHandler) getDepth(ctx context.Context) ([]byte, error) {
-	var data []byte
-	c, cancel := context.WithTimeout(ctx, time.Second*3)
-	defer cancel()
-	select {
-	case <-c.Done():
-		return nil, errors.New("timeout")
-	case data = <-h.ch:
-		log.Debugw("受信！ getDepth", "key", h.cp)
+// resumeTrades lastidの約定より後に受信した約定を返す
+// 約定はtid順に届くとは限らないので、tidの大小ではなく受信した順で決める
+// lastidの約定がもうメモリに無い場合は、lastidより大きいtidの約定を返す
+func resumeTrades(sda StoreDataArray, lastid uint64) StoreDataArray {
+	start := -1
+	for i := len(sda) - 1; i >= 0; i-- {
+		if sda[i].Trade != nil && sda[i].Trade.Tid == lastid {
+			start = i + 1
+			break
+		}
+	}
+	var tl StoreDataArray
+	for i, sd := range sda {
+		if sd.Trade == nil {
+			continue
+		}
+		if (start >= 0 && i >= start) || (start < 0 && sd.Trade.Tid > lastid) {
+			tl = append(tl, sd)
+		}
 	}
-	return data, nil
+	return tl
 }
 
-func (h *DepthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	data, err := h.getDepth(r.Context())
-	if err == nil {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		_, err := w.Write(data)
-		if err != nil {
-			log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
+func parseEventID(v string) (uint64, bool) {
+	id, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+	return id, err == nil
+}
+
+func appendTradeEvent(buf []byte, t *Trade) []byte {
+	buf = append(buf, "event: trade\nid: "...)
+	buf = strconv.AppendUint(buf, t.Tid, 10)
+	buf = append(buf, "\ndata: "...)
+	data, _ := json.Marshal(t)
+	buf = append(buf, data...)
+	return append(buf, "\n\n"...)
+}
+
+func appendLastPriceEvent(buf []byte, id uint64, lp LastPrice) []byte {
+	buf = append(buf, "event: lastprice\n"...)
+	if id > 0 {
+		buf = append(buf, "id: "...)
+		buf = strconv.AppendUint(buf, id, 10)
+		buf = append(buf, '\n')
+	}
+	buf = append(buf, "data: "...)
+	data, _ := json.Marshal(lp)
+	buf = append(buf, data...)
+	return append(buf, "\n\n"...)
+}
+
+const (
+	historyLimitMax   = 10000
+	historyNextCursor = "X-Next-Cursor"
+)
+
+// ServeHTTP 日毎のファイルから[since, until)の範囲のStoreDataを返す
+// limitは古い方からの件数で、続きがある場合はX-Next-Cursorヘッダの値をcursorに指定して再度要求する
+// （oldstreamのlimitは新しい方からの件数。履歴は前から順に辿るので向きが逆）
+// 範囲が日本時間の0時区切りで絞り込みが無い場合は、圧縮済みのアーカイブを1日分ずつそのまま返す
+func (h *HistoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseStoreDataQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Since.IsZero() {
+		http.Error(w, "sinceを指定してください。", http.StatusBadRequest)
+		return
+	}
+	if q.Until.IsZero() {
+		q.Until = time.Now()
+	}
+	if q.Limit == 0 || q.Limit > historyLimitMax {
+		q.Limit = historyLimitMax
+	}
+	cur, err := parseHistoryCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	whole := isDayStart(q.Since) && isDayStart(q.Until) && q.Fields == false && r.URL.Query().Get("limit") == ""
+	if whole && cur.ts.IsZero() && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		// ファイル名の日付は日本時間
+		day := dayStart(q.Since)
+		if cur.day.IsZero() == false {
+			day = cur.day
+		}
+		if h.servePassthrough(w, r, day, q.Until) {
+			return
+		}
+		// アーカイブが無い日（当日など）以降は通常の読み込みで返す
+		q.Since = day
+	} else if cur.day.IsZero() == false {
+		q.Since = cur.day
+	}
+	var last time.Time
+	skip, same := 0, 0
+	if cur.ts.IsZero() == false {
+		q.Since = cur.ts
+		last, skip, same = cur.ts, cur.skip, cur.skip
+	}
+
+	sda := make(StoreDataArray, 0, 1024)
+	more := false
+	err = h.st.Range(q.Since, q.Until, func(sd StoreData) error {
+		// cursorのskipは返した件数なので、項目で絞り込んだ後に数える
+		if q.Fields {
+			l := q.filter(StoreDataArray{sd})
+			if len(l) == 0 {
+				return nil
+			}
+			sd = l[0]
+		}
+		ts := time.Time(sd.Timestamp)
+		if skip > 0 && ts.Equal(cur.ts) {
+			skip--
+			return nil
+		}
+		if len(sda) >= q.Limit {
+			more = true
+			return errStopRead
 		}
-	} else {
+		if ts.Equal(last) == false {
+			last = ts
+			same = 0
+		}
+		same++
+		sda = append(sda, sd)
+		return nil
+	})
+	if err != nil {
+		log.Warnw("履歴の読み込みに失敗しました。", "error", err, "key", h.cp)
 		http.Error(w, "データ取得に失敗しました。", http.StatusInternalServerError)
+		return
+	}
+	if more {
+		w.Header().Set(historyNextCursor, historyCursor{ts: last, skip: same}.String())
 	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	storeDataArrayToJSON(w, sda)
 }
 
-func (h *TicksHandler) getTick(ctx context.Context) ([]Ticker, error) {
-	var tl []Ticker
-	c, cancel := context.WithTimeout(ctx, time.Second*3)
-	defer cancel()
-	select {
-	case <-c.Done():
-		return nil, errors.New("timeout")
-	case tl = <-h.ch:
-		log.Debugw("受信！ getTick", "key", h.cp)
+// servePassthrough 圧縮済みのアーカイブを1日分そのまま返す
+// Appではgzipハンドラを通るが、Content-Encodingを設定した応答は圧縮しないので二重に圧縮されない
+// gzipハンドラを入れ替える場合はこの前提を確認すること
+func (h *HistoryHandler) servePassthrough(w http.ResponseWriter, r *http.Request, day, until time.Time) bool {
+	p := createStoreFilePath(h.root, day, h.cp, "stream") + ".gz"
+	fp, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+	next := day.AddDate(0, 0, 1)
+	if next.Before(until) {
+		w.Header().Set(historyNextCursor, historyCursor{day: next}.String())
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	if _, err := io.Copy(w, fp); err != nil {
+		log.Warnw("アーカイブの送信に失敗しました。", "error", err, "path", p)
 	}
-	return tl, nil
+	return true
 }
 
-func (h *TicksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	tl, err := h.getTick(r.Context())
-	if err == nil {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		err := json.NewEncoder(w).Encode(tl)
+// historyCursor 履歴の続きの位置
+// tsの時刻の先頭skip件は返却済み、もしくはday（日本時間の0時）から
+type historyCursor struct {
+	ts   time.Time
+	skip int
+	day  time.Time
+}
+
+func (c historyCursor) String() string {
+	if c.day.IsZero() == false {
+		return "d" + c.day.In(jst).Format("20060102")
+	}
+	return strconv.FormatInt(c.ts.Unix(), 10) + "." + strconv.Itoa(c.skip)
+}
+
+func parseHistoryCursor(s string) (historyCursor, error) {
+	var c historyCursor
+	if s == "" {
+		return c, nil
+	}
+	if strings.HasPrefix(s, "d") {
+		day, err := time.ParseInLocation("20060102", s[1:], jst)
 		if err != nil {
-			log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
+			return c, errors.New("cursorが不正です。")
 		}
-	} else {
-		http.Error(w, "データ取得に失敗しました。", http.StatusInternalServerError)
+		c.day = day
+		return c, nil
 	}
+	l := strings.Split(s, ".")
+	if len(l) != 2 {
+		return c, errors.New("cursorが不正です。")
+	}
+	ts, err := strconv.ParseInt(l[0], 10, 64)
+	if err != nil {
+		return c, errors.New("cursorが不正です。")
+	}
+	skip, err := strconv.Atoi(l[1])
+	if err != nil || skip < 0 {
+		return c, errors.New("cursorが不正です。")
+	}
+	c.ts = time.Unix(ts, 0)
+	c.skip = skip
+	return c, nil
 }
 
-func (h *GetMonitoringHandler) getResultMonitor(ctx context.Context) (ResultMonitor, error) {
-	var res ResultMonitor
-	lctx, lcancel := context.WithTimeout(ctx, time.Second*3)
-	defer lcancel()
-	select {
-	case <-lctx.Done():
-		return res, errors.New("timeout")
-	case res = <-h.ch:
-		log.Debugw("受信！ getResultMonitor", "data", res)
+// ServeHTTP 約定から作ったローソク足を返す
+// interval（1m,5m,15m,1h,4h,1d）は必須、since・until・limitで絞り込める
+func (h *CandlesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseStoreDataQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cl, err := h.cs.Candles(r.URL.Query().Get("interval"), q.Since, q.Until, q.Limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(cl)
+	if err != nil {
+		log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
 	}
-	return res, nil
 }
 
-func (h *GetMonitoringHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	res, err := h.getResultMonitor(r.Context())
-	if err == nil {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		err := json.NewEncoder(w).Encode(res)
+// ServeHTTP atの時点の板をアーカイブから再現する
+// atを省略した場合は現在
+func (h *BookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	at := time.Now()
+	if v := r.URL.Query().Get("at"); v != "" {
+		t, err := ParseTime(v)
 		if err != nil {
-			log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
+			http.Error(w, "atが不正です。"+err.Error(), http.StatusBadRequest)
+			return
 		}
-	} else {
+		at = t
+	}
+	bs, err := reconstructBook(h.root, h.cp, at)
+	if err == ErrBookNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Warnw("板の再現に失敗しました。", "error", err, "key", h.cp)
+		http.Error(w, "データ取得に失敗しました。", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(bs)
+	if err != nil {
+		log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
+	}
+}
+
+// ServeHTTP ストリームを受信できなかった期間を返す
+// since・untilで絞り込める
+func (h *GapsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseStoreDataQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gl, err := h.gaps.Gaps(q.Since, q.Until)
+	if err != nil {
+		log.Warnw("欠損の記録の読み込みに失敗しました。", "error", err, "key", h.cp)
 		http.Error(w, "データ取得に失敗しました。", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(gl)
+	if err != nil {
+		log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
+	}
+}
+
+// ServeHTTP データの保存先とアクセスログの使用量を返す
+func (h *DiskUsageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err := json.NewEncoder(w).Encode(h.report())
+	if err != nil {
+		log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
+	}
+}
+
+// ServeHTTP プロセスが動いていれば200を返す
+func (h *HealthzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, "ok\n")
+}
+
+// ServeHTTP 通貨ペア毎の上流との接続状態と保存先の空き容量を返す
+// 準備ができていなければ503
+func (h *ReadyzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rd := h.reg.Readiness(time.Now())
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if rd.Ready == false {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(rd)
+	if err != nil {
+		log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
+	}
+}
+
+func (h *PairAdminHandler) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, prefix) == false {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(h.token)) == 1
+}
+
+// ServeHTTP 通貨ペアの一覧・起動・停止
+// GET    /api/unko.in/1/admin/pairs
+// PUT    /api/unko.in/1/admin/pairs/{取引所}/{通貨ペア}
+// DELETE /api/unko.in/1/admin/pairs/{取引所}/{通貨ペア}
+func (h *PairAdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.authorized(r) == false {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "認証に失敗しました。", http.StatusUnauthorized)
+		return
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, PairAdminPath), "/")
+	var id PairID
+	if rest != "" {
+		l := strings.Split(rest, "/")
+		if len(l) != 2 || l[0] == "" || l[1] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		id = PairID{Exchange: l[0], Pair: l[1]}
+	}
+	var err error
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+	case rest != "" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		err = h.reg.Start(id)
+	case rest != "" && r.Method == http.MethodDelete:
+		err = h.reg.Stop(id)
+	default:
+		http.Error(w, "メソッドが不正です。", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrPairExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, ErrPairNotFound), errors.Is(err, ErrExchangeNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(struct {
+		Pairs []PairID `json:"pairs"`
+	}{Pairs: h.reg.Keys()})
+	if err != nil {
+		log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
 	}
 }
@@ -0,0 +1,499 @@
+package zbbv
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeArchive 1日分のアーカイブを作る
+func writeArchive(t *testing.T, root, key string, day time.Time, sda StoreDataArray) []byte {
+	t.Helper()
+	var raw bytes.Buffer
+	storeDataArrayToJSON(&raw, sda)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(raw.Bytes())
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p := createStoreFilePath(root, day, key, "stream") + ".gz"
+	if err := createDir(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tradeData(ts time.Time, tid uint64) StoreData {
+	return StoreData{
+		Trade:     &Trade{CurrentyPair: "btc_jpy", TradeType: "bid", Price: 100, Tid: tid, Amount: 1, Date: uint64(ts.Unix())},
+		Timestamp: Unixtime(ts),
+	}
+}
+
+// newHistoryTestHandler 2日分のアーカイブを持つHistoryHandler
+// 1日目は同じ時刻の約定が3件と2件、2日目は1件
+func newHistoryTestHandler(t *testing.T) (h *HistoryHandler, day time.Time, files [][]byte) {
+	t.Helper()
+	root := t.TempDir()
+	key := "btc_jpy"
+	day = time.Date(2023, 11, 15, 0, 0, 0, 0, jst)
+	t1 := day.Add(10 * time.Hour)
+	t2 := t1.Add(time.Minute)
+	t3 := day.AddDate(0, 0, 1).Add(9 * time.Hour)
+	files = append(files,
+		writeArchive(t, root, key, day, StoreDataArray{
+			tradeData(t1, 1), tradeData(t1, 2), tradeData(t1, 3),
+			tradeData(t2, 4), tradeData(t2, 5),
+		}),
+		writeArchive(t, root, key, day.AddDate(0, 0, 1), StoreDataArray{
+			tradeData(t3, 6),
+		}),
+	)
+	conf := NewConfig()
+	st, err := newFileStore(conf, root, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return &HistoryHandler{cp: key, root: root, st: st}, day, files
+}
+
+func getHistory(h http.Handler, v url.Values, gz bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/api/zaif/1/history/btc_jpy?"+v.Encode(), nil)
+	if gz {
+		r.Header.Set("Accept-Encoding", "gzip")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func decodeTids(t *testing.T, body []byte) []uint64 {
+	t.Helper()
+	var sda StoreDataArray
+	if err := json.Unmarshal(body, &sda); err != nil {
+		t.Fatalf("%v\n%s", err, body)
+	}
+	l := make([]uint64, 0, len(sda))
+	for _, sd := range sda {
+		l = append(l, sd.Trade.Tid)
+	}
+	return l
+}
+
+func TestHistoryCursorSameTimestamp(t *testing.T) {
+	h, day, _ := newHistoryTestHandler(t)
+	for _, limit := range []int{1, 2, 3, 4, 10} {
+		v := url.Values{}
+		v.Set("since", strconv.FormatInt(day.Unix(), 10))
+		v.Set("until", strconv.FormatInt(day.AddDate(0, 0, 2).Unix(), 10))
+		v.Set("limit", strconv.Itoa(limit))
+		var got []uint64
+		for page := 0; ; page++ {
+			if page > 10 {
+				t.Fatalf("limit:%d 終わりません。got:%v", limit, got)
+			}
+			w := getHistory(h, v, true)
+			if w.Code != http.StatusOK {
+				t.Fatalf("limit:%d status:%d %s", limit, w.Code, w.Body)
+			}
+			// limitがあればアーカイブをそのまま返さない
+			if ce := w.Header().Get("Content-Encoding"); ce != "" {
+				t.Fatalf("limit:%d Content-Encoding:%q", limit, ce)
+			}
+			tl := decodeTids(t, w.Body.Bytes())
+			if len(tl) > limit {
+				t.Errorf("limit:%d page:%d len:%d", limit, page, len(tl))
+			}
+			got = append(got, tl...)
+			cur := w.Header().Get(historyNextCursor)
+			if cur == "" {
+				break
+			}
+			v.Set("cursor", cur)
+		}
+		want := []uint64{1, 2, 3, 4, 5, 6}
+		if len(got) != len(want) {
+			t.Errorf("limit:%d got:%v want:%v", limit, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("limit:%d got:%v want:%v", limit, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestHistoryCursorSkip(t *testing.T) {
+	h, day, _ := newHistoryTestHandler(t)
+	v := url.Values{}
+	v.Set("since", strconv.FormatInt(day.Unix(), 10))
+	v.Set("until", strconv.FormatInt(day.AddDate(0, 0, 2).Unix(), 10))
+	v.Set("limit", "2")
+	t1 := day.Add(10 * time.Hour)
+	for _, it := range []struct {
+		cursor string
+		tids   []uint64
+		next   string
+	}{
+		// 同じ時刻の3件の途中から
+		{historyCursor{ts: t1, skip: 1}.String(), []uint64{2, 3}, historyCursor{ts: t1, skip: 3}.String()},
+		{historyCursor{ts: t1, skip: 2}.String(), []uint64{3, 4}, historyCursor{ts: t1.Add(time.Minute), skip: 1}.String()},
+		// 同じ時刻の件数を超えていれば次の時刻から
+		{historyCursor{ts: t1, skip: 5}.String(), []uint64{4, 5}, historyCursor{ts: t1.Add(time.Minute), skip: 2}.String()},
+	} {
+		v.Set("cursor", it.cursor)
+		w := getHistory(h, v, false)
+		got := decodeTids(t, w.Body.Bytes())
+		if len(got) != len(it.tids) || got[0] != it.tids[0] || got[1] != it.tids[1] {
+			t.Errorf("cursor:%s got:%v want:%v", it.cursor, got, it.tids)
+		}
+		if next := w.Header().Get(historyNextCursor); next != it.next {
+			t.Errorf("cursor:%s next:%q want:%q", it.cursor, next, it.next)
+		}
+	}
+}
+
+func TestHistoryPassthrough(t *testing.T) {
+	h, day, files := newHistoryTestHandler(t)
+	v := url.Values{}
+	v.Set("since", strconv.FormatInt(day.Unix(), 10))
+	v.Set("until", strconv.FormatInt(day.AddDate(0, 0, 2).Unix(), 10))
+
+	// 1日目はアーカイブをそのまま返して、続きは日付のcursor
+	w := getHistory(h, v, true)
+	if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Content-Encoding:%q", ce)
+	}
+	if bytes.Equal(w.Body.Bytes(), files[0]) == false {
+		t.Error("1日目のアーカイブと一致しません")
+	}
+	next := w.Header().Get(historyNextCursor)
+	if want := "d20231116"; next != want {
+		t.Fatalf("next:%q want:%q", next, want)
+	}
+
+	// 2日目で終わり
+	v.Set("cursor", next)
+	w = getHistory(h, v, true)
+	if bytes.Equal(w.Body.Bytes(), files[1]) == false {
+		t.Error("2日目のアーカイブと一致しません")
+	}
+	if next := w.Header().Get(historyNextCursor); next != "" {
+		t.Errorf("next:%q", next)
+	}
+
+	// gzipを受け付けなければ日付のcursorから読んで返す
+	w = getHistory(h, v, false)
+	if ce := w.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("Content-Encoding:%q", ce)
+	}
+	if got := decodeTids(t, w.Body.Bytes()); len(got) != 1 || got[0] != 6 {
+		t.Errorf("cursor:%s got:%v", next, got)
+	}
+
+	// アーカイブが無い日は読み込んで返す
+	v.Set("cursor", "d20231117")
+	v.Set("until", strconv.FormatInt(day.AddDate(0, 0, 3).Unix(), 10))
+	w = getHistory(h, v, true)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("status:%d Content-Encoding:%q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if got := decodeTids(t, w.Body.Bytes()); len(got) != 0 {
+		t.Errorf("got:%v", got)
+	}
+}
+
+func TestParseHistoryCursor(t *testing.T) {
+	for _, s := range []string{"d2023111", "1700000000", "1700000000.-1", "x.1", "1700000000.1.2"} {
+		if _, err := parseHistoryCursor(s); err == nil {
+			t.Errorf("%q: エラーになりません", s)
+		}
+	}
+	c := historyCursor{ts: time.Unix(1700000000, 0), skip: 3}
+	got, err := parseHistoryCursor(c.String())
+	if err != nil || got.ts.Equal(c.ts) == false || got.skip != c.skip {
+		t.Errorf("%s: %+v %v", c, got, err)
+	}
+	d := historyCursor{day: time.Date(2023, 11, 15, 0, 0, 0, 0, jst)}
+	got, err = parseHistoryCursor(d.String())
+	if err != nil || got.day.Equal(d.day) == false {
+		t.Errorf("%s: %+v %v", d, got, err)
+	}
+}
+
+func TestHistoryCursorFields(t *testing.T) {
+	root := t.TempDir()
+	key := "btc_jpy"
+	day := time.Date(2023, 11, 15, 0, 0, 0, 0, jst)
+	t1 := day.Add(10 * time.Hour)
+	quote := func(ts time.Time) StoreData {
+		return StoreData{Ask: &PriceAmount{101, 1}, Timestamp: Unixtime(ts)}
+	}
+	// 同じ時刻に気配だけのレコードと約定が混ざっている
+	writeArchive(t, root, key, day, StoreDataArray{
+		quote(t1), tradeData(t1, 1), quote(t1), quote(t1), tradeData(t1, 2),
+		tradeData(t1, 3), quote(t1), tradeData(t1, 4), quote(t1.Add(time.Second)), tradeData(t1.Add(time.Second), 5),
+	})
+	st, err := newFileStore(NewConfig(), root, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	h := &HistoryHandler{cp: key, root: root, st: st}
+	for _, limit := range []int{1, 2, 3} {
+		v := url.Values{}
+		v.Set("since", strconv.FormatInt(day.Unix(), 10))
+		v.Set("until", strconv.FormatInt(day.AddDate(0, 0, 1).Unix(), 10))
+		v.Set("limit", strconv.Itoa(limit))
+		v.Set("fields", "trade")
+		var got []uint64
+		for page := 0; ; page++ {
+			if page > 10 {
+				t.Fatalf("limit:%d 終わりません。got:%v", limit, got)
+			}
+			w := getHistory(h, v, false)
+			if w.Code != http.StatusOK {
+				t.Fatalf("limit:%d status:%d %s", limit, w.Code, w.Body)
+			}
+			got = append(got, decodeTids(t, w.Body.Bytes())...)
+			cur := w.Header().Get(historyNextCursor)
+			if cur == "" {
+				break
+			}
+			v.Set("cursor", cur)
+		}
+		if equalUint64s(got, []uint64{1, 2, 3, 4, 5}) == false {
+			t.Errorf("limit:%d got:%v", limit, got)
+		}
+	}
+}
+
+type sseEvent struct {
+	name    string
+	id      string
+	data    string
+	comment string
+}
+
+// readSSE 空行までの1イベントを読む
+func readSSE(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("イベントが届きません。%v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return ev
+		}
+		k, v, _ := strings.Cut(line, ":")
+		v = strings.TrimPrefix(v, " ")
+		switch k {
+		case "":
+			ev.comment = v
+		case "event":
+			ev.name = v
+		case "id":
+			ev.id = v
+		case "data":
+			ev.data = v
+		}
+	}
+}
+
+// readTradeEvents n件の約定イベントを読んでtidを返す
+func readTradeEvents(t *testing.T, r *bufio.Reader, n int) []uint64 {
+	t.Helper()
+	var tids []uint64
+	for len(tids) < n {
+		ev := readSSE(t, r)
+		if ev.name != "trade" {
+			continue
+		}
+		var tr Trade
+		if err := json.Unmarshal([]byte(ev.data), &tr); err != nil {
+			t.Fatal(err)
+		}
+		if ev.id != strconv.FormatUint(tr.Tid, 10) {
+			t.Errorf("id:%s tid:%d", ev.id, tr.Tid)
+		}
+		tids = append(tids, tr.Tid)
+	}
+	return tids
+}
+
+// startEventStream EventStreamHandlerに接続して購読が始まるまで待つ
+func startEventStream(t *testing.T, h *EventStreamHandler, lastid string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastid != "" {
+		req.Header.Set("Last-Event-ID", lastid)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status:%d", res.StatusCode)
+	}
+	return res, bufio.NewReader(res.Body)
+}
+
+// newEventStreamTestHandler 後から届いたtid:6を含む約定をメモリに持つEventStreamHandler
+func newEventStreamTestHandler() *EventStreamHandler {
+	ts := time.Date(2023, 11, 15, 10, 0, 0, 0, jst)
+	h := &EventStreamHandler{
+		cp:        "btc_jpy",
+		hub:       newStreamHub(16),
+		oldstream: newPublisher[StoreDataArray](encodeStoreDataArray),
+		lastprice: newPublisher[LastPrice](nil),
+	}
+	h.oldstream.Publish(StoreDataArray{
+		tradeData(ts, 5),
+		tradeData(ts, 7),
+		{Ask: &PriceAmount{101, 1}, Timestamp: Unixtime(ts)},
+		tradeData(ts.Add(time.Second), 6),
+		tradeData(ts.Add(time.Second), 8),
+	}, DataMeta{})
+	h.lastprice.Publish(LastPrice{Action: "bid", Price: 100}, DataMeta{})
+	return h
+}
+
+func TestResumeTrades(t *testing.T) {
+	sda := newEventStreamTestHandler().oldstream.Load().data
+	for _, tc := range []struct {
+		lastid uint64
+		want   []uint64
+	}{
+		// 受信した順で後の約定。tidが小さくても後から届いたものは送る
+		{7, []uint64{6, 8}},
+		{6, []uint64{8}},
+		{5, []uint64{7, 6, 8}},
+		{8, nil},
+		// メモリに無いIDはtidで比べる
+		{3, []uint64{5, 7, 6, 8}},
+		{100, nil},
+	} {
+		var got []uint64
+		for _, sd := range resumeTrades(sda, tc.lastid) {
+			got = append(got, sd.Trade.Tid)
+		}
+		if equalUint64s(got, tc.want) == false {
+			t.Errorf("lastid:%d got:%v want:%v", tc.lastid, got, tc.want)
+		}
+	}
+}
+
+func TestEventStreamResume(t *testing.T) {
+	h := newEventStreamTestHandler()
+	_, r := startEventStream(t, h, "7")
+	if got := readTradeEvents(t, r, 2); equalUint64s(got, []uint64{6, 8}) == false {
+		t.Errorf("再送 got:%v want:[6 8]", got)
+	}
+	ev := readSSE(t, r)
+	if ev.name != "lastprice" || ev.id != "8" {
+		t.Errorf("最終取引価格のイベントが違います。%+v", ev)
+	}
+	// 再送した約定と重なった分は送らず、tidが小さくても新しく受信した約定は送る
+	ts := time.Date(2023, 11, 15, 10, 0, 2, 0, jst)
+	for _, tid := range []uint64{8, 4, 9} {
+		h.hub.Publish(StreamEvent{Data: tradeData(ts, tid), LastPrice: LastPrice{Action: "bid", Price: 100}})
+	}
+	if got := readTradeEvents(t, r, 2); equalUint64s(got, []uint64{4, 9}) == false {
+		t.Errorf("購読 got:%v want:[4 9]", got)
+	}
+	// 価格が変わった時だけ送る
+	h.hub.Publish(StreamEvent{Data: StoreData{Timestamp: Unixtime(ts)}, LastPrice: LastPrice{Action: "ask", Price: 101}})
+	ev = readSSE(t, r)
+	if ev.name != "lastprice" || ev.id != "9" || ev.data != `{"action":"ask","price":101}` {
+		t.Errorf("最終取引価格のイベントが違います。%+v", ev)
+	}
+}
+
+func TestEventStreamNoResume(t *testing.T) {
+	h := newEventStreamTestHandler()
+	// Last-Event-IDが無ければ再送しない
+	_, r := startEventStream(t, h, "")
+	if ev := readSSE(t, r); ev.name != "" {
+		t.Errorf("最初はretryだけのはずです。%+v", ev)
+	}
+	if ev := readSSE(t, r); ev.name != "lastprice" || ev.id != "" {
+		t.Errorf("最終取引価格のイベントが違います。%+v", ev)
+	}
+	h.hub.Publish(StreamEvent{Data: tradeData(time.Now(), 8), LastPrice: LastPrice{Action: "bid", Price: 100}})
+	if got := readTradeEvents(t, r, 1); equalUint64s(got, []uint64{8}) == false {
+		t.Errorf("got:%v", got)
+	}
+}
+
+func TestEventStreamHeartbeat(t *testing.T) {
+	defer func(d time.Duration) { eventStreamHeartbeat = d }(eventStreamHeartbeat)
+	eventStreamHeartbeat = 10 * time.Millisecond
+	h := newEventStreamTestHandler()
+	_, r := startEventStream(t, h, "8")
+	for i := 0; i < 2; i++ {
+		if ev := readSSE(t, r); ev.name == "trade" {
+			t.Errorf("再送する約定はありません。%+v", ev)
+		}
+	}
+	if ev := readSSE(t, r); ev.comment != "heartbeat" {
+		t.Errorf("heartbeatが届きません。%+v", ev)
+	}
+}
+
+func TestEventStreamDisconnect(t *testing.T) {
+	h := newEventStreamTestHandler()
+	// クライアントが切断したら購読をやめる
+	res, r := startEventStream(t, h, "")
+	readSSE(t, r)
+	if h.hub.Len() != 1 {
+		t.Fatalf("Len = %d", h.hub.Len())
+	}
+	res.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for h.hub.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("切断しても購読が残っています。")
+		}
+		// 書き込みに失敗するまで送る
+		h.hub.Publish(StreamEvent{Data: tradeData(time.Now(), 10), LastPrice: LastPrice{Action: "bid", Price: 100}})
+		time.Sleep(time.Millisecond)
+	}
+	// 閉じたら接続を終える
+	_, r = startEventStream(t, h, "")
+	readSSE(t, r)
+	h.hub.Close()
+	for {
+		if _, err := r.ReadString('\n'); err != nil {
+			if err != io.EOF {
+				t.Errorf("err = %v", err)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package zbbv
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+)
+
+const (
+	DefaultHealthStreamMaxAge = 300 // 秒
+	DefaultHealthDepthMaxAge  = 300 // 秒
+	DefaultHealthMinFreeDisk  = 100 // MB
+	// 再接続は最初に5秒程度待つので、1回目の再接続で繋がれば準備ができたままにする
+	DefaultHealthReconnectGrace = 60 // 秒
+)
+
+// HealthConfig readyzで準備ができていないとする条件（0は見ない）
+type HealthConfig struct {
+	// 最後にストリームのメッセージを受信してからの秒数
+	StreamMaxAge int `json:"stream_max_age"`
+	// 最後に板情報APIの取得に成功してからの秒数
+	DepthMaxAge int `json:"depth_max_age"`
+	// 最後にティッカーAPIの取得に成功してからの秒数（取得は日に1回）
+	TickerMaxAge int `json:"ticker_max_age"`
+	// データの保存先の空き容量（MB）
+	MinFreeDisk int `json:"min_free_disk_mb"`
+	// ストリームが切断されてから、接続していなくても準備ができているものとする秒数
+	// 一度も接続していなければ起動してから数える
+	ReconnectGrace int `json:"reconnect_grace"`
+	// 準備ができていなくてもreadyzを失敗させない通貨ペア（{取引所}/{通貨ペア}）
+	OptionalPairs []string `json:"optional_pairs"`
+}
+
+// required 準備ができていなければreadyzを失敗させる通貨ペアか
+func (hc HealthConfig) required(id PairID) bool {
+	for _, s := range hc.OptionalPairs {
+		if s == id.Exchange+"/"+id.Pair {
+			return false
+		}
+	}
+	return true
+}
+
+// pairHealth 通貨ペア毎の上流との接続状態
+type pairHealth struct {
+	sync.Mutex
+	started     time.Time
+	connected   bool
+	lastClose   time.Time // 最後に切断された時刻
+	lastMessage time.Time
+	lastDepth   time.Time
+	lastTicker  time.Time
+	writeErr    error
+	writeErrAt  time.Time
+}
+
+func newPairHealth(now time.Time) *pairHealth {
+	return &pairHealth{started: now}
+}
+
+func (ph *pairHealth) setConnected(now time.Time, b bool) {
+	ph.Lock()
+	defer ph.Unlock()
+	if ph.connected && b == false {
+		ph.lastClose = now
+	}
+	ph.connected = b
+}
+
+func (ph *pairHealth) message(now time.Time) {
+	ph.Lock()
+	defer ph.Unlock()
+	ph.lastMessage = now
+}
+
+// lastReceived 最後にストリームのメッセージを受信した時刻
+func (ph *pairHealth) lastReceived() time.Time {
+	ph.Lock()
+	defer ph.Unlock()
+	return ph.lastMessage
+}
+
+func (ph *pairHealth) depth(now time.Time) {
+	ph.Lock()
+	defer ph.Unlock()
+	ph.lastDepth = now
+}
+
+func (ph *pairHealth) ticker(now time.Time) {
+	ph.Lock()
+	defer ph.Unlock()
+	ph.lastTicker = now
+}
+
+// write 書き込みの結果
+// 失敗は次に成功するまで続いているものとする
+func (ph *pairHealth) write(now time.Time, err error) {
+	ph.Lock()
+	defer ph.Unlock()
+	if err == nil {
+		ph.writeErr = nil
+		return
+	}
+	if ph.writeErr == nil {
+		ph.writeErrAt = now
+	}
+	ph.writeErr = err
+}
+
+// PairStatus readyzで返す通貨ペア毎の状態
+type PairStatus struct {
+	PairID
+	Ready bool `json:"ready"`
+	// falseの場合は準備ができていなくてもreadyzを失敗させない
+	Required    bool      `json:"required"`
+	Connected   bool      `json:"connected"`
+	LastClose   *Unixtime `json:"last_close,omitempty"`
+	LastMessage *Unixtime `json:"last_message,omitempty"`
+	MessageAge  float64   `json:"message_age_sec"` // 受信していなければ起動してからの秒数
+	LastDepth   *Unixtime `json:"last_depth,omitempty"`
+	LastTicker  *Unixtime `json:"last_ticker,omitempty"`
+	WriteError  string    `json:"write_error,omitempty"`
+	WriteErrAt  *Unixtime `json:"write_error_since,omitempty"`
+	Problems    []string  `json:"problems,omitempty"`
+}
+
+func optUnixtime(t time.Time) *Unixtime {
+	if t.IsZero() {
+		return nil
+	}
+	u := Unixtime(t)
+	return &u
+}
+
+// status hcの条件で準備ができているか調べる
+// まだ一度も成功していない場合は起動した時刻から数える
+func (ph *pairHealth) status(id PairID, hc HealthConfig, now time.Time) PairStatus {
+	ph.Lock()
+	defer ph.Unlock()
+	since := func(t time.Time) time.Duration {
+		if t.IsZero() {
+			t = ph.started
+		}
+		return now.Sub(t)
+	}
+	ps := PairStatus{
+		PairID:      id,
+		Required:    hc.required(id),
+		Connected:   ph.connected,
+		LastClose:   optUnixtime(ph.lastClose),
+		LastMessage: optUnixtime(ph.lastMessage),
+		MessageAge:  since(ph.lastMessage).Seconds(),
+		LastDepth:   optUnixtime(ph.lastDepth),
+		LastTicker:  optUnixtime(ph.lastTicker),
+	}
+	// 切断されてもreconnect_graceの間は再接続を待つ
+	if ph.connected == false && since(ph.lastClose) > time.Duration(hc.ReconnectGrace)*time.Second {
+		ps.Problems = append(ps.Problems, "ストリームに接続していません")
+	}
+	check := func(name string, t time.Time, max int) {
+		if max > 0 && since(t) > time.Duration(max)*time.Second {
+			ps.Problems = append(ps.Problems, name+"が古くなっています")
+		}
+	}
+	check("ストリーム", ph.lastMessage, hc.StreamMaxAge)
+	check("板情報", ph.lastDepth, hc.DepthMaxAge)
+	check("ティッカー", ph.lastTicker, hc.TickerMaxAge)
+	if ph.writeErr != nil {
+		ps.WriteError = ph.writeErr.Error()
+		ps.WriteErrAt = optUnixtime(ph.writeErrAt)
+		ps.Problems = append(ps.Problems, "ストリームの保存に失敗しています")
+	}
+	ps.Ready = len(ps.Problems) == 0
+	return ps
+}
+
+// DiskStatus データの保存先の空き容量
+type DiskStatus struct {
+	Path  string `json:"path"`
+	Free  uint64 `json:"free_bytes"`
+	Ready bool   `json:"ready"`
+	// 空き容量が取得できなかった場合は準備ができているものとする
+	Error string `json:"error,omitempty"`
+}
+
+// Readiness readyzの応答
+type Readiness struct {
+	Ready bool         `json:"ready"`
+	Time  Unixtime     `json:"time"`
+	Pairs []PairStatus `json:"pairs"`
+	Disks []DiskStatus `json:"disks"`
+}
+
+// Readiness 起動中の全ての通貨ペアと保存先の状態
+// optional_pairsの通貨ペアは状態を返すだけで全体の準備には含めない
+func (reg *PairRegistry) Readiness(now time.Time) Readiness {
+	hc := reg.conf.Health
+	rd := Readiness{Ready: true, Time: Unixtime(now), Pairs: []PairStatus{}, Disks: []DiskStatus{}}
+	for _, id := range reg.Keys() {
+		reg.RLock()
+		p, ok := reg.pairs[id]
+		reg.RUnlock()
+		if ok == false {
+			continue
+		}
+		ps := p.health.status(id, hc, now)
+		rd.Ready = rd.Ready && (ps.Ready || ps.Required == false)
+		rd.Pairs = append(rd.Pairs, ps)
+	}
+	roots := make(map[string]struct{}, len(reg.exchanges))
+	for _, rex := range reg.exchanges {
+		roots[rex.root] = struct{}{}
+	}
+	paths := make([]string, 0, len(roots))
+	for p := range roots {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		ds := DiskStatus{Path: p, Ready: true}
+		free, err := diskFree(existingDir(p))
+		if err != nil {
+			ds.Error = err.Error()
+		} else {
+			ds.Free = free
+			ds.Ready = hc.MinFreeDisk <= 0 || free >= uint64(hc.MinFreeDisk)<<20
+		}
+		rd.Ready = rd.Ready && ds.Ready
+		rd.Disks = append(rd.Disks, ds)
+	}
+	return rd
+}
+
+// existingDir 保存先がまだ作られていなければ作られる場所の親
+func existingDir(p string) string {
+	for {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return p
+		}
+		p = parent
+	}
+}
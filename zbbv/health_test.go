@@ -0,0 +1,83 @@
+package zbbv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPairHealthReconnectGrace(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	id := PairID{Exchange: DefaultExchange, Pair: "btc_jpy"}
+	hc := HealthConfig{ReconnectGrace: 60}
+	ph := newPairHealth(t0)
+	// 一度も接続していなければ起動してから数える
+	if ps := ph.status(id, hc, t0.Add(30*time.Second)); ps.Ready == false {
+		t.Errorf("起動直後 = %+v", ps)
+	}
+	if ps := ph.status(id, hc, t0.Add(90*time.Second)); ps.Ready {
+		t.Errorf("接続できないまま猶予を過ぎた = %+v", ps)
+	}
+	ph.setConnected(t0.Add(time.Minute), true)
+	ph.setConnected(t0.Add(time.Hour), false)
+	for _, it := range []struct {
+		grace int
+		after time.Duration
+		ready bool
+	}{
+		{60, 10 * time.Second, true},
+		{60, 60 * time.Second, true},
+		{60, 61 * time.Second, false},
+		{0, time.Second, false},
+	} {
+		hc.ReconnectGrace = it.grace
+		ps := ph.status(id, hc, t0.Add(time.Hour+it.after))
+		if ps.Ready != it.ready {
+			t.Errorf("grace:%d 切断から%s ready:%v want:%v %v", it.grace, it.after, ps.Ready, it.ready, ps.Problems)
+		}
+		if ps.LastClose == nil || time.Time(*ps.LastClose).Equal(t0.Add(time.Hour)) == false {
+			t.Errorf("last_close = %v", ps.LastClose)
+		}
+	}
+	// 再接続すれば猶予に関係なく準備ができている
+	ph.setConnected(t0.Add(2*time.Hour), true)
+	if ps := ph.status(id, HealthConfig{}, t0.Add(3*time.Hour)); ps.Ready == false {
+		t.Errorf("再接続 = %+v", ps)
+	}
+}
+
+func TestReadinessOptionalPairs(t *testing.T) {
+	t0 := time.Now()
+	conf := NewConfig()
+	conf.Health = HealthConfig{ReconnectGrace: 0, OptionalPairs: []string{"zaif/xem_jpy"}}
+	up := newPairHealth(t0)
+	up.setConnected(t0, true)
+	down := newPairHealth(t0)
+	btc := PairID{Exchange: DefaultExchange, Pair: "btc_jpy"}
+	xem := PairID{Exchange: DefaultExchange, Pair: "xem_jpy"}
+	reg := &PairRegistry{
+		conf:  conf,
+		pairs: map[PairID]*Pair{btc: {health: up}, xem: {health: down}},
+	}
+	// 任意の通貨ペアが切断されていても準備ができている
+	rd := reg.Readiness(t0.Add(time.Second))
+	if rd.Ready == false || len(rd.Pairs) != 2 {
+		t.Fatalf("readiness = %+v", rd)
+	}
+	for _, ps := range rd.Pairs {
+		switch ps.PairID {
+		case btc:
+			if ps.Required == false || ps.Ready == false {
+				t.Errorf("btc_jpy = %+v", ps)
+			}
+		case xem:
+			if ps.Required || ps.Ready {
+				t.Errorf("xem_jpy = %+v", ps)
+			}
+		}
+	}
+	// 必須の通貨ペアが切断されていれば準備ができていない
+	up.setConnected(t0.Add(time.Second), false)
+	if rd := reg.Readiness(t0.Add(2 * time.Second)); rd.Ready {
+		t.Errorf("readiness = %+v", rd)
+	}
+}
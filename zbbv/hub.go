@@ -0,0 +1,121 @@
+package zbbv
+
+import (
+	"sync"
+)
+
+// StreamEvent streamStoreProcが配信する1件分の更新
+type StreamEvent struct {
+	Data      StoreData
+	LastPrice LastPrice
+}
+
+// StreamHub streamStoreProcが生成したStoreDataを購読者に配信する
+// 送信待ちが溢れた購読者は切り離す
+type StreamHub struct {
+	sync.Mutex
+	size   int
+	subs   map[*Subscriber]struct{}
+	closed bool
+}
+
+// Subscriber StreamHubの購読者
+type Subscriber struct {
+	ch      chan StreamEvent
+	done    chan struct{}
+	once    sync.Once
+	evicted bool
+}
+
+func newStreamHub(size int) *StreamHub {
+	return &StreamHub{
+		size: size,
+		subs: make(map[*Subscriber]struct{}),
+	}
+}
+
+// Subscribe 購読を開始する
+// 使い終わったらUnsubscribeを呼ぶこと
+func (h *StreamHub) Subscribe() *Subscriber {
+	sub := &Subscriber{
+		ch:   make(chan StreamEvent, h.size),
+		done: make(chan struct{}),
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		sub.close()
+	} else {
+		h.subs[sub] = struct{}{}
+	}
+	return sub
+}
+
+// Unsubscribe 購読を終了する
+func (h *StreamHub) Unsubscribe(sub *Subscriber) {
+	h.Lock()
+	delete(h.subs, sub)
+	h.Unlock()
+	sub.close()
+}
+
+// Publish 全ての購読者に送信する
+// 送信待ちが溢れている購読者は待たずに切り離す
+func (h *StreamHub) Publish(ev StreamEvent) {
+	h.Lock()
+	defer h.Unlock()
+	for sub := range h.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.evicted = true
+			delete(h.subs, sub)
+			sub.close()
+		}
+	}
+}
+
+// Len 購読者数
+func (h *StreamHub) Len() int {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.subs)
+}
+
+// Close 全ての購読者を切り離して以降の購読を受け付けない
+func (h *StreamHub) Close() {
+	h.Lock()
+	defer h.Unlock()
+	h.closed = true
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		sub.close()
+	}
+}
+
+// C 受信用チャンネル
+func (sub *Subscriber) C() <-chan StreamEvent {
+	return sub.ch
+}
+
+// Done 切り離された時に閉じられる
+func (sub *Subscriber) Done() <-chan struct{} {
+	return sub.done
+}
+
+// Evicted 送信待ちが溢れて切り離された場合はtrue
+// Doneが閉じられた後に参照すること
+func (sub *Subscriber) Evicted() bool {
+	select {
+	case <-sub.done:
+		return sub.evicted
+	default:
+		return false
+	}
+}
+
+func (sub *Subscriber) close() {
+	sub.once.Do(func() {
+		close(sub.done)
+	})
+}
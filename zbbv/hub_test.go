@@ -0,0 +1,193 @@
+package zbbv
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func hubEvent(tid uint64) StreamEvent {
+	return StreamEvent{Data: tradeData(time.Unix(1700000000, 0), tid)}
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestStreamHubSlowConsumer(t *testing.T) {
+	const size = 4
+	hub := newStreamHub(size)
+	slow := hub.Subscribe()
+	fast := hub.Subscribe()
+	// 送信待ちが上限に達するまでは切り離さない
+	for i := 1; i <= size; i++ {
+		hub.Publish(hubEvent(uint64(i)))
+		<-fast.C()
+	}
+	if hub.Len() != 2 || isClosed(slow.Done()) || slow.Evicted() {
+		t.Fatalf("上限までで切り離しました。Len:%d", hub.Len())
+	}
+	// 溢れた購読者だけ切り離す
+	hub.Publish(hubEvent(size + 1))
+	if isClosed(slow.Done()) == false || slow.Evicted() == false {
+		t.Fatal("読まない購読者が切り離されません")
+	}
+	if hub.Len() != 1 || isClosed(fast.Done()) {
+		t.Fatalf("読んでいる購読者も切り離しました。Len:%d", hub.Len())
+	}
+	if ev := <-fast.C(); ev.Data.Trade.Tid != size+1 {
+		t.Errorf("tid = %d, want %d", ev.Data.Trade.Tid, size+1)
+	}
+	// 切り離された購読者の送信待ちは上限まで
+	if n := len(slow.C()); n != size {
+		t.Errorf("送信待ち = %d, want %d", n, size)
+	}
+	for i := 1; i <= size; i++ {
+		if ev := <-slow.C(); ev.Data.Trade.Tid != uint64(i) {
+			t.Errorf("%d件目のtid = %d", i, ev.Data.Trade.Tid)
+		}
+	}
+	// 切り離された後は届かない
+	hub.Publish(hubEvent(size + 2))
+	if n := len(slow.C()); n != 0 {
+		t.Errorf("切り離した後に%d件届きました", n)
+	}
+	hub.Unsubscribe(slow)
+	hub.Unsubscribe(fast)
+	if hub.Len() != 0 || isClosed(fast.Done()) == false || fast.Evicted() {
+		t.Errorf("購読を終了できません。Len:%d", hub.Len())
+	}
+}
+
+func TestStreamHubClose(t *testing.T) {
+	hub := newStreamHub(4)
+	subs := []*Subscriber{hub.Subscribe(), hub.Subscribe()}
+	hub.Close()
+	for i, sub := range subs {
+		if isClosed(sub.Done()) == false || sub.Evicted() {
+			t.Errorf("%d: 閉じた時に切り離されません", i)
+		}
+		// 閉じた後にUnsubscribeしてもよい
+		hub.Unsubscribe(sub)
+	}
+	if hub.Len() != 0 {
+		t.Errorf("Len = %d", hub.Len())
+	}
+	// 閉じた後の購読はすぐに終わる
+	sub := hub.Subscribe()
+	if isClosed(sub.Done()) == false || hub.Len() != 0 {
+		t.Error("閉じた後に購読できました")
+	}
+	hub.Publish(hubEvent(1))
+	if len(sub.C()) != 0 {
+		t.Error("閉じた後に届きました")
+	}
+}
+
+// dialRelay StreamRelayHandlerに接続して購読が始まるまで待つ
+func dialRelay(t *testing.T, hub *StreamHub) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(&StreamRelayHandler{cp: "btc_jpy", hub: hub})
+	t.Cleanup(srv.Close)
+	con, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { con.Close() })
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("購読が始まりません")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return con
+}
+
+// readRelay 閉じられるまで読んで、届いたtidと閉じた理由を返す
+func readRelay(t *testing.T, con *websocket.Conn) ([]uint64, *websocket.CloseError) {
+	t.Helper()
+	con.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var tids []uint64
+	for {
+		var sd StoreData
+		if err := con.ReadJSON(&sd); err != nil {
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) == false {
+				t.Fatalf("閉じる理由が届きません。%v", err)
+			}
+			return tids, ce
+		}
+		tids = append(tids, sd.Trade.Tid)
+	}
+}
+
+func TestStreamRelayHandlerSlowConsumer(t *testing.T) {
+	hub := newStreamHub(4)
+	// 読まないクライアント
+	con := dialRelay(t, hub)
+	deadline := time.Now().Add(10 * time.Second)
+	n := uint64(0)
+	for hub.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d件送っても切り離されません", n)
+		}
+		n++
+		hub.Publish(hubEvent(n))
+	}
+	tids, ce := readRelay(t, con)
+	if ce.Code != websocket.ClosePolicyViolation {
+		t.Errorf("code = %d, want %d", ce.Code, websocket.ClosePolicyViolation)
+	}
+	// 切り離すまでは1件も抜けずに届く
+	if uint64(len(tids)) > n {
+		t.Errorf("送った%d件より多く届きました。%d件", n, len(tids))
+	}
+	for i, tid := range tids {
+		if tid != uint64(i+1) {
+			t.Fatalf("%d件目のtid = %d", i, tid)
+		}
+	}
+}
+
+func TestStreamRelayHandlerClose(t *testing.T) {
+	hub := newStreamHub(16)
+	con := dialRelay(t, hub)
+	for i := uint64(1); i <= 3; i++ {
+		hub.Publish(hubEvent(i))
+	}
+	// 届いてから閉じる
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hub.Lock()
+		pending := 0
+		for sub := range hub.subs {
+			pending += len(sub.ch)
+		}
+		hub.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("送信待ちが減りません")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	hub.Close()
+	tids, ce := readRelay(t, con)
+	if ce.Code != websocket.CloseGoingAway {
+		t.Errorf("code = %d, want %d", ce.Code, websocket.CloseGoingAway)
+	}
+	if equalUint64s(tids, []uint64{1, 2, 3}) == false {
+		t.Errorf("tids = %v", tids)
+	}
+}
@@ -0,0 +1,290 @@
+package zbbv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 時刻がこれだけ空いていたら抜けとして報告する
+const DefaultVerifyGap = 10 * time.Minute
+
+// Manifest 日毎のアーカイブに書いた内容
+// manifest/{通貨ペア}/{通貨ペア}_YYYYMMDD.json（列指向形式は{通貨ペア}_YYYYMMDD.zcol.json）
+type Manifest struct {
+	Count    int      `json:"count"`     // StoreDataの件数
+	Trades   int      `json:"trades"`    // 約定の件数
+	FirstTs  Unixtime `json:"first_ts"`  // 最初のStoreDataの時刻
+	LastTs   Unixtime `json:"last_ts"`   // 最後のStoreDataの時刻
+	FirstTid uint64   `json:"first_tid"` // 最初の約定のTid
+	LastTid  uint64   `json:"last_tid"`  // 最後の約定のTid
+	Size     int64    `json:"size"`      // アーカイブのバイト数
+	SHA256   string   `json:"sha256"`    // アーカイブのSHA-256
+}
+
+// diff 食い違っている項目
+func (m Manifest) diff(o Manifest) []string {
+	var l []string
+	add := func(name string, a, b interface{}) {
+		if a != b {
+			l = append(l, fmt.Sprintf("%s=%v/%v", name, a, b))
+		}
+	}
+	add("count", m.Count, o.Count)
+	add("trades", m.Trades, o.Trades)
+	add("first_ts", time.Time(m.FirstTs).Unix(), time.Time(o.FirstTs).Unix())
+	add("last_ts", time.Time(m.LastTs).Unix(), time.Time(o.LastTs).Unix())
+	add("first_tid", m.FirstTid, o.FirstTid)
+	add("last_tid", m.LastTid, o.LastTid)
+	add("size", m.Size, o.Size)
+	add("sha256", m.SHA256, o.SHA256)
+	return l
+}
+
+func hashFile(p string) (string, int64, error) {
+	fp, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, fp)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// scanArchive 圧縮済みのアーカイブか列指向形式のファイルを読み直してマニフェストを作る
+// fnがnilで無ければ1件毎に渡す
+func scanArchive(p string, fn func(StoreData)) (Manifest, error) {
+	if strings.HasSuffix(p, ".zcol") {
+		return scanColFile(p, fn)
+	}
+	return scanFile(p, func(fn func(StoreData) error) error {
+		return readStoreDataFile(p, true, fn)
+	}, fn)
+}
+
+// scanColFile 列指向形式のファイルを読み直してマニフェストを作る
+func scanColFile(p string, fn func(StoreData)) (Manifest, error) {
+	return scanFile(p, func(fn func(StoreData) error) error {
+		return readColFile(p, time.Time{}, time.Time{}, fn)
+	}, fn)
+}
+
+func scanFile(p string, read func(func(StoreData) error) error, fn func(StoreData)) (Manifest, error) {
+	var m Manifest
+	var err error
+	m.SHA256, m.Size, err = hashFile(p)
+	if err != nil {
+		return m, err
+	}
+	err = read(func(sd StoreData) error {
+		if m.Count == 0 {
+			m.FirstTs = sd.Timestamp
+		}
+		m.LastTs = sd.Timestamp
+		m.Count++
+		if sd.Trade != nil {
+			if m.Trades == 0 {
+				m.FirstTid = sd.Trade.Tid
+			}
+			m.LastTid = sd.Trade.Tid
+			m.Trades++
+		}
+		if fn != nil {
+			fn(sd)
+		}
+		return nil
+	})
+	return m, err
+}
+
+func buildManifest(p string) (Manifest, error) {
+	return scanArchive(p, nil)
+}
+
+func readManifest(p string) (Manifest, error) {
+	var m Manifest
+	fp, err := os.Open(p)
+	if err != nil {
+		return m, err
+	}
+	defer fp.Close()
+	err = json.NewDecoder(fp).Decode(&m)
+	return m, err
+}
+
+// VerifyOptions verifyの条件
+type VerifyOptions struct {
+	// 時刻がこれ以上空いていたら報告する
+	Gap time.Duration
+	// Tidがこれより大きく飛んでいたら報告する（0は報告しない）
+	// Tidは取引所全体で振られるので、通貨ペア毎に見ると飛ぶのが普通
+	TidGap uint64
+	// マニフェストが無いアーカイブはマニフェストを作る
+	Write bool
+}
+
+// gapChecker 前の1件との時刻とTidの差を調べる
+// 日をまたいで続けて使う
+type gapChecker struct {
+	opt     VerifyOptions
+	lastTs  time.Time
+	lastTid uint64
+	report  func(string)
+}
+
+func (gc *gapChecker) check(sd StoreData) {
+	ts := time.Time(sd.Timestamp)
+	if gc.lastTs.IsZero() == false {
+		if d := ts.Sub(gc.lastTs); gc.opt.Gap > 0 && d >= gc.opt.Gap {
+			gc.report(fmt.Sprintf("時刻の抜け %s〜%s (%s)", gc.lastTs.In(jst).Format(time.RFC3339), ts.In(jst).Format(time.RFC3339), d))
+		} else if d < 0 {
+			gc.report(fmt.Sprintf("時刻の逆転 %s→%s", gc.lastTs.In(jst).Format(time.RFC3339), ts.In(jst).Format(time.RFC3339)))
+		}
+	}
+	if ts.After(gc.lastTs) {
+		gc.lastTs = ts
+	}
+	t := sd.Trade
+	if t == nil {
+		return
+	}
+	if gc.lastTid > 0 {
+		switch {
+		case t.Tid <= gc.lastTid:
+			gc.report(fmt.Sprintf("Tidの逆転・重複 %d→%d", gc.lastTid, t.Tid))
+		case gc.opt.TidGap > 0 && t.Tid-gc.lastTid > gc.opt.TidGap:
+			gc.report(fmt.Sprintf("Tidの抜け %d〜%d (%d)", gc.lastTid, t.Tid, t.Tid-gc.lastTid))
+		}
+	}
+	if t.Tid > gc.lastTid {
+		gc.lastTid = t.Tid
+	}
+}
+
+// verifyPair 通貨ペアのアーカイブと列指向形式のファイルをマニフェストと突き合わせる
+// 問題があった件数を返す
+func verifyPair(root, key string, opt VerifyOptions, report func(string)) (int, error) {
+	bad := 0
+	fail := func(s string) {
+		bad++
+		report(s)
+	}
+	days := make(map[time.Time]struct{})
+	for _, pattern := range []string{
+		filepath.Join(root, "stream", key, key+"_*.json.gz"),
+		filepath.Join(root, "col", key, key+"_*.zcol"),
+		filepath.Join(root, "manifest", key, key+"_*.json"),
+	} {
+		match, _ := filepath.Glob(pattern)
+		for _, p := range match {
+			if day, ok := dayFileDate(key, filepath.Base(p)); ok {
+				days[day] = struct{}{}
+			}
+		}
+	}
+	// check ファイルを読み直してマニフェストと突き合わせる
+	check := func(date, p, mp string, fn func(StoreData)) error {
+		want, merr := readManifest(mp)
+		if _, err := os.Stat(p); err != nil {
+			fail(fmt.Sprintf("%s アーカイブがありません", date))
+			return nil
+		}
+		got, err := scanArchive(p, fn)
+		if err != nil {
+			fail(fmt.Sprintf("%s 読み込みに失敗しました %s (%d件目まで)", date, err, got.Count))
+			return nil
+		}
+		switch {
+		case merr != nil && opt.Write:
+			if err := writeJSONFile(mp, got); err != nil {
+				return err
+			}
+			report(fmt.Sprintf("%s マニフェストを作りました %d件", date, got.Count))
+		case merr != nil:
+			fail(fmt.Sprintf("%s マニフェストがありません %d件", date, got.Count))
+		default:
+			if dl := got.diff(want); len(dl) > 0 {
+				fail(fmt.Sprintf("%s マニフェストと一致しません %v", date, dl))
+			} else {
+				report(fmt.Sprintf("%s OK %d件", date, got.Count))
+			}
+		}
+		return nil
+	}
+	today := dayStart(time.Now())
+	gc := &gapChecker{opt: opt, report: fail}
+	for _, day := range sortedDays(days) {
+		date := day.Format("20060102")
+		ap := createStoreFilePath(root, day, key, "stream") + ".gz"
+		mp := createStoreFilePath(root, day, key, "manifest")
+		cp := createColFilePath(root, day, key)
+		cmp := createColManifestPath(root, day, key)
+		_, aerr := os.Stat(ap)
+		_, merr := os.Stat(mp)
+		_, cerr := os.Stat(cp)
+		_, cmerr := os.Stat(cmp)
+		if cerr == nil && cmerr != nil && day.Before(today) == false {
+			// 書き込み中の日のマニフェストは日付が変わってから作る
+			report(fmt.Sprintf("%s 列指向形式 書き込み中", date))
+			cerr, cmerr = os.ErrNotExist, os.ErrNotExist
+		}
+		// 読み出しと同じく両方の形式がある日は列指向形式の方で抜けを調べる
+		fn := gc.check
+		if cerr == nil {
+			fn = nil
+		}
+		if aerr == nil || merr == nil {
+			if err := check(date, ap, mp, fn); err != nil {
+				return bad, err
+			}
+		}
+		if cerr == nil || cmerr == nil {
+			if err := check(date+" 列指向形式", cp, cmp, gc.check); err != nil {
+				return bad, err
+			}
+		}
+	}
+	return bad, nil
+}
+
+func sortedDays(set map[time.Time]struct{}) []time.Time {
+	days := make([]time.Time, 0, len(set))
+	for day := range set {
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days
+}
+
+// Verify 設定された全ての通貨ペアのアーカイブを読み直してマニフェストと突き合わせ、時刻とTidの抜けを報告する
+// 問題があった件数を返す
+func Verify(conf *Config, w io.Writer, opt VerifyOptions) (int, error) {
+	if err := conf.Validate(); err != nil {
+		return 0, err
+	}
+	bad := 0
+	for _, ec := range conf.Exchanges {
+		root := ec.dataPath(conf.RootDataPath)
+		for _, key := range ec.CurrencyPairs {
+			n, err := verifyPair(root, key, opt, func(s string) {
+				fmt.Fprintf(w, "%s %s %s\n", ec.Name, key, s)
+			})
+			bad += n
+			if err != nil {
+				return bad, fmt.Errorf("%s %s: %w", ec.Name, key, err)
+			}
+		}
+	}
+	return bad, nil
+}
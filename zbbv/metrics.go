@@ -0,0 +1,147 @@
+package zbbv
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const MetricsPath = "/metrics"
+
+// metricsRegistry 同じプロセスで複数起動しても二重登録にならないようにDefaultRegistererは使わない
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "zbbv_http_request_duration_seconds",
+		Help:    "HTTPリクエストの処理時間",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"route", "method"})
+	httpResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zbbv_http_responses_total",
+		Help: "HTTPステータスコード毎のレスポンス数",
+	}, []string{"route", "method", "code"})
+	streamMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zbbv_stream_messages_total",
+		Help: "受信したストリームのメッセージ数",
+	}, []string{"exchange", "pair"})
+	storeDataWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zbbv_store_data_written_total",
+		Help: "保存したStoreDataの件数",
+	}, []string{"exchange", "pair"})
+	storeDataDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zbbv_store_data_dropped_total",
+		Help: "保存できなかったStoreDataの件数",
+	}, []string{"exchange", "pair", "reason"})
+	storeQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "zbbv_store_queue_length",
+		Help: "保存待ちのStoreDataの件数",
+	}, []string{"exchange", "pair"})
+	bookSnapshotsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zbbv_book_snapshots_dropped_total",
+		Help: "書き出し待ちが溢れて次の差分に回した板の数",
+	}, []string{"exchange", "pair"})
+	streamReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zbbv_stream_reconnects_total",
+		Help: "ストリームに再接続した回数（dialは接続の失敗、readは接続中の切断）",
+	}, []string{"exchange", "pair", "reason"})
+	fetchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zbbv_fetch_errors_total",
+		Help: "板情報・ティッカーAPIの取得に失敗した回数",
+	}, []string{"exchange", "pair", "api"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestDuration,
+		httpResponses,
+		streamMessages,
+		storeDataWritten,
+		storeDataDropped,
+		storeQueueLength,
+		bookSnapshotsDropped,
+		streamReconnects,
+		fetchErrors,
+	)
+}
+
+// pairMetrics 通貨ペアのラベルを付けたメトリクス
+type pairMetrics struct {
+	messages     prometheus.Counter
+	written      prometheus.Counter
+	writeErrors  prometheus.Counter
+	queueDropped prometheus.Counter
+	queueLength  prometheus.Gauge
+	bookDropped  prometheus.Counter
+	dialRetries  prometheus.Counter
+	readRetries  prometheus.Counter
+	depthErrors  prometheus.Counter
+	tickerErrors prometheus.Counter
+}
+
+func newPairMetrics(exchange, pair string) *pairMetrics {
+	l := prometheus.Labels{"exchange": exchange, "pair": pair}
+	return &pairMetrics{
+		messages:     streamMessages.With(l),
+		written:      storeDataWritten.With(l),
+		writeErrors:  storeDataDropped.MustCurryWith(l).WithLabelValues("write_error"),
+		queueDropped: storeDataDropped.MustCurryWith(l).WithLabelValues("queue_full"),
+		queueLength:  storeQueueLength.With(l),
+		bookDropped:  bookSnapshotsDropped.With(l),
+		dialRetries:  streamReconnects.MustCurryWith(l).WithLabelValues(GapDial),
+		readRetries:  streamReconnects.MustCurryWith(l).WithLabelValues(GapRead),
+		depthErrors:  fetchErrors.MustCurryWith(l).WithLabelValues("depth"),
+		tickerErrors: fetchErrors.MustCurryWith(l).WithLabelValues("ticker"),
+	}
+}
+
+// pairAPIKinds 通貨ペア毎のAPIの種類
+// ラベルの種類が増えすぎないようにこれ以外は纏める
+var pairAPIKinds = map[string]struct{}{
+	"oldstream": {}, "lastprice": {}, "depth": {}, "ticks": {}, "stream": {}, "events": {},
+	"history": {}, "candles": {}, "book": {}, "gaps": {},
+}
+
+// routePattern メトリクスのラベルに使うURLのパターン
+func routePattern(uri string) string {
+	path := uri
+	if u, err := url.ParseRequestURI(uri); err == nil {
+		path = u.Path
+	}
+	if _, kind, ok := splitPairPath(path); ok {
+		if _, ok := pairAPIKinds[kind]; ok {
+			return "/api/{exchange}/1/" + kind + "/{pair}"
+		}
+		return "/api/{exchange}/1/other"
+	}
+	switch {
+	case path == MetricsPath, path == HealthzPath, path == ReadyzPath, path == DiskUsagePath, path == "/api/unko.in/1/monitor":
+		return path
+	case strings.HasPrefix(path, PairAdminPath):
+		return PairAdminPath
+	case strings.HasPrefix(path, "/api/"):
+		return "/api/other"
+	}
+	return "static"
+}
+
+func methodLabel(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return m
+	}
+	return "OTHER"
+}
+
+func observeHTTP(ri ResponseInfo) {
+	route := routePattern(ri.uri)
+	method := methodLabel(ri.method)
+	httpRequestDuration.WithLabelValues(route, method).Observe(ri.end.Sub(ri.start).Seconds())
+	httpResponses.WithLabelValues(route, method, strconv.Itoa(ri.status)).Inc()
+}
@@ -3,8 +3,10 @@ package zbbv
 import (
 	"bufio"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
+	"sort"
 	"time"
 )
 
@@ -20,13 +22,235 @@ type ResponseInfo struct {
 	protocol  string
 	addr      string
 }
+
+// ResultMonitor 直近1分・5分・1時間の集計
+// 集計は1分毎に更新する
 type ResultMonitor struct {
-	err                 error
-	ResponseTimeSum     time.Duration
-	ResponseCount       uint
-	ResponseCodeOkCount uint
-	ResponseCodeNgCount uint
+	Time    Unixtime                 `json:"time"`
+	Windows map[string]MonitorWindow `json:"windows"` // 1m, 5m, 1h
+}
+
+// MonitorWindow 期間内のレスポンスの集計
+type MonitorWindow struct {
+	Start Unixtime     `json:"start"`
+	Total LatencyStats `json:"total"`
+	OK    uint64       `json:"ok"` // ステータスコードが400未満
+	NG    uint64       `json:"ng"`
+	// ルートのパターン→ステータスコードの分類（2xxなど）
+	Routes map[string]map[string]LatencyStats `json:"routes"`
+}
+
+// LatencyStats 応答時間の統計（ミリ秒）
+type LatencyStats struct {
+	Count uint64  `json:"count"`
+	Mean  float64 `json:"mean_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// 集計する期間（分）
+var monitorWindows = []struct {
+	name    string
+	minutes int
+}{{"1m", 1}, {"5m", 5}, {"1h", 60}}
+
+// 分位数の相対誤差
+const sketchAccuracy = 0.01
+
+var (
+	sketchGamma    = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// これ未満（ミリ秒）は0として数える
+const sketchMinValue = 1e-3
+
+// latencySketch 分位数を求めるためのスケッチ（DDSketch）
+// 値を対数の幅のバケットに数えるだけなので、分毎のスケッチを足し合わせて期間の分位数を出せる
+type latencySketch struct {
+	count uint64
+	zero  uint64
+	sum   float64
+	max   float64
+	bins  map[int]uint64
+}
+
+func newLatencySketch() *latencySketch {
+	return &latencySketch{bins: make(map[int]uint64)}
+}
+
+func (ls *latencySketch) add(v float64) {
+	ls.count++
+	ls.sum += v
+	if v > ls.max {
+		ls.max = v
+	}
+	if v < sketchMinValue {
+		ls.zero++
+		return
+	}
+	ls.bins[int(math.Ceil(math.Log(v)/sketchLogGamma))]++
+}
+
+func (ls *latencySketch) merge(o *latencySketch) {
+	ls.count += o.count
+	ls.zero += o.zero
+	ls.sum += o.sum
+	if o.max > ls.max {
+		ls.max = o.max
+	}
+	for k, n := range o.bins {
+		ls.bins[k] += n
+	}
+}
+
+func (ls *latencySketch) quantile(q float64) float64 {
+	if ls.count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(ls.count-1))
+	if rank < ls.zero {
+		return 0
+	}
+	keys := make([]int, 0, len(ls.bins))
+	for k := range ls.bins {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	n := ls.zero
+	for _, k := range keys {
+		n += ls.bins[k]
+		if n > rank {
+			// バケットの範囲(γ^(k-1), γ^k]の中で相対誤差が最小になる値
+			return math.Min(2*math.Pow(sketchGamma, float64(k))/(sketchGamma+1), ls.max)
+		}
+	}
+	return ls.max
+}
+
+func (ls *latencySketch) stats() LatencyStats {
+	st := LatencyStats{Count: ls.count}
+	if ls.count == 0 {
+		return st
+	}
+	st.Mean = ls.sum / float64(ls.count)
+	st.P50 = ls.quantile(0.50)
+	st.P90 = ls.quantile(0.90)
+	st.P95 = ls.quantile(0.95)
+	st.P99 = ls.quantile(0.99)
+	st.Max = ls.max
+	return st
+}
+
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "other"
+	}
+	return fmt.Sprintf("%dxx", status/100)
 }
+
+type monitorKey struct {
+	route string
+	class string
+}
+
+// monitorMinute 1分間の集計
+type monitorMinute struct {
+	start    time.Time
+	ok       uint64
+	ng       uint64
+	sketches map[monitorKey]*latencySketch
+}
+
+func newMonitorMinute(start time.Time) *monitorMinute {
+	return &monitorMinute{start: start, sketches: make(map[monitorKey]*latencySketch)}
+}
+
+// monitorRing 直近1時間分の1分毎の集計
+type monitorRing struct {
+	cur     *monitorMinute
+	minutes []*monitorMinute // 古い順
+}
+
+func newMonitorRing(now time.Time) *monitorRing {
+	return &monitorRing{cur: newMonitorMinute(now)}
+}
+
+func (mr *monitorRing) add(ri ResponseInfo) {
+	if ri.status < 400 {
+		mr.cur.ok++
+	} else {
+		mr.cur.ng++
+	}
+	k := monitorKey{route: routePattern(ri.uri), class: statusClass(ri.status)}
+	ls, ok := mr.cur.sketches[k]
+	if ok == false {
+		ls = newLatencySketch()
+		mr.cur.sketches[k] = ls
+	}
+	ls.add(float64(ri.end.Sub(ri.start)) / float64(time.Millisecond))
+}
+
+// rotate 今の1分を締めて次の1分を始める
+func (mr *monitorRing) rotate(now time.Time) {
+	keep := monitorWindows[len(monitorWindows)-1].minutes
+	mr.minutes = append(mr.minutes, mr.cur)
+	if len(mr.minutes) > keep {
+		mr.minutes = mr.minutes[len(mr.minutes)-keep:]
+	}
+	mr.cur = newMonitorMinute(now)
+}
+
+// result 締めた分だけで期間毎に集計する
+func (mr *monitorRing) result(now time.Time) ResultMonitor {
+	res := ResultMonitor{
+		Time:    Unixtime(now),
+		Windows: make(map[string]MonitorWindow, len(monitorWindows)),
+	}
+	for _, w := range monitorWindows {
+		l := mr.minutes
+		if len(l) > w.minutes {
+			l = l[len(l)-w.minutes:]
+		}
+		res.Windows[w.name] = aggregateMinutes(l, now)
+	}
+	return res
+}
+
+func aggregateMinutes(l []*monitorMinute, now time.Time) MonitorWindow {
+	mw := MonitorWindow{
+		Start:  Unixtime(now),
+		Routes: make(map[string]map[string]LatencyStats),
+	}
+	if len(l) > 0 {
+		mw.Start = Unixtime(l[0].start)
+	}
+	total := newLatencySketch()
+	sm := make(map[monitorKey]*latencySketch)
+	for _, m := range l {
+		mw.OK += m.ok
+		mw.NG += m.ng
+		for k, ls := range m.sketches {
+			total.merge(ls)
+			if _, ok := sm[k]; ok == false {
+				sm[k] = newLatencySketch()
+			}
+			sm[k].merge(ls)
+		}
+	}
+	mw.Total = total.stats()
+	for k, ls := range sm {
+		if _, ok := mw.Routes[k.route]; ok == false {
+			mw.Routes[k.route] = make(map[string]LatencyStats)
+		}
+		mw.Routes[k.route][k.class] = ls.stats()
+	}
+	return mw
+}
+
 type MonitoringResponseWriter struct {
 	http.ResponseWriter
 	ri   ResponseInfo
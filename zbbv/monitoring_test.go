@@ -0,0 +1,188 @@
+package zbbv
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// exactQuantile quantileと同じ順位の値
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func checkSketchAccuracy(t *testing.T, name string, ls *latencySketch, vl []float64) {
+	t.Helper()
+	sorted := append([]float64(nil), vl...)
+	sort.Float64s(sorted)
+	for _, q := range []float64{0.5, 0.9, 0.95, 0.99} {
+		want := exactQuantile(sorted, q)
+		got := ls.quantile(q)
+		if math.Abs(got-want) > sketchAccuracy*want+1e-9 {
+			t.Errorf("%s p%g: got %g, want %g（相対誤差 %g）", name, q*100, got, want, math.Abs(got-want)/want)
+		}
+	}
+}
+
+func TestLatencySketchQuantile(t *testing.T) {
+	// 一様分布
+	uniform := make([]float64, 0, 10000)
+	for i := 1; i <= 10000; i++ {
+		uniform = append(uniform, float64(i)/10)
+	}
+	// 裾の長い分布
+	rnd := rand.New(rand.NewSource(1))
+	lognormal := make([]float64, 0, 10000)
+	for i := 0; i < 10000; i++ {
+		lognormal = append(lognormal, math.Exp(rnd.NormFloat64()*1.5+2))
+	}
+	for _, tc := range []struct {
+		name string
+		vl   []float64
+	}{
+		{"uniform", uniform},
+		{"lognormal", lognormal},
+	} {
+		ls := newLatencySketch()
+		sum, max := 0.0, 0.0
+		for _, v := range tc.vl {
+			ls.add(v)
+			sum += v
+			max = math.Max(max, v)
+		}
+		checkSketchAccuracy(t, tc.name, ls, tc.vl)
+		st := ls.stats()
+		if st.Count != uint64(len(tc.vl)) || st.Max != max || math.Abs(st.Mean-sum/float64(len(tc.vl))) > 1e-9 {
+			t.Errorf("%s: stats %+v", tc.name, st)
+		}
+		// 最大値を超えない
+		if got := ls.quantile(1); got > max || math.Abs(got-max) > sketchAccuracy*max {
+			t.Errorf("%s p100: got %g, want %g", tc.name, got, max)
+		}
+	}
+}
+
+func TestLatencySketchZero(t *testing.T) {
+	ls := newLatencySketch()
+	if st := ls.stats(); st != (LatencyStats{}) {
+		t.Errorf("空 %+v", st)
+	}
+	// sketchMinValue未満は0として数える
+	for i := 0; i < 60; i++ {
+		ls.add(sketchMinValue / 2)
+	}
+	for i := 0; i < 40; i++ {
+		ls.add(10)
+	}
+	if got := ls.quantile(0.5); got != 0 {
+		t.Errorf("p50: got %g, want 0", got)
+	}
+	if got := ls.quantile(0.9); math.Abs(got-10) > 10*sketchAccuracy {
+		t.Errorf("p90: got %g, want 10", got)
+	}
+}
+
+func TestLatencySketchMerge(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	all := newLatencySketch()
+	parts := []*latencySketch{newLatencySketch(), newLatencySketch(), newLatencySketch()}
+	vl := make([]float64, 0, 9000)
+	for i := 0; i < 9000; i++ {
+		v := rnd.ExpFloat64() * 50
+		if i%100 == 0 {
+			v = 0
+		}
+		vl = append(vl, v)
+		all.add(v)
+		// 分によって分布が偏るように
+		parts[int(v)%len(parts)].add(v)
+	}
+	merged := newLatencySketch()
+	for _, ls := range parts {
+		merged.merge(ls)
+	}
+	// 足し合わせたスケッチは1つのスケッチに全部数えたものと同じ
+	want, got := all.stats(), merged.stats()
+	if got.Count != want.Count || got.P50 != want.P50 || got.P90 != want.P90 || got.P95 != want.P95 ||
+		got.P99 != want.P99 || got.Max != want.Max || math.Abs(got.Mean-want.Mean) > 1e-9 {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	checkSketchAccuracy(t, "merged", merged, vl)
+	// 足し合わせても元のスケッチは変わらない
+	n := uint64(0)
+	for _, ls := range parts {
+		n += ls.count
+	}
+	if n != all.count {
+		t.Errorf("元のスケッチの件数 %d, want %d", n, all.count)
+	}
+}
+
+func TestMonitorRingRotate(t *testing.T) {
+	const uri = "/api/zaif/1/oldstream/btc_jpy"
+	route := routePattern(uri)
+	t0 := time.Date(2023, 11, 15, 10, 0, 0, 0, jst)
+	mr := newMonitorRing(t0)
+	// まだ締めた分が無い
+	res := mr.result(t0)
+	for _, w := range monitorWindows {
+		if mw := res.Windows[w.name]; mw.Total.Count != 0 || time.Time(mw.Start).Equal(t0) == false {
+			t.Errorf("%s: 締める前 %+v", w.name, mw)
+		}
+	}
+	// i分目はi+1件、応答時間はi+1ミリ秒
+	const minutes = 65
+	at := func(i int) time.Time { return t0.Add(time.Duration(i) * time.Minute) }
+	for i := 0; i < minutes; i++ {
+		for j := 0; j <= i; j++ {
+			start := at(i).Add(time.Duration(j) * time.Millisecond)
+			mr.add(ResponseInfo{uri: uri, status: 200, start: start, end: start.Add(time.Duration(i+1) * time.Millisecond)})
+		}
+		if i == minutes-1 {
+			mr.add(ResponseInfo{uri: uri, status: 404, start: at(i), end: at(i).Add(time.Millisecond)})
+		}
+		mr.rotate(at(i + 1))
+	}
+	// 締めていない分は数えない
+	mr.add(ResponseInfo{uri: uri, status: 200, start: at(minutes), end: at(minutes).Add(time.Hour)})
+	if len(mr.minutes) != 60 {
+		t.Errorf("保持している分 %d", len(mr.minutes))
+	}
+	res = mr.result(at(minutes))
+	for _, tc := range []struct {
+		name  string
+		first int // 期間の最初の分
+		ng    uint64
+	}{
+		{"1m", minutes - 1, 1},
+		{"5m", minutes - 5, 1},
+		{"1h", minutes - 60, 1},
+	} {
+		mw := res.Windows[tc.name]
+		var ok uint64
+		for i := tc.first; i < minutes; i++ {
+			ok += uint64(i + 1)
+		}
+		if time.Time(mw.Start).Equal(at(tc.first)) == false {
+			t.Errorf("%s: Start %v, want %v", tc.name, time.Time(mw.Start).In(jst), at(tc.first))
+		}
+		if mw.OK != ok || mw.NG != tc.ng || mw.Total.Count != ok+tc.ng {
+			t.Errorf("%s: ok:%d ng:%d count:%d, want ok:%d ng:%d", tc.name, mw.OK, mw.NG, mw.Total.Count, ok, tc.ng)
+		}
+		if mw.Total.Max != minutes {
+			t.Errorf("%s: Max %g", tc.name, mw.Total.Max)
+		}
+		if st := mw.Routes[route]["2xx"]; st.Count != ok {
+			t.Errorf("%s: 2xx %+v", tc.name, st)
+		}
+		if st := mw.Routes[route]["4xx"]; st.Count != tc.ng || st.Max != 1 {
+			t.Errorf("%s: 4xx %+v", tc.name, st)
+		}
+	}
+	// 1分の期間は最後の1分だけ
+	if p50 := res.Windows["1m"].Routes[route]["2xx"].P50; math.Abs(p50-minutes) > minutes*sketchAccuracy {
+		t.Errorf("1m p50 %g", p50)
+	}
+}
@@ -0,0 +1,756 @@
+package zbbv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PairAPIPrefix 取引所毎のAPIの接頭辞 /api/{取引所}/1/
+func PairAPIPrefix(exchange string) string {
+	return "/api/" + exchange + "/1/"
+}
+
+var (
+	ErrPairExists       = errors.New("通貨ペアは既に起動しています")
+	ErrPairNotFound     = errors.New("通貨ペアが見つかりません")
+	ErrExchangeNotFound = errors.New("取引所が見つかりません")
+)
+
+// PairID 取引所と通貨ペアの組
+type PairID struct {
+	Exchange string `json:"exchange"`
+	Pair     string `json:"pair"`
+}
+
+// Pair 通貨ペア毎のgoroutine一式とハンドラ
+type Pair struct {
+	key      string
+	ex       Exchange
+	root     string
+	conf     *Config
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	handlers map[string]http.Handler
+	store    Store
+	hub      *StreamHub
+	candles  *CandleSet
+	book     *OrderBook
+	// ハンドラに公開するデータ
+	oldstream *publisher[StoreDataArray]
+	lastprice *publisher[LastPrice]
+	ticks     *publisher[[]Ticker]
+	gaps      *gapTracker
+	metrics   *pairMetrics
+	health    *pairHealth
+}
+
+type registryExchange struct {
+	ex   Exchange
+	root string
+}
+
+// PairRegistry 起動中の通貨ペアを管理する
+type PairRegistry struct {
+	sync.RWMutex
+	ctx       context.Context
+	conf      *Config
+	exchanges map[string]registryExchange
+	pairs     map[PairID]*Pair
+	// 起動処理中の通貨ペア
+	starting map[PairID]struct{}
+}
+
+func newPairRegistry(conf *Config) (*PairRegistry, error) {
+	reg := &PairRegistry{
+		conf:      conf,
+		exchanges: make(map[string]registryExchange, len(conf.Exchanges)),
+		pairs:     make(map[PairID]*Pair),
+		starting:  make(map[PairID]struct{}),
+	}
+	for i := range conf.Exchanges {
+		ec := &conf.Exchanges[i]
+		ex, err := newExchange(*ec)
+		if err != nil {
+			return nil, err
+		}
+		reg.exchanges[ec.Name] = registryExchange{ex: ex, root: ec.dataPath(conf.RootDataPath)}
+	}
+	return reg, nil
+}
+
+// run 通貨ペアの起動に使う親contextを設定する
+func (reg *PairRegistry) run(ctx context.Context) {
+	reg.Lock()
+	defer reg.Unlock()
+	reg.ctx = ctx
+}
+
+// Exchanges 登録されている取引所の一覧（昇順）
+func (reg *PairRegistry) Exchanges() []string {
+	l := make([]string, 0, len(reg.exchanges))
+	for name := range reg.exchanges {
+		l = append(l, name)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// Start 通貨ペアの処理を起動してハンドラを登録する
+// 保存先を開く処理（前の日のファイルの圧縮など）は時間がかかるのでロックの外で行う
+func (reg *PairRegistry) Start(id PairID) error {
+	if currencyPairRegexp.MatchString(id.Pair) == false {
+		return fmt.Errorf("通貨ペアの形式が不正です。pair:%q", id.Pair)
+	}
+	rex, ok := reg.exchanges[id.Exchange]
+	if ok == false {
+		return ErrExchangeNotFound
+	}
+	reg.Lock()
+	_, exists := reg.pairs[id]
+	_, starting := reg.starting[id]
+	ctx := reg.ctx
+	switch {
+	case exists || starting:
+		reg.Unlock()
+		return ErrPairExists
+	case ctx == nil:
+		reg.Unlock()
+		return errors.New("通貨ペア管理が起動していません")
+	case ctx.Err() != nil:
+		reg.Unlock()
+		return ctx.Err()
+	}
+	// 同じ通貨ペアの保存先を同時に開かないように予約しておく
+	reg.starting[id] = struct{}{}
+	reg.Unlock()
+
+	p, err := startPair(ctx, reg.conf, rex, id.Pair)
+
+	reg.Lock()
+	delete(reg.starting, id)
+	if err == nil {
+		if _, ok := reg.pairs[id]; ok {
+			err = ErrPairExists
+		} else if ctx.Err() != nil {
+			// 起動している間にStopAllされた
+			err = ctx.Err()
+		} else {
+			reg.pairs[id] = p
+		}
+	}
+	reg.Unlock()
+	if err != nil {
+		if p != nil {
+			p.stop()
+		}
+		return err
+	}
+	log.Infow("通貨ペアを起動しました。", "exchange", id.Exchange, "key", id.Pair)
+	return nil
+}
+
+// Stop 通貨ペアの処理を停止してハンドラを外す
+// goroutineが全て終了するまで待機する
+func (reg *PairRegistry) Stop(id PairID) error {
+	reg.Lock()
+	p, ok := reg.pairs[id]
+	if ok {
+		delete(reg.pairs, id)
+	}
+	reg.Unlock()
+	if ok == false {
+		return ErrPairNotFound
+	}
+	p.stop()
+	log.Infow("通貨ペアを停止しました。", "exchange", id.Exchange, "key", id.Pair)
+	return nil
+}
+
+// StopAll 全ての通貨ペアを停止する
+func (reg *PairRegistry) StopAll() {
+	reg.Lock()
+	pl := make([]*Pair, 0, len(reg.pairs))
+	for id, p := range reg.pairs {
+		pl = append(pl, p)
+		delete(reg.pairs, id)
+	}
+	reg.Unlock()
+	var wg sync.WaitGroup
+	for _, p := range pl {
+		wg.Add(1)
+		go func(p *Pair) {
+			defer wg.Done()
+			p.stop()
+		}(p)
+	}
+	wg.Wait()
+}
+
+// Keys 起動中の通貨ペア一覧（昇順）
+func (reg *PairRegistry) Keys() []PairID {
+	reg.RLock()
+	defer reg.RUnlock()
+	keys := make([]PairID, 0, len(reg.pairs))
+	for id := range reg.pairs {
+		keys = append(keys, id)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Exchange != keys[j].Exchange {
+			return keys[i].Exchange < keys[j].Exchange
+		}
+		return keys[i].Pair < keys[j].Pair
+	})
+	return keys
+}
+
+// ServeHTTP /api/{取引所}/1/{種類}/{通貨ペア} を各通貨ペアのハンドラに振り分ける
+func (reg *PairRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, kind, ok := splitPairPath(r.URL.Path)
+	if ok == false {
+		http.NotFound(w, r)
+		return
+	}
+	reg.RLock()
+	p, ok := reg.pairs[id]
+	reg.RUnlock()
+	if ok == false {
+		http.NotFound(w, r)
+		return
+	}
+	h, ok := p.handlers[kind]
+	if ok == false {
+		http.NotFound(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+func splitPairPath(path string) (id PairID, kind string, ok bool) {
+	// /api/{取引所}/1/{種類}/{通貨ペア}
+	l := strings.Split(path, "/")
+	if len(l) != 6 || l[0] != "" || l[1] != "api" || l[3] != "1" {
+		return PairID{}, "", false
+	}
+	if l[2] == "" || l[4] == "" || l[5] == "" {
+		return PairID{}, "", false
+	}
+	return PairID{Exchange: l[2], Pair: l[5]}, l[4], true
+}
+
+func startPair(parent context.Context, conf *Config, rex registryExchange, key string) (*Pair, error) {
+	st, err := openStore(conf, rex.root, key)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(parent)
+	p := &Pair{
+		store:     st,
+		key:       key,
+		ex:        rex.ex,
+		root:      rex.root,
+		conf:      conf,
+		cancel:    cancel,
+		hub:       newStreamHub(conf.RelayQueueSize),
+		candles:   newCandleSet(conf.CandleRebuildDays),
+		book:      newOrderBook(),
+		oldstream: newPublisher[StoreDataArray](encodeStoreDataArray),
+		lastprice: newPublisher[LastPrice](nil),
+		ticks:     newPublisher[[]Ticker](nil),
+		gaps:      newGapTracker(st, key),
+		metrics:   newPairMetrics(rex.ex.Name(), key),
+		health:    newPairHealth(time.Now()),
+	}
+	sch := make(chan Stream, 8)
+	storesch := make(chan StoreData, 256)
+	bookch := make(chan BookSnapshot, 64)
+	// まとめて起動
+	p.wg.Add(7)
+	go p.streamReaderProc(ctx, sch)
+	go p.streamStoreProc(ctx, sch, storesch, bookch)
+	go p.storeWriterProc(storesch)
+	go p.getDepthProc(ctx, bookch)
+	go p.bookWriterProc(ctx, bookch)
+	go p.getTickerProc(ctx)
+	go p.retentionProc(ctx)
+	// URL設定
+	p.handlers = map[string]http.Handler{
+		"oldstream": &OldStreamHandler{cp: key, pub: p.oldstream},
+		"lastprice": &LastPriceHandler{cp: key, pub: p.lastprice},
+		"depth":     &DepthHandler{cp: key, book: p.book},
+		"ticks":     &TicksHandler{cp: key, pub: p.ticks},
+		"stream":    &StreamRelayHandler{cp: key, hub: p.hub},
+		"events":    &EventStreamHandler{cp: key, hub: p.hub, oldstream: p.oldstream, lastprice: p.lastprice},
+		"history":   &HistoryHandler{cp: key, root: p.root, st: p.store},
+		"candles":   &CandlesHandler{cp: key, cs: p.candles},
+		"book":      &BookHandler{cp: key, root: p.root},
+		"gaps":      &GapsHandler{cp: key, gaps: p.gaps},
+	}
+	return p, nil
+}
+
+func (p *Pair) stop() {
+	p.cancel()
+	p.wg.Wait()
+	p.hub.Close()
+	p.gaps.shutdown(time.Now())
+	// storeWriterProcは終了しているのでここで書き込む
+	p.appendGapMarks()
+	if err := p.store.Close(); err != nil {
+		log.Warnw("保存先を閉じるのに失敗しました。", "error", err, "key", p.key)
+	}
+}
+
+// streamRetryJitter 再接続までの待ち時間に足す乱数の上限
+var streamRetryJitter = 5 * time.Second
+
+func (p *Pair) streamReaderProc(ctx context.Context, wsch chan<- Stream) {
+	defer p.wg.Done()
+	wait := time.Duration(rand.Int63n(int64(streamRetryJitter)))
+	name := p.ex.Name()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infow("streamReaderProc終了", "exchange", name, "key", p.key)
+			return
+		case <-time.After(wait):
+		}
+		exit := func() (exit bool) {
+			ch := make(chan error, 1)
+			dialctx, dialcancel := context.WithTimeout(ctx, time.Second*7)
+			defer dialcancel()
+			defer close(ch) // 複数回作成される可能性があるためクローズしておく
+			con, dialerr := p.ex.Subscribe(dialctx, p.key)
+			if dialerr != nil {
+				// Dialが失敗した理由がよくわからない
+				// contextを伝搬してきた通知で失敗した？普通にタイムアウトした？
+				// 先の処理に丸投げ
+				ch <- dialerr
+			} else {
+				defer con.Close()
+				log.Infow("Websoket接続開始", "exchange", name, "key", p.key)
+				p.health.setConnected(time.Now(), true)
+				defer func() { p.health.setConnected(time.Now(), false) }()
+				p.wg.Add(1)
+				go func() {
+					defer p.wg.Done()
+					for i := 0; ; i++ {
+						s, err := con.Read()
+						if err != nil {
+							ch <- err
+							return
+						}
+						now := time.Now()
+						p.health.message(now)
+						if i == 0 {
+							// 最初のメッセージが届いたら欠損を終える
+							p.gaps.close(now)
+						}
+						select {
+						case wsch <- s:
+						case <-ctx.Done():
+							ch <- ctx.Err()
+							return
+						}
+					}
+				}()
+			}
+			select {
+			case <-ctx.Done():
+				// シャットダウンする場合
+				if con != nil {
+					con.Close()
+				}
+				<-ch
+				exit = true
+			case err := <-ch:
+				// 普通の通信異常（リトライするやつ）
+				log.Warnw("websocket通信が切断されました。", "error", err, "exchange", name, "key", p.key)
+				if dialerr != nil {
+					p.metrics.dialRetries.Inc()
+					p.gaps.open(time.Now(), GapDial, err)
+				} else {
+					p.metrics.readRetries.Inc()
+					// 切断に気付くのは読み込みが失敗した時なので、最後に受信した時刻から欠損を始める
+					start := p.health.lastReceived()
+					if start.IsZero() {
+						start = time.Now()
+					}
+					p.gaps.open(start, GapRead, err)
+				}
+				exit = false
+			}
+			return exit
+		}()
+		if exit {
+			log.Infow("streamReaderProc終了", "exchange", name, "key", p.key)
+			return
+		}
+		if wait < 180*time.Second {
+			wait *= 2
+			wait += time.Duration(rand.Int63n(int64(streamRetryJitter)))
+		}
+	}
+}
+
+// storeQueueMax 保存待ちとしてメモリ上に溜めておくStoreDataの上限
+// ディスクが遅い間も受信・板・配信を止めないように溜めておき、超えた分は捨てて数える
+const storeQueueMax = 100000
+
+// streamStoreProc ストリームのメッセージを板・StoreData・ローソク足に反映して公開する
+// メモリ上のStoreDataArrayは公開した写しと配列を共有するので、プールには返さない
+// 保存はstoreWriterProcに任せ、書き込みが追いつかない分はpendingに溜める
+// 終了する時は溜めた分を全て渡してからwschを閉じる
+func (p *Pair) streamStoreProc(ctx context.Context, rsch <-chan Stream, wsch chan<- StoreData, bookch chan<- BookSnapshot) {
+	defer p.wg.Done()
+	var pending []StoreData
+	dropped := 0
+	defer func() {
+		for _, sd := range pending {
+			wsch <- sd
+		}
+		close(wsch)
+	}()
+	oldstream := Stream{}
+	loaded, err := p.store.LoadRing()
+	if err != nil {
+		log.Warnw("バッファの読み込みに失敗しました。", "error", err, "key", p.key)
+	}
+	sda := append(make(StoreDataArray, 0, p.conf.StoreDataMax+1), loaded...)
+	if loaded != nil {
+		loaded.Close()
+	}
+	// 最初のメッセージが届くまでは読み込んだバッファの最後の時刻
+	meta := DataMeta{Source: DataSourceRestored}
+	if len(sda) > 0 {
+		meta.AsOf = time.Time(sda[len(sda)-1].Timestamp)
+	}
+	publish := func() {
+		// 容量を切り詰めて、公開した後に追加したものが見えないようにする
+		p.oldstream.Publish(sda[:len(sda):len(sda)], meta)
+		p.lastprice.Publish(oldstream.LastPrice, meta)
+	}
+	publish()
+	// 再起動の前に取り込んだ約定を重複して保存しないように
+	tt := newTradeTracker()
+	tt.restore(sda)
+	// ローソク足はアーカイブから作り直している間も更新しておき、出来上がったら置き換える
+	rebuiltch := make(chan *CandleSet, 1)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		rs, err := rebuildCandleSet(p.store, p.conf.CandleRebuildDays, time.Now())
+		if err != nil {
+			log.Warnw("ローソク足の作り直しに失敗しました。", "error", err, "key", p.key)
+		}
+		rebuiltch <- rs
+	}()
+	defer func() {
+		if len(sda) > 0 {
+			err := p.store.SaveRing(sda)
+			if err != nil {
+				log.Warnw("バッファの保存に失敗しました。", "error", err, "key", p.key)
+			}
+		}
+	}()
+	for {
+		var out chan<- StoreData
+		var next StoreData
+		if len(pending) > 0 {
+			out = wsch
+			next = pending[0]
+		}
+		select {
+		case <-ctx.Done():
+			log.Infow("streamStoreProc終了", "key", p.key, "pending", len(pending))
+			return
+		case out <- next:
+			pending[0] = StoreData{}
+			pending = pending[1:]
+			if len(pending) == 0 {
+				pending = nil
+				if dropped > 0 {
+					log.Warnw("保存待ちが溢れて捨てたStoreDataがあります。", "key", p.key, "count", dropped)
+					dropped = 0
+				}
+			}
+		case s := <-rsch:
+			p.metrics.messages.Inc()
+			p.book.Update(s)
+			p.sendBook(bookch)
+			sdl := streamToStoreData(s, oldstream, tt)
+			oldstream = s
+			meta = DataMeta{AsOf: s.Timestamp, Source: DataSourceStream}
+			for _, sd := range sdl {
+				sda.Push(sd, p.conf.StoreDataMax)
+				p.candles.AddStoreData(sd)
+				p.hub.Publish(StreamEvent{Data: sd, LastPrice: s.LastPrice})
+				if len(pending) >= storeQueueMax {
+					if dropped == 0 {
+						log.Warnw("保存待ちが溢れました。書き込めるまで捨てます。", "key", p.key, "max", storeQueueMax)
+					}
+					dropped++
+					p.metrics.queueDropped.Inc()
+					continue
+				}
+				pending = append(pending, sd)
+				// storeWriterProcが受け取った時に減らす
+				p.metrics.queueLength.Inc()
+			}
+			publish()
+		case rs := <-rebuiltch:
+			p.candles.replace(rs, sda)
+		}
+	}
+}
+
+// storeWriterProc 保存先への書き込み
+// 日本時間の0時になったらStoreDataが届かなくても前の日のファイルを閉じる
+// 同期する時に異常終了に備えて最後に受信した時刻も保存する
+// 欠損の印は溜まっていれば次のStoreDataの前か同期する時に書き込む
+// streamStoreProcがrschを閉じるまで書き込み、保存先はstopで閉じる
+func (p *Pair) storeWriterProc(rsch <-chan StoreData) {
+	defer p.wg.Done()
+	tc := time.NewTicker(storeFlushInterval)
+	defer tc.Stop()
+	untilMidnight := func() time.Duration {
+		return time.Until(dayStart(time.Now()).AddDate(0, 0, 1))
+	}
+	mt := time.NewTimer(untilMidnight())
+	defer mt.Stop()
+	for {
+		select {
+		case <-mt.C:
+			if err := p.store.Rotate(time.Now()); err != nil {
+				log.Warnw("ストリームのファイルの切り替えに失敗しました。", "error", err, "key", p.key)
+			}
+			mt.Reset(untilMidnight())
+		case <-tc.C:
+			p.appendGapMarks()
+			if err := p.store.Flush(); err != nil {
+				log.Warnw("ストリームの同期に失敗しました。", "error", err, "key", p.key)
+			}
+			p.gaps.heartbeat(p.health.lastReceived())
+		case sd, ok := <-rsch:
+			if ok == false {
+				log.Infow("storeWriterProc終了", "key", p.key)
+				return
+			}
+			p.metrics.queueLength.Dec()
+			p.appendGapMarks()
+			err := p.store.Append(sd)
+			p.health.write(time.Now(), err)
+			if err != nil {
+				p.metrics.writeErrors.Inc()
+				log.Warnw("ストリームの保存に失敗しました。", "error", err, "key", p.key)
+			} else {
+				p.metrics.written.Inc()
+			}
+		}
+	}
+}
+
+// appendGapMarks 欠損の印をストリームのアーカイブに追記する
+// Appendと同じgoroutineから呼ぶ
+func (p *Pair) appendGapMarks() {
+	for _, sd := range p.gaps.takeMarks() {
+		if err := p.store.Append(sd); err != nil {
+			log.Warnw("欠損の印の保存に失敗しました。", "error", err, "key", p.key, "start", time.Time(sd.Gap.Start))
+		}
+	}
+}
+
+func (p *Pair) getTickerProc(ctx context.Context) {
+	defer p.wg.Done()
+	sl, err := p.store.LoadTickers()
+	if err != nil {
+		log.Warnw("ティッカーの読み込みに失敗しました。", "error", err, "key", p.key)
+	}
+	tl := ticksFromSnapshots(sl)
+	// 最後の日をどこから取ったか
+	src := DataSourceCache
+	publish := func() {
+		p.ticks.Publish(copyTicks(tl), ticksMeta(tl, src, time.Now()))
+	}
+	publish()
+	// 欠けている日はアーカイブの約定から補う
+	builtch := make(chan []Ticker, 1)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		btl, err := buildTicks(p.store, p.root, p.key, time.Now(), false, DefaultTickTolerance, func(r TickReport) {
+			if r.Snapshot == nil {
+				log.Infow("日毎のティッカーをアーカイブから補いました。", "report", r.String())
+			} else {
+				log.Warnw("スナップショットとアーカイブが食い違っています。", "report", r.String())
+			}
+		})
+		if err != nil {
+			log.Warnw("日毎のティッカーの作り直しに失敗しました。", "error", err, "key", p.key)
+			btl = nil
+		}
+		builtch <- btl
+	}()
+	old := time.Now()
+	// 日付が変わってから取得できるまで再試行する
+	var pending time.Time
+	retry := 0
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infow("getTickerProc終了", "key", p.key)
+			return
+		case btl := <-builtch:
+			if btl != nil {
+				tl = mergeTicks(btl, tl)
+				publish()
+			}
+		case now := <-t.C:
+			if now.Day() != old.Day() {
+				pending = dayStart(old)
+				retry = 0
+			}
+			old = now
+			if pending.IsZero() {
+				break
+			}
+			date := pending.Format("20060102")
+			zt, err := p.ex.Ticker(ctx, p.key)
+			if err != nil {
+				p.metrics.tickerErrors.Inc()
+				retry++
+				log.Warnw("ティッカーの取得に失敗しました。", "error", err, "key", p.key, "date", date, "retry", retry)
+				if retry < tickRetryMax {
+					break
+				}
+			} else {
+				p.health.ticker(time.Now())
+				if err := p.store.SaveTicker(date, zt); err != nil {
+					log.Warnw("ティッカーの保存に失敗しました。", "error", err, "key", p.key, "date", date)
+				}
+			}
+			day := pending
+			pending = time.Time{}
+			at, ok, aerr := archiveTicker(p.store, day)
+			if aerr == nil && ok {
+				if zt != nil {
+					if fl := compareTicker(at, zt, DefaultTickTolerance); len(fl) > 0 {
+						log.Warnw("スナップショットとアーカイブが食い違っています。", "report", TickReport{Pair: p.key, Date: date, Archive: at, Snapshot: zt, Fields: fl}.String())
+					}
+				}
+				src = DataSourceCache
+				tl = mergeTicks([]Ticker{at}, tl)
+				publish()
+				break
+			}
+			if zt == nil {
+				// 後で起動した時にアーカイブから補う
+				break
+			}
+			var open float64
+			if len(tl) > 0 {
+				open = tl[len(tl)-1].Close
+			} else {
+				open = zt.Last
+			}
+			src = DataSourcePoll
+			tl = mergeTicks([]Ticker{{
+				Date:   date,
+				Open:   open,
+				Close:  zt.Last,
+				High:   zt.High,
+				Low:    zt.Low,
+				Vwap:   zt.Vwap,
+				Volume: zt.Volume,
+			}}, tl)
+			publish()
+		}
+	}
+}
+
+// getDepthProc 板情報APIを定期的に取得する
+// ストリームから板が更新されている間は使われない
+func (p *Pair) getDepthProc(ctx context.Context, bookch chan<- BookSnapshot) {
+	defer p.wg.Done()
+	p.seedDepth(ctx, bookch)
+	tc := time.NewTicker(time.Second * 30)
+	defer tc.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infow("getDepthProc終了", "key", p.key)
+			return
+		case <-tc.C:
+			p.seedDepth(ctx, bookch)
+		}
+	}
+}
+
+func (p *Pair) seedDepth(ctx context.Context, bookch chan<- BookSnapshot) {
+	d, err := p.ex.Depth(ctx, p.key)
+	if err != nil {
+		p.metrics.depthErrors.Inc()
+		log.Warnw("板情報の取得に失敗しました。", "error", err, "key", p.key)
+		return
+	}
+	now := time.Now()
+	p.health.depth(now)
+	if p.book.Seed(d, now) {
+		log.Debugw("板情報APIの値で板を更新しました。", "key", p.key)
+		p.sendBook(bookch)
+	}
+}
+
+// sendBook 板の写しをbookWriterProcに送る
+// 書き出しは前回書き出した板との差分なので、溢れて届かなかった分は次の差分に含まれる
+func (p *Pair) sendBook(bookch chan<- BookSnapshot) {
+	select {
+	case bookch <- p.book.Snapshot():
+	default:
+		p.metrics.bookDropped.Inc()
+	}
+}
+
+func (p *Pair) bookWriterProc(ctx context.Context, bookch <-chan BookSnapshot) {
+	defer p.wg.Done()
+	bw := newBookWriter(p.root, p.key)
+	defer bw.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infow("bookWriterProc終了", "key", p.key)
+			return
+		case bs := <-bookch:
+			if err := bw.Write(bs); err != nil {
+				log.Warnw("板の書き出しに失敗しました。", "error", err, "key", p.key)
+			}
+		}
+	}
+}
+
+// retentionProc 保持期間を過ぎたデータを定期的に片付ける
+func (p *Pair) retentionProc(ctx context.Context) {
+	defer p.wg.Done()
+	tc := time.NewTimer(retentionDelay)
+	defer tc.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infow("retentionProc終了", "key", p.key)
+			return
+		case <-tc.C:
+			if err := applyRetention(ctx, p.store, p.root, p.key, p.conf.Retention, time.Now()); err != nil {
+				log.Warnw("保持期間を過ぎたデータの片付けに失敗しました。", "error", err, "key", p.key)
+			}
+			tc.Reset(retentionInterval)
+		}
+	}
+}
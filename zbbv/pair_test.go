@@ -0,0 +1,309 @@
+package zbbv
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// offlineExchange どこにも接続できない取引所
+type offlineExchange struct{}
+
+var errOffline = errors.New("offline")
+
+func (offlineExchange) Name() string { return DefaultExchange }
+func (offlineExchange) Subscribe(ctx context.Context, pair string) (StreamConn, error) {
+	return nil, errOffline
+}
+func (offlineExchange) Depth(ctx context.Context, pair string) (*Depth, error) {
+	return nil, errOffline
+}
+func (offlineExchange) Ticker(ctx context.Context, pair string) (*Ticker24h, error) {
+	return nil, errOffline
+}
+
+func TestPairRegistryStartOutsideLock(t *testing.T) {
+	const backend = "test-blocking"
+	opened := make(chan struct{}, 2)
+	release := make(chan struct{})
+	storeFactories[backend] = func(conf *Config, root, key string) (Store, error) {
+		opened <- struct{}{}
+		<-release
+		return newFileStore(conf, root, key)
+	}
+	defer delete(storeFactories, backend)
+
+	conf := NewConfig()
+	conf.Store = backend
+	conf.RootDataPath = t.TempDir()
+	reg := &PairRegistry{
+		conf:      conf,
+		exchanges: map[string]registryExchange{DefaultExchange: {ex: offlineExchange{}, root: conf.RootDataPath}},
+		pairs:     make(map[PairID]*Pair),
+		starting:  make(map[PairID]struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reg.run(ctx)
+
+	id := PairID{Exchange: DefaultExchange, Pair: "btc_jpy"}
+	errch := make(chan error, 1)
+	go func() {
+		errch <- reg.Start(id)
+	}()
+	select {
+	case <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("保存先が開かれません")
+	}
+	// 保存先を開いている間も他の操作は待たされない
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if keys := reg.Keys(); len(keys) != 0 {
+			t.Errorf("Keys = %v", keys)
+		}
+		if err := reg.Start(id); err != ErrPairExists {
+			t.Errorf("起動中の通貨ペアのStart = %v, want ErrPairExists", err)
+		}
+		if err := reg.Stop(id); err != ErrPairNotFound {
+			t.Errorf("起動中の通貨ペアのStop = %v, want ErrPairNotFound", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("保存先を開いている間ロックが取れません")
+	}
+	close(release)
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+	if keys := reg.Keys(); len(keys) != 1 || keys[0] != id {
+		t.Errorf("Keys = %v", keys)
+	}
+	if err := reg.Start(id); err != ErrPairExists {
+		t.Errorf("Start = %v, want ErrPairExists", err)
+	}
+	if err := reg.Stop(id); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPairRegistryStartCanceled(t *testing.T) {
+	const backend = "test-canceled"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	storeFactories[backend] = func(conf *Config, root, key string) (Store, error) {
+		// 開いている間に停止された
+		cancel()
+		return newFileStore(conf, root, key)
+	}
+	defer delete(storeFactories, backend)
+
+	conf := NewConfig()
+	conf.Store = backend
+	conf.RootDataPath = t.TempDir()
+	reg := &PairRegistry{
+		conf:      conf,
+		exchanges: map[string]registryExchange{DefaultExchange: {ex: offlineExchange{}, root: conf.RootDataPath}},
+		pairs:     make(map[PairID]*Pair),
+		starting:  make(map[PairID]struct{}),
+	}
+	reg.run(ctx)
+	id := PairID{Exchange: DefaultExchange, Pair: "btc_jpy"}
+	if err := reg.Start(id); err != context.Canceled {
+		t.Errorf("Start = %v, want context.Canceled", err)
+	}
+	if keys := reg.Keys(); len(keys) != 0 {
+		t.Errorf("Keys = %v", keys)
+	}
+}
+
+// chanExchange chに送ったメッセージをストリームとして返す取引所
+type chanExchange struct {
+	offlineExchange
+	conn *chanConn
+}
+
+type chanConn struct {
+	ch   chan Stream
+	done chan struct{}
+	once sync.Once
+}
+
+func (e chanExchange) Subscribe(ctx context.Context, pair string) (StreamConn, error) {
+	return e.conn, nil
+}
+
+func (c *chanConn) Read() (Stream, error) {
+	select {
+	case s := <-c.ch:
+		return s, nil
+	case <-c.done:
+		return Stream{}, errOffline
+	}
+}
+
+func (c *chanConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+// slowStore gateを閉じるまでAppendが戻らない保存先
+type slowStore struct {
+	Store
+	gate chan struct{}
+}
+
+func (s slowStore) Append(sd StoreData) error {
+	<-s.gate
+	return s.Store.Append(sd)
+}
+
+func TestStreamStoreProcDoesNotWaitForWriter(t *testing.T) {
+	defer func(d time.Duration) { streamRetryJitter = d }(streamRetryJitter)
+	streamRetryJitter = time.Millisecond
+	const backend = "test-slow"
+	gate := make(chan struct{})
+	storeFactories[backend] = func(conf *Config, root, key string) (Store, error) {
+		st, err := newFileStore(conf, root, key)
+		return slowStore{Store: st, gate: gate}, err
+	}
+	defer delete(storeFactories, backend)
+
+	conf := NewConfig()
+	conf.Store = backend
+	root := t.TempDir()
+	conn := &chanConn{ch: make(chan Stream), done: make(chan struct{})}
+	queue := storeQueueLength.WithLabelValues(DefaultExchange, "btc_jpy")
+	base := testutil.ToFloat64(queue)
+	p, err := startPair(context.Background(), conf, registryExchange{ex: chanExchange{conn: conn}, root: root}, "btc_jpy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 書き込みチャネルの容量を超えて送っても受信と公開は止まらない
+	const n = 1000
+	now := time.Now()
+	for i := 1; i <= n; i++ {
+		s := Stream{
+			Trades:    []Trade{{CurrentyPair: "btc_jpy", TradeType: "bid", Price: float64(i), Tid: uint64(i), Amount: 1}},
+			Timestamp: now,
+			LastPrice: LastPrice{Action: "bid", Price: float64(i)},
+		}
+		select {
+		case conn.ch <- s:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d件目で受信が止まりました", i)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if s := p.lastprice.Load(); s != nil && s.data.Price == n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("最後のメッセージが公開されません")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 書き込み中の1件以外は保存待ち
+	for testutil.ToFloat64(queue)-base != n-1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("保存待ちの件数 = %v, want %d", testutil.ToFloat64(queue)-base, n-1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 停止する時は保存待ちを全て書き込む
+	close(gate)
+	p.stop()
+	if got := testutil.ToFloat64(queue) - base; got != 0 {
+		t.Errorf("停止後の保存待ちの件数 = %v", got)
+	}
+	var got []uint64
+	err = readStoreDataFile(createStoreFilePath(root, dayStart(now), "btc_jpy", "tmp"), false, func(sd StoreData) error {
+		if sd.Gap != nil {
+			// 停止した時の欠損の印
+			return nil
+		}
+		got = append(got, sd.Trade.Tid)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != n {
+		t.Fatalf("保存した件数 = %d, want %d", len(got), n)
+	}
+	for i, tid := range got {
+		if tid != uint64(i+1) {
+			t.Fatalf("%d件目のTid = %d", i, tid)
+		}
+	}
+}
+
+func TestStreamReaderReadGapStart(t *testing.T) {
+	defer func(d time.Duration) { streamRetryJitter = d }(streamRetryJitter)
+	streamRetryJitter = time.Millisecond
+	root := t.TempDir()
+	conn := &chanConn{ch: make(chan Stream), done: make(chan struct{})}
+	p, err := startPair(context.Background(), NewConfig(), registryExchange{ex: chanExchange{conn: conn}, root: root}, "btc_jpy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case conn.ch <- Stream{Timestamp: time.Now()}:
+	case <-time.After(5 * time.Second):
+		t.Fatal("受信が始まりません")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.health.lastReceived().IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("受信した時刻が記録されません")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 最後に受信してから切断に気付くまで時間が掛かった
+	last := time.Now().Add(-time.Hour).Truncate(time.Second)
+	p.health.message(last)
+	conn.Close()
+	for {
+		p.gaps.Lock()
+		cur := p.gaps.cur
+		p.gaps.Unlock()
+		if cur != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("欠損が始まりません")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.stop()
+	var gl []Gap
+	err = readStoreDataRange(root, "btc_jpy", last, time.Now().Add(24*time.Hour), func(sd StoreData) error {
+		if sd.Gap != nil {
+			gl = append(gl, *sd.Gap)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 切断の始まりと終わり、停止の始まり
+	if len(gl) != 3 {
+		t.Fatalf("印 = %+v", gl)
+	}
+	for i, g := range gl[:2] {
+		if g.Reason != GapRead || time.Time(g.Start).Equal(last) == false || (g.End != nil) != (i == 1) {
+			t.Errorf("%d: 印 = %+v, want start:%v", i, g, last)
+		}
+	}
+	if gl[2].Reason != GapShutdown || gl[2].End != nil {
+		t.Errorf("停止の印 = %+v", gl[2])
+	}
+}
@@ -0,0 +1,126 @@
+package zbbv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// StoreDataQuery StoreDataの絞り込み条件
+type StoreDataQuery struct {
+	Since  time.Time // この時刻以降（ゼロ値は無制限）
+	Until  time.Time // この時刻より前（ゼロ値は無制限）
+	Limit  int       // 0は無制限
+	Ask    bool
+	Bid    bool
+	Trade  bool
+	Gap    bool // 欠損の印
+	Fields bool // 項目の絞り込みをするか
+}
+
+func parseStoreDataQuery(r *http.Request) (StoreDataQuery, error) {
+	var q StoreDataQuery
+	var err error
+	v := r.URL.Query()
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = ParseTime(s); err != nil {
+			return q, fmt.Errorf("sinceが不正です。%w", err)
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = ParseTime(s); err != nil {
+			return q, fmt.Errorf("untilが不正です。%w", err)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("limitが不正です。limit:%q", s)
+		}
+	}
+	if s := v.Get("fields"); s != "" {
+		q.Fields = true
+		for _, f := range splitList(s) {
+			switch f {
+			case "ask":
+				q.Ask = true
+			case "bid":
+				q.Bid = true
+			case "trade":
+				q.Trade = true
+			case "gap":
+				q.Gap = true
+			default:
+				return q, fmt.Errorf("fieldsが不正です。field:%q", f)
+			}
+		}
+	}
+	return q, nil
+}
+
+// ParseTime UNIX時間（秒）かRFC3339形式の時刻
+func ParseTime(s string) (time.Time, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(i, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("UNIX時間かRFC3339形式で指定してください")
+	}
+	return t, nil
+}
+
+// apply 時刻順に並んだsdaを絞り込む
+// 範囲は二分探索で求めるので、項目の絞り込みが無ければsdaの部分スライスを返す
+func (q StoreDataQuery) apply(sda StoreDataArray) StoreDataArray {
+	start := 0
+	if q.Since.IsZero() == false {
+		start = sda.search(q.Since)
+	}
+	end := len(sda)
+	if q.Until.IsZero() == false {
+		end = sda.search(q.Until)
+	}
+	if end < start {
+		end = start
+	}
+	sda = sda[start:end]
+	if q.Fields {
+		sda = q.filter(sda)
+	}
+	if q.Limit > 0 && len(sda) > q.Limit {
+		sda = sda[len(sda)-q.Limit:]
+	}
+	return sda
+}
+
+func (q StoreDataQuery) filter(sda StoreDataArray) StoreDataArray {
+	res := make(StoreDataArray, 0, len(sda))
+	for _, sd := range sda {
+		if q.Ask == false {
+			sd.Ask = nil
+		}
+		if q.Bid == false {
+			sd.Bid = nil
+		}
+		if q.Trade == false {
+			sd.Trade = nil
+		}
+		if q.Gap == false {
+			sd.Gap = nil
+		}
+		if sd.Ask != nil || sd.Bid != nil || sd.Trade != nil || sd.Gap != nil {
+			res = append(res, sd)
+		}
+	}
+	return res
+}
+
+// search t以降の最初の位置
+func (sda StoreDataArray) search(t time.Time) int {
+	return sort.Search(len(sda), func(i int) bool {
+		return time.Time(sda[i].Timestamp).Before(t) == false
+	})
+}
@@ -0,0 +1,124 @@
+package zbbv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseStoreDataQuery(t *testing.T) {
+	since := time.Date(2023, 11, 15, 10, 0, 0, 0, jst)
+	for _, tc := range []struct {
+		query string
+		want  StoreDataQuery
+		err   bool
+	}{
+		{"", StoreDataQuery{}, false},
+		{"since=1700010000", StoreDataQuery{Since: time.Unix(1700010000, 0)}, false},
+		{"since=2023-11-15T10:00:00%2B09:00", StoreDataQuery{Since: since}, false},
+		{"until=2023-11-15T01:00:00Z", StoreDataQuery{Until: since}, false},
+		{"since=1700010000&until=1700020000&limit=10", StoreDataQuery{Since: time.Unix(1700010000, 0), Until: time.Unix(1700020000, 0), Limit: 10}, false},
+		// untilがsince以前でもエラーにはせず、空の範囲になる
+		{"since=1700020000&until=1700010000", StoreDataQuery{Since: time.Unix(1700020000, 0), Until: time.Unix(1700010000, 0)}, false},
+		{"limit=0", StoreDataQuery{}, false},
+		{"fields=trade", StoreDataQuery{Trade: true, Fields: true}, false},
+		{"fields=ask,bid", StoreDataQuery{Ask: true, Bid: true, Fields: true}, false},
+		{"fields=ask,+bid,,trade,gap", StoreDataQuery{Ask: true, Bid: true, Trade: true, Gap: true, Fields: true}, false},
+		{"since=yesterday", StoreDataQuery{}, true},
+		{"since=2023-11-15", StoreDataQuery{}, true},
+		{"until=1.5", StoreDataQuery{}, true},
+		{"limit=-1", StoreDataQuery{}, true},
+		{"limit=ten", StoreDataQuery{}, true},
+		{"fields=price", StoreDataQuery{}, true},
+		{"fields=trade,ticker", StoreDataQuery{}, true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/zaif/1/oldstream/btc_jpy?"+tc.query, nil)
+		q, err := parseStoreDataQuery(r)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: エラーになりません。%+v", tc.query, q)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.query, err)
+			continue
+		}
+		if q.Since.Equal(tc.want.Since) == false || q.Until.Equal(tc.want.Until) == false || q.Limit != tc.want.Limit ||
+			q.Ask != tc.want.Ask || q.Bid != tc.want.Bid || q.Trade != tc.want.Trade || q.Gap != tc.want.Gap || q.Fields != tc.want.Fields {
+			t.Errorf("%q: got %+v, want %+v", tc.query, q, tc.want)
+		}
+	}
+}
+
+func TestStoreDataQueryApply(t *testing.T) {
+	base := time.Date(2023, 11, 15, 10, 0, 0, 0, jst)
+	at := func(sec int) time.Time { return base.Add(time.Duration(sec) * time.Second) }
+	// 0秒 気配, 10秒 約定1, 10秒 約定2, 20秒 気配と約定3, 30秒 欠損, 40秒 約定4
+	sda := StoreDataArray{
+		{Ask: &PriceAmount{101, 1}, Bid: &PriceAmount{99, 1}, Timestamp: Unixtime(at(0))},
+		tradeData(at(10), 1),
+		tradeData(at(10), 2),
+		tradeData(at(20), 3),
+		{Gap: &Gap{Start: Unixtime(at(25)), Reason: GapRead}, Timestamp: Unixtime(at(30))},
+		tradeData(at(40), 4),
+	}
+	sda[3].Bid = &PriceAmount{98, 1}
+	for _, tc := range []struct {
+		name string
+		q    StoreDataQuery
+		want []int // sdaの位置
+	}{
+		{"無条件", StoreDataQuery{}, []int{0, 1, 2, 3, 4, 5}},
+		{"since", StoreDataQuery{Since: at(10)}, []int{1, 2, 3, 4, 5}},
+		{"sinceが間", StoreDataQuery{Since: at(15)}, []int{3, 4, 5}},
+		// untilは含まない
+		{"until", StoreDataQuery{Until: at(20)}, []int{0, 1, 2}},
+		{"範囲", StoreDataQuery{Since: at(10), Until: at(30)}, []int{1, 2, 3}},
+		{"until=since", StoreDataQuery{Since: at(10), Until: at(10)}, nil},
+		{"untilがsinceより前", StoreDataQuery{Since: at(30), Until: at(10)}, nil},
+		{"範囲外", StoreDataQuery{Since: at(50)}, nil},
+		// limitは新しい方から
+		{"limit", StoreDataQuery{Limit: 2}, []int{4, 5}},
+		{"limitが件数より多い", StoreDataQuery{Limit: 10}, []int{0, 1, 2, 3, 4, 5}},
+		{"範囲とlimit", StoreDataQuery{Until: at(20), Limit: 2}, []int{1, 2}},
+		// limitは絞り込んだ後の件数
+		{"fieldsとlimit", StoreDataQuery{Trade: true, Fields: true, Limit: 3}, []int{2, 3, 5}},
+		{"fields=ask", StoreDataQuery{Ask: true, Fields: true}, []int{0}},
+		{"fields=bid", StoreDataQuery{Bid: true, Fields: true}, []int{0, 3}},
+		{"fields=gap", StoreDataQuery{Gap: true, Fields: true}, []int{4}},
+		{"fields=ask,trade", StoreDataQuery{Ask: true, Trade: true, Fields: true}, []int{0, 1, 2, 3, 5}},
+	} {
+		got := tc.q.apply(sda)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: %d件, want %d件 %+v", tc.name, len(got), len(tc.want), got)
+			continue
+		}
+		for i, j := range tc.want {
+			want := sda[j]
+			if tc.q.Fields {
+				// 指定しなかった項目は消す
+				if tc.q.Ask == false {
+					want.Ask = nil
+				}
+				if tc.q.Bid == false {
+					want.Bid = nil
+				}
+				if tc.q.Trade == false {
+					want.Trade = nil
+				}
+				if tc.q.Gap == false {
+					want.Gap = nil
+				}
+			}
+			if sameStoreData(got[i], want) == false {
+				t.Errorf("%s %d: got %+v, want %+v", tc.name, i, got[i], want)
+			}
+		}
+	}
+	// 元のStoreDataArrayは変更しない
+	if sda[0].Bid == nil || sda[3].Trade == nil || sda[4].Gap == nil {
+		t.Error("元のStoreDataArrayを変更しました。")
+	}
+}
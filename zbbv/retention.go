@@ -0,0 +1,213 @@
+package zbbv
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 起動してから保持期間の片付けを始めるまでの待ち時間と、その後の間隔
+const (
+	retentionDelay    = 5 * time.Minute
+	retentionInterval = 6 * time.Hour
+)
+
+// 使用量の集計は重いのでこの間は使い回す
+const diskUsageCacheTime = time.Minute
+
+const DiskUsagePath = "/api/unko.in/1/disk"
+
+// RetentionConfig カテゴリ毎の保持日数
+// 0は無期限
+type RetentionConfig struct {
+	// ストリーム（期限を過ぎた日は1分足と日毎のティッカーに間引いてから消す）
+	Stream int `json:"stream"`
+	// 板の記録
+	Book int `json:"book"`
+	// 間引いた1分足
+	Candle int `json:"candle"`
+	// アクセスログ
+	AccessLog int `json:"access_log"`
+}
+
+// diskUsageCategories 使用量を集計するデータの保存先のフォルダ
+var diskUsageCategories = []string{"stream", "col", "tmp", "tick", "daily", "book", "candle", "manifest", "gap", "sqlite"}
+
+// applyRetention 保持期間を過ぎたデータを片付ける
+// ストリームは消す前に1分足と日毎のティッカーに間引いて残す
+func applyRetention(ctx context.Context, st Store, root, key string, rc RetentionConfig, now time.Time) error {
+	today := dayStart(now)
+	if rc.Stream > 0 {
+		before := today.AddDate(0, 0, -rc.Stream)
+		days, err := st.Days()
+		if err != nil {
+			return err
+		}
+		for _, day := range days {
+			if day.Before(before) == false || ctx.Err() != nil {
+				break
+			}
+			if err := compactDay(st, root, key, day); err != nil {
+				return err
+			}
+			if err := st.Purge(day); err != nil {
+				return err
+			}
+			log.Infow("保持期間を過ぎたストリームを間引きました。", "key", key, "date", day.Format("20060102"))
+		}
+	}
+	if rc.Book > 0 {
+		removeDayFiles(filepath.Join(root, "book", key), key, today.AddDate(0, 0, -rc.Book))
+	}
+	if rc.Candle > 0 {
+		removeDayFiles(filepath.Join(root, "candle", key), key, today.AddDate(0, 0, -rc.Candle))
+	}
+	return nil
+}
+
+// compactDay その日の約定から1分足と日毎のティッカーを作って保存する
+// 1分足はcandle/{通貨ペア}/{通貨ペア}_YYYYMMDD.json
+func compactDay(st Store, root, key string, day time.Time) error {
+	cp := createStoreFilePath(root, day, key, "daily")
+	if _, err := readDailyTicker(cp); err != nil {
+		t, ok, err := archiveTicker(st, day)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := writeDailyTicker(cp, t); err != nil {
+				return err
+			}
+		}
+	}
+	cl := make([]Candle, 0, CandleMax)
+	seen := make(map[uint64]struct{}, 1024)
+	err := st.Range(day, day.AddDate(0, 0, 1), func(sd StoreData) error {
+		t := sd.Trade
+		if t == nil {
+			return nil
+		}
+		if _, dup := seen[t.Tid]; dup {
+			return nil
+		}
+		seen[t.Tid] = struct{}{}
+		ts := time.Time(sd.Timestamp)
+		if t.Date > 0 {
+			ts = time.Unix(int64(t.Date), 0)
+		}
+		cl = addCandle(cl, CandleMax, candleStart(ts, time.Minute), t.Price, t.Amount, true)
+		return nil
+	})
+	if err != nil || len(cl) == 0 {
+		return err
+	}
+	return writeJSONFile(createStoreFilePath(root, day, key, "candle"), cl)
+}
+
+// writeJSONFile 別名で書き出して同期してから置き換える
+func writeJSONFile(p string, v interface{}) error {
+	if err := createDir(p); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	wfp, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer wfp.Close()
+	if err := json.NewEncoder(wfp).Encode(v); err != nil {
+		return err
+	}
+	if err := wfp.Sync(); err != nil {
+		return err
+	}
+	if err := wfp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// removeDayFiles フォルダ内のbeforeより前の日のファイルを消す
+func removeDayFiles(dir, key string, before time.Time) {
+	match, _ := filepath.Glob(filepath.Join(dir, key+"_*"))
+	for _, p := range match {
+		day, ok := dayFileDate(key, filepath.Base(p))
+		if ok == false || day.Before(before) == false {
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			log.Warnw("保持期間を過ぎたファイルの削除に失敗しました。", "error", err, "path", p)
+			continue
+		}
+		log.Infow("保持期間を過ぎたファイルを削除しました。", "path", p)
+	}
+}
+
+// DiskUsage フォルダ以下のファイルの合計
+type DiskUsage struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+func (du *DiskUsage) add(o DiskUsage) {
+	du.Bytes += o.Bytes
+	du.Files += o.Files
+}
+
+// DiskUsageReport 取引所毎・カテゴリ毎の使用量
+type DiskUsageReport struct {
+	Time      Unixtime                        `json:"time"`
+	Total     DiskUsage                       `json:"total"`
+	Exchanges map[string]map[string]DiskUsage `json:"exchanges"`
+	AccessLog DiskUsage                       `json:"access_log"`
+}
+
+func dirUsage(dir string) DiskUsage {
+	var du DiskUsage
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			du.Bytes += fi.Size()
+			du.Files++
+		}
+		return nil
+	})
+	return du
+}
+
+func diskUsage(conf *Config, now time.Time) DiskUsageReport {
+	rep := DiskUsageReport{
+		Time:      Unixtime(now),
+		Exchanges: make(map[string]map[string]DiskUsage, len(conf.Exchanges)),
+		AccessLog: dirUsage(conf.AccessLogPath),
+	}
+	rep.Total.add(rep.AccessLog)
+	for _, ec := range conf.Exchanges {
+		root := ec.dataPath(conf.RootDataPath)
+		m := make(map[string]DiskUsage, len(diskUsageCategories))
+		for _, cate := range diskUsageCategories {
+			du := dirUsage(filepath.Join(root, cate))
+			m[cate] = du
+			rep.Total.add(du)
+		}
+		rep.Exchanges[ec.Name] = m
+	}
+	return rep
+}
+
+func (h *DiskUsageHandler) report() DiskUsageReport {
+	h.Lock()
+	defer h.Unlock()
+	now := time.Now()
+	if now.Sub(h.at) >= diskUsageCacheTime {
+		h.rep = diskUsage(h.conf, now)
+		h.at = now
+	}
+	return h.rep
+}
@@ -0,0 +1,166 @@
+package zbbv
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// purgeCheckStore 消す時点で間引いたファイルが揃っているかを覚えておく
+type purgeCheckStore struct {
+	Store
+	root   string
+	key    string
+	purged map[time.Time]bool // 日付毎に、消す時点で1分足と日毎のティッカーがあったか
+}
+
+func (s *purgeCheckStore) Purge(day time.Time) error {
+	_, cerr := os.Stat(createStoreFilePath(s.root, day, s.key, "candle"))
+	_, derr := os.Stat(createStoreFilePath(s.root, day, s.key, "daily"))
+	s.purged[day] = cerr == nil && derr == nil
+	return s.Store.Purge(day)
+}
+
+// writeRetentionDays dayから1日毎にn日分の約定を書き出す
+// 1日毎に10時から1分毎の約定が3件ずつ
+func writeRetentionDays(t *testing.T, root, key string, day time.Time, n int) []time.Time {
+	t.Helper()
+	days := make([]time.Time, 0, n)
+	for i := 0; i < n; i++ {
+		d := day.AddDate(0, 0, i)
+		base := d.Add(10 * time.Hour)
+		tid := uint64(i*10 + 1)
+		writeArchive(t, root, key, d, StoreDataArray{
+			tradeData(base, tid),
+			tradeData(base.Add(time.Minute), tid+1),
+			tradeData(base.Add(2*time.Minute), tid+2),
+		})
+		days = append(days, d)
+	}
+	return days
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func TestApplyRetention(t *testing.T) {
+	root := t.TempDir()
+	const key = "btc_jpy"
+	now := time.Date(2023, 11, 20, 12, 0, 0, 0, jst)
+	days := writeRetentionDays(t, root, key, dayStart(now).AddDate(0, 0, -4), 4)
+	for _, d := range []time.Time{days[0], days[3]} {
+		p := createBookFilePath(root, d, key)
+		writeBookLines(t, p, `{"t":"s","seq":1,"ts":1700010000,"asks":[],"bids":[]}`)
+	}
+	fs, err := newFileStore(NewConfig(), root, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	st := &purgeCheckStore{Store: fs, root: root, key: key, purged: make(map[time.Time]bool)}
+	if err := applyRetention(context.Background(), st, root, key, RetentionConfig{Stream: 2, Book: 2}, now); err != nil {
+		t.Fatal(err)
+	}
+	for i, d := range days {
+		archive := createStoreFilePath(root, d, key, "stream") + ".gz"
+		candle := createStoreFilePath(root, d, key, "candle")
+		daily := createStoreFilePath(root, d, key, "daily")
+		if i >= 2 {
+			// 保持期間内の日には触らない
+			if fileExists(archive) == false || fileExists(candle) || fileExists(daily) {
+				t.Errorf("%s: 保持期間内の日が変わりました。", d.Format("20060102"))
+			}
+			if _, ok := st.purged[d]; ok {
+				t.Errorf("%s: 保持期間内の日を消しました。", d.Format("20060102"))
+			}
+			continue
+		}
+		if fileExists(archive) {
+			t.Errorf("%s: 保持期間を過ぎたストリームが残っています。", d.Format("20060102"))
+		}
+		if st.purged[d] == false {
+			t.Errorf("%s: 1分足と日毎のティッカーを書く前にストリームを消しました。", d.Format("20060102"))
+		}
+		var cl []Candle
+		buf, err := os.ReadFile(candle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(buf, &cl); err != nil {
+			t.Fatal(err)
+		}
+		if len(cl) != 3 || time.Time(cl[0].Time).Equal(d.Add(10*time.Hour)) == false || cl[0].Volume != 1 {
+			t.Errorf("%s: 1分足が違います。%+v", d.Format("20060102"), cl)
+		}
+		tk, err := readDailyTicker(daily)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tk.Open != 100 || tk.Close != 100 || tk.Volume != 3 {
+			t.Errorf("%s: 日毎のティッカーが違います。%+v", d.Format("20060102"), tk)
+		}
+	}
+	if got, err := st.Days(); err != nil || len(got) != 2 || got[0].Equal(days[2]) == false {
+		t.Errorf("残った日が違います。%v err:%v", got, err)
+	}
+	if fileExists(createBookFilePath(root, days[0], key)) {
+		t.Errorf("保持期間を過ぎた板の記録が残っています。")
+	}
+	if fileExists(createBookFilePath(root, days[3], key)) == false {
+		t.Errorf("保持期間内の板の記録を消しました。")
+	}
+}
+
+func TestApplyRetentionCompactFailure(t *testing.T) {
+	root := t.TempDir()
+	const key = "btc_jpy"
+	now := time.Date(2023, 11, 20, 12, 0, 0, 0, jst)
+	days := writeRetentionDays(t, root, key, dayStart(now).AddDate(0, 0, -4), 3)
+	// 1分足を置き換えられないようにする
+	candle := createStoreFilePath(root, days[0], key, "candle")
+	if err := os.MkdirAll(filepath.Join(candle, "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := newFileStore(NewConfig(), root, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	st := &purgeCheckStore{Store: fs, root: root, key: key, purged: make(map[time.Time]bool)}
+	if err := applyRetention(context.Background(), st, root, key, RetentionConfig{Stream: 2}, now); err == nil {
+		t.Fatal("間引きに失敗したのにエラーになりません。")
+	}
+	if len(st.purged) != 0 {
+		t.Errorf("間引きに失敗したのに消しました。%v", st.purged)
+	}
+	for _, d := range days {
+		if fileExists(createStoreFilePath(root, d, key, "stream")+".gz") == false {
+			t.Errorf("%s: ストリームが消えました。", d.Format("20060102"))
+		}
+	}
+	got, err := st.Days()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(days) {
+		t.Errorf("残った日が違います。%v", got)
+	}
+	// 次の片付けでやり直せる
+	if err := os.RemoveAll(candle); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyRetention(context.Background(), st, root, key, RetentionConfig{Stream: 2}, now); err != nil {
+		t.Fatal(err)
+	}
+	if st.purged[days[0]] == false || st.purged[days[1]] == false {
+		t.Errorf("やり直した片付けで間引いていません。%v", st.purged)
+	}
+	if fileExists(createStoreFilePath(root, days[2], key, "stream")+".gz") == false {
+		t.Errorf("保持期間内のストリームが消えました。")
+	}
+}
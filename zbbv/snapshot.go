@@ -0,0 +1,72 @@
+package zbbv
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// snapshot 公開した時点のデータ
+// 公開した後は変更しないので、いくつのハンドラからでも同時に読める
+// JSONとETagは最初に要求された時に一度だけ作る
+type snapshot[T any] struct {
+	data T
+	meta DataMeta
+	enc  func(T) ([]byte, error)
+	once sync.Once
+	body []byte
+	etag string
+	err  error
+}
+
+// JSON 末尾に改行の付いたJSONとETag
+func (s *snapshot[T]) JSON() ([]byte, string, error) {
+	s.once.Do(func() {
+		s.body, s.err = s.enc(s.data)
+		if s.err == nil {
+			s.etag = bodyETag(s.body)
+		}
+	})
+	return s.body, s.etag, s.err
+}
+
+// publisher 最新のsnapshotをアトミックに差し替える
+// 書き込むのは持ち主のgoroutineだけで、読む側は待たされない
+type publisher[T any] struct {
+	p   atomic.Pointer[snapshot[T]]
+	enc func(T) ([]byte, error)
+}
+
+func newPublisher[T any](enc func(T) ([]byte, error)) *publisher[T] {
+	if enc == nil {
+		enc = marshalJSONLine[T]
+	}
+	return &publisher[T]{enc: enc}
+}
+
+// Publish vを公開する
+// vの中身は公開した後に変更しないこと
+func (pub *publisher[T]) Publish(v T, meta DataMeta) {
+	pub.p.Store(&snapshot[T]{data: v, meta: meta, enc: pub.enc})
+}
+
+// Load 最新のsnapshot
+// まだ公開していなければnil
+func (pub *publisher[T]) Load() *snapshot[T] {
+	return pub.p.Load()
+}
+
+func marshalJSONLine[T any](v T) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+func encodeStoreDataArray(sda StoreDataArray) ([]byte, error) {
+	var buf bytes.Buffer
+	storeDataArrayToJSON(&buf, sda)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,257 @@
+package zbbv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ベンチマークの同時リクエスト数（SetParallelism×GOMAXPROCS）
+var benchParallelism = []int{1, 64, 1024}
+
+// 公開し直す間隔（ストリームのメッセージが届く頻度の目安）
+const benchPublishInterval = 10 * time.Millisecond
+
+// benchResponseWriter 応答を捨ててステータスコードだけ覚えておく
+type benchResponseWriter struct {
+	h    http.Header
+	code int
+}
+
+func (w *benchResponseWriter) Header() http.Header { return w.h }
+
+func (w *benchResponseWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (w *benchResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// chanHandler 以前の実装を再現したハンドラ
+// 持ち主のgoroutineのselectから1リクエスト毎に写しを受け取り、受け取ってからJSONを作る
+// 3秒で受け取れなければ失敗する
+type chanHandler[T any] struct {
+	ch    <-chan T
+	write func(w http.ResponseWriter, v T) error
+}
+
+func (h *chanHandler[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*3)
+	defer cancel()
+	select {
+	case <-ctx.Done():
+		http.Error(w, "データ取得に失敗しました。", http.StatusInternalServerError)
+	case v := <-h.ch:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := h.write(w, v); err != nil {
+			log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
+		}
+	}
+}
+
+// startChanOwner 以前の持ち主のgoroutineを再現する
+// 公開し直す間もselectの同じループでリクエスト毎にcopyした写しを渡す
+func startChanOwner[T any](b *testing.B, copy func() T) <-chan T {
+	ch := make(chan T)
+	done := make(chan struct{})
+	b.Cleanup(func() { close(done) })
+	go func() {
+		tc := time.NewTicker(benchPublishInterval)
+		defer tc.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tc.C:
+			case ch <- copy():
+			}
+		}
+	}()
+	return ch
+}
+
+// startPublisher 持ち主のgoroutineが公開し直し続ける
+func startPublisher[T any](b *testing.B, pub *publisher[T], v T) {
+	pub.Publish(v, DataMeta{AsOf: time.Now(), Source: DataSourceStream})
+	done := make(chan struct{})
+	b.Cleanup(func() { close(done) })
+	go func() {
+		tc := time.NewTicker(benchPublishInterval)
+		defer tc.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-tc.C:
+				pub.Publish(v, DataMeta{AsOf: now, Source: DataSourceStream})
+			}
+		}
+	}()
+}
+
+func encodeJSON[T any](w http.ResponseWriter, v T) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// benchHandler parallelism毎にhへ同時にリクエストする
+// 200以外の応答の割合をerrors/opとして記録する
+func benchHandler(b *testing.B, path string, h http.Handler) {
+	for _, par := range benchParallelism {
+		b.Run(fmt.Sprintf("p=%d", par), func(b *testing.B) {
+			var failed atomic.Int64
+			b.ReportAllocs()
+			b.SetParallelism(par)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := httptest.NewRequest(http.MethodGet, path, nil)
+				w := &benchResponseWriter{h: make(http.Header)}
+				for pb.Next() {
+					w.code = 0
+					h.ServeHTTP(w, r)
+					if w.code != http.StatusOK {
+						failed.Add(1)
+					}
+				}
+			})
+			b.ReportMetric(float64(failed.Load())/float64(b.N), "errors/op")
+		})
+	}
+}
+
+func benchStoreDataArray() StoreDataArray {
+	base := time.Date(2023, 11, 15, 10, 0, 0, 0, jst)
+	sda := make(StoreDataArray, 0, DefaultStoreDataMax)
+	for i := 0; i < DefaultStoreDataMax; i++ {
+		sd := tradeData(base.Add(time.Duration(i)*time.Second), uint64(i+1))
+		sd.Ask = &PriceAmount{5000000 + float64(i%100), 0.0123}
+		sda = append(sda, sd)
+	}
+	return sda
+}
+
+func BenchmarkOldStreamHandler(b *testing.B) {
+	sda := benchStoreDataArray()
+	const path = "/api/zaif/1/oldstream/btc_jpy"
+	b.Run("publisher", func(b *testing.B) {
+		pub := newPublisher[StoreDataArray](encodeStoreDataArray)
+		startPublisher(b, pub, sda)
+		benchHandler(b, path, &OldStreamHandler{cp: "btc_jpy", pub: pub})
+	})
+	b.Run("channel", func(b *testing.B) {
+		ch := startChanOwner(b, sda.Copy)
+		benchHandler(b, path, &chanHandler[StoreDataArray]{ch: ch, write: func(w http.ResponseWriter, v StoreDataArray) error {
+			defer v.Close()
+			storeDataArrayToJSON(w, v)
+			return nil
+		}})
+	})
+}
+
+func BenchmarkLastPriceHandler(b *testing.B) {
+	lp := LastPrice{Action: "bid", Price: 5000000}
+	const path = "/api/zaif/1/lastprice/btc_jpy"
+	b.Run("publisher", func(b *testing.B) {
+		pub := newPublisher[LastPrice](nil)
+		startPublisher(b, pub, lp)
+		benchHandler(b, path, &LastPriceHandler{cp: "btc_jpy", pub: pub})
+	})
+	b.Run("channel", func(b *testing.B) {
+		ch := startChanOwner(b, func() LastPrice { return lp })
+		benchHandler(b, path, &chanHandler[LastPrice]{ch: ch, write: encodeJSON[LastPrice]})
+	})
+}
+
+func BenchmarkDepthHandler(b *testing.B) {
+	s := Stream{Timestamp: time.Now()}
+	for i := 0; i < 100; i++ {
+		s.Asks = append(s.Asks, PriceAmount{5000000 + float64(i*5), 0.01 * float64(i+1)})
+		s.Bids = append(s.Bids, PriceAmount{4999995 - float64(i*5), 0.01 * float64(i+1)})
+	}
+	const path = "/api/zaif/1/depth/btc_jpy"
+	b.Run("publisher", func(b *testing.B) {
+		book := newOrderBook()
+		book.Update(s)
+		done := make(chan struct{})
+		b.Cleanup(func() { close(done) })
+		go func() {
+			tc := time.NewTicker(benchPublishInterval)
+			defer tc.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case now := <-tc.C:
+					s := s
+					s.Timestamp = now
+					book.Update(s)
+				}
+			}
+		}()
+		benchHandler(b, path, &DepthHandler{cp: "btc_jpy", book: book})
+	})
+	b.Run("channel", func(b *testing.B) {
+		// 以前は持ち主が作ったJSONを渡していた
+		buf, err := json.Marshal(s)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ch := startChanOwner(b, func() []byte { return buf })
+		benchHandler(b, path, &chanHandler[[]byte]{ch: ch, write: func(w http.ResponseWriter, v []byte) error {
+			_, err := w.Write(v)
+			return err
+		}})
+	})
+}
+
+func BenchmarkTicksHandler(b *testing.B) {
+	tl := make([]Ticker, 0, 365)
+	day := time.Date(2023, 1, 1, 0, 0, 0, 0, jst)
+	for i := 0; i < cap(tl); i++ {
+		tl = append(tl, Ticker{Date: day.AddDate(0, 0, i).Format("2006-01-02"), Open: 5000000, Close: 5000100, High: 5100000, Low: 4900000, Vwap: 5000050, Volume: 1234.5})
+	}
+	const path = "/api/zaif/1/ticks/btc_jpy"
+	b.Run("publisher", func(b *testing.B) {
+		pub := newPublisher[[]Ticker](nil)
+		startPublisher(b, pub, tl)
+		benchHandler(b, path, &TicksHandler{cp: "btc_jpy", pub: pub})
+	})
+	b.Run("channel", func(b *testing.B) {
+		ch := startChanOwner(b, func() []Ticker { return copyTicks(tl) })
+		benchHandler(b, path, &chanHandler[[]Ticker]{ch: ch, write: encodeJSON[[]Ticker]})
+	})
+}
+
+func BenchmarkMonitoringHandler(b *testing.B) {
+	rm := ResultMonitor{Time: Unixtime(time.Now()), Windows: make(map[string]MonitorWindow)}
+	for _, mw := range monitorWindows {
+		routes := make(map[string]map[string]LatencyStats)
+		for _, route := range []string{"/api/zaif/1/oldstream/", "/api/zaif/1/lastprice/", "/api/zaif/1/depth/", "/api/zaif/1/ticks/"} {
+			routes[route] = map[string]LatencyStats{
+				"2xx": {Count: 1000, Mean: 1.2, P50: 1, P90: 2, P95: 3, P99: 5, Max: 20},
+				"5xx": {Count: 3, Mean: 3000, P50: 3000, P90: 3000, P95: 3000, P99: 3000, Max: 3000},
+			}
+		}
+		rm.Windows[mw.name] = MonitorWindow{Start: rm.Time, Total: LatencyStats{Count: 4012}, OK: 4000, NG: 12, Routes: routes}
+	}
+	const path = "/api/unko.in/1/monitor"
+	b.Run("publisher", func(b *testing.B) {
+		pub := newPublisher[ResultMonitor](nil)
+		startPublisher(b, pub, rm)
+		benchHandler(b, path, &GetMonitoringHandler{pub: pub})
+	})
+	b.Run("channel", func(b *testing.B) {
+		ch := startChanOwner(b, func() ResultMonitor { return rm })
+		benchHandler(b, path, &chanHandler[ResultMonitor]{ch: ch, write: encodeJSON[ResultMonitor]})
+	})
+}
@@ -0,0 +1,287 @@
+//go:build sqlite
+
+package zbbv
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore 通貨ペア毎に1つのSQLiteのデータベースに保存する
+// データベースはsqlite/{通貨ペア}.db
+//
+//	sqlite3 data/sqlite/btc_jpy.db "SELECT datetime(ts, 'unixepoch'), price, amount FROM trades ORDER BY tid DESC LIMIT 10"
+type sqliteStore struct {
+	db  *sql.DB
+	ins *sql.Stmt
+}
+
+// streamは1レコードが1件のStoreData
+// 約定と気配はそれぞれtrades・quotesのビューで参照できる
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS stream (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	ts INTEGER NOT NULL,
+	ask_price REAL, ask_amount REAL,
+	bid_price REAL, bid_amount REAL,
+	tid INTEGER, trade_type TEXT, trade_price REAL, trade_amount REAL, trade_date INTEGER, currency_pair TEXT
+);
+CREATE INDEX IF NOT EXISTS stream_ts ON stream (ts);
+CREATE VIEW IF NOT EXISTS trades AS
+	SELECT tid, ts, trade_date AS date, trade_type, trade_price AS price, trade_amount AS amount, currency_pair
+	FROM stream WHERE tid IS NOT NULL;
+CREATE VIEW IF NOT EXISTS quotes AS
+	SELECT ts, ask_price, ask_amount, bid_price, bid_amount
+	FROM stream WHERE ask_price IS NOT NULL OR bid_price IS NOT NULL;
+CREATE TABLE IF NOT EXISTS tickers (
+	date TEXT PRIMARY KEY,
+	last REAL, high REAL, low REAL, vwap REAL, volume REAL, bid REAL, ask REAL
+);
+CREATE TABLE IF NOT EXISTS gaps (
+	start INTEGER PRIMARY KEY,
+	end INTEGER,
+	reason TEXT NOT NULL,
+	error TEXT
+);
+CREATE TABLE IF NOT EXISTS ring (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	data BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS heartbeat (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	ts INTEGER NOT NULL
+);
+`
+
+func init() {
+	storeFactories[StoreBackendSQLite] = newSQLiteStore
+}
+
+func newSQLiteStore(conf *Config, root, key string) (Store, error) {
+	p := filepath.Join(root, "sqlite", key+".db")
+	if err := createDir(p); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+p+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	ins, err := db.Prepare(`INSERT INTO stream (ts, ask_price, ask_amount, bid_price, bid_amount,
+		tid, trade_type, trade_price, trade_amount, trade_date, currency_pair) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db, ins: ins}, nil
+}
+
+func (s *sqliteStore) Append(sd StoreData) error {
+	if sd.Ask == nil && sd.Bid == nil && sd.Trade == nil {
+		// 欠損の印はgapsテーブルに記録しているので、streamには入れない
+		return nil
+	}
+	args := make([]interface{}, 11)
+	args[0] = time.Time(sd.Timestamp).Unix()
+	if sd.Ask != nil {
+		args[1], args[2] = sd.Ask[0], sd.Ask[1]
+	}
+	if sd.Bid != nil {
+		args[3], args[4] = sd.Bid[0], sd.Bid[1]
+	}
+	if t := sd.Trade; t != nil {
+		args[5], args[6], args[7], args[8], args[9], args[10] = int64(t.Tid), t.TradeType, t.Price, t.Amount, int64(t.Date), t.CurrentyPair
+	}
+	_, err := s.ins.Exec(args...)
+	return err
+}
+
+func (s *sqliteStore) Range(since, until time.Time, fn func(StoreData) error) error {
+	rows, err := s.db.Query(`SELECT ts, ask_price, ask_amount, bid_price, bid_amount,
+		tid, trade_type, trade_price, trade_amount, trade_date, currency_pair
+		FROM stream WHERE ts >= ? AND ts < ? ORDER BY ts, id`, since.Unix(), until.Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ts int64
+		var ap, aa, bp, ba, tp, ta sql.NullFloat64
+		var tid, date sql.NullInt64
+		var tt, cp sql.NullString
+		if err := rows.Scan(&ts, &ap, &aa, &bp, &ba, &tid, &tt, &tp, &ta, &date, &cp); err != nil {
+			return err
+		}
+		sd := StoreData{Timestamp: Unixtime(time.Unix(ts, 0))}
+		if ap.Valid {
+			sd.Ask = &PriceAmount{ap.Float64, aa.Float64}
+		}
+		if bp.Valid {
+			sd.Bid = &PriceAmount{bp.Float64, ba.Float64}
+		}
+		if tid.Valid {
+			sd.Trade = &Trade{
+				CurrentyPair: cp.String,
+				TradeType:    tt.String,
+				Price:        tp.Float64,
+				Tid:          uint64(tid.Int64),
+				Amount:       ta.Float64,
+				Date:         uint64(date.Int64),
+			}
+		}
+		if err := fn(sd); err != nil {
+			if err == errStopRead {
+				return nil
+			}
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStore) Days() ([]time.Time, error) {
+	// 日本時間の日毎にまとめる
+	_, offset := time.Now().In(jst).Zone()
+	rows, err := s.db.Query(`SELECT DISTINCT (ts + ?) / 86400 FROM stream ORDER BY 1`, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	days := make([]time.Time, 0, 365)
+	for rows.Next() {
+		var d int64
+		if err := rows.Scan(&d); err != nil {
+			return nil, err
+		}
+		days = append(days, dayStart(time.Unix(d*86400-int64(offset), 0)))
+	}
+	return days, rows.Err()
+}
+
+func (s *sqliteStore) SaveTicker(date string, zt *Ticker24h) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO tickers (date, last, high, low, vwap, volume, bid, ask)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, date, zt.Last, zt.High, zt.Low, zt.Vwap, zt.Volume, zt.Bid, zt.Ask)
+	return err
+}
+
+func (s *sqliteStore) LoadTickers() ([]TickerSnapshot, error) {
+	rows, err := s.db.Query(`SELECT date, last, high, low, vwap, volume, bid, ask FROM tickers ORDER BY date`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sl := make([]TickerSnapshot, 0, 365)
+	for rows.Next() {
+		var t TickerSnapshot
+		if err := rows.Scan(&t.Date, &t.Last, &t.High, &t.Low, &t.Vwap, &t.Volume, &t.Bid, &t.Ask); err != nil {
+			return nil, err
+		}
+		sl = append(sl, t)
+	}
+	return sl, rows.Err()
+}
+
+func (s *sqliteStore) SaveRing(sda StoreDataArray) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(sda); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO ring (id, data) VALUES (1, ?)`, buf.Bytes())
+	return err
+}
+
+func (s *sqliteStore) LoadRing() (StoreDataArray, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT data FROM ring WHERE id = 1`).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sda := NewStoreDataArray()
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&sda)
+	return sda, err
+}
+
+func (s *sqliteStore) SaveHeartbeat(t time.Time) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO heartbeat (id, ts) VALUES (1, ?)`, t.Unix())
+	return err
+}
+
+func (s *sqliteStore) LoadHeartbeat() (time.Time, error) {
+	var ts int64
+	err := s.db.QueryRow(`SELECT ts FROM heartbeat WHERE id = 1`).Scan(&ts)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(ts, 0), nil
+}
+
+func (s *sqliteStore) AppendGap(g Gap) error {
+	var end interface{}
+	if g.End != nil {
+		end = time.Time(*g.End).Unix()
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO gaps (start, end, reason, error) VALUES (?, ?, ?, ?)`,
+		time.Time(g.Start).Unix(), end, g.Reason, g.Error)
+	return err
+}
+
+func (s *sqliteStore) Gaps() ([]Gap, error) {
+	rows, err := s.db.Query(`SELECT start, end, reason, error FROM gaps ORDER BY start`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var gl []Gap
+	for rows.Next() {
+		var start int64
+		var end sql.NullInt64
+		var reason string
+		var e sql.NullString
+		if err := rows.Scan(&start, &end, &reason, &e); err != nil {
+			return nil, err
+		}
+		g := Gap{Start: Unixtime(time.Unix(start, 0)), Reason: reason, Error: e.String}
+		if end.Valid {
+			t := Unixtime(time.Unix(end.Int64, 0))
+			g.End = &t
+		}
+		gl = append(gl, g)
+	}
+	return gl, rows.Err()
+}
+
+// Flush 1件毎にコミットしているので何もしない
+func (s *sqliteStore) Flush() error {
+	return nil
+}
+
+// Purge 消した分の領域はファイルを小さくせずに再利用する
+func (s *sqliteStore) Purge(day time.Time) error {
+	day = dayStart(day)
+	_, err := s.db.Exec(`DELETE FROM stream WHERE ts >= ? AND ts < ?`, day.Unix(), day.AddDate(0, 0, 1).Unix())
+	return err
+}
+
+// Rotate 日毎にファイルを分けていないので何もしない
+func (s *sqliteStore) Rotate(now time.Time) error {
+	return nil
+}
+
+func (s *sqliteStore) Close() error {
+	s.ins.Close()
+	return s.db.Close()
+}
@@ -0,0 +1,12 @@
+//go:build sqlite
+
+package zbbv
+
+import "testing"
+
+func TestSQLiteStoreContract(t *testing.T) {
+	conf := NewConfig()
+	testStoreContract(t, func(root string) (Store, error) {
+		return newSQLiteStore(conf, root, "btc_jpy")
+	})
+}
@@ -0,0 +1,140 @@
+package zbbv
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// storeFlushInterval 書き込み待ちをディスクに同期する間隔
+// 異常終了した場合に失うのはjsonでこの間隔分、columnarではcolBlockIntervalを足した分まで
+const storeFlushInterval = 5 * time.Second
+
+const (
+	StreamFormatJSON     = "json"
+	StreamFormatColumnar = "columnar"
+)
+
+// StreamStorage 通貨ペア毎のStoreDataの保存先
+// 日本時間の日毎に分けて保存する
+type StreamStorage interface {
+	// Append 1件追記する
+	Append(sd StoreData) error
+	// Range [since, until)の範囲のStoreDataを時刻順にfnに渡す
+	Range(since, until time.Time, fn func(StoreData) error) error
+	// Flush 書き込み待ちをディスクに同期する
+	Flush() error
+	// Rotate nowで日付が変わっていれば前の日のファイルを閉じる
+	Rotate(now time.Time) error
+	Close() error
+}
+
+type streamStorageFactory func(root, key string) (StreamStorage, error)
+
+var streamStorageFactories = map[string]streamStorageFactory{
+	StreamFormatJSON:     newJSONStreamStorage,
+	StreamFormatColumnar: newColumnarStreamStorage,
+}
+
+func newStreamStorage(format, root, key string) (StreamStorage, error) {
+	f, ok := streamStorageFactories[format]
+	if ok == false {
+		return nil, fmt.Errorf("対応していない保存形式です。format:%q", format)
+	}
+	return f(root, key)
+}
+
+// StreamFormats 対応している保存形式の一覧
+func StreamFormats() []string {
+	l := make([]string, 0, len(streamStorageFactories))
+	for name := range streamStorageFactories {
+		l = append(l, name)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// jsonStreamStorage 1件1行のJSONで書き込み、日付が変わったらgzipで圧縮する
+// 日付はStoreDataの時刻か時計の新しい方で決めるので、日付が変わった後に届いた前の日のStoreDataは新しい日のファイルに入る
+type jsonStreamStorage struct {
+	root string
+	key  string
+	si   *StoreItem
+	day  time.Time // 書き込み中の日（日本時間の0時）
+}
+
+func newJSONStreamStorage(root, key string) (StreamStorage, error) {
+	return &jsonStreamStorage{root: root, key: key, day: dayStart(time.Now())}, nil
+}
+
+func (s *jsonStreamStorage) Append(sd StoreData) error {
+	if day := dayStart(time.Time(sd.Timestamp)); day.After(s.day) {
+		s.day = day
+	}
+	var err error
+	if s.si == nil {
+		s.si, err = newStoreItem(s.root, s.day, s.key)
+		if err != nil {
+			s.si = nil
+			return err
+		}
+	} else if s.si.date.Equal(s.day) == false {
+		err = s.si.nextFile(s.day)
+	}
+	if err == nil {
+		err = s.si.writeJsonLine(sd)
+	}
+	if err != nil {
+		s.reset()
+	}
+	return err
+}
+
+// reset 書き込みに失敗したファイルを閉じて、次のAppendで開き直す
+// 開き直す時に途中で終わっている最後の1件を切り詰める
+func (s *jsonStreamStorage) reset() {
+	if err := s.si.Close(); err != nil {
+		log.Warnw("書き込みに失敗したファイルを閉じるのに失敗しました。", "error", err, "path", s.si.createPathTmp())
+	}
+	s.si = nil
+}
+
+func (s *jsonStreamStorage) Rotate(now time.Time) error {
+	day := dayStart(now)
+	if day.After(s.day) == false {
+		return nil
+	}
+	s.day = day
+	if s.si == nil {
+		return nil
+	}
+	err := s.si.nextFile(s.day)
+	if err != nil {
+		s.reset()
+	}
+	return err
+}
+
+func (s *jsonStreamStorage) Range(since, until time.Time, fn func(StoreData) error) error {
+	return readStoreDataRange(s.root, s.key, since, until, fn)
+}
+
+func (s *jsonStreamStorage) Flush() error {
+	if s.si == nil {
+		return nil
+	}
+	err := s.si.Sync()
+	if err != nil {
+		s.reset()
+	}
+	return err
+}
+
+func (s *jsonStreamStorage) Close() error {
+	if s.si == nil {
+		return nil
+	}
+	err := s.si.Close()
+	s.si = nil
+	return err
+}
@@ -0,0 +1,220 @@
+package zbbv
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	StoreBackendFile   = "file"
+	StoreBackendSQLite = "sqlite"
+)
+
+// Store 通貨ペア毎の保存先
+// Append・Closeは1つのgoroutineから呼び、それ以外は並行して呼んでもよい
+type Store interface {
+	// Append StoreDataを1件追記する
+	Append(sd StoreData) error
+	// Range [since, until)の範囲のStoreDataを時刻順にfnに渡す
+	// fnがerrStopReadを返した場合はnilを返して終了する
+	Range(since, until time.Time, fn func(StoreData) error) error
+	// Days StoreDataがある日（日本時間の0時）の一覧を古い順に返す
+	Days() ([]time.Time, error)
+	// SaveTicker 日付が変わった時に取得したティッカーを保存する
+	SaveTicker(date string, zt *Ticker24h) error
+	// LoadTickers 保存したティッカーを日付順に返す
+	LoadTickers() ([]TickerSnapshot, error)
+	// SaveRing 再起動後に使うためにメモリ上のStoreDataを保存する
+	SaveRing(sda StoreDataArray) error
+	// LoadRing SaveRingで保存したStoreDataを返す（無ければnil）
+	LoadRing() (StoreDataArray, error)
+	// SaveHeartbeat 最後にストリームを受信した時刻を保存する
+	SaveHeartbeat(t time.Time) error
+	// LoadHeartbeat SaveHeartbeatで保存した時刻を返す（無ければゼロ値）
+	LoadHeartbeat() (time.Time, error)
+	// AppendGap ストリームの欠損を記録する
+	AppendGap(g Gap) error
+	// Gaps 記録した欠損を開始時刻順に返す（開始時刻が同じものは後の記録を使う）
+	Gaps() ([]Gap, error)
+	// Flush 書き込み待ちをディスクに同期する
+	Flush() error
+	// Rotate nowで日付が変わっていれば前の日のファイルを閉じる
+	Rotate(now time.Time) error
+	// Purge その日（日本時間の0時）のStoreDataを消す
+	Purge(day time.Time) error
+	Close() error
+}
+
+type storeFactory func(conf *Config, root, key string) (Store, error)
+
+// sqliteはcgoが必要なのでビルドタグで有効にした時だけ登録する
+var storeFactories = map[string]storeFactory{
+	StoreBackendFile: newFileStore,
+}
+
+func openStore(conf *Config, root, key string) (Store, error) {
+	f, ok := storeFactories[conf.Store]
+	if ok == false {
+		return nil, fmt.Errorf("対応していない保存先です。store:%q", conf.Store)
+	}
+	return f(conf, root, key)
+}
+
+// StoreBackends 対応している保存先の一覧
+func StoreBackends() []string {
+	l := make([]string, 0, len(storeFactories))
+	for name := range storeFactories {
+		l = append(l, name)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// fileStore これまで通りのフォルダ構成で保存する
+//
+//	stream/{通貨ペア}/   圧縮済みのJSON（stream_formatがjson）
+//	col/{通貨ペア}/      列指向形式（stream_formatがcolumnar）
+//	tmp/{通貨ペア}/      書き込み中のJSON
+//	tmp/{通貨ペア}_buffer.gob
+//	tmp/{通貨ペア}_heartbeat.json 最後に受信した時刻
+//	manifest/{通貨ペア}/ アーカイブのマニフェスト
+//	tick/{通貨ペア}/     ティッカー
+//	gap/{通貨ペア}.ndjson ストリームの欠損
+type fileStore struct {
+	root   string
+	key    string
+	stream StreamStorage
+	gaps   *gapFile
+}
+
+func newFileStore(conf *Config, root, key string) (Store, error) {
+	// 停止している間に日付が変わった場合に残る書き込み中のファイルを片付ける
+	sweepStoreFiles(root, key, dayStart(time.Now()))
+	sweepColFiles(root, key, dayStart(time.Now()))
+	st, err := newStreamStorage(conf.StreamFormat, root, key)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{root: root, key: key, stream: st, gaps: &gapFile{p: createGapFilePath(root, key)}}, nil
+}
+
+func (fs *fileStore) Append(sd StoreData) error {
+	return fs.stream.Append(sd)
+}
+
+func (fs *fileStore) Range(since, until time.Time, fn func(StoreData) error) error {
+	return fs.stream.Range(since, until, fn)
+}
+
+func (fs *fileStore) Days() ([]time.Time, error) {
+	return archiveDays(fs.root, fs.key), nil
+}
+
+func (fs *fileStore) tickDir() string {
+	return filepath.Join(fs.root, "tick", fs.key)
+}
+
+func (fs *fileStore) SaveTicker(date string, zt *Ticker24h) error {
+	return createTickJSONFile(filepath.Join(fs.tickDir(), fmt.Sprintf("%s_%s.json", date, fs.key)), zt)
+}
+
+func (fs *fileStore) LoadTickers() ([]TickerSnapshot, error) {
+	return readTickSnapshots(fs.tickDir()), nil
+}
+
+func (fs *fileStore) SaveRing(sda StoreDataArray) error {
+	return streamBufferWriteProc(fs.root, fs.key, sda)
+}
+
+func (fs *fileStore) LoadRing() (StoreDataArray, error) {
+	sda, err := streamBufferReadProc(fs.root, fs.key)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return sda, err
+}
+
+func (fs *fileStore) SaveHeartbeat(t time.Time) error {
+	return writeJSONFile(createHeartbeatFilePath(fs.root, fs.key), Unixtime(t))
+}
+
+func (fs *fileStore) LoadHeartbeat() (time.Time, error) {
+	var ts Unixtime
+	buf, err := os.ReadFile(createHeartbeatFilePath(fs.root, fs.key))
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(buf, &ts)
+	}
+	return time.Time(ts), err
+}
+
+func (fs *fileStore) AppendGap(g Gap) error {
+	return fs.gaps.append(g)
+}
+
+func (fs *fileStore) Gaps() ([]Gap, error) {
+	return fs.gaps.read()
+}
+
+func (fs *fileStore) Flush() error {
+	return fs.stream.Flush()
+}
+
+func (fs *fileStore) Rotate(now time.Time) error {
+	return fs.stream.Rotate(now)
+}
+
+func (fs *fileStore) Purge(day time.Time) error {
+	for _, p := range []string{
+		createColFilePath(fs.root, day, fs.key),
+		createColManifestPath(fs.root, day, fs.key),
+		createStoreFilePath(fs.root, day, fs.key, "stream") + ".gz",
+		createStoreFilePath(fs.root, day, fs.key, "manifest"),
+		createStoreFilePath(fs.root, day, fs.key, "tmp"),
+	} {
+		if err := os.Remove(p); err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *fileStore) Close() error {
+	return fs.stream.Close()
+}
+
+// archiveDays アーカイブか書き込み中のファイルがある日の一覧を古い順に返す
+func archiveDays(root, key string) []time.Time {
+	set := make(map[time.Time]struct{})
+	for _, cate := range []string{"col", "stream", "tmp"} {
+		match, _ := filepath.Glob(filepath.Join(root, cate, key, key+"_*"))
+		for _, p := range match {
+			if day, ok := dayFileDate(key, filepath.Base(p)); ok {
+				set[day] = struct{}{}
+			}
+		}
+	}
+	days := make([]time.Time, 0, len(set))
+	for day := range set {
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days
+}
+
+// dayFileDate {通貨ペア}_YYYYMMDD で始まるファイル名の日付（日本時間の0時）
+func dayFileDate(key, name string) (time.Time, bool) {
+	name = strings.TrimPrefix(name, key+"_")
+	if len(name) < 8 {
+		return time.Time{}, false
+	}
+	day, err := time.ParseInLocation("20060102", name[:8], jst)
+	return day, err == nil
+}
@@ -0,0 +1,179 @@
+package zbbv
+
+import (
+	"testing"
+	"time"
+)
+
+// testStoreContract Storeの実装が満たすべき振る舞い
+// openは同じrootで呼ぶと前に閉じた保存先を開き直す
+func testStoreContract(t *testing.T, open func(root string) (Store, error)) {
+	t.Helper()
+	root := t.TempDir()
+	st, err := open(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { st.Close() }()
+
+	// 何も保存していない
+	if sda, err := st.LoadRing(); err != nil || sda != nil {
+		t.Errorf("LoadRing = %v %v, want nil nil", sda, err)
+	}
+	if beat, err := st.LoadHeartbeat(); err != nil || beat.IsZero() == false {
+		t.Errorf("LoadHeartbeat = %v %v, want zero nil", beat, err)
+	}
+	if gl, err := st.Gaps(); err != nil || len(gl) != 0 {
+		t.Errorf("Gaps = %v %v", gl, err)
+	}
+	if days, err := st.Days(); err != nil || len(days) != 0 {
+		t.Errorf("Days = %v %v", days, err)
+	}
+
+	// 日付はStoreDataの時刻か時計の新しい方で決まるので、今日と明日に書く
+	day1 := dayStart(time.Now())
+	day2 := day1.AddDate(0, 0, 1)
+	sda := StoreDataArray{
+		{Ask: &PriceAmount{101, 0.5}, Bid: &PriceAmount{99, 2}, Timestamp: Unixtime(day1.Add(time.Hour))},
+		tradeData(day1.Add(time.Hour), 1),
+		tradeData(day1.Add(2*time.Hour), 2),
+		tradeData(day2.Add(time.Hour), 3),
+		{Bid: &PriceAmount{98, 1}, Timestamp: Unixtime(day2.Add(2 * time.Hour))},
+	}
+	for _, sd := range sda {
+		if err := st.Append(sd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// 書き込み中のブロックを持つ形式もあるので、閉じてから読む
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if st, err = open(root); err != nil {
+		t.Fatal(err)
+	}
+	rangeData := func(since, until time.Time) StoreDataArray {
+		t.Helper()
+		var got StoreDataArray
+		if err := st.Range(since, until, func(sd StoreData) error {
+			got = append(got, sd)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	sameArray := func(name string, got, want StoreDataArray) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Errorf("%s: got %d件, want %d件", name, len(got), len(want))
+			return
+		}
+		for i := range want {
+			if sameStoreData(got[i], want[i]) == false {
+				t.Errorf("%s %d: got %+v, want %+v", name, i, got[i], want[i])
+			}
+		}
+	}
+	sameArray("全体", rangeData(day1, day2.AddDate(0, 0, 1)), sda)
+	sameArray("1日目", rangeData(day1, day2), sda[:3])
+	// untilは含まない
+	sameArray("途中まで", rangeData(day1, day1.Add(2*time.Hour)), sda[:2])
+	// errStopReadで止めるとエラーにならない
+	n := 0
+	if err := st.Range(day1, day2.AddDate(0, 0, 1), func(StoreData) error {
+		n++
+		return errStopRead
+	}); err != nil || n != 1 {
+		t.Errorf("Range = %v, %d件", err, n)
+	}
+	if days, err := st.Days(); err != nil || len(days) != 2 || days[0].Equal(day1) == false || days[1].Equal(day2) == false {
+		t.Errorf("Days = %v %v, want [%v %v]", days, err, day1, day2)
+	}
+
+	// 消した日だけ無くなる
+	if err := st.Purge(day1); err != nil {
+		t.Fatal(err)
+	}
+	sameArray("消した後", rangeData(day1, day2.AddDate(0, 0, 1)), sda[3:])
+	if days, err := st.Days(); err != nil || len(days) != 1 || days[0].Equal(day2) == false {
+		t.Errorf("消した後のDays = %v %v", days, err)
+	}
+
+	// メモリ上のStoreData
+	if err := st.SaveRing(sda[:2]); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := st.LoadRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameArray("LoadRing", ring, sda[:2])
+
+	// 最後に受信した時刻は秒まで
+	beat := time.Now().Truncate(time.Second)
+	if err := st.SaveHeartbeat(beat.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SaveHeartbeat(beat); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := st.LoadHeartbeat(); err != nil || got.Equal(beat) == false {
+		t.Errorf("LoadHeartbeat = %v %v, want %v", got, err, beat)
+	}
+
+	// 同じ開始時刻の欠損は後の記録を使い、開始時刻順に並べる
+	t0 := day1.Add(3 * time.Hour)
+	for _, g := range []Gap{
+		{Start: Unixtime(t0.Add(time.Hour)), Reason: GapShutdown},
+		{Start: Unixtime(t0), Reason: GapRead, Error: "EOF"},
+		closedGap(t0, t0.Add(time.Minute), GapRead),
+	} {
+		if err := st.AppendGap(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gl, err := st.Gaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gl) != 2 {
+		t.Fatalf("Gaps = %+v", gl)
+	}
+	if time.Time(gl[0].Start).Equal(t0) == false || gl[0].End == nil || time.Time(*gl[0].End).Equal(t0.Add(time.Minute)) == false || gl[0].Reason != GapRead {
+		t.Errorf("Gaps[0] = %+v", gl[0])
+	}
+	if time.Time(gl[1].Start).Equal(t0.Add(time.Hour)) == false || gl[1].End != nil || gl[1].Reason != GapShutdown {
+		t.Errorf("Gaps[1] = %+v", gl[1])
+	}
+
+	// 開き直しても残っている
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if st, err = open(root); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := st.LoadHeartbeat(); err != nil || got.Equal(beat) == false {
+		t.Errorf("開き直した後のLoadHeartbeat = %v %v", got, err)
+	}
+	if gl, err := st.Gaps(); err != nil || len(gl) != 2 {
+		t.Errorf("開き直した後のGaps = %+v %v", gl, err)
+	}
+	sameArray("開き直した後", rangeData(day1, day2.AddDate(0, 0, 1)), sda[3:])
+}
+
+func TestFileStoreContract(t *testing.T) {
+	for _, format := range StreamFormats() {
+		t.Run(format, func(t *testing.T) {
+			conf := NewConfig()
+			conf.StreamFormat = format
+			testStoreContract(t, func(root string) (Store, error) {
+				return newFileStore(conf, root, "btc_jpy")
+			})
+		})
+	}
+}
@@ -4,9 +4,13 @@ import (
 	"bufio"
 	"compress/gzip"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
@@ -18,20 +22,23 @@ type StoreData struct {
 	Ask       *PriceAmount `json:"ask,omitempty"`
 	Bid       *PriceAmount `json:"bid,omitempty"`
 	Trade     *Trade       `json:"trade,omitempty"`
+	Gap       *Gap         `json:"gap,omitempty"` // 欠損の印（始まった時と終わった時に記録する）
 	Timestamp Unixtime     `json:"ts"`
 }
 type StoreItem struct {
+	root     string
 	date     time.Time
 	name     string
 	nonempty bool
+	count    int // 書き込んだ件数
 	w        *bufio.Writer
 	fp       *os.File
 	buf      []byte
 }
 type StoreDataArray []StoreData
 
-func streamBufferReadProc(key string) (StoreDataArray, error) {
-	p := createBufferFilePath(key)
+func streamBufferReadProc(root, key string) (StoreDataArray, error) {
+	p := createBufferFilePath(root, key)
 	rfp, err := os.Open(p)
 	if err != nil {
 		return nil, err
@@ -42,8 +49,8 @@ func streamBufferReadProc(key string) (StoreDataArray, error) {
 	return sda, err
 }
 
-func streamBufferWriteProc(key string, sda StoreDataArray) error {
-	p := createBufferFilePath(key)
+func streamBufferWriteProc(root, key string, sda StoreDataArray) error {
+	p := createBufferFilePath(root, key)
 	direrr := createDir(p)
 	if direrr != nil {
 		return direrr
@@ -91,6 +98,13 @@ func storeDataToJSON(buf []byte, sd StoreData) []byte {
 		buf = strconv.AppendUint(buf, sd.Trade.Date, 10)
 		buf = append(buf, `},`...)
 	}
+	if sd.Gap != nil {
+		// 欠損の印は少なく、理由のエラーは任意の文字列なのでencoding/jsonに任せる
+		buf = append(buf, `"gap":`...)
+		b, _ := json.Marshal(sd.Gap)
+		buf = append(buf, b...)
+		buf = append(buf, ',')
+	}
 	buf = append(buf, `"ts":`...)
 	buf = strconv.AppendInt(buf, time.Time(sd.Timestamp).Unix(), 10)
 	buf = append(buf, '}')
@@ -115,42 +129,39 @@ func storeDataArrayToJSON(w io.Writer, sda StoreDataArray) {
 	bufferPool.Put(buf[:0])
 }
 
-func streamToStoreData(s, olds ZaifStream) (StoreData, bool) {
+// streamToStoreData 前回のメッセージから変わった気配と新しい約定をStoreDataにする
+// 約定は1件毎に1レコードとし、気配の変化は最初のレコードに載せる
+func streamToStoreData(s, olds Stream, tt *tradeTracker) []StoreData {
+	ts := Unixtime(s.Timestamp)
+	sd := StoreData{Timestamp: ts}
 	valid := false
-	sd := StoreData{}
-	sd.Timestamp = Unixtime(s.Timestamp)
-	if len(olds.Asks) == 0 {
+	if len(s.Asks) > 0 && (len(olds.Asks) == 0 || s.Asks[0] != olds.Asks[0]) {
 		sd.Ask = &s.Asks[0]
+		valid = true
+	}
+	if len(s.Bids) > 0 && (len(olds.Bids) == 0 || s.Bids[0] != olds.Bids[0]) {
 		sd.Bid = &s.Bids[0]
-		sd.Trade = &s.Trades[0]
 		valid = true
-	} else {
-		switch {
-		case s.Asks[0][0] != olds.Asks[0][0],
-			s.Asks[0][1] != olds.Asks[0][1]:
-			sd.Ask = &s.Asks[0]
-			valid = true
-		}
-		switch {
-		case s.Bids[0][0] != olds.Bids[0][0],
-			s.Bids[0][1] != olds.Bids[0][1]:
-			sd.Bid = &s.Bids[0]
-			valid = true
-		}
-		switch {
-		case s.Trades[0].TradeType != olds.Trades[0].TradeType,
-			s.Trades[0].Price != olds.Trades[0].Price,
-			s.Trades[0].Tid != olds.Trades[0].Tid,
-			s.Trades[0].Amount != olds.Trades[0].Amount:
-			sd.Trade = &s.Trades[0]
-			valid = true
+	}
+	tl := tt.fresh(s.Trades)
+	sdl := make([]StoreData, 0, len(tl)+1)
+	for i := range tl {
+		if i == 0 {
+			sd.Trade = &tl[0]
+			sdl = append(sdl, sd)
+			continue
 		}
+		sdl = append(sdl, StoreData{Trade: &tl[i], Timestamp: ts})
+	}
+	if len(sdl) == 0 && valid {
+		sdl = append(sdl, sd)
 	}
-	return sd, valid
+	return sdl
 }
 
-func newStoreItem(date time.Time, name string) (*StoreItem, error) {
+func newStoreItem(root string, date time.Time, name string) (*StoreItem, error) {
 	si := &StoreItem{}
+	si.root = root
 	si.buf = make([]byte, 0, 16*1024)
 	si.date = date
 	si.name = name
@@ -164,26 +175,64 @@ func newStoreItem(date time.Time, name string) (*StoreItem, error) {
 	return si, err
 }
 
+var errStoreItemClosed = errors.New("書き込み中のファイルが開いていません。")
+
+// writeJsonLine 1件を書き込む
+// 区切りと合わせて1回で書き込み、書けた場合だけ数える
 func (si *StoreItem) writeJsonLine(sd StoreData) error {
-	if si.nonempty {
-		si.w.Write([]byte{',', '\n'})
+	if si.fp == nil {
+		return errStoreItemClosed
 	}
 	si.buf = si.buf[:0]
+	if si.nonempty {
+		si.buf = append(si.buf, ',', '\n')
+	}
 	si.buf = storeDataToJSON(si.buf, sd)
-	_, err := si.w.Write(si.buf)
+	if _, err := si.w.Write(si.buf); err != nil {
+		return err
+	}
 	si.nonempty = true
-	return err
+	si.count++
+	return nil
+}
+
+// Sync 書き込み待ちを書き出してディスクに同期する
+func (si *StoreItem) Sync() error {
+	if si.fp == nil {
+		return errStoreItemClosed
+	}
+	if err := si.w.Flush(); err != nil {
+		return err
+	}
+	return si.fp.Sync()
 }
 
+// Close 閉じた後にもう一度呼んでも何もしない
 func (si *StoreItem) Close() error {
-	si.w.Flush()
-	err := si.fp.Close()
+	if si.fp == nil {
+		return nil
+	}
+	err := si.Sync()
+	if cerr := si.fp.Close(); err == nil {
+		err = cerr
+	}
 	si.fp = nil
 	return err
 }
 
 func (si *StoreItem) fileopen(p string) error {
-	st, err := os.Stat(p)
+	n, err := repairStoreFile(p)
+	if err != nil && os.IsNotExist(err) == false {
+		if err != errBrokenStoreFile {
+			return err
+		}
+		// 読めないファイルは残しておいて新しく作る
+		log.Warnw("読めないファイルを退避します。", "path", p)
+		if err := os.Rename(p, p+".broken"); err != nil {
+			return err
+		}
+		err = os.ErrNotExist
+	}
 	if err != nil {
 		fp, err := os.Create(p)
 		if err != nil {
@@ -192,65 +241,205 @@ func (si *StoreItem) fileopen(p string) error {
 		si.fp = fp
 		si.w.Reset(si.fp)
 		si.w.WriteByte('[')
-		si.w.Flush() // JSONの正しさを保つために書き込みしておく
 		si.nonempty = false
-	} else {
-		fp, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
-		if err != nil {
-			return err
-		}
-		si.fp = fp
-		si.w.Reset(si.fp)
-		si.nonempty = st.Size() > 2
+		si.count = 0
+		// JSONの正しさを保つために書き込みしておく
+		return si.Sync()
+	}
+	fp, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
 	}
+	si.fp = fp
+	si.w.Reset(si.fp)
+	si.nonempty = n > 0
+	si.count = n
 	return nil
 }
 
+var errBrokenStoreFile = errors.New("JSONの配列ではありません。")
+
+// repairStoreFile 書き込み中に止まったファイルを最後まで読める1件の後ろで切り詰める
+// 閉じ括弧で終わっている場合も追記できるように取り除く
+// 読めた件数を返す
+func repairStoreFile(p string) (n int, err error) {
+	fp, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+	st, err := fp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	dec := json.NewDecoder(bufio.NewReaderSize(fp, 64*1024))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		if st.Size() == 0 {
+			return 0, os.ErrNotExist
+		}
+		return 0, errBrokenStoreFile
+	}
+	end := dec.InputOffset()
+	for dec.More() {
+		var sd StoreData
+		if err := dec.Decode(&sd); err != nil {
+			break
+		}
+		end = dec.InputOffset()
+		n++
+	}
+	if end == st.Size() {
+		return n, nil
+	}
+	if tok, err := dec.Token(); err != nil || tok != json.Delim(']') || dec.InputOffset() != st.Size() {
+		log.Warnw("途中で終わっている記録を切り詰めます。", "path", p, "size", st.Size(), "offset", end, "count", n)
+	}
+	if err := fp.Truncate(end); err != nil {
+		return 0, err
+	}
+	return n, fp.Sync()
+}
+
+// nextFile 書き込み中のファイルを閉じてアーカイブにし、dateのファイルを開く
+// 開けなかった場合はエラーを返し、書き込みは呼び出し側で開き直すまで失敗する
 func (si *StoreItem) nextFile(date time.Time) error {
-	si.w.WriteByte(']')
-	si.Close()
-	si.store()
+	if si.fp != nil {
+		// bufio.Writerのエラーは残るので、閉じ括弧を書けなければCloseも失敗する
+		si.w.WriteByte(']')
+		if err := si.Close(); err != nil {
+			// 閉じ括弧まで書けたか分からないので、起動時と同じく切り詰めてからアーカイブにする
+			log.Warnw("書き込み中のファイルを閉じるのに失敗しました。", "error", err, "path", si.createPathTmp())
+			err = finishStoreFile(si.createPathTmp(), si.createPathStream(), createStoreFilePath(si.root, si.date, si.name, "manifest"))
+			if err != nil {
+				log.Warnw("アーカイブの作成に失敗しました。次の起動時にもう一度試します。", "error", err, "path", si.createPathTmp())
+			}
+		} else if err := si.store(); err != nil {
+			log.Warnw("アーカイブの作成に失敗しました。次の起動時にもう一度試します。", "error", err, "path", si.createPathTmp())
+		}
+	}
 	si.date = date
 	p := si.createPathTmp()
 	return si.fileopen(p)
 }
 
+// store 書き込み中のファイルを圧縮してアーカイブにする
 func (si *StoreItem) store() error {
-	n := si.createPathStream()
-	if err := createDir(n); err != nil {
+	return archiveStoreFile(si.createPathTmp(), si.createPathStream(), createStoreFilePath(si.root, si.date, si.name, "manifest"), si.count)
+}
+
+// archiveStoreFile 閉じ括弧まで書いたファイルを圧縮してアーカイブにする
+// アーカイブを読み直してn件あることを確かめ、マニフェストをmpに書いてから元のファイルを消す
+// 別名で書き出して同期してから置き換えるので、途中で止まっても壊れたアーカイブは残らない
+func archiveStoreFile(src, dst, mp string, n int) error {
+	if err := createDir(dst); err != nil {
+		return err
+	}
+	if err := gzipFile(src, dst); err != nil {
+		return err
+	}
+	m, err := buildManifest(dst)
+	if err != nil {
 		return err
 	}
-	o := si.createPathTmp()
-	rfp, err := os.Open(o)
+	if m.Count != n {
+		return fmt.Errorf("アーカイブの件数が合いません。count:%d want:%d", m.Count, n)
+	}
+	if err := writeJSONFile(mp, m); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// sweepStoreFiles 停止している間に日付が変わって残った書き込み中のファイルをアーカイブにする
+// today以降のファイルはそのまま
+func sweepStoreFiles(root, key string, today time.Time) {
+	match, _ := filepath.Glob(filepath.Join(root, "tmp", key, key+"_*.json"))
+	for _, p := range match {
+		day, ok := dayFileDate(key, filepath.Base(p))
+		if ok == false || day.Before(today) == false {
+			continue
+		}
+		dst := createStoreFilePath(root, day, key, "stream") + ".gz"
+		mp := createStoreFilePath(root, day, key, "manifest")
+		if err := finishStoreFile(p, dst, mp); err != nil {
+			log.Warnw("書き込み中のファイルのアーカイブに失敗しました。", "error", err, "path", p)
+			continue
+		}
+		log.Infow("書き込み中のファイルをアーカイブにしました。", "path", p, "archive", dst)
+	}
+}
+
+// finishStoreFile 途中で終わっているファイルを閉じてからアーカイブにする
+func finishStoreFile(src, dst, mp string) error {
+	n, err := repairStoreFile(src)
+	if err != nil {
+		return err
+	}
+	// 以前はアーカイブにした後も残していたので、同じ件数のアーカイブがあれば作り直さない
+	if m, err := buildManifest(dst); err == nil && m.Count == n {
+		if err := writeJSONFile(mp, m); err != nil {
+			return err
+		}
+		return os.Remove(src)
+	}
+	fp, err := os.OpenFile(src, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write([]byte{']'}); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return archiveStoreFile(src, dst, mp, n)
+}
+
+func gzipFile(src, dst string) error {
+	rfp, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer rfp.Close()
-	wfp, err := os.Create(n)
+	tmp := dst + ".tmp"
+	wfp, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmp)
 	defer wfp.Close()
 	gz, _ := gzip.NewWriterLevel(wfp, gzip.BestSpeed)
-	defer gz.Close()
-	_, err = io.Copy(gz, rfp)
-	if err != nil {
+	if _, err := io.Copy(gz, rfp); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
 		return err
 	}
-	return gz.Flush()
+	if err := wfp.Sync(); err != nil {
+		return err
+	}
+	if err := wfp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
 }
 
 func (si *StoreItem) createPathTmp() string {
-	return createStoreFilePath(si.date, si.name, "tmp")
+	return createStoreFilePath(si.root, si.date, si.name, "tmp")
 }
 
 func (si *StoreItem) createPathStream() string {
-	return createStoreFilePath(si.date, si.name, "stream") + ".gz"
+	return createStoreFilePath(si.root, si.date, si.name, "stream") + ".gz"
 }
 
 var storeDataArrayPool = sync.Pool{
 	New: func() interface{} {
-		return StoreDataArray(make([]StoreData, 0, StoreDataMax))
+		return StoreDataArray(make([]StoreData, 0, DefaultStoreDataMax))
 	},
 }
 
@@ -262,10 +451,12 @@ func (sda StoreDataArray) Copy() StoreDataArray {
 	sda2 = append(sda2, sda...)
 	return sda2
 }
-func (sda *StoreDataArray) Push(sd StoreData) {
+
+// Push 末尾に追加してmax件を超えた古いものを捨てる
+// 公開した写しと配列を共有しているので捨てたものも書き換えない（appendで配列を作り直した時に解放される）
+func (sda *StoreDataArray) Push(sd StoreData, max int) {
 	*sda = append(*sda, sd)
-	if len(*sda) > StoreDataMax {
-		(*sda)[0] = StoreData{}
+	if len(*sda) > max {
 		*sda = (*sda)[1:]
 	}
 }
@@ -0,0 +1,151 @@
+package zbbv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRepairStoreFile(t *testing.T) {
+	rec1 := `{"trade":{"currenty_pair":"btc_jpy","trade_type":"bid","price":100,"tid":1,"amount":1,"date":1700000000},"ts":1700000000}`
+	rec2 := `{"ask":[101,0.5],"ts":1700000001}`
+	for _, it := range []struct {
+		name string
+		in   string
+		n    int
+		out  string
+		err  error
+	}{
+		{"途中で終わっている最後の1件", "[" + rec1 + ",\n" + rec2 + ",\n" + `{"ts":17`, 2, "[" + rec1 + ",\n" + rec2, nil},
+		{"区切りで終わっている", "[" + rec1 + ",\n", 1, "[" + rec1, nil},
+		{"閉じ括弧で終わっている", "[" + rec1 + ",\n" + rec2 + "]", 2, "[" + rec1 + ",\n" + rec2, nil},
+		{"そのまま追記できる", "[" + rec1, 1, "[" + rec1, nil},
+		{"開き括弧だけ", "[", 0, "[", nil},
+		{"空のファイル", "", 0, "", os.ErrNotExist},
+		{"配列ではない", rec1, 0, rec1, errBrokenStoreFile},
+	} {
+		p := filepath.Join(t.TempDir(), "btc_jpy_20231115.json")
+		if err := os.WriteFile(p, []byte(it.in), 0644); err != nil {
+			t.Fatal(err)
+		}
+		n, err := repairStoreFile(p)
+		if err != it.err || n != it.n {
+			t.Errorf("%s: n:%d err:%v, want n:%d err:%v", it.name, n, err, it.n, it.err)
+		}
+		if buf, err := os.ReadFile(p); err != nil || string(buf) != it.out {
+			t.Errorf("%s: got %q, want %q (%v)", it.name, buf, it.out, err)
+		}
+	}
+}
+
+func readStoreTids(t *testing.T, p string, gz bool) []uint64 {
+	t.Helper()
+	var l []uint64
+	err := readStoreDataFile(p, gz, func(sd StoreData) error {
+		l = append(l, sd.Trade.Tid)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestStoreItemAppendAfterRepair(t *testing.T) {
+	root := t.TempDir()
+	day := time.Date(2023, 11, 15, 0, 0, 0, 0, jst)
+	si, err := newStoreItem(root, day, "btc_jpy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tid := range []uint64{1, 2} {
+		if err := si.writeJsonLine(tradeData(day.Add(time.Hour), tid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := si.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 閉じた後の書き込みは捨てずにエラーにする
+	if err := si.writeJsonLine(tradeData(day.Add(time.Hour), 3)); err != errStoreItemClosed {
+		t.Errorf("閉じた後のwriteJsonLine = %v", err)
+	}
+	if err := si.Sync(); err != errStoreItemClosed {
+		t.Errorf("閉じた後のSync = %v", err)
+	}
+	if si.count != 2 {
+		t.Errorf("count = %d", si.count)
+	}
+	// 書き込み途中で止まった
+	p := si.createPathTmp()
+	fp, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.WriteString(`,` + "\n" + `{"trade":{"tid":`)
+	fp.Close()
+
+	si, err = newStoreItem(root, day, "btc_jpy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si.count != 2 {
+		t.Errorf("開き直した後のcount = %d", si.count)
+	}
+	if err := si.writeJsonLine(tradeData(day.Add(time.Hour), 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := si.nextFile(day.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	si.Close()
+	if got := readStoreTids(t, si.createPathTmp(), false); len(got) != 0 {
+		t.Errorf("次の日のファイル = %v", got)
+	}
+	if got := readStoreTids(t, createStoreFilePath(root, day, "btc_jpy", "stream")+".gz", true); equalUint64s(got, []uint64{1, 2, 4}) == false {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestJSONStreamStorageReopen(t *testing.T) {
+	root := t.TempDir()
+	st, err := newJSONStreamStorage(root, "btc_jpy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	today := dayStart(time.Now())
+	tomorrow := today.AddDate(0, 0, 1)
+	if err := st.Append(tradeData(today.Add(time.Hour), 1)); err != nil {
+		t.Fatal(err)
+	}
+	// 次の日のファイルを開けない
+	p := createStoreFilePath(root, tomorrow, "btc_jpy", "tmp")
+	if err := os.Mkdir(p, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tid := range []uint64{2, 3} {
+		if err := st.Append(tradeData(tomorrow.Add(time.Hour), tid)); err == nil {
+			t.Errorf("Tid:%d 開けないファイルへの書き込みが成功しました", tid)
+		}
+	}
+	if err := st.Flush(); err != nil {
+		t.Errorf("Flush = %v", err)
+	}
+	// 開けるようになれば開き直して書き込む
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Append(tradeData(tomorrow.Add(time.Hour), 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readStoreTids(t, createStoreFilePath(root, today, "btc_jpy", "stream")+".gz", true); equalUint64s(got, []uint64{1}) == false {
+		t.Errorf("today got %v", got)
+	}
+	if got := readStoreTids(t, p, false); equalUint64s(got, []uint64{4}) == false {
+		t.Errorf("tomorrow got %v", got)
+	}
+}
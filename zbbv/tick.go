@@ -1,16 +1,14 @@
 package zbbv
 
 import (
-	"context"
 	"encoding/json"
-	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
-	"time"
 )
 
-type ZaifTicker struct {
+// Ticker24h 正規化した過去24時間のティッカー
+type Ticker24h struct {
 	Last   float64 `json:"last"`   // 終値
 	High   float64 `json:"high"`   // 過去24時間の高値
 	Low    float64 `json:"low"`    // 過去24時間の安値
@@ -20,6 +18,12 @@ type ZaifTicker struct {
 	Ask    float64 `json:"ask"`    // 売気配値
 }
 
+// TickerSnapshot 日付が変わった時に取得した過去24時間のティッカー
+type TickerSnapshot struct {
+	Date string `json:"date"`
+	Ticker24h
+}
+
 type Ticker struct {
 	Date   string  `json:"date"`   // 日付
 	Open   float64 `json:"open"`   // 始値
@@ -30,93 +34,79 @@ type Ticker struct {
 	Volume float64 `json:"volume"` // 過去24時間の出来高
 }
 
-func getZaifTicker(ctx context.Context, key string) (*ZaifTicker, error) {
-	c, cancel := context.WithTimeout(ctx, 3*time.Second)
-	defer cancel()
-	req, err := http.NewRequestWithContext(c, http.MethodGet, ZaifTickerUrl+key, nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	var tc ZaifTicker
-	err = json.NewDecoder(resp.Body).Decode(&tc)
-	return &tc, err
-}
-
 func copyTicks(tcl []Ticker) []Ticker {
 	return append([]Ticker(nil), tcl...)
 }
 
-func createZaifTickJSONFile(p string, tc *ZaifTicker) {
-	direrr := createDir(p)
-	if direrr != nil {
-		log.Warnw("フォルダ作成に失敗しました。", "error", direrr, "path", p)
-		return
+func createTickJSONFile(p string, tc *Ticker24h) error {
+	if err := createDir(p); err != nil {
+		return err
 	}
 	wfp, err := os.Create(p)
 	if err != nil {
-		log.Warnw("ファイル作成に失敗しました。", "error", err, "path", p)
-		return
+		return err
 	}
 	defer wfp.Close()
 	err = json.NewEncoder(wfp).Encode(tc)
 	if err != nil {
-		log.Warnw("JSON出力に失敗しました。", "error", err, "path", p)
-		return
-	}
-	err = wfp.Sync()
-	if err != nil {
-		log.Warnw("JSON出力に失敗しました。", "error", err, "path", p)
-		return
+		return err
 	}
+	return wfp.Sync()
 }
 
-func readTicks(dir string) []Ticker {
-	tl := make([]Ticker, 0, 365)
+// readTickSnapshots フォルダ内のティッカーを日付順に読む
+func readTickSnapshots(dir string) []TickerSnapshot {
+	sl := make([]TickerSnapshot, 0, 365)
 	match, err := filepath.Glob(filepath.Join(dir, "*.json"))
 	if len(match) > 0 && err == nil {
 		// 昇順
 		sort.Slice(match, func(i, j int) bool { return match[i] < match[j] })
-		var old ZaifTicker
 		for _, p := range match {
 			_, file := filepath.Split(p)
 			if len(file) <= 13 {
 				continue
 			}
-			zt, err := readZaifTickData(p)
+			zt, err := readTickData(p)
 			if err != nil {
 				break
 			}
-			if old.Last == 0 {
-				old.Last = zt.Last
-			}
-			t := Ticker{
-				Date:   file[0:8],
-				Open:   old.Last,
-				Close:  zt.Last,
-				High:   zt.High,
-				Low:    zt.Low,
-				Vwap:   zt.Vwap,
-				Volume: zt.Volume,
-			}
-			tl = append(tl, t)
-			old = *zt
+			sl = append(sl, TickerSnapshot{Date: file[0:8], Ticker24h: *zt})
+		}
+	}
+	return sl
+}
+
+// ticksFromSnapshots 日付順のスナップショットから日毎のティッカーを作る
+// 始値は前日の終値
+func ticksFromSnapshots(sl []TickerSnapshot) []Ticker {
+	tl := make([]Ticker, 0, len(sl))
+	var old Ticker24h
+	for _, it := range sl {
+		zt := it.Ticker24h
+		if old.Last == 0 {
+			old.Last = zt.Last
 		}
+		tl = append(tl, Ticker{
+			Date:   it.Date,
+			Open:   old.Last,
+			Close:  zt.Last,
+			High:   zt.High,
+			Low:    zt.Low,
+			Vwap:   zt.Vwap,
+			Volume: zt.Volume,
+		})
+		old = zt
 	}
 	return tl
 }
 
-func readZaifTickData(p string) (*ZaifTicker, error) {
+func readTickData(p string) (*Ticker24h, error) {
 	fp, err := os.Open(p)
 	if err != nil {
 		return nil, err
 	}
 	defer fp.Close()
-	var tc ZaifTicker
+	var tc Ticker24h
 	err = json.NewDecoder(fp).Decode(&tc)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,68 @@
+package zbbv
+
+import (
+	"sort"
+)
+
+// 取り込み済みとして覚えておくTidの数
+const tradeSeenMax = 4096
+
+// tradeTracker 取り込み済みの約定をTidで覚えておく
+// 重複して届いた約定と、遅れて届いた古い約定を見分けるために使う
+type tradeTracker struct {
+	floor uint64 // これ以下のTidは取り込み済みとみなす
+	last  uint64 // 取り込んだ中で最大のTid
+	seen  map[uint64]struct{}
+}
+
+func newTradeTracker() *tradeTracker {
+	return &tradeTracker{seen: make(map[uint64]struct{}, tradeSeenMax)}
+}
+
+// add 初めて見るTidならtrueを返して覚える
+func (tt *tradeTracker) add(tid uint64) bool {
+	if tid <= tt.floor {
+		return false
+	}
+	if _, ok := tt.seen[tid]; ok {
+		return false
+	}
+	tt.seen[tid] = struct{}{}
+	if tid > tt.last {
+		tt.last = tid
+	}
+	if len(tt.seen) > tradeSeenMax {
+		// 古い方の半分を忘れる
+		l := make([]uint64, 0, len(tt.seen))
+		for t := range tt.seen {
+			l = append(l, t)
+		}
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		for _, t := range l[:len(l)/2] {
+			delete(tt.seen, t)
+		}
+		tt.floor = l[len(l)/2-1]
+	}
+	return true
+}
+
+// fresh 取り込んでいない約定をTidの昇順で返す
+func (tt *tradeTracker) fresh(tl []Trade) []Trade {
+	nl := make([]Trade, 0, len(tl))
+	for _, t := range tl {
+		if tt.add(t.Tid) {
+			nl = append(nl, t)
+		}
+	}
+	sort.Slice(nl, func(i, j int) bool { return nl[i].Tid < nl[j].Tid })
+	return nl
+}
+
+// restore リングバッファに残っている約定を取り込み済みにする
+func (tt *tradeTracker) restore(sda StoreDataArray) {
+	for _, sd := range sda {
+		if sd.Trade != nil {
+			tt.add(sd.Trade.Tid)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package zbbv
+
+import (
+	"testing"
+)
+
+func tradeList(tids ...uint64) []Trade {
+	tl := make([]Trade, 0, len(tids))
+	for _, tid := range tids {
+		tl = append(tl, Trade{Tid: tid})
+	}
+	return tl
+}
+
+func tradeTids(tl []Trade) []uint64 {
+	l := make([]uint64, 0, len(tl))
+	for _, t := range tl {
+		l = append(l, t.Tid)
+	}
+	return l
+}
+
+func equalUint64s(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTradeTrackerFresh(t *testing.T) {
+	tt := newTradeTracker()
+	for _, it := range []struct {
+		in   []uint64
+		want []uint64
+	}{
+		// Zaifは新しい順に送ってくる
+		{[]uint64{12, 11, 10}, []uint64{10, 11, 12}},
+		// 重複は取り込まない
+		{[]uint64{13, 12, 11}, []uint64{13}},
+		// 同じメッセージの中の重複
+		{[]uint64{15, 15, 14, 14}, []uint64{14, 15}},
+		// 遅れて届いた古い約定も取り込む
+		{[]uint64{16, 9, 5}, []uint64{5, 9, 16}},
+		{[]uint64{9, 5, 16}, []uint64{}},
+		{nil, []uint64{}},
+	} {
+		got := tradeTids(tt.fresh(tradeList(it.in...)))
+		if equalUint64s(got, it.want) == false {
+			t.Errorf("fresh(%v) = %v, want %v", it.in, got, it.want)
+		}
+	}
+	if tt.last != 16 {
+		t.Errorf("last = %d", tt.last)
+	}
+}
+
+func TestTradeTrackerFloor(t *testing.T) {
+	tt := newTradeTracker()
+	// 覚えておける数を超えると古い方の半分を忘れてfloorを上げる
+	for tid := uint64(1); tid <= tradeSeenMax+1; tid++ {
+		if tt.add(tid) == false {
+			t.Fatalf("add(%d) = false", tid)
+		}
+	}
+	if len(tt.seen) > tradeSeenMax {
+		t.Errorf("len(seen) = %d", len(tt.seen))
+	}
+	floor := tt.floor
+	if floor == 0 || floor >= tradeSeenMax+1 {
+		t.Fatalf("floor = %d", floor)
+	}
+	// 忘れた分もfloor以下なので取り込まない
+	if got := tradeTids(tt.fresh(tradeList(1, floor))); len(got) != 0 {
+		t.Errorf("floor以下 = %v", got)
+	}
+	// floorより上で覚えている分は重複
+	if got := tradeTids(tt.fresh(tradeList(floor+1, tradeSeenMax+1))); len(got) != 0 {
+		t.Errorf("floorより上の重複 = %v", got)
+	}
+	// floorより上の新しい約定は取り込む
+	if got := tradeTids(tt.fresh(tradeList(tradeSeenMax+3, tradeSeenMax+2))); equalUint64s(got, []uint64{tradeSeenMax + 2, tradeSeenMax + 3}) == false {
+		t.Errorf("新しい約定 = %v", got)
+	}
+}
+
+func TestTradeTrackerRestore(t *testing.T) {
+	tt := newTradeTracker()
+	tt.restore(StoreDataArray{
+		{Trade: &Trade{Tid: 3}},
+		{},
+		{Trade: &Trade{Tid: 5}},
+	})
+	if got := tradeTids(tt.fresh(tradeList(6, 5, 4, 3))); equalUint64s(got, []uint64{4, 6}) == false {
+		t.Errorf("fresh = %v", got)
+	}
+}
+
+func TestStreamToStoreDataTrades(t *testing.T) {
+	tt := newTradeTracker()
+	s := Stream{
+		Asks:   []PriceAmount{{101, 1}},
+		Bids:   []PriceAmount{{99, 1}},
+		Trades: tradeList(3, 2, 1),
+	}
+	sdl := streamToStoreData(s, Stream{}, tt)
+	if len(sdl) != 3 {
+		t.Fatalf("len = %d", len(sdl))
+	}
+	// 気配の変化は最初のレコードだけに載せる
+	if sdl[0].Ask == nil || sdl[0].Bid == nil || sdl[1].Ask != nil || sdl[2].Bid != nil {
+		t.Errorf("気配 = %+v", sdl)
+	}
+	for i, sd := range sdl {
+		if sd.Trade == nil || sd.Trade.Tid != uint64(i+1) {
+			t.Errorf("sdl[%d] = %+v", i, sd)
+		}
+	}
+	// 約定が無くても気配が変われば1件
+	old := s
+	s.Asks = []PriceAmount{{102, 1}}
+	sdl = streamToStoreData(s, old, tt)
+	if len(sdl) != 1 || sdl[0].Ask == nil || sdl[0].Bid != nil || sdl[0].Trade != nil {
+		t.Errorf("気配の変化 = %+v", sdl)
+	}
+	// 何も変わらなければ無し
+	if sdl = streamToStoreData(s, s, tt); len(sdl) != 0 {
+		t.Errorf("変化無し = %+v", sdl)
+	}
+}
@@ -0,0 +1,124 @@
+package zbbv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type ZaifStream struct {
+	Asks         []PriceAmount `json:"asks"`
+	Bids         []PriceAmount `json:"bids"`
+	Trades       []Trade       `json:"trades"`
+	Timestamp    Timestamp     `json:"timestamp"`
+	LastPrice    LastPrice     `json:"last_price"`
+	CurrentyPair string        `json:"currency_pair"`
+}
+
+type ZaifTicker struct {
+	Last   float64 `json:"last"`   // 終値
+	High   float64 `json:"high"`   // 過去24時間の高値
+	Low    float64 `json:"low"`    // 過去24時間の安値
+	Vwap   float64 `json:"vwap"`   // 過去24時間の加重平均
+	Volume float64 `json:"volume"` // 過去24時間の出来高
+	Bid    float64 `json:"bid"`    // 買気配値
+	Ask    float64 `json:"ask"`    // 売気配値
+}
+
+type zaifExchange struct {
+	name      string
+	streamURL string
+	depthURL  string
+	tickerURL string
+}
+type zaifStreamConn struct {
+	con *websocket.Conn
+}
+
+func newZaifExchange(ec ExchangeConfig) (Exchange, error) {
+	return &zaifExchange{
+		name:      ec.Name,
+		streamURL: ec.StreamURL,
+		depthURL:  ec.DepthURL,
+		tickerURL: ec.TickerURL,
+	}, nil
+}
+
+func (z *zaifExchange) Name() string {
+	return z.name
+}
+
+func (z *zaifExchange) Subscribe(ctx context.Context, pair string) (StreamConn, error) {
+	con, _, err := websocket.DefaultDialer.DialContext(ctx, z.streamURL+pair, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &zaifStreamConn{con: con}, nil
+}
+
+func (z *zaifExchange) Depth(ctx context.Context, pair string) (*Depth, error) {
+	c, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var d Depth
+	if err := getZaifJSON(c, z.depthURL+pair, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (z *zaifExchange) Ticker(ctx context.Context, pair string) (*Ticker24h, error) {
+	c, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	var zt ZaifTicker
+	if err := getZaifJSON(c, z.tickerURL+pair, &zt); err != nil {
+		return nil, err
+	}
+	return &Ticker24h{
+		Last:   zt.Last,
+		High:   zt.High,
+		Low:    zt.Low,
+		Vwap:   zt.Vwap,
+		Volume: zt.Volume,
+		Bid:    zt.Bid,
+		Ask:    zt.Ask,
+	}, nil
+}
+
+func (c *zaifStreamConn) Read() (Stream, error) {
+	zs := ZaifStream{}
+	if err := c.con.ReadJSON(&zs); err != nil {
+		return Stream{}, err
+	}
+	return Stream{
+		Asks:         zs.Asks,
+		Bids:         zs.Bids,
+		Trades:       zs.Trades,
+		Timestamp:    time.Time(zs.Timestamp),
+		LastPrice:    zs.LastPrice,
+		CurrencyPair: zs.CurrentyPair,
+	}, nil
+}
+
+func (c *zaifStreamConn) Close() error {
+	return c.con.Close()
+}
+
+func getZaifJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTPステータスが異常です。status:%d url:%s", resp.StatusCode, u)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,305 @@
+// Package zaiftest はZaifのストリーム・板情報・ティッカーAPIを模倣する偽サーバです。
+// 本物の ws.zaif.jp / api.zaif.jp に接続せずにzbbv.Appを動かすために使います。
+package zaiftest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tanaton/zaifbotbattleviewer/zbbv"
+)
+
+const (
+	StreamPath = "/stream"
+	DepthPath  = "/depth/"
+	TickerPath = "/ticker/"
+)
+
+// Server 偽のZaif
+type Server struct {
+	mu       sync.Mutex
+	srv      *httptest.Server
+	upgrader websocket.Upgrader
+	pairs    map[string]*pair
+	interval time.Duration
+}
+
+type pair struct {
+	script  []zbbv.ZaifStream
+	depth   *zbbv.Depth
+	ticker  *zbbv.ZaifTicker
+	conns   map[*conn]struct{}
+	connect int
+	waiter  chan struct{}
+}
+
+type conn struct {
+	ws   *websocket.Conn
+	ch   chan zbbv.ZaifStream
+	done chan struct{}
+	once sync.Once
+}
+
+// New 起動していない偽サーバを生成する
+// http.ListenAndServe 等に渡して使う
+func New() *Server {
+	return &Server{
+		pairs: make(map[string]*pair),
+	}
+}
+
+// NewServer ループバックアドレスで起動した偽サーバを生成する
+func NewServer() *Server {
+	s := New()
+	s.srv = httptest.NewServer(s)
+	return s
+}
+
+// Close 接続中のストリームを全て切断してサーバを停止する
+func (s *Server) Close() {
+	s.mu.Lock()
+	for _, p := range s.pairs {
+		for c := range p.conns {
+			c.close()
+		}
+	}
+	s.mu.Unlock()
+	if s.srv != nil {
+		s.srv.CloseClientConnections()
+		s.srv.Close()
+	}
+}
+
+// URL 起動中のサーバのURL
+func (s *Server) URL() string {
+	if s.srv == nil {
+		return ""
+	}
+	return s.srv.URL
+}
+
+// StreamURL zbbv.ExchangeConfig.StreamURL に設定する値
+func (s *Server) StreamURL() string {
+	return "ws" + strings.TrimPrefix(s.URL(), "http") + StreamPath + "?currency_pair="
+}
+
+// DepthURL zbbv.ExchangeConfig.DepthURL に設定する値
+func (s *Server) DepthURL() string {
+	return s.URL() + DepthPath
+}
+
+// TickerURL zbbv.ExchangeConfig.TickerURL に設定する値
+func (s *Server) TickerURL() string {
+	return s.URL() + TickerPath
+}
+
+// ExchangeConfig 偽サーバに接続する取引所の設定
+func (s *Server) ExchangeConfig(pairs ...string) zbbv.ExchangeConfig {
+	return zbbv.ExchangeConfig{
+		Name:          zbbv.DefaultExchange,
+		StreamURL:     s.StreamURL(),
+		DepthURL:      s.DepthURL(),
+		TickerURL:     s.TickerURL(),
+		CurrencyPairs: pairs,
+	}
+}
+
+// SetInterval 台本のメッセージを送る間隔
+func (s *Server) SetInterval(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interval = d
+}
+
+// Script 接続直後に順番に送るメッセージを設定する
+func (s *Server) Script(key string, msgs ...zbbv.ZaifStream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pair(key).script = append([]zbbv.ZaifStream(nil), msgs...)
+}
+
+// SetDepth 板情報APIが返す値を設定する
+// 設定していない通貨ペアは404を返す
+func (s *Server) SetDepth(key string, d zbbv.Depth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pair(key).depth = &d
+}
+
+// SetTicker ティッカーAPIが返す値を設定する
+// 設定していない通貨ペアは404を返す
+func (s *Server) SetTicker(key string, t zbbv.ZaifTicker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pair(key).ticker = &t
+}
+
+// Send 接続中の全てのストリームにメッセージを送る
+func (s *Server) Send(key string, msg zbbv.ZaifStream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.pair(key).conns {
+		select {
+		case c.ch <- msg:
+		case <-c.done:
+		}
+	}
+}
+
+// Disconnect 接続中のストリームを全て切断する
+// 再接続の確認に使う
+func (s *Server) Disconnect(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.pair(key).conns {
+		c.close()
+	}
+}
+
+// Connections これまでに受け付けたストリーム接続の数
+func (s *Server) Connections(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pair(key).connect
+}
+
+// WaitConnections 接続数がn以上になるまで待つ
+// タイムアウトした場合はfalseを返す
+func (s *Server) WaitConnections(key string, n int, timeout time.Duration) bool {
+	tm := time.NewTimer(timeout)
+	defer tm.Stop()
+	for {
+		s.mu.Lock()
+		p := s.pair(key)
+		if p.connect >= n {
+			s.mu.Unlock()
+			return true
+		}
+		if p.waiter == nil {
+			p.waiter = make(chan struct{})
+		}
+		w := p.waiter
+		s.mu.Unlock()
+		select {
+		case <-w:
+		case <-tm.C:
+			return false
+		}
+	}
+}
+
+func (s *Server) pair(key string) *pair {
+	p, ok := s.pairs[key]
+	if ok == false {
+		p = &pair{conns: make(map[*conn]struct{})}
+		s.pairs[key] = p
+	}
+	return p
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == StreamPath:
+		s.serveStream(w, r)
+	case strings.HasPrefix(r.URL.Path, DepthPath):
+		key := strings.TrimPrefix(r.URL.Path, DepthPath)
+		s.mu.Lock()
+		d := s.pair(key).depth
+		s.mu.Unlock()
+		if d == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, d)
+	case strings.HasPrefix(r.URL.Path, TickerPath):
+		key := strings.TrimPrefix(r.URL.Path, TickerPath)
+		s.mu.Lock()
+		t := s.pair(key).ticker
+		s.mu.Unlock()
+		if t == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, t)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("currency_pair")
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &conn{
+		ws:   ws,
+		ch:   make(chan zbbv.ZaifStream),
+		done: make(chan struct{}),
+	}
+	s.mu.Lock()
+	p := s.pair(key)
+	script := append([]zbbv.ZaifStream(nil), p.script...)
+	interval := s.interval
+	p.conns[c] = struct{}{}
+	p.connect++
+	if p.waiter != nil {
+		close(p.waiter)
+		p.waiter = nil
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(p.conns, c)
+		s.mu.Unlock()
+		c.close()
+	}()
+	// 相手が切断したことを検知するために読み捨てる
+	go func() {
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				c.close()
+				return
+			}
+		}
+	}()
+	for _, msg := range script {
+		if interval > 0 {
+			select {
+			case <-time.After(interval):
+			case <-c.done:
+				return
+			}
+		}
+		if err := ws.WriteJSON(msg); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case msg := <-c.ch:
+			if err := ws.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *conn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.ws.Close()
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
@@ -5,36 +5,26 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/crypto/acme/autocert"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-const RootDomain = "crypto.unko.in"
-
-const (
-	StoreDataMax  = 1 << 14 // 16384
-	ZaifStremUrl  = "wss://ws.zaif.jp/stream?currency_pair="
-	ZaifDepthUrl  = "https://api.zaif.jp/api/1/depth/"
-	ZaifTickerUrl = "https://api.zaif.jp/api/1/ticker/"
-	AccessLogPath = "./log"
-	RootDataPath  = "data"
-)
-
 type PriceAmount [2]float64
 type LastPrice struct {
 	Action string  `json:"action"`
@@ -50,13 +40,17 @@ type Trade struct {
 }
 type Timestamp time.Time
 
+const timestampLayout = `"2006-01-02 15:04:05.000000"`
+
 func (ts *Timestamp) UnmarshalJSON(data []byte) error {
 	// 2019-07-08 18:59:36.105162
-	loc, _ := time.LoadLocation("Asia/Tokyo")
-	t, err := time.ParseInLocation(`"2006-01-02 15:04:05.000000"`, string(data), loc)
+	t, err := time.ParseInLocation(timestampLayout, string(data), jst)
 	*ts = Timestamp(t)
 	return err
 }
+func (ts Timestamp) MarshalJSON() ([]byte, error) {
+	return time.Time(ts).In(jst).AppendFormat(nil, timestampLayout), nil
+}
 
 type Unixtime time.Time
 
@@ -79,21 +73,16 @@ func (ts Unixtime) MarshalBinary() ([]byte, error) {
 	return time.Time(ts).MarshalBinary()
 }
 
-type ZaifStream struct {
-	Asks         []PriceAmount `json:"asks"`
-	Bids         []PriceAmount `json:"bids"`
-	Trades       []Trade       `json:"trades"`
-	Timestamp    Timestamp     `json:"timestamp"`
-	LastPrice    LastPrice     `json:"last_price"`
-	CurrentyPair string        `json:"currency_pair"`
-}
 type Srv struct {
 	s *http.Server
 	f func(s *http.Server) error
 }
 
 type App struct {
-	wg sync.WaitGroup
+	wg    sync.WaitGroup
+	conf  *Config
+	mux   *http.ServeMux
+	pairs *PairRegistry
 }
 
 var gzipContentTypeList = []string{
@@ -103,13 +92,6 @@ var gzipContentTypeList = []string{
 	"text/plain",
 	"application/json",
 }
-var zaifStremURLList = []string{
-	"btc_jpy",
-	"xem_jpy",
-	"mona_jpy",
-	"bch_jpy",
-	"eth_jpy",
-}
 var bufferPool = sync.Pool{
 	New: func() interface{} {
 		return make([]byte, 0, 32*1024)
@@ -117,6 +99,17 @@ var bufferPool = sync.Pool{
 }
 var log *zap.SugaredLogger
 
+// Zaifのタイムスタンプは日本時間
+var jst = loadJST()
+
+func loadJST() *time.Location {
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		return time.FixedZone("Asia/Tokyo", 9*60*60)
+	}
+	return loc
+}
+
 func init() {
 	//logger, err := zap.NewDevelopment()
 	logger, err := zap.NewProduction()
@@ -127,43 +120,64 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-func New() *App {
-	return &App{}
+// New 設定を検査してAppを生成する
+// 設定に誤りがある場合は何も起動せずにエラーを返す
+func New(conf *Config) (*App, error) {
+	if conf == nil {
+		conf = NewConfig()
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	app := &App{
+		conf: conf,
+		// 同じプロセスで複数起動できるようにDefaultServeMuxは使わない
+		mux: http.NewServeMux(),
+	}
+	// 取引所の生成は起動前に済ませて問題があればここで返す
+	pairs, err := newPairRegistry(conf)
+	if err != nil {
+		return nil, err
+	}
+	app.pairs = pairs
+	return app, nil
 }
 
 func (app *App) Run(ctx context.Context) error {
 	ctx, exitch := app.startExitManageProc(ctx)
+	app.pairs.run(ctx)
 
-	for _, key := range zaifStremURLList {
-		sdch := make(chan StoreDataArray)
-		lpch := make(chan LastPrice)
-		depthch := make(chan []byte)
-		sch := make(chan ZaifStream, 8)
-		storesch := make(chan StoreData, 256)
-		tch := make(chan []Ticker)
-		// まとめて起動
-		app.wg.Add(5)
-		go app.streamReaderProc(ctx, key, sch)
-		go app.streamStoreProc(ctx, key, sch, storesch, sdch, lpch)
-		go app.storeWriterProc(ctx, key, storesch)
-		go app.getDepthProc(ctx, key, depthch)
-		go app.getTickerProc(ctx, key, tch)
-		// URL設定
-		http.Handle("/api/zaif/1/oldstream/"+key, &OldStreamHandler{cp: key, ch: sdch})
-		http.Handle("/api/zaif/1/lastprice/"+key, &LastPriceHandler{cp: key, ch: lpch})
-		http.Handle("/api/zaif/1/depth/"+key, &DepthHandler{cp: key, ch: depthch})
-		http.Handle("/api/zaif/1/ticks/"+key, &TicksHandler{cp: key, ch: tch})
+	for _, ec := range app.conf.Exchanges {
+		for _, key := range ec.CurrencyPairs {
+			id := PairID{Exchange: ec.Name, Pair: key}
+			if err := app.pairs.Start(id); err != nil {
+				log.Warnw("通貨ペアの起動に失敗しました。", "error", err, "exchange", ec.Name, "key", key)
+			}
+		}
 	}
 
-	monich := make(chan ResultMonitor)
+	monitor := newPublisher[ResultMonitor](nil)
 	rich := make(chan ResponseInfo, 32)
 
 	app.wg.Add(1)
-	go app.serverMonitoringProc(ctx, rich, monich)
+	go app.serverMonitoringProc(ctx, rich, monitor)
 
 	// URL設定
-	http.Handle("/api/unko.in/1/monitor", &GetMonitoringHandler{ch: monich})
-	http.Handle("/", http.FileServer(http.Dir("./public_html")))
+	for _, name := range app.pairs.Exchanges() {
+		app.mux.Handle(PairAPIPrefix(name), app.pairs)
+	}
+	app.mux.Handle("/api/unko.in/1/monitor", &GetMonitoringHandler{pub: monitor})
+	app.mux.Handle(DiskUsagePath, &DiskUsageHandler{conf: app.conf})
+	app.mux.Handle(HealthzPath, &HealthzHandler{})
+	app.mux.Handle(ReadyzPath, &ReadyzHandler{reg: app.pairs})
+	// 圧縮はgzipハンドラに任せる
+	app.mux.Handle(MetricsPath, promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{DisableCompression: true}))
+	if app.conf.AdminToken != "" {
+		ah := &PairAdminHandler{reg: app.pairs, token: app.conf.AdminToken}
+		app.mux.Handle(PairAdminPath, ah)
+		app.mux.Handle(PairAdminPath+"/", ah)
+	}
+	app.mux.Handle("/", http.FileServer(http.Dir(app.conf.PublicPath)))
 
 	ghfunc, err := gziphandler.GzipHandlerWithOpts(gziphandler.CompressionLevel(gzip.BestSpeed), gziphandler.ContentTypes(gzipContentTypeList))
 	if err != nil {
@@ -171,18 +185,22 @@ func (app *App) Run(ctx context.Context) error {
 		log.Infow("サーバーハンドラの作成に失敗しました。", "error", err)
 		return app.shutdown(ctx)
 	}
-	h := MonitoringHandler(ghfunc(http.DefaultServeMux), rich)
+	h := MonitoringHandler(bypassGzipForStreaming(ghfunc(app.mux), app.mux), rich)
 
 	// サーバ情報
-	sl := []Srv{
-		Srv{
-			s: &http.Server{Addr: ":8080", Handler: h},
+	sl := []Srv{}
+	if app.conf.ListenAddr != "" {
+		sl = append(sl, Srv{
+			s: &http.Server{Addr: app.conf.ListenAddr, Handler: h},
 			f: func(s *http.Server) error { return s.ListenAndServe() },
-		},
-		Srv{
+		})
+	}
+	if app.conf.RootDomain != "" {
+		domain := app.conf.RootDomain
+		sl = append(sl, Srv{
 			s: &http.Server{Handler: h},
-			f: func(s *http.Server) error { return s.Serve(autocert.NewListener(RootDomain)) },
-		},
+			f: func(s *http.Server) error { return s.Serve(autocert.NewListener(domain)) },
+		})
 	}
 	for _, s := range sl {
 		s := s // ローカル化
@@ -230,6 +248,10 @@ func (app *App) shutdown(ctx context.Context, sl ...Srv) error {
 			}
 		}(sctx, srv.s)
 	}
+	// 通貨ペアの処理を停止
+	if app.pairs != nil {
+		app.pairs.StopAll()
+	}
 	// サーバーの終了待機
 	app.wg.Wait()
 	return log.Sync()
@@ -267,211 +289,26 @@ func (app *App) startExitManageProc(ctx context.Context) (context.Context, chan<
 	return ectx, exitch
 }
 
-func (app *App) streamReaderProc(ctx context.Context, key string, wsch chan<- ZaifStream) {
-	defer app.wg.Done()
-	wait := time.Duration(rand.Uint64()%5000) * time.Millisecond
-	wss := ZaifStremUrl + key
-	for {
-		time.Sleep(wait)
-		exit := func() (exit bool) {
-			ch := make(chan error, 1)
-			dialctx, dialcancel := context.WithTimeout(ctx, time.Second*7)
-			defer dialcancel()
-			defer close(ch) // 複数回作成される可能性があるためクローズしておく
-			con, _, dialerr := websocket.DefaultDialer.DialContext(dialctx, wss, nil)
-			if dialerr != nil {
-				// Dialが失敗した理由がよくわからない
-				// contextを伝搬してきた通知で失敗した？普通にタイムアウトした？
-				// 先の処理に丸投げ
-				ch <- dialerr
-			} else {
-				defer con.Close()
-				log.Infow("Websoket接続開始", "path", wss)
-				app.wg.Add(1)
-				go func() {
-					defer app.wg.Done()
-					for {
-						s := ZaifStream{}
-						err := con.ReadJSON(&s)
-						if err != nil {
-							ch <- err
-							return
-						}
-						wsch <- s
-					}
-				}()
-			}
-			select {
-			case <-ctx.Done():
-				// シャットダウンする場合
-				if con != nil {
-					con.Close()
-				}
-				<-ch
-				exit = true
-			case err := <-ch:
-				// 普通の通信異常（リトライするやつ）
-				log.Warnw("websocket通信が切断されました。", "error", err, "url", wss)
-				exit = false
-			}
-			return exit
-		}()
-		if exit {
-			log.Infow("streamReaderProc終了", "url", wss)
-			return
-		}
-		if wait < 180*time.Second {
-			wait *= 2
-			wait += time.Duration(rand.Uint64()%5000) * time.Millisecond
-		}
-	}
-}
-
-func (app *App) streamStoreProc(ctx context.Context, key string, rsch <-chan ZaifStream, wsch chan<- StoreData, sdch chan<- StoreDataArray, lpch chan<- LastPrice) {
-	defer app.wg.Done()
-	oldstream := ZaifStream{}
-	sda, err := streamBufferReadProc(key)
-	if err != nil {
-		log.Warnw("バッファの読み込みに失敗しました。", "error", err, "key", key)
-	}
-	sdatmp := sda.Copy()
-	defer func() {
-		if sda != nil {
-			err := streamBufferWriteProc(key, sda)
-			if err != nil {
-				log.Warnw("バッファの保存に失敗しました。", "error", err, "key", key)
-			}
-			sda.Close()
-		}
-		if sdatmp != nil {
-			sdatmp.Close()
-		}
-	}()
-	for {
-		select {
-		case <-ctx.Done():
-			log.Infow("streamStoreProc終了", "key", key)
-			return
-		case s := <-rsch:
-			sd, ok := streamToStoreData(s, oldstream)
-			oldstream = s
-			if ok {
-				sda.Push(sd)
-				sdatmp.Push(sd)
-				select {
-				case wsch <- sd:
-					log.Debugw("送信！ streamStoreProc -> storeWriterProc", "key", key, "data", sd)
-				default:
-					// 送信できなかったらすぐに諦める
-				}
-			}
-		case sdch <- sdatmp:
-			sdatmp = sda.Copy()
-		case lpch <- oldstream.LastPrice:
-		}
-	}
-}
-
-func (app *App) storeWriterProc(ctx context.Context, key string, rsch <-chan StoreData) {
-	defer app.wg.Done()
-	old := time.Now()
-	var si *StoreItem
-	for {
-		select {
-		case <-ctx.Done():
-			if si != nil {
-				si.Close()
-			}
-			log.Infow("storeWriterProc終了", "key", key)
-			return
-		case sd := <-rsch:
-			date := time.Time(sd.Timestamp)
-			var err error
-			if si == nil {
-				si, err = newStoreItem(date, key)
-				if err != nil {
-					log.Warnw("JSONファイル生成に失敗しました。", "error", err, "name", key)
-					break
-				}
-			} else if date.Day() != old.Day() {
-				err = si.nextFile(date)
-				if err != nil {
-					log.Warnw("JSONファイル生成に失敗しました。", "error", err, "name", key)
-					break
-				}
-			}
-			old = date
-			err = si.writeJsonLine(sd)
-			if err != nil {
-				log.Warnw("JSONファイル出力に失敗しました。", "error", err)
-				break
-			}
-		}
-	}
-}
-
-func (app *App) getTickerProc(ctx context.Context, key string, tch chan<- []Ticker) {
-	defer app.wg.Done()
-	dir := filepath.Join(RootDataPath, "tick", key)
-	tl := readTicks(dir)
-	old := time.Now()
-	t := time.NewTicker(time.Minute)
-	defer t.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			log.Infow("getTickerProc終了", "key", key)
-			return
-		case now := <-t.C:
-			if now.Day() != old.Day() {
-				zt, err := getZaifTicker(ctx, key)
-				if err != nil {
-					break
-				}
-				date := old.Format("20060102")
-				p := filepath.Join(dir, fmt.Sprintf("%s_%s.json", date, key))
-				createZaifTickJSONFile(p, zt)
-				var open float64
-				if len(tl) > 0 {
-					open = tl[len(tl)-1].Close
-				} else {
-					open = zt.Last
-				}
-				tl = append(tl, Ticker{
-					Date:   date,
-					Open:   open,
-					Close:  zt.Last,
-					High:   zt.High,
-					Low:    zt.Low,
-					Vwap:   zt.Vwap,
-					Volume: zt.Volume,
-				})
-			}
-			old = now
-		case tch <- copyTicks(tl):
-		}
-	}
-}
-
 // サーバお手軽監視用
-func (app *App) serverMonitoringProc(ctx context.Context, rich <-chan ResponseInfo, monich chan<- ResultMonitor) {
+func (app *App) serverMonitoringProc(ctx context.Context, rich <-chan ResponseInfo, monitor *publisher[ResultMonitor]) {
 	defer app.wg.Done()
 	// logrotateの設定がめんどくせーのでアプリでやる
 	// https://github.com/uber-go/zap/blob/master/FAQ.md
 	logger := zap.New(zapcore.NewCore(
 		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
 		zapcore.AddSync(&lumberjack.Logger{
-			Filename:   filepath.Join(AccessLogPath, "access.log"),
+			Filename:   filepath.Join(app.conf.AccessLogPath, "access.log"),
 			MaxSize:    100, // megabytes
 			MaxBackups: 100,
-			MaxAge:     7,    // days
-			Compress:   true, // disabled by default
+			MaxAge:     app.conf.Retention.AccessLog, // days
+			Compress:   true,                         // disabled by default
 		}),
 		zap.InfoLevel,
 	))
 	defer logger.Sync()
-	res := ResultMonitor{}
-	resmin := ResultMonitor{}
+	now := time.Now()
+	ring := newMonitorRing(now)
+	monitor.Publish(ring.result(now), DataMeta{AsOf: now})
 	tc := time.NewTicker(time.Minute)
 	defer tc.Stop()
 	for {
@@ -479,16 +316,10 @@ func (app *App) serverMonitoringProc(ctx context.Context, rich <-chan ResponseIn
 		case <-ctx.Done():
 			log.Infow("serverMonitoringProc終了")
 			return
-		case monich <- resmin:
 		case ri := <-rich:
+			observeHTTP(ri)
+			ring.add(ri)
 			ela := ri.end.Sub(ri.start)
-			res.ResponseCount++
-			res.ResponseTimeSum += ela
-			if ri.status < 400 {
-				res.ResponseCodeOkCount++
-			} else {
-				res.ResponseCodeNgCount++
-			}
 			// アクセスログ出力
 			logger.Info("-",
 				zap.String("addr", ri.addr),
@@ -501,61 +332,13 @@ func (app *App) serverMonitoringProc(ctx context.Context, rich <-chan ResponseIn
 				zap.String("ua", ri.userAgent),
 				zap.Duration("elapse", ela),
 			)
-		case <-tc.C:
-			resmin = res
-			res = ResultMonitor{}
+		case now := <-tc.C:
+			ring.rotate(now)
+			monitor.Publish(ring.result(now), DataMeta{AsOf: now})
 		}
 	}
 }
 
-func (app *App) getDepthProc(ctx context.Context, key string, depthch chan<- []byte) {
-	defer app.wg.Done()
-	data, err := getDepth(ctx, key)
-	if err != nil {
-		data = []byte{'{', '}'}
-	}
-	tc := time.NewTicker(time.Second * 30)
-	defer tc.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			log.Infow("getDepthProc終了", "key", key)
-			return
-		case <-tc.C:
-			buf, err := getDepth(ctx, key)
-			if err == nil {
-				data = buf
-			}
-		case depthch <- copyByteSlice(data):
-		}
-	}
-}
-
-func getDepth(ctx context.Context, key string) ([]byte, error) {
-	c, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
-	req, err := http.NewRequestWithContext(c, http.MethodGet, ZaifDepthUrl+key, nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err == nil {
-		defer resp.Body.Close()
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-		return data, nil
-	}
-	return nil, err
-}
-
-func copyByteSlice(data []byte) []byte {
-	// 配列のゼロクリアを省略する最適化が入っているらしいので
-	// https://github.com/golang/go/issues/26252
-	return append([]byte(nil), data...)
-}
-
 func createDir(p string) error {
 	dir := filepath.Dir(p)
 	if dir == "." {
@@ -572,10 +355,26 @@ func createDir(p string) error {
 	return err
 }
 
-func createStoreFilePath(date time.Time, key, cate string) string {
-	return filepath.Join(RootDataPath, cate, key, fmt.Sprintf("%s_%s.json", key, date.Format("20060102")))
+func createStoreFilePath(root string, date time.Time, key, cate string) string {
+	return filepath.Join(root, cate, key, fmt.Sprintf("%s_%s.json", key, date.Format("20060102")))
 }
 
-func createBufferFilePath(key string) string {
-	return filepath.Join(RootDataPath, "tmp", fmt.Sprintf("%s_buffer.gob", key))
+func createHeartbeatFilePath(root, key string) string {
+	return filepath.Join(root, "tmp", fmt.Sprintf("%s_heartbeat.json", key))
+}
+
+func createBufferFilePath(root, key string) string {
+	return filepath.Join(root, "tmp", fmt.Sprintf("%s_buffer.gob", key))
+}
+
+// WebSocketとServer-Sent Eventsはgzipハンドラを通さない
+// バッファリングされると逐次送信できないため
+func bypassGzipForStreaming(gz, raw http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			raw.ServeHTTP(w, r)
+		} else {
+			gz.ServeHTTP(w, r)
+		}
+	})
 }